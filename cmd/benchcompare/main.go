@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/tjungblu/octosql-plugin-etcdsnapshot/pkg/benchcompare"
+)
+
+func main() {
+	threshold := flag.Float64("threshold", 10, "relative change in percent a metric may get worse by")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: benchcompare [flags] <old.txt> <new.txt>\n\nCompares two go test -bench outputs and exits with 1 on regressions. Run the benchmarks with -count 10, a metric\nisn't flagged unless a Mann-Whitney U test finds its old and new samples differ significantly.\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	old, err := parseFile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	current, err := parseFile(flag.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	comparisons := benchcompare.Compare(old, current, *threshold)
+	if err := benchcompare.Write(os.Stdout, comparisons); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	for _, name := range benchcompare.Missing(old, current) {
+		fmt.Printf("%s is missing in %s\n", name, flag.Arg(1))
+	}
+	if regressions := benchcompare.Regressions(comparisons); regressions > 0 {
+		fmt.Printf("%d metrics got worse by more than %.1f%%\n", regressions, *threshold)
+		os.Exit(1)
+	}
+}
+
+func parseFile(path string) (benchcompare.Results, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open benchmark results: %w", err)
+	}
+	defer f.Close()
+	return benchcompare.Parse(f)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"io"
 	"log"
 	"os"
@@ -13,6 +14,15 @@ import (
 )
 
 func main() {
+	transport := flag.String("transport", mcp.TransportStdio, "transport to serve: 'stdio', 'http' (streamable HTTP) or 'sse'")
+	addr := flag.String("addr", mcp.DefaultAddr, "listen address for the 'http' and 'sse' transports, other addresses than loopback need an auth token")
+	authToken := flag.String("auth-token", os.Getenv("ETCDSNAPSHOT_MCP_TOKEN"), "bearer token required for the 'http' and 'sse' transports, defaults to $ETCDSNAPSHOT_MCP_TOKEN")
+	rulesFile := flag.String("rules", "", "YAML file changing the built-in health rules or adding new ones")
+	exportDir := flag.String("export-dir", "", "absolute path of the directory export_manifests writes below, the tool is disabled without")
+	index := flag.Bool("index", false, "use the persistent snapshot index, so the queries of an analysis don't all scan the snapshot")
+	queryTimeout := flag.Duration("query-timeout", 0, "how long a query may run before it's cancelled, e.g. '5m', zero is unlimited")
+	flag.Parse()
+
 	// Create a context that can be cancelled on signal
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -23,16 +33,25 @@ func main() {
 
 	// Initialize the MCP server with etcd snapshot capabilities
 	server, err := mcp.NewServer(mcp.Config{
-		Name:        "etcd-snapshot-analyzer",
-		Version:     "1.0.0",
-		Description: "MCP server for analyzing etcd snapshots from Kubernetes/OpenShift clusters",
+		Name:         "etcd-snapshot-analyzer",
+		Version:      "1.0.0",
+		Description:  "MCP server for analyzing etcd snapshots from Kubernetes/OpenShift clusters",
+		Transport:    *transport,
+		Addr:         *addr,
+		AuthToken:    *authToken,
+		RulesFile:    *rulesFile,
+		ExportDir:    *exportDir,
+		Index:        *index,
+		QueryTimeout: *queryTimeout,
 	})
 	if err != nil {
 		log.Fatalf("Failed to create MCP server: %v", err)
 	}
 
 	// Start the server in a goroutine
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		if err := server.Start(ctx); err != nil {
 			if errors.Is(err, io.EOF) {
 				// Normal termination when stdin is closed - trigger shutdown
@@ -50,6 +69,12 @@ func main() {
 	case <-ctx.Done():
 		// Context was cancelled (e.g., due to EOF)
 		log.Println("MCP server terminated normally")
+	case <-done:
 	}
 	cancel()
+
+	// the http transports drain their sessions after cancellation, stdio can't be interrupted
+	if *transport != mcp.TransportStdio {
+		<-done
+	}
 }
@@ -0,0 +1,268 @@
+// Package benchcompare compares two runs of Go benchmarks and flags the metrics that got worse by more than a
+// threshold when a Mann-Whitney U test tells the change apart from the noise of the samples, to catch performance
+// regressions between commits.
+package benchcompare
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Results are the samples of every benchmark and unit, a benchmark run with -count has several
+type Results map[string]map[string][]float64
+
+// procsSuffix is the GOMAXPROCS suffix go test appends to the benchmark names
+var procsSuffix = regexp.MustCompile(`-\d+$`)
+
+// Parse reads the output of go test -bench, lines that aren't benchmark results are skipped. When the benchmarked
+// code prints to stdout, go test writes the results on a line of their own after the output, they belong to the
+// benchmark named last.
+func Parse(r io.Reader) (Results, error) {
+	results := make(Results)
+	pending := ""
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "Benchmark") {
+			pending = fields[0]
+		} else if pending != "" {
+			fields = append([]string{pending}, fields...)
+		}
+		// BenchmarkName-8  <iterations>  <value> <unit>  <value> <unit> ...
+		if len(fields) < 4 || len(fields)%2 != 0 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[1]); err != nil {
+			continue
+		}
+		pending = ""
+
+		name := procsSuffix.ReplaceAllString(fields[0], "")
+		for i := 2; i < len(fields); i += 2 {
+			value, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value '%s' of %s in benchmark %s", fields[i], fields[i+1], name)
+			}
+			if results[name] == nil {
+				results[name] = make(map[string][]float64)
+			}
+			results[name][fields[i+1]] = append(results[name][fields[i+1]], value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read benchmark results: %w", err)
+	}
+	return results, nil
+}
+
+// Comparison is the change of a metric of a benchmark between two runs
+type Comparison struct {
+	Benchmark string
+	Unit      string
+	// Old and New are the medians of the samples
+	Old float64
+	New float64
+	// Delta is the relative change of New to Old in percent
+	Delta float64
+	// P is the p-value of a two-sided Mann-Whitney U test of the old and new samples, the change may be noise when
+	// it's not below Alpha
+	P float64
+	// Regression is set when the metric got worse by more than the threshold and the change is significant
+	Regression bool
+}
+
+// Alpha is the significance level of the Mann-Whitney U test, as in benchstat
+const Alpha = 0.05
+
+// Significant tells whether the samples differ by more than noise
+func (c Comparison) Significant() bool {
+	return c.P < Alpha
+}
+
+// higherIsBetter tells whether the metric is a throughput like rows/s or MB/s, for all others like ns/op, B/op,
+// allocs/op or peak-RSS-MB lower is better
+func higherIsBetter(unit string) bool {
+	return strings.HasSuffix(unit, "/s")
+}
+
+// Compare compares the metrics both runs have, threshold is the relative change in percent a metric may get worse
+// by without being flagged. A change of the medians alone isn't flagged unless a Mann-Whitney U test of the samples
+// finds it significant. Unlike comparing the ranges, the test ranks all samples, so a single outlier can neither hide
+// a shift of the others nor make one up. It needs at least four samples per run to reach Alpha, run the benchmarks
+// with -count 10 like benchstat recommends. The comparisons are sorted by benchmark and unit.
+func Compare(old, current Results, threshold float64) []Comparison {
+	var comparisons []Comparison
+	for name, units := range current {
+		for unit, samples := range units {
+			oldSamples := old[name][unit]
+			if len(oldSamples) == 0 {
+				continue
+			}
+
+			c := Comparison{Benchmark: name, Unit: unit, Old: median(oldSamples), New: median(samples), P: mannWhitneyU(oldSamples, samples)}
+			switch {
+			case c.Old != 0:
+				c.Delta = (c.New - c.Old) / c.Old * 100
+			case c.New != 0:
+				c.Delta = math.Inf(1)
+			}
+			worse := c.Delta
+			if higherIsBetter(unit) {
+				worse = -worse
+			}
+			c.Regression = worse > threshold && c.Significant()
+			comparisons = append(comparisons, c)
+		}
+	}
+
+	sort.Slice(comparisons, func(i, j int) bool {
+		if comparisons[i].Benchmark != comparisons[j].Benchmark {
+			return comparisons[i].Benchmark < comparisons[j].Benchmark
+		}
+		return comparisons[i].Unit < comparisons[j].Unit
+	})
+	return comparisons
+}
+
+// Regressions returns the number of flagged comparisons
+func Regressions(comparisons []Comparison) int {
+	regressions := 0
+	for _, c := range comparisons {
+		if c.Regression {
+			regressions++
+		}
+	}
+	return regressions
+}
+
+// Missing returns the benchmarks of the old run the current one doesn't have, sorted by name
+func Missing(old, current Results) []string {
+	var missing []string
+	for name := range old {
+		if _, ok := current[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// Write prints the comparisons as a table
+func Write(w io.Writer, comparisons []Comparison) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "BENCHMARK\tUNIT\tOLD\tNEW\tDELTA\tP\t")
+	for _, c := range comparisons {
+		flag := ""
+		switch {
+		case c.Regression:
+			flag = "REGRESSION"
+		case !c.Significant():
+			flag = "~"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%+.2f%%\t%.3f\t%s\n", c.Benchmark, c.Unit, formatValue(c.Old), formatValue(c.New), c.Delta, c.P, flag)
+	}
+	return tw.Flush()
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// mannWhitneyU returns the p-value of a two-sided Mann-Whitney U test of the samples, the probability of ranks at
+// least as far apart if both samples came from the same distribution. Without ties it's computed from the exact
+// distribution of U, with ties from the normal approximation with tie correction.
+func mannWhitneyU(a, b []float64) float64 {
+	type sample struct {
+		value float64
+		first bool
+	}
+	all := make([]sample, 0, len(a)+len(b))
+	for _, v := range a {
+		all = append(all, sample{value: v, first: true})
+	}
+	for _, v := range b {
+		all = append(all, sample{value: v})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].value < all[j].value })
+
+	// tied samples share the mean of their ranks
+	rankSum, tieSum := 0.0, 0.0
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].value == all[i].value {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for _, s := range all[i:j] {
+			if s.first {
+				rankSum += rank
+			}
+		}
+		t := float64(j - i)
+		tieSum += t*t*t - t
+		i = j
+	}
+
+	n1, n2 := float64(len(a)), float64(len(b))
+	u := rankSum - n1*(n1+1)/2
+	if tieSum == 0 {
+		return exactMannWhitneyU(len(a), len(b), int(u))
+	}
+
+	n := n1 + n2
+	variance := n1 * n2 / 12 * ((n + 1) - tieSum/(n*(n-1)))
+	if variance <= 0 {
+		// all samples are equal
+		return 1
+	}
+	// with continuity correction
+	z := math.Max(math.Abs(u-n1*n2/2)-0.5, 0) / math.Sqrt(variance)
+	return math.Min(math.Erfc(z/math.Sqrt2), 1)
+}
+
+// exactMannWhitneyU returns the two-sided p-value of u for samples of n1 and n2 values without ties. The number of
+// orderings with U = k is the coefficient of q^k of the Gaussian binomial coefficient (n1+n2 choose n1), which is
+// built up as the product of (1-q^(n2+i))/(1-q^i) for i up to n1.
+func exactMannWhitneyU(n1, n2, u int) float64 {
+	counts := make([]float64, n1*n2+1)
+	counts[0] = 1
+	for i := 1; i <= n1; i++ {
+		// multiply by 1-q^(n2+i), then divide by 1-q^i
+		for k := len(counts) - 1; k >= n2+i; k-- {
+			counts[k] -= counts[k-n2-i]
+		}
+		for k := i; k < len(counts); k++ {
+			counts[k] += counts[k-i]
+		}
+	}
+
+	total, below, above := 0.0, 0.0, 0.0
+	for k, c := range counts {
+		total += c
+		if k <= u {
+			below += c
+		}
+		if k >= u {
+			above += c
+		}
+	}
+	return math.Min(2*math.Min(below, above)/total, 1)
+}
+
+func median(samples []float64) float64 {
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
@@ -0,0 +1,126 @@
+package benchcompare
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const oldRun = `goos: linux
+goarch: amd64
+pkg: github.com/tjungblu/octosql-plugin-etcdsnapshot/pkg/etcdsnapshot
+BenchmarkCalculateEtcdStats/namespaces=10-8   	found 892 records in snapshot
+     100	   2000000 ns/op	  300000 rows/s	   30.00 peak-RSS-MB	 2000000 B/op	    3000 allocs/op
+BenchmarkCalculateEtcdStats/namespaces=10-8   	     100	   2200000 ns/op	  280000 rows/s	   30.00 peak-RSS-MB	 2000000 B/op	    3000 allocs/op
+BenchmarkCalculateEtcdStats/namespaces=10-8   	     100	   2100000 ns/op	  290000 rows/s	   30.00 peak-RSS-MB	 2000000 B/op	    3000 allocs/op
+BenchmarkCalculateEtcdStats/namespaces=10-8   	     100	   2050000 ns/op	  295000 rows/s	   30.00 peak-RSS-MB	 2000000 B/op	    3000 allocs/op
+BenchmarkCalculateEtcdStats/namespaces=10-8   	     100	   2150000 ns/op	  285000 rows/s	   30.00 peak-RSS-MB	 2000000 B/op	    3000 allocs/op
+BenchmarkRemoved-8   	     100	   1000 ns/op
+PASS
+`
+
+const newRun = `BenchmarkCalculateEtcdStats/namespaces=10-16   	     100	   2500000 ns/op	  240000 rows/s	   30.50 peak-RSS-MB	 1000000 B/op	    3000 allocs/op
+BenchmarkCalculateEtcdStats/namespaces=10-16   	     100	   2450000 ns/op	  245000 rows/s	   30.50 peak-RSS-MB	 1000000 B/op	    3000 allocs/op
+BenchmarkCalculateEtcdStats/namespaces=10-16   	     100	   2550000 ns/op	  235000 rows/s	   30.50 peak-RSS-MB	 1000000 B/op	    3000 allocs/op
+BenchmarkCalculateEtcdStats/namespaces=10-16   	     100	   2400000 ns/op	  250000 rows/s	   30.50 peak-RSS-MB	 1000000 B/op	    3000 allocs/op
+BenchmarkCalculateEtcdStats/namespaces=10-16   	     100	   2600000 ns/op	  230000 rows/s	   30.50 peak-RSS-MB	 1000000 B/op	    3000 allocs/op
+BenchmarkAdded-16   	     100	   1000 ns/op
+`
+
+func TestParse(t *testing.T) {
+	results, err := Parse(strings.NewReader(oldRun))
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Equal(t, []float64{2000000, 2200000, 2100000, 2050000, 2150000}, results["BenchmarkCalculateEtcdStats/namespaces=10"]["ns/op"])
+	require.Equal(t, []float64{30, 30, 30, 30, 30}, results["BenchmarkCalculateEtcdStats/namespaces=10"]["peak-RSS-MB"])
+	require.Equal(t, []float64{1000}, results["BenchmarkRemoved"]["ns/op"])
+
+	// the results of a benchmark that prints are on a line of their own
+	require.Equal(t, []float64{300000, 280000, 290000, 295000, 285000}, results["BenchmarkCalculateEtcdStats/namespaces=10"]["rows/s"])
+
+	_, err = Parse(strings.NewReader("BenchmarkBroken-8   100   fast ns/op\n"))
+	require.ErrorContains(t, err, "invalid value 'fast' of ns/op in benchmark BenchmarkBroken")
+}
+
+func TestCompare(t *testing.T) {
+	old, err := Parse(strings.NewReader(oldRun))
+	require.NoError(t, err)
+	current, err := Parse(strings.NewReader(newRun))
+	require.NoError(t, err)
+
+	comparisons := Compare(old, current, 10)
+	require.Len(t, comparisons, 5)
+	byUnit := make(map[string]Comparison)
+	for _, c := range comparisons {
+		require.Equal(t, "BenchmarkCalculateEtcdStats/namespaces=10", c.Benchmark)
+		byUnit[c.Unit] = c
+	}
+
+	// the median of the old run is compared, 2.5ms is 19% slower and 240000 rows/s 17% less
+	require.Equal(t, float64(2100000), byUnit["ns/op"].Old)
+	require.InDelta(t, 19.05, byUnit["ns/op"].Delta, 0.01)
+	require.True(t, byUnit["ns/op"].Regression)
+	require.InDelta(t, -17.24, byUnit["rows/s"].Delta, 0.01)
+	require.True(t, byUnit["rows/s"].Regression)
+	// every new sample is slower than every old one, 2 of the 252 orderings of five samples each are that far apart
+	require.InDelta(t, 2.0/252, byUnit["ns/op"].P, 1e-9)
+	// equal samples don't differ at all
+	require.Equal(t, float64(1), byUnit["allocs/op"].P)
+	// less memory and small changes are fine
+	require.False(t, byUnit["B/op"].Regression)
+	require.False(t, byUnit["peak-RSS-MB"].Regression)
+	require.False(t, byUnit["allocs/op"].Regression)
+	require.Equal(t, 2, Regressions(comparisons))
+
+	require.Equal(t, 0, Regressions(Compare(old, current, 20)))
+	require.Equal(t, []string{"BenchmarkRemoved"}, Missing(old, current))
+
+	var out bytes.Buffer
+	require.NoError(t, Write(&out, comparisons))
+	require.Contains(t, out.String(), "BenchmarkCalculateEtcdStats/namespaces=10  ns/op")
+	require.Contains(t, out.String(), "+19.05%  0.008  REGRESSION")
+}
+
+func TestCompareIgnoresNoise(t *testing.T) {
+	old := Results{"BenchmarkNoisy": {"ns/op": {1000, 1100, 1200, 1300, 1400}}}
+	current := Results{"BenchmarkNoisy": {"ns/op": {1150, 1250, 1350, 1450, 1500}}}
+
+	// the median is 12.5% slower, but the samples interleave: 28 of the 252 orderings have the old samples ranked
+	// as low or lower
+	comparisons := Compare(old, current, 10)
+	require.Len(t, comparisons, 1)
+	require.InDelta(t, 12.5, comparisons[0].Delta, 0.01)
+	require.InDelta(t, 2*28.0/252, comparisons[0].P, 1e-9)
+	require.False(t, comparisons[0].Regression)
+
+	// a single sample per run can't tell a change from noise
+	require.Equal(t, 0, Regressions(Compare(Results{"BenchmarkOnce": {"ns/op": {1000}}}, Results{"BenchmarkOnce": {"ns/op": {2000}}}, 10)))
+
+	var out bytes.Buffer
+	require.NoError(t, Write(&out, comparisons))
+	require.Contains(t, out.String(), "+12.50%  0.222  ~")
+}
+
+func TestCompareDoesNotLetAnOutlierHideAShift(t *testing.T) {
+	// one old run hit a slow machine, all the others are 20% faster than the new runs
+	old := Results{"BenchmarkShift": {"ns/op": {1000, 1001, 1002, 1003, 1004, 1005, 1006, 1007, 1008, 5000}}}
+	current := Results{"BenchmarkShift": {"ns/op": {1200, 1201, 1202, 1203, 1204, 1205, 1206, 1207, 1208, 1209}}}
+
+	comparisons := Compare(old, current, 10)
+	require.Len(t, comparisons, 1)
+	require.InDelta(t, 19.91, comparisons[0].Delta, 0.01)
+	require.Less(t, comparisons[0].P, 0.01)
+	require.True(t, comparisons[0].Regression)
+
+	// with ties the normal approximation flags it the same
+	old["BenchmarkShift"]["ns/op"] = []float64{1000, 1000, 1001, 1001, 1002, 1002, 1003, 1003, 1004, 5000}
+	current["BenchmarkShift"]["ns/op"] = []float64{1200, 1200, 1201, 1201, 1202, 1202, 1203, 1203, 1204, 1204}
+	require.Equal(t, 1, Regressions(Compare(old, current, 10)))
+
+	// a single outlier doesn't make up a regression either
+	current["BenchmarkShift"]["ns/op"] = []float64{1000, 1000, 1001, 1001, 1002, 1002, 1003, 1003, 1004, 9000}
+	old["BenchmarkShift"]["ns/op"] = []float64{800, 1000, 1001, 1001, 1002, 1002, 1003, 1003, 1004, 1004}
+	require.Equal(t, 0, Regressions(Compare(old, current, 0)))
+}
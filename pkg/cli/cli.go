@@ -0,0 +1,504 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tjungblu/octosql-plugin-etcdsnapshot/pkg/etcdsnapshot"
+	"github.com/tjungblu/octosql-plugin-etcdsnapshot/pkg/query"
+)
+
+// Exit codes of Run
+const (
+	ExitOK = 0
+	// ExitError is returned for invalid arguments and failed commands
+	ExitError = 1
+	// ExitUnhealthy is returned by health when a finding is at least as severe as -fail-on
+	ExitUnhealthy = 2
+)
+
+// command is a subcommand of the CLI. run parses the arguments left after the flags and returns the result
+// to print, or an exit code with the result when the command decides it.
+type command struct {
+	usage       string
+	description string
+	// formats are the output formats of the command, the first is the default, defaults to table, json and yaml
+	formats []string
+	flags   func(fs *flag.FlagSet, o *options)
+	run     func(ctx context.Context, e *query.Engine, o *options, args []string) (interface{}, int, error)
+}
+
+// options are the flags of all commands, each command registers the ones it uses
+type options struct {
+	output    string
+	quota     string
+	rulesFile string
+	failOn    string
+	resource  string
+	namespace string
+	name      string
+	diffType  string
+	out       string
+	format    string
+	strip     bool
+	include   stringList
+	exclude   stringList
+	where     string
+	values    stringList
+	revision  int64
+	target    string
+}
+
+// stringList is a flag that can be given multiple times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+var commands = map[string]command{
+	"stats": {
+		usage:       "stats [flags] <snapshot>",
+		description: "Show the size, revisions, quota usage and storage insights of a snapshot",
+		flags:       quotaFlag,
+		run: func(ctx context.Context, e *query.Engine, o *options, args []string) (interface{}, int, error) {
+			snapshot, err := snapshotArgs(args, 1, 1)
+			if err != nil {
+				return nil, ExitError, err
+			}
+			result, err := e.GetSnapshotMetadata(ctx, snapshot[0], o.quota)
+			return result, ExitOK, err
+		},
+	},
+	"health": {
+		usage:       "health [flags] <snapshot>",
+		description: "Check a snapshot against the health rules, exits with 2 when a finding is at least as severe as -fail-on",
+		flags: func(fs *flag.FlagSet, o *options) {
+			quotaFlag(fs, o)
+			fs.StringVar(&o.rulesFile, "rules", "", "YAML file changing the built-in health rules or adding new ones")
+			fs.StringVar(&o.failOn, "fail-on", string(query.SeverityCritical), "lowest severity that fails the check: info, warning, critical or none")
+		},
+		run: func(ctx context.Context, e *query.Engine, o *options, args []string) (interface{}, int, error) {
+			snapshot, err := snapshotArgs(args, 1, 1)
+			if err != nil {
+				return nil, ExitError, err
+			}
+			if e, err = engineWithRules(e, o.rulesFile); err != nil {
+				return nil, ExitError, err
+			}
+			var failOn query.Severity
+			if o.failOn != "none" {
+				if failOn, err = query.ParseSeverity(o.failOn); err != nil {
+					return nil, ExitError, err
+				}
+			}
+
+			result, err := e.CheckHealth(ctx, snapshot[0], o.quota)
+			if err != nil {
+				return nil, ExitError, err
+			}
+			return result, healthExitCode(result.Findings, failOn), nil
+		},
+	},
+	"report": {
+		usage:       "report [flags] <snapshot>",
+		description: "Write the versioned health report with the meta table as JSON, YAML or Prometheus textfile",
+		formats:     []string{formatJSON, formatYAML, formatPrometheus},
+		flags: func(fs *flag.FlagSet, o *options) {
+			quotaFlag(fs, o)
+			fs.StringVar(&o.rulesFile, "rules", "", "YAML file changing the built-in health rules or adding new ones")
+			fs.StringVar(&o.out, "out", "", "file to write the report to instead of stdout, replaced atomically for the textfile collector")
+		},
+		run: func(ctx context.Context, e *query.Engine, o *options, args []string) (interface{}, int, error) {
+			snapshot, err := snapshotArgs(args, 1, 1)
+			if err != nil {
+				return nil, ExitError, err
+			}
+			if e, err = engineWithRules(e, o.rulesFile); err != nil {
+				return nil, ExitError, err
+			}
+			report, err := e.HealthReport(ctx, snapshot[0], o.quota)
+			return report, ExitOK, err
+		},
+	},
+	"diff": {
+		usage:       "diff [flags] <snapshot1> <snapshot2>",
+		description: "Show the keys or revisions added or removed between two snapshots",
+		flags: func(fs *flag.FlagSet, o *options) {
+			fs.StringVar(&o.diffType, "type", "added", "added or removed keys, or added_revisions or removed_revisions")
+		},
+		run: func(ctx context.Context, e *query.Engine, o *options, args []string) (interface{}, int, error) {
+			snapshots, err := snapshotArgs(args, 2, 2)
+			if err != nil {
+				return nil, ExitError, err
+			}
+			switch o.diffType {
+			case "added", "removed", "added_revisions", "removed_revisions":
+			default:
+				return nil, ExitError, fmt.Errorf("invalid diff type '%s', expected added, removed, added_revisions or removed_revisions", o.diffType)
+			}
+			result, err := e.CompareSnapshots(ctx, snapshots[0], snapshots[1], o.diffType)
+			return result, ExitOK, err
+		},
+	},
+	"find": {
+		usage:       "find [flags] <snapshot> <resourceType>",
+		description: "Find the revisions of a resource type, optionally in a namespace or with a name",
+		flags: func(fs *flag.FlagSet, o *options) {
+			fs.StringVar(&o.namespace, "namespace", "", "only find resources in this namespace")
+			fs.StringVar(&o.name, "name", "", "only find resources with this name")
+		},
+		run: func(ctx context.Context, e *query.Engine, o *options, args []string) (interface{}, int, error) {
+			args, err := snapshotArgs(args, 2, 1)
+			if err != nil {
+				return nil, ExitError, err
+			}
+			result, err := e.FindResources(ctx, args[1], o.namespace, o.name, args[0])
+			return result, ExitOK, err
+		},
+	},
+	"get": {
+		usage:       "get [flags] <snapshot> <key>",
+		description: "Show the latest revision of a key including its value",
+		run: func(ctx context.Context, e *query.Engine, o *options, args []string) (interface{}, int, error) {
+			args, err := snapshotArgs(args, 2, 1)
+			if err != nil {
+				return nil, ExitError, err
+			}
+			result, err := e.GetKey(ctx, args[0], args[1])
+			return result, ExitOK, err
+		},
+	},
+	"query": {
+		usage:       "query [flags] <snapshot> <sql>",
+		description: "Run a SQL query, {{SNAPSHOT}} in the query is replaced with the snapshot",
+		run: func(ctx context.Context, e *query.Engine, o *options, args []string) (interface{}, int, error) {
+			args, err := snapshotArgs(args, 2, 1)
+			if err != nil {
+				return nil, ExitError, err
+			}
+			result, err := e.ExecuteQuery(ctx, args[1], args[0])
+			return result, ExitOK, err
+		},
+	},
+	"export": {
+		usage:       "export [flags] <snapshot> <dir>",
+		description: "Write the latest revision of the matching keys as manifests to <dir>/<group>/<resource>/<namespace>/<name>.yaml, built-in types are decoded from protobuf",
+		flags: func(fs *flag.FlagSet, o *options) {
+			fs.StringVar(&o.resource, "resource", "", "only export this resource type, e.g. deployments")
+			fs.StringVar(&o.namespace, "namespace", "", "only export resources in this namespace")
+			fs.StringVar(&o.name, "name", "", "only export resources with this name")
+			fs.StringVar(&o.format, "format", "yaml", "format of the manifests: yaml or json")
+			fs.BoolVar(&o.strip, "strip", false, "remove the status and the metadata set by the apiserver, like uid and resourceVersion")
+		},
+		run: func(ctx context.Context, e *query.Engine, o *options, args []string) (interface{}, int, error) {
+			args, err := snapshotArgs(args, 2, 2)
+			if err != nil {
+				return nil, ExitError, err
+			}
+			result, err := e.ExportManifests(ctx, args[0], query.ExportOptions{
+				ResourceType:      o.resource,
+				Namespace:         o.namespace,
+				Name:              o.name,
+				Dir:               args[1],
+				Format:            o.format,
+				StripServerFields: o.strip,
+			})
+			return result, ExitOK, err
+		},
+	},
+	"write": {
+		usage:       "write [flags] <snapshot> <target>",
+		description: "Write the latest revision of the selected keys to a new snapshot that etcdutl can restore",
+		flags: func(fs *flag.FlagSet, o *options) {
+			fs.Var(&o.include, "include-prefix", "only keep keys with this prefix, can be given multiple times")
+			fs.Var(&o.exclude, "exclude-prefix", "drop keys with this prefix, can be given multiple times")
+			fs.StringVar(&o.where, "where", "", "only keep keys with a revision matching this SQL condition, e.g. \"namespace = 'default'\"")
+			fs.Var(&o.values, "set", "replace the value of a key with the content of a file, as key=file, can be given multiple times")
+		},
+		run: func(ctx context.Context, e *query.Engine, o *options, args []string) (interface{}, int, error) {
+			args, err := snapshotArgs(args, 2, 2)
+			if err != nil {
+				return nil, ExitError, err
+			}
+			result, err := writeSnapshot(ctx, e, o, args[0], args[1])
+			return result, ExitOK, err
+		},
+	},
+	"compact": {
+		usage:       "compact [flags] <snapshot>",
+		description: "Simulate a compaction and defrag with the exact revisions and bytes they reclaim, the snapshot isn't changed",
+		flags: func(fs *flag.FlagSet, o *options) {
+			fs.Int64Var(&o.revision, "revision", 0, "revision to compact at, defaults to the highest revision of the snapshot")
+			fs.StringVar(&o.target, "target", "", "write the compacted and defragmented database to this new snapshot")
+		},
+		run: func(ctx context.Context, e *query.Engine, o *options, args []string) (interface{}, int, error) {
+			snapshot, err := snapshotArgs(args, 1, 1)
+			if err != nil {
+				return nil, ExitError, err
+			}
+			if o.revision < 0 {
+				return nil, ExitError, fmt.Errorf("invalid revision %d", o.revision)
+			}
+			result, err := simulateCompaction(snapshot[0], o.revision, o.target)
+			return result, ExitOK, err
+		},
+	},
+	"leases": {
+		usage:       "leases [flags] <snapshot>",
+		description: "List the leases attached to keys with the revisions and bytes they hold",
+		run: func(ctx context.Context, e *query.Engine, o *options, args []string) (interface{}, int, error) {
+			snapshot, err := snapshotArgs(args, 1, 1)
+			if err != nil {
+				return nil, ExitError, err
+			}
+			result, err := e.ListLeases(ctx, snapshot[0])
+			return result, ExitOK, err
+		},
+	},
+}
+
+// engineWithRules returns an engine with the rules of the file, or e without a file
+func engineWithRules(e *query.Engine, rulesFile string) (*query.Engine, error) {
+	if rulesFile == "" {
+		return e, nil
+	}
+	rules, err := query.LoadRules(rulesFile)
+	if err != nil {
+		return nil, err
+	}
+	return query.NewEngineWithRules(rules)
+}
+
+// writeSnapshot writes the keys selected by the flags of the write command from source to target
+func writeSnapshot(ctx context.Context, e *query.Engine, o *options, source, target string) (*query.AnalysisResult, error) {
+	opts := etcdsnapshot.WriteOptions{IncludePrefixes: o.include, ExcludePrefixes: o.exclude}
+	if len(o.values) > 0 {
+		opts.Values = make(map[string][]byte, len(o.values))
+	}
+	for _, value := range o.values {
+		key, file, ok := strings.Cut(value, "=")
+		if !ok || key == "" || file == "" {
+			return nil, fmt.Errorf("invalid value '%s', expected key=file", value)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read value of key [%s]: %w", key, err)
+		}
+		opts.Values[key] = data
+	}
+	if o.where != "" {
+		keys, err := e.MatchingKeys(ctx, source, o.where)
+		if err != nil {
+			return nil, err
+		}
+		opts.Keys = keys
+	}
+
+	written, err := etcdsnapshot.WriteSnapshot(source, target, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	insights := []string{
+		fmt.Sprintf("The snapshot is compacted at revision %d, restore it with 'etcdutl snapshot restore %s'", written.CompactRevision, target),
+	}
+	if missing := len(opts.Values) - written.ReplacedValues; missing > 0 {
+		insights = append(insights, fmt.Sprintf("%d values were not replaced, their keys were not selected or don't exist", missing))
+	}
+	return &query.AnalysisResult{
+		Type:    "write",
+		Summary: fmt.Sprintf("Wrote %d keys to %s", written.KeptKeys, target),
+		Details: map[string]interface{}{
+			"snapshot": map[string]interface{}{
+				"kept_keys":        written.KeptKeys,
+				"dropped_keys":     written.DroppedKeys,
+				"replaced_values":  written.ReplacedValues,
+				"compact_revision": written.CompactRevision,
+				"size":             written.Size,
+			},
+		},
+		Insights: insights,
+		Findings: []query.Finding{},
+	}, nil
+}
+
+// simulateCompaction compacts and defragments the snapshot, only the target is written
+func simulateCompaction(snapshot string, revision int64, target string) (*query.AnalysisResult, error) {
+	if target != "" {
+		abs, err := filepath.Abs(target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve path '%s': %w", target, err)
+		}
+		target = abs
+	}
+
+	compaction, err := etcdsnapshot.SimulateCompaction(snapshot, etcdsnapshot.CompactionOptions{Revision: revision, Target: target})
+	if err != nil {
+		return nil, err
+	}
+
+	insights := []string{
+		"A compaction only moves pages to the freelist, the database file shrinks with the defrag after it",
+	}
+	if compaction.DefragSize > compaction.Size {
+		insights = append(insights, "The defragmented database is larger than the snapshot, which is compact already")
+	}
+	if target != "" {
+		insights = append(insights, fmt.Sprintf("Wrote the compacted and defragmented database to %s", target))
+	}
+	return &query.AnalysisResult{
+		Type: "compaction",
+		Summary: fmt.Sprintf("Compacting at revision %d drops %d of %d revisions, a defrag then reclaims %d bytes (%d pages)",
+			compaction.Revision, compaction.DroppedRevisions, compaction.Revisions, compaction.ReclaimedBytes(), compaction.ReclaimedPages()),
+		Details: map[string]interface{}{
+			"compaction": map[string]interface{}{
+				"revision":           compaction.Revision,
+				"previous_revision":  compaction.PreviousRevision,
+				"revisions":          compaction.Revisions,
+				"dropped_revisions":  compaction.DroppedRevisions,
+				"dropped_tombstones": compaction.DroppedTombstones,
+				"removed_keys":       compaction.RemovedKeys,
+				"dropped_bytes":      compaction.DroppedBytes,
+			},
+			"defrag": map[string]interface{}{
+				"page_size":          compaction.PageSize,
+				"size":               compaction.Size,
+				"size_in_use":        compaction.SizeInUse,
+				"defrag_size":        compaction.DefragSize,
+				"defrag_size_in_use": compaction.DefragSizeInUse,
+				"reclaimed_bytes":    compaction.ReclaimedBytes(),
+				"reclaimed_pages":    compaction.ReclaimedPages(),
+			},
+		},
+		Insights: insights,
+		Findings: []query.Finding{},
+	}, nil
+}
+
+func quotaFlag(fs *flag.FlagSet, o *options) {
+	fs.StringVar(&o.quota, "quota", "", "storage quota of the cluster in bytes, as set with --quota-backend-bytes, defaults to etcd's 8GB")
+}
+
+// Run runs the command in args, e.g. "health -o json /backup/etcd.snapshot", and returns the exit code
+func Run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		printUsage(stderr)
+		if len(args) == 0 {
+			return ExitError
+		}
+		return ExitOK
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command '%s'\n\n", args[0])
+		printUsage(stderr)
+		return ExitError
+	}
+
+	formats := cmd.formats
+	if formats == nil {
+		formats = []string{formatTable, formatJSON, formatYAML}
+	}
+
+	o := &options{}
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&o.output, "o", formats[0], "output format: "+joinOr(formats))
+	if cmd.flags != nil {
+		cmd.flags(fs, o)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: etcdsnapshot %s\n\n%s\n\nFlags:\n", cmd.usage, cmd.description)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitError
+	}
+	if !contains(formats, o.output) {
+		fmt.Fprintf(stderr, "invalid output format '%s', expected %s\n", o.output, joinOr(formats))
+		return ExitError
+	}
+
+	engine, err := query.NewEngine()
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to create query engine: %v\n", err)
+		return ExitError
+	}
+
+	result, code, err := cmd.run(ctx, engine, o, fs.Args())
+	if err != nil {
+		fmt.Fprintf(stderr, "%s failed: %v\n", args[0], err)
+		return ExitError
+	}
+	if o.out != "" {
+		err = writeFile(o.out, o.output, result)
+	} else {
+		err = write(stdout, o.output, result)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to write output: %v\n", err)
+		return ExitError
+	}
+	return code
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: etcdsnapshot <command> [flags] <args>\n\nInspect etcd snapshots, the queries run in-process on the etcdsnapshot plugin without octosql.\n\nCommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-8s %s\n", name, commands[name].description)
+	}
+	fmt.Fprintf(w, "\nRun 'etcdsnapshot <command> -h' for the flags of a command.\n")
+}
+
+// snapshotArgs checks that there are n arguments and makes the first paths of them absolute, as the engine
+// requires for snapshots and directories
+func snapshotArgs(args []string, n, paths int) ([]string, error) {
+	if len(args) != n {
+		return nil, fmt.Errorf("expected %d arguments, got %d", n, len(args))
+	}
+
+	args = append([]string(nil), args...)
+	for i := 0; i < paths; i++ {
+		abs, err := filepath.Abs(args[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve path '%s': %w", args[i], err)
+		}
+		args[i] = abs
+	}
+	return args, nil
+}
+
+// healthExitCode returns ExitUnhealthy when a finding is at least as severe as failOn, an empty failOn never fails
+func healthExitCode(findings []query.Finding, failOn query.Severity) int {
+	if failOn == "" {
+		return ExitOK
+	}
+	for _, f := range findings {
+		if f.Severity.AtLeast(failOn) {
+			return ExitUnhealthy
+		}
+	}
+	return ExitOK
+}
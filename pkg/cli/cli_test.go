@@ -0,0 +1,134 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tjungblu/octosql-plugin-etcdsnapshot/pkg/query"
+)
+
+func run(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := Run(context.Background(), args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestRunUsage(t *testing.T) {
+	code, _, stderr := run()
+	require.Equal(t, ExitError, code)
+	for name := range commands {
+		require.Contains(t, stderr, "  "+name+" ")
+	}
+
+	code, _, _ = run("help")
+	require.Equal(t, ExitOK, code)
+
+	code, _, stderr = run("stats", "-h")
+	require.Equal(t, ExitOK, code)
+	require.Contains(t, stderr, "Usage: etcdsnapshot stats [flags] <snapshot>")
+	require.Contains(t, stderr, "-quota")
+
+	code, _, stderr = run("defrag")
+	require.Equal(t, ExitError, code)
+	require.Contains(t, stderr, "unknown command 'defrag'")
+}
+
+func TestRunInvalidArguments(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"stats", "-o", "xml", "etcd.snapshot"}, "invalid output format 'xml'"},
+		{[]string{"stats"}, "stats failed: expected 1 arguments, got 0"},
+		{[]string{"get", "etcd.snapshot"}, "get failed: expected 2 arguments, got 1"},
+		{[]string{"diff", "-type", "changed", "a.snapshot", "b.snapshot"}, "invalid diff type 'changed'"},
+		{[]string{"health", "-fail-on", "fatal", "etcd.snapshot"}, "invalid severity 'fatal'"},
+		{[]string{"health", "-rules", "/nonexistent/rules.yaml", "etcd.snapshot"}, "failed to read rules"},
+		{[]string{"leases", "/nonexistent/etcd.snapshot"}, "does not exist"},
+		{[]string{"export", "-format", "xml", "etcd.snapshot", "manifests"}, "invalid format 'xml', expected yaml or json"},
+		{[]string{"write", "-set", "/registry/pods/default/nginx", "a.snapshot", "b.snapshot"}, "invalid value '/registry/pods/default/nginx', expected key=file"},
+		{[]string{"compact", "-revision", "-1", "etcd.snapshot"}, "invalid revision -1"},
+		{[]string{"report", "-o", "table", "etcd.snapshot"}, "invalid output format 'table', expected json, yaml or prometheus"},
+		{[]string{"stats", "-o", "prometheus", "etcd.snapshot"}, "invalid output format 'prometheus', expected table, json or yaml"},
+	} {
+		code, stdout, stderr := run(tc.args...)
+		require.Equal(t, ExitError, code, tc.args)
+		require.Empty(t, stdout, tc.args)
+		require.Contains(t, stderr, tc.expected, tc.args)
+	}
+}
+
+func TestRunWrite(t *testing.T) {
+	dir := t.TempDir()
+	value := filepath.Join(dir, "value")
+	require.NoError(t, os.WriteFile(value, []byte("fixed"), 0600))
+	target := filepath.Join(dir, "written.snapshot")
+
+	code, stdout, stderr := run("write", "-o", "json", "-exclude-prefix", "b", "-set", "d="+value, "../etcdsnapshot/data/basic.snapshot", target)
+	require.Equal(t, ExitOK, code, stderr)
+	require.FileExists(t, target)
+
+	var result query.AnalysisResult
+	require.NoError(t, json.Unmarshal([]byte(stdout), &result))
+	require.Equal(t, "write", result.Type)
+	require.Equal(t, "Wrote 2 keys to "+target, result.Summary)
+	details := result.Details["snapshot"].(map[string]interface{})
+	require.Equal(t, float64(2), details["kept_keys"])
+	require.Equal(t, float64(1), details["dropped_keys"])
+	require.Equal(t, float64(1), details["replaced_values"])
+
+	code, _, stderr = run("write", "../etcdsnapshot/data/basic.snapshot", target)
+	require.Equal(t, ExitError, code)
+	require.Contains(t, stderr, "already exists")
+}
+
+func TestRunCompact(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "compacted.snapshot")
+
+	code, stdout, stderr := run("compact", "-o", "json", "-target", target, "../etcdsnapshot/data/basic.snapshot")
+	require.Equal(t, ExitOK, code, stderr)
+	require.FileExists(t, target)
+
+	var result query.AnalysisResult
+	require.NoError(t, json.Unmarshal([]byte(stdout), &result))
+	require.Equal(t, "compaction", result.Type)
+	compaction := result.Details["compaction"].(map[string]interface{})
+	require.Equal(t, float64(4), compaction["revision"])
+	require.Equal(t, float64(0), compaction["dropped_revisions"])
+
+	code, _, stderr = run("compact", "-revision", "5", "../etcdsnapshot/data/basic.snapshot")
+	require.Equal(t, ExitError, code)
+	require.Contains(t, stderr, "revision 5 is higher than the highest revision 4 of the snapshot")
+}
+
+func TestSnapshotArgs(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	defer func() { require.NoError(t, os.Chdir(wd)) }()
+
+	// only the snapshots are resolved, not the key
+	args, err := snapshotArgs([]string{"etcd.snapshot", "/registry/pods/default/nginx"}, 2, 1)
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(dir, "etcd.snapshot"), "/registry/pods/default/nginx"}, args)
+
+	args, err = snapshotArgs([]string{"a.snapshot", "/backup/b.snapshot"}, 2, 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(dir, "a.snapshot"), "/backup/b.snapshot"}, args)
+}
+
+func TestHealthExitCode(t *testing.T) {
+	findings := []query.Finding{{RuleID: "fragmentation", Severity: query.SeverityWarning}}
+
+	require.Equal(t, ExitOK, healthExitCode(findings, query.SeverityCritical))
+	require.Equal(t, ExitUnhealthy, healthExitCode(findings, query.SeverityWarning))
+	require.Equal(t, ExitUnhealthy, healthExitCode(findings, query.SeverityInfo))
+	require.Equal(t, ExitOK, healthExitCode(findings, ""))
+	require.Equal(t, ExitOK, healthExitCode(nil, query.SeverityInfo))
+}
@@ -0,0 +1,241 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/tjungblu/octosql-plugin-etcdsnapshot/pkg/query"
+	"gopkg.in/yaml.v3"
+)
+
+// The output formats
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+	formatYAML  = "yaml"
+	// formatPrometheus is the text format of the node exporter's textfile collector, only for reports
+	formatPrometheus = "prometheus"
+)
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// joinOr joins the values to "a, b or c"
+func joinOr(values []string) string {
+	if len(values) == 1 {
+		return values[0]
+	}
+	return strings.Join(values[:len(values)-1], ", ") + " or " + values[len(values)-1]
+}
+
+// write writes the result of a command, a *query.QueryResult, *query.AnalysisResult or *query.Report, in the format
+func write(w io.Writer, format string, result interface{}) error {
+	switch format {
+	case formatPrometheus:
+		report, ok := result.(*query.Report)
+		if !ok {
+			return fmt.Errorf("can't print %T as prometheus metrics", result)
+		}
+		return query.WritePrometheus(w, report)
+	case formatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	case formatYAML:
+		return writeYAML(w, result)
+	}
+
+	switch r := result.(type) {
+	case *query.QueryResult:
+		return writeRows(w, r.Columns, r.Data)
+	case *query.AnalysisResult:
+		return writeAnalysis(w, r)
+	default:
+		return fmt.Errorf("can't print %T as table", result)
+	}
+}
+
+// writeYAML writes the result with the keys of its JSON encoding, in their order
+func writeYAML(w io.Writer, result interface{}) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	// YAML is a superset of JSON, the node keeps the key order and only needs the JSON flow style removed
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return err
+	}
+	blockStyle(&node)
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&node); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
+
+// writeRows writes rows as aligned table with the given columns
+func writeRows(w io.Writer, columns []string, rows []map[string]interface{}) error {
+	if len(rows) == 0 {
+		_, err := fmt.Fprintln(w, "No results")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(columns, "\t"))
+	for _, row := range rows {
+		cells := make([]string, len(columns))
+		for i, column := range columns {
+			cells[i] = formatCell(row[column])
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	return tw.Flush()
+}
+
+// writeAnalysis writes the summary, the findings and then every detail of an analysis
+func writeAnalysis(w io.Writer, result *query.AnalysisResult) error {
+	fmt.Fprintln(w, result.Summary)
+
+	if len(result.Findings) > 0 {
+		fmt.Fprintln(w, "\nFindings:")
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "SEVERITY\tRULE\tMESSAGE")
+		for _, f := range result.Findings {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", f.Severity, f.RuleID, f.Message)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	keys := make([]string, 0, len(result.Details))
+	for key := range result.Details {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "\n%s:\n", key)
+		if err := writeDetail(w, result.Details[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeDetail(w io.Writer, detail interface{}) error {
+	switch d := detail.(type) {
+	case []map[string]interface{}:
+		return writeRows(w, rowColumns(d), d)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(d))
+		for key := range d {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for _, key := range keys {
+			fmt.Fprintf(tw, "  %s:\t%s\n", key, formatCell(d[key]))
+		}
+		return tw.Flush()
+	case []string:
+		for _, s := range d {
+			fmt.Fprintf(w, "  - %s\n", s)
+		}
+		return nil
+	default:
+		_, err := fmt.Fprintf(w, "  %s\n", formatCell(d))
+		return err
+	}
+}
+
+// rowColumns returns the sorted columns of all rows
+func rowColumns(rows []map[string]interface{}) []string {
+	set := make(map[string]bool)
+	for _, row := range rows {
+		for column := range row {
+			set[column] = true
+		}
+	}
+	columns := make([]string, 0, len(set))
+	for column := range set {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// formatCell formats a value of a JSON decoded row, NULL as empty cell and fractions with two decimals, the
+// JSON and YAML output keep the full precision
+func formatCell(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float64:
+		if value == math.Trunc(value) {
+			return strconv.FormatFloat(value, 'f', -1, 64)
+		}
+		return strconv.FormatFloat(value, 'f', 2, 64)
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Sprint(value)
+		}
+		return string(data)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// writeFile writes the result to a temporary file next to path and renames it, so readers like the textfile
+// collector never see a partial file
+func writeFile(path, format string, result interface{}) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if err := write(f, format, result); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+	// CreateTemp creates the file only readable by the owner
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to set file permissions: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename temporary file: %w", err)
+	}
+	return nil
+}
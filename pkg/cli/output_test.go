@@ -0,0 +1,112 @@
+package cli
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tjungblu/octosql-plugin-etcdsnapshot/pkg/query"
+)
+
+func testAnalysis() *query.AnalysisResult {
+	return &query.AnalysisResult{
+		Type:    "health",
+		Summary: "Health check completed with 0 critical, 1 warning and 0 info findings",
+		Details: map[string]interface{}{
+			"recommendations": []string{"Run defragmentation"},
+			"namespace_usage": []map[string]interface{}{
+				{"namespace": "default", "total_size_bytes": float64(2048)},
+				{"namespace": "kube-system", "total_size_bytes": 1.5},
+			},
+			"quota": map[string]interface{}{"bytes": float64(8589934592), "source": "default"},
+		},
+		Insights: []string{"High fragmentation: 40.0%"},
+		Findings: []query.Finding{{RuleID: "fragmentation", Severity: query.SeverityWarning, Value: 0.4, Threshold: 0.2, Message: "High fragmentation: 40.0%"}},
+	}
+}
+
+func TestWriteTable(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, write(&out, formatTable, &query.QueryResult{
+		Columns: []string{"key", "lease", "value"},
+		Data: []map[string]interface{}{
+			{"key": "/registry/leases/a", "lease": float64(7587869834), "value": nil},
+			{"key": "/registry/pods/default/nginx-with-a-long-name", "lease": float64(0), "value": "{}"},
+		},
+	}))
+	require.Equal(t, `key                                            lease       value
+/registry/leases/a                             7587869834  
+/registry/pods/default/nginx-with-a-long-name  0           {}
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, write(&out, formatTable, &query.QueryResult{}))
+	require.Equal(t, "No results\n", out.String())
+
+	out.Reset()
+	require.NoError(t, write(&out, formatTable, testAnalysis()))
+	require.Equal(t, `Health check completed with 0 critical, 1 warning and 0 info findings
+
+Findings:
+SEVERITY  RULE           MESSAGE
+warning   fragmentation  High fragmentation: 40.0%
+
+namespace_usage:
+namespace    total_size_bytes
+default      2048
+kube-system  1.50
+
+quota:
+  bytes:   8589934592
+  source:  default
+
+recommendations:
+  - Run defragmentation
+`, out.String())
+}
+
+func TestWriteJSONAndYAML(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, write(&out, formatJSON, &query.QueryResult{Columns: []string{"key"}, Data: []map[string]interface{}{{"key": "/registry/a"}}, Count: 1}))
+	require.JSONEq(t, `{"data":[{"key":"/registry/a"}],"columns":["key"],"count":1}`, out.String())
+
+	// the keys are the JSON keys in the order of the struct, strings that look like numbers stay strings
+	out.Reset()
+	require.NoError(t, write(&out, formatYAML, &query.QueryResult{Columns: []string{"name"}, Data: []map[string]interface{}{{"name": "10"}}, Count: 1}))
+	require.Equal(t, `data:
+  - name: "10"
+columns:
+  - name
+count: 1
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, write(&out, formatYAML, testAnalysis()))
+	require.Contains(t, out.String(), `findings:
+  - rule_id: fragmentation
+    severity: warning
+`)
+}
+
+func TestWriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "etcd_snapshot.prom")
+	require.NoError(t, os.WriteFile(path, []byte("stale"), 0644))
+
+	report := &query.Report{Version: query.ReportVersion}
+	require.NoError(t, writeFile(path, formatPrometheus, report))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(data), "etcd_snapshot_findings{severity=\"critical\"} 0\n")
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	// the temporary file is removed and the old file kept when writing fails
+	require.Error(t, writeFile(path, formatPrometheus, &query.QueryResult{}))
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(entries))
+}
@@ -0,0 +1,260 @@
+package etcdsnapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/server/v3/mvcc/buckets"
+)
+
+const (
+	// revBytesLen is the length of a revision key as created by revToBytes
+	revBytesLen = 17
+	// markTombstone is appended to the revision key of a deletion
+	markTombstone byte = 't'
+)
+
+// snapshotBackend is a read-only handle on the bbolt database of a snapshot. Unlike backend.NewDefaultBackend it
+// only takes a shared file lock and never starts a write transaction, so the same file can be opened concurrently.
+type snapshotBackend struct {
+	db   *bolt.DB
+	path string
+
+	// size is the size of the database file, sizeInUse excludes the pages on the freelist
+	size      int64
+	sizeInUse int64
+}
+
+func openSnapshotBackend(path string) (*snapshotBackend, error) {
+	// bbolt creates missing files even when opening them read-only
+	if _, err := os.Stat(path); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("snapshot '%s' does not exist: %w", path, err)
+		}
+		return nil, fmt.Errorf("failed to stat snapshot '%s': %w", path, err)
+	}
+
+	db, err := bolt.Open(path, 0400, &bolt.Options{
+		ReadOnly: true,
+		// the freelist is needed to compute sizeInUse, read-only databases skip loading it otherwise
+		PreLoadFreelist: true,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bbolt database [%s]: %w", path, err)
+	}
+
+	b := &snapshotBackend{db: db, path: path}
+	err = db.View(func(tx *bolt.Tx) error {
+		// same accounting as etcd's backend does on every transaction
+		b.size = tx.Size()
+		b.sizeInUse = b.size - int64(db.Stats().FreePageN)*int64(db.Info().PageSize)
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *snapshotBackend) Size() int64 {
+	return b.size
+}
+
+func (b *snapshotBackend) SizeInUse() int64 {
+	return b.sizeInUse
+}
+
+func (b *snapshotBackend) Close() error {
+	return b.db.Close()
+}
+
+// forEachRevision calls fn for every entry in the key bucket in revision order. Key and value are only valid
+// for the duration of the call. A missing key bucket is treated as an empty database. The scan stops with an
+// error once ctx is done.
+func (b *snapshotBackend) forEachRevision(ctx context.Context, fn func(revision, value []byte) error) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	return b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(buckets.Key.Name())
+		if bucket == nil {
+			return nil
+		}
+		progress := newScanProgress(ctx, b.path, b.sizeInUse)
+		err := bucket.ForEach(func(revision, value []byte) error {
+			progress.add(revision, value)
+			if progress.revisions%cancelCheckEvery == 0 {
+				if err := checkContext(ctx); err != nil {
+					return err
+				}
+			}
+			return fn(revision, value)
+		})
+		if err == nil {
+			progress.finish()
+		}
+		return err
+	})
+}
+
+// forEachChunk passes the values of the key bucket to fn in chunks of up to size revisions. The values point
+// into the database and stay valid until done returns, which is called before the read transaction ends, even
+// if fn returned an error or ctx is done.
+func (b *snapshotBackend) forEachChunk(ctx context.Context, size int, fn func(seq int, values [][]byte) error, done func()) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		defer done()
+
+		bucket := tx.Bucket(buckets.Key.Name())
+		if bucket == nil {
+			return nil
+		}
+
+		progress := newScanProgress(ctx, b.path, b.sizeInUse)
+		seq := 0
+		values := make([][]byte, 0, size)
+		c := bucket.Cursor()
+		for k, v := c.First(); v != nil; k, v = c.Next() {
+			progress.add(k, v)
+			if progress.revisions%cancelCheckEvery == 0 {
+				if err := checkContext(ctx); err != nil {
+					return err
+				}
+			}
+			values = append(values, v)
+			if len(values) == size {
+				if err := fn(seq, values); err != nil {
+					return err
+				}
+				seq++
+				values = make([][]byte, 0, size)
+			}
+		}
+		if len(values) > 0 {
+			if err := fn(seq, values); err != nil {
+				return err
+			}
+		}
+		progress.finish()
+		return nil
+	})
+}
+
+// forEachLatest calls fn with the latest revision of every key that isn't deleted, ordered by key. This is
+// the state of the cluster at the time of the snapshot, as the apiserver would see it. It stops with an error
+// once ctx is done.
+func (b *snapshotBackend) forEachLatest(ctx context.Context, fn func(kv mvccpb.KeyValue) error) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	return b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(buckets.Key.Name())
+		if bucket == nil {
+			return nil
+		}
+
+		// only the key is needed to find the latest revisions, so the values aren't unmarshaled yet
+		latest := make(map[string][]byte)
+		progress := newScanProgress(ctx, b.path, b.sizeInUse)
+		err := bucket.ForEach(func(revision, value []byte) error {
+			progress.add(revision, value)
+			if progress.revisions%cancelCheckEvery == 0 {
+				if err := checkContext(ctx); err != nil {
+					return err
+				}
+			}
+			key, err := keyValueKey(value)
+			if err != nil {
+				return err
+			}
+			if isTombstone(revision) {
+				delete(latest, string(key))
+			} else {
+				latest[string(key)] = append([]byte(nil), revision...)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		progress.finish()
+
+		keys := make([]string, 0, len(latest))
+		for key := range latest {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for i, key := range keys {
+			if i%cancelCheckEvery == 0 {
+				if err := checkContext(ctx); err != nil {
+					return err
+				}
+			}
+			kv := mvccpb.KeyValue{}
+			if err := kv.Unmarshal(bucket.Get(latest[key])); err != nil {
+				return fmt.Errorf("failed to unmarshal value of key [%s]: %w", key, err)
+			}
+			if err := fn(kv); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// leaseTTLs returns the granted TTL in seconds of every lease in the lease bucket, keyed by lease id
+func (b *snapshotBackend) leaseTTLs() (map[int64]int64, error) {
+	ttls := make(map[int64]int64)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(buckets.Lease.Name())
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, value []byte) error {
+			// leasepb.Lease: 1 ID, 2 TTL, decoded by hand because leasepb pulls in the whole etcdserverpb
+			var id, ttl int64
+			err := forEachProtoField(value, func(f protoField) error {
+				switch f.num {
+				case 1:
+					id = int64(f.varint)
+				case 2:
+					ttl = int64(f.varint)
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("failed to unmarshal lease: %w", err)
+			}
+			ttls[id] = ttl
+			return nil
+		})
+	})
+	return ttls, err
+}
+
+// isTombstone returns whether the revision marks the deletion of a key, etcd appends a 't' to those
+func isTombstone(revision []byte) bool {
+	return len(revision) == revBytesLen+1 && revision[revBytesLen] == markTombstone
+}
+
+// keyValueKey returns the key field of a marshaled mvccpb.KeyValue without unmarshaling the value
+func keyValueKey(value []byte) ([]byte, error) {
+	var key []byte
+	err := forEachProtoField(value, func(f protoField) error {
+		if f.num == 1 {
+			key = f.bytes
+		}
+		return nil
+	})
+	return key, err
+}
@@ -0,0 +1,235 @@
+package etcdsnapshot
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxIdleBackends is how many backends without references stay open for the next query
+const maxIdleBackends = 8
+
+// backends is the process-wide cache shared by all queries. octosql runs a process per query, so there it's only
+// shared by the tables of one query, like the sides of a join. The command line and the MCP server run their queries
+// in-process, all queries of the command or the server share it.
+var backends = newBackendCache()
+
+// fileIdentity identifies a version of a snapshot file, a change of any field invalidates the cached backend
+type fileIdentity struct {
+	inode uint64
+	size  int64
+	mtime time.Time
+}
+
+type cachedBackend struct {
+	path     string
+	identity fileIdentity
+	backend  *snapshotBackend
+
+	// refs and lastUsed are guarded by the cache mutex
+	refs     int
+	stale    bool
+	lastUsed time.Time
+
+	stats    *sharedResult[EtcdStats]
+	index    *sharedResult[*snapshotIndex]
+	timeline *sharedResult[*revisionTimeline]
+}
+
+// sharedResult is computed once per file version by the first query that needs it, the others wait for it.
+// A computation stopped by the context of its query isn't kept, the next query that needs it starts over.
+type sharedResult[T any] struct {
+	// sem is held while computing, unlike a mutex waiting for it can be cancelled
+	sem   chan struct{}
+	done  bool
+	value T
+	err   error
+}
+
+func newSharedResult[T any]() *sharedResult[T] {
+	return &sharedResult[T]{sem: make(chan struct{}, 1)}
+}
+
+func (r *sharedResult[T]) get(ctx context.Context, compute func() (T, error)) (T, error) {
+	select {
+	case r.sem <- struct{}{}:
+	case <-ctx.Done():
+		var zero T
+		return zero, checkContext(ctx)
+	}
+	defer func() { <-r.sem }()
+
+	if !r.done {
+		value, err := compute()
+		if err != nil && ctx.Err() != nil {
+			return value, err
+		}
+		r.value, r.err, r.done = value, err, true
+	}
+	return r.value, r.err
+}
+
+// etcdStats computes the statistics of the key bucket once per file version, from the index if there is one
+func (c *cachedBackend) etcdStats(ctx context.Context, index *snapshotIndex) (EtcdStats, error) {
+	return c.stats.get(ctx, func() (EtcdStats, error) {
+		if index != nil {
+			return index.etcdStats(), nil
+		}
+		return calculateEtcdStats(ctx, c.backend)
+	})
+}
+
+// snapshotIndex loads or builds the persistent index once per file version
+func (c *cachedBackend) snapshotIndex(ctx context.Context, cfg Config, dataDir bool) (*snapshotIndex, error) {
+	return c.index.get(ctx, func() (*snapshotIndex, error) {
+		return loadOrBuildIndex(ctx, cfg, c.path, dataDir, c.backend)
+	})
+}
+
+// revisionTimeline collects the timestamps of all objects once per file version, the encryption config is
+// part of the plugin configuration and can't change between queries
+func (c *cachedBackend) revisionTimeline(ctx context.Context, cfg Config) (*revisionTimeline, error) {
+	return c.timeline.get(ctx, func() (*revisionTimeline, error) {
+		decrypter, err := newDecrypter(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return buildRevisionTimeline(ctx, c.backend, decrypter)
+	})
+}
+
+// backendCache keeps read-only backends open across queries on the same file. Entries are refcounted, a
+// backend whose file changed on disk is dropped from the cache and closed once its last user releases it.
+type backendCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedBackend
+	// opening are the files being opened, the mutex isn't held while bbolt waits for the file lock
+	opening map[string]chan struct{}
+
+	open func(path string) (*snapshotBackend, error)
+}
+
+func newBackendCache() *backendCache {
+	return &backendCache{
+		entries: make(map[string]*cachedBackend),
+		opening: make(map[string]chan struct{}),
+		open:    openSnapshotBackend,
+	}
+}
+
+// acquire returns an open backend for the given database file, the caller must release it when done. Concurrent
+// callers of the same file wait for the first one to open it and then share its backend.
+func (c *backendCache) acquire(path string) (*cachedBackend, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if stat.IsDir() {
+		return nil, fmt.Errorf("expected a database file, but [%s] is a directory", path)
+	}
+	identity := fileIdentity{inode: fileInode(stat), size: stat.Size(), mtime: stat.ModTime()}
+
+	c.mu.Lock()
+	for {
+		if entry, ok := c.entries[path]; ok {
+			if entry.identity == identity {
+				entry.refs++
+				entry.lastUsed = time.Now()
+				c.mu.Unlock()
+				return entry, nil
+			}
+			c.evictLocked(entry)
+		}
+		opened, ok := c.opening[path]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+		<-opened
+		c.mu.Lock()
+	}
+	opened := make(chan struct{})
+	c.opening[path] = opened
+	c.mu.Unlock()
+
+	etcdBackend, err := c.open(path)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.opening, path)
+	close(opened)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &cachedBackend{
+		path:     path,
+		identity: identity,
+		backend:  etcdBackend,
+		refs:     1,
+		lastUsed: time.Now(),
+		stats:    newSharedResult[EtcdStats](),
+		index:    newSharedResult[*snapshotIndex](),
+		timeline: newSharedResult[*revisionTimeline](),
+	}
+	c.entries[path] = entry
+	c.closeIdleLocked()
+	return entry, nil
+}
+
+// release gives up a reference obtained through acquire
+func (c *backendCache) release(entry *cachedBackend) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.refs--
+	if entry.refs == 0 && entry.stale {
+		_ = entry.backend.Close()
+		return
+	}
+	c.closeIdleLocked()
+}
+
+// evictLocked removes the entry from the cache, it's closed immediately when nobody uses it anymore
+func (c *backendCache) evictLocked(entry *cachedBackend) {
+	if c.entries[entry.path] == entry {
+		delete(c.entries, entry.path)
+	}
+	entry.stale = true
+	if entry.refs == 0 {
+		_ = entry.backend.Close()
+	}
+}
+
+// closeIdleLocked evicts the least recently used backends without references above maxIdleBackends
+func (c *backendCache) closeIdleLocked() {
+	for {
+		var idle int
+		var oldest *cachedBackend
+		for _, entry := range c.entries {
+			if entry.refs > 0 {
+				continue
+			}
+			idle++
+			if oldest == nil || entry.lastUsed.Before(oldest.lastUsed) {
+				oldest = entry
+			}
+		}
+		if idle <= maxIdleBackends {
+			return
+		}
+		c.evictLocked(oldest)
+	}
+}
+
+// closeAll evicts every entry, backends in use are closed once they're released
+func (c *backendCache) closeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, entry := range c.entries {
+		c.evictLocked(entry)
+	}
+}
@@ -0,0 +1,289 @@
+package etcdsnapshot
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/tjungblu/octosql-plugin-etcdsnapshot/pkg/sqlengine"
+)
+
+func copySnapshot(t *testing.T) string {
+	data, err := os.ReadFile("data/basic.snapshot")
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "basic.snapshot")
+	require.NoError(t, os.WriteFile(path, data, 0600))
+	return path
+}
+
+func TestBackendCacheReusesOpenBackend(t *testing.T) {
+	cache := newBackendCache()
+	defer cache.closeAll()
+	path := copySnapshot(t)
+
+	first, err := cache.acquire(path)
+	require.NoError(t, err)
+	second, err := cache.acquire(path)
+	require.NoError(t, err)
+
+	require.Same(t, first, second)
+	require.Equal(t, 2, first.refs)
+
+	cache.release(first)
+	cache.release(second)
+	require.Equal(t, 0, first.refs)
+	require.False(t, first.stale)
+
+	// idle backends stay open for the next query
+	third, err := cache.acquire(path)
+	require.NoError(t, err)
+	require.Same(t, first, third)
+	cache.release(third)
+}
+
+func TestBackendCacheInvalidatesChangedFile(t *testing.T) {
+	cache := newBackendCache()
+	defer cache.closeAll()
+	path := copySnapshot(t)
+
+	first, err := cache.acquire(path)
+	require.NoError(t, err)
+
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, later, later))
+
+	second, err := cache.acquire(path)
+	require.NoError(t, err)
+	require.NotSame(t, first, second)
+
+	// the stale backend stays usable until its last user releases it
+	require.True(t, first.stale)
+	_, err = first.etcdStats(context.Background(), nil)
+	require.NoError(t, err)
+	cache.release(first)
+
+	cache.release(second)
+}
+
+func TestBackendCacheMemoizesStats(t *testing.T) {
+	cache := newBackendCache()
+	defer cache.closeAll()
+	path := copySnapshot(t)
+
+	entry, err := cache.acquire(path)
+	require.NoError(t, err)
+	defer cache.release(entry)
+
+	stats, err := entry.etcdStats(context.Background(), nil)
+	require.NoError(t, err)
+	require.Equal(t, 3, stats.totalKeys)
+
+	again, err := entry.etcdStats(context.Background(), nil)
+	require.NoError(t, err)
+	require.Equal(t, stats, again)
+}
+
+func TestBackendCacheConcurrentAcquire(t *testing.T) {
+	cache := newBackendCache()
+	defer cache.closeAll()
+	path := copySnapshot(t)
+
+	var wg sync.WaitGroup
+	entries := make([]*cachedBackend, 16)
+	for i := range entries {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			entry, err := cache.acquire(path)
+			require.NoError(t, err)
+			_, err = entry.etcdStats(context.Background(), nil)
+			require.NoError(t, err)
+			entries[i] = entry
+		}(i)
+	}
+	wg.Wait()
+
+	for _, entry := range entries {
+		require.Same(t, entries[0], entry)
+		cache.release(entry)
+	}
+	require.Equal(t, 0, entries[0].refs)
+}
+
+func TestBackendCacheOpensOutsideOfTheLock(t *testing.T) {
+	cache := newBackendCache()
+	defer cache.closeAll()
+	slow, fast := copySnapshot(t), copySnapshot(t)
+
+	opening := make(chan struct{})
+	proceed := make(chan struct{})
+	var opened int
+	cache.open = func(path string) (*snapshotBackend, error) {
+		if path == slow {
+			opened++
+			close(opening)
+			<-proceed
+		}
+		return openSnapshotBackend(path)
+	}
+
+	var wg sync.WaitGroup
+	entries := make([]*cachedBackend, 4)
+	for i := range entries {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			entry, err := cache.acquire(slow)
+			require.NoError(t, err)
+			entries[i] = entry
+		}(i)
+		if i == 0 {
+			<-opening
+		}
+	}
+
+	// other files can be acquired while one is waiting for its file lock
+	entry, err := cache.acquire(fast)
+	require.NoError(t, err)
+	cache.release(entry)
+
+	close(proceed)
+	wg.Wait()
+
+	// the callers waiting for the slow file share its backend instead of opening it again
+	require.Equal(t, 1, opened)
+	for _, entry := range entries {
+		require.Same(t, entries[0], entry)
+		cache.release(entry)
+	}
+	require.Equal(t, 0, entries[0].refs)
+	require.Empty(t, cache.opening)
+}
+
+func TestBackendCacheOpenError(t *testing.T) {
+	cache := newBackendCache()
+	path := copySnapshot(t)
+	cache.open = func(string) (*snapshotBackend, error) { return nil, fmt.Errorf("locked") }
+
+	_, err := cache.acquire(path)
+	require.ErrorContains(t, err, "locked")
+	require.Empty(t, cache.entries)
+	require.Empty(t, cache.opening)
+
+	// the next caller tries again
+	cache.open = openSnapshotBackend
+	entry, err := cache.acquire(path)
+	require.NoError(t, err)
+	cache.release(entry)
+	cache.closeAll()
+}
+
+func TestBackendCacheEvictsIdleBackends(t *testing.T) {
+	cache := newBackendCache()
+	defer cache.closeAll()
+
+	for i := 0; i < maxIdleBackends+2; i++ {
+		entry, err := cache.acquire(copySnapshot(t))
+		require.NoError(t, err)
+		cache.release(entry)
+	}
+
+	require.Len(t, cache.entries, maxIdleBackends)
+}
+
+func TestBackendCacheIsSharedAcrossQueries(t *testing.T) {
+	cache := newBackendCache()
+	defer cache.closeAll()
+	opens := 0
+	cache.open = func(path string) (*snapshotBackend, error) {
+		opens++
+		return openSnapshotBackend(path)
+	}
+	previous := backends
+	backends = cache
+	defer func() { backends = previous }()
+
+	// two queries of an in-process engine, like the command line and the MCP server run them
+	path := copySnapshot(t)
+	db := &Database{}
+	for i := 0; i < 2; i++ {
+		result, err := sqlengine.Execute(context.Background(), db, "SELECT totalKeys FROM "+path+"?meta=true")
+		require.NoError(t, err)
+		require.Equal(t, [][]interface{}{{int64(3)}}, result.Rows)
+	}
+
+	require.Equal(t, 1, opens)
+	require.Len(t, cache.entries, 1)
+	require.True(t, cache.entries[path].stats.done)
+}
+
+func TestBackendCacheWithNonexistentFile(t *testing.T) {
+	cache := newBackendCache()
+
+	_, err := cache.acquire("nonexistent.snapshot")
+	require.Error(t, err)
+	require.Empty(t, cache.entries)
+}
+
+func TestSnapshotBackendSizes(t *testing.T) {
+	b, err := openSnapshotBackend("data/basic.snapshot")
+	require.NoError(t, err)
+	defer b.Close()
+
+	require.Greater(t, b.Size(), int64(0))
+	require.Greater(t, b.SizeInUse(), int64(0))
+	require.LessOrEqual(t, b.SizeInUse(), b.Size())
+}
+
+func TestSharedResultIsntKeptWhenCancelled(t *testing.T) {
+	result := newSharedResult[int]()
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := result.get(ctx, func() (int, error) {
+		cancel()
+		return 0, checkContext(ctx)
+	})
+	require.ErrorContains(t, err, "query cancelled")
+
+	computed := 0
+	for i := 0; i < 2; i++ {
+		value, err := result.get(context.Background(), func() (int, error) {
+			computed++
+			return 42, nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 42, value)
+	}
+	require.Equal(t, 1, computed)
+}
+
+func TestSharedResultWaitIsCancellable(t *testing.T) {
+	result := newSharedResult[int]()
+	computing := make(chan struct{})
+	finish := make(chan struct{})
+	go func() {
+		_, _ = result.get(context.Background(), func() (int, error) {
+			close(computing)
+			<-finish
+			return 1, nil
+		})
+	}()
+	<-computing
+
+	// a query waiting for another one's computation can still time out
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := result.get(ctx, func() (int, error) { return 2, nil })
+	require.ErrorContains(t, err, "query timed out")
+
+	close(finish)
+	value, err := result.get(context.Background(), func() (int, error) { return 2, nil })
+	require.NoError(t, err)
+	require.Equal(t, 1, value)
+}
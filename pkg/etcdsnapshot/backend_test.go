@@ -0,0 +1,108 @@
+package etcdsnapshot
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/server/v3/mvcc/buckets"
+)
+
+// testRevision is a put or, with deleted set, a deletion of a key
+type testRevision struct {
+	key     string
+	value   string
+	deleted bool
+	lease   int64
+}
+
+// writeTestSnapshot creates a database with one revision per entry, starting at revision 2 like etcd does
+func writeTestSnapshot(tb testing.TB, revisions []testRevision) string {
+	path := filepath.Join(tb.TempDir(), "test.snapshot")
+	db, err := bolt.Open(path, 0600, nil)
+	require.NoError(tb, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(buckets.Key.Name())
+		if err != nil {
+			return err
+		}
+
+		created := make(map[string]int64)
+		versions := make(map[string]int64)
+		for i, r := range revisions {
+			rev := int64(i + 2)
+			revision := revToBytes(rev, 0)
+			kv := mvccpb.KeyValue{Key: []byte(r.key), ModRevision: rev}
+			if r.deleted {
+				revision = append(revision, markTombstone)
+				delete(created, r.key)
+				delete(versions, r.key)
+			} else {
+				if _, ok := created[r.key]; !ok {
+					created[r.key] = rev
+				}
+				versions[r.key]++
+				kv.CreateRevision = created[r.key]
+				kv.Version = versions[r.key]
+				kv.Value = []byte(r.value)
+				kv.Lease = r.lease
+			}
+
+			data, err := kv.Marshal()
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(revision, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(tb, err)
+	return path
+}
+
+func TestForEachLatest(t *testing.T) {
+	path := writeTestSnapshot(t, []testRevision{
+		{key: "/registry/b", value: "b1"},
+		{key: "/registry/a", value: "a1"},
+		{key: "/registry/b", value: "b2"},
+		{key: "/registry/c", value: "c1"},
+		{key: "/registry/c", deleted: true},
+		{key: "/registry/d", value: "d1"},
+		{key: "/registry/d", deleted: true},
+		{key: "/registry/d", value: "d2"},
+	})
+
+	etcdBackend, err := openSnapshotBackend(path)
+	require.NoError(t, err)
+	defer etcdBackend.Close()
+
+	var latest []string
+	err = etcdBackend.forEachLatest(context.Background(), func(kv mvccpb.KeyValue) error {
+		latest = append(latest, string(kv.Key)+"="+string(kv.Value))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"/registry/a=a1", "/registry/b=b2", "/registry/d=d2"}, latest)
+}
+
+func TestIsTombstone(t *testing.T) {
+	require.False(t, isTombstone(revToBytes(5, 0)))
+	require.True(t, isTombstone(append(revToBytes(5, 0), markTombstone)))
+}
+
+func TestKeyValueKey(t *testing.T) {
+	kv := mvccpb.KeyValue{Key: []byte("/registry/pods/default/nginx"), Value: []byte("value"), ModRevision: 3}
+	data, err := kv.Marshal()
+	require.NoError(t, err)
+
+	key, err := keyValueKey(data)
+	require.NoError(t, err)
+	require.Equal(t, "/registry/pods/default/nginx", string(key))
+}
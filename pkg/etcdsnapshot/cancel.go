@@ -0,0 +1,24 @@
+package etcdsnapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// cancelCheckEvery is the number of revisions a scan reads between looking at the context of the query
+const cancelCheckEvery = 256
+
+// checkContext returns an error once the query was cancelled or timed out, the error says which of the two
+// and wraps the context's error
+func checkContext(ctx context.Context) error {
+	err := ctx.Err()
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("query timed out: %w", err)
+	default:
+		return fmt.Errorf("query cancelled: %w", err)
+	}
+}
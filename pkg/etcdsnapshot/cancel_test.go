@@ -0,0 +1,111 @@
+package etcdsnapshot
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cube2222/octosql/execution"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tjungblu/octosql-plugin-etcdsnapshot/pkg/snapshotgen"
+)
+
+// countingContext is cancelled once its error was looked at a number of times, which cancels a scan in the
+// middle without depending on timing
+type countingContext struct {
+	context.Context
+	cancel    context.CancelFunc
+	remaining atomic.Int64
+}
+
+func cancelAfterChecks(checks int64) *countingContext {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &countingContext{Context: ctx, cancel: cancel}
+	c.remaining.Store(checks)
+	return c
+}
+
+func (c *countingContext) Err() error {
+	if c.remaining.Add(-1) < 0 {
+		c.cancel()
+	}
+	return c.Context.Err()
+}
+
+func TestCheckContext(t *testing.T) {
+	require.NoError(t, checkContext(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := checkContext(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+	require.EqualError(t, err, "query cancelled: context canceled")
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	err = checkContext(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.EqualError(t, err, "query timed out: context deadline exceeded")
+}
+
+func TestCancelMidScan(t *testing.T) {
+	cfg := snapshotgen.DefaultConfig()
+	cfg.Namespaces = 100
+	path := filepath.Join(t.TempDir(), "generated.snapshot")
+	result, err := snapshotgen.Generate(path, cfg)
+	require.NoError(t, err)
+	// the scans are cancelled after 10 checks or 100 records, long before they're done
+	require.Greater(t, result.Revisions, 20*cancelCheckEvery)
+
+	for name, ds := range map[string]*DatasourceExecuting{
+		"content":          {schema: SchemaContent, fieldIndices: []int{0, 7}, config: Config{ScanWorkers: 1}},
+		"parallel content": {schema: SchemaContent, fieldIndices: []int{0, 7}, config: Config{ScanWorkers: 4}},
+		"indexed content":  {schema: SchemaContent, fieldIndices: []int{0, 7}, config: Config{Index: true, IndexDir: t.TempDir()}},
+		"meta":             {schema: SchemaMeta, fieldIndices: []int{5, 6}},
+		"owners":           {schema: SchemaOwners, fieldIndices: []int{0}},
+		"events":           {schema: SchemaEvents, fieldIndices: []int{0}},
+		"timeline":         {schema: SchemaTimeline, fieldIndices: []int{0}},
+		"churn":            {schema: SchemaChurn, fieldIndices: []int{0}},
+		"sizes":            {schema: SchemaSizes, fieldIndices: []int{0}},
+		"tree":             {schema: SchemaTree, fieldIndices: []int{0}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ds.path = path
+			ctx := cancelAfterChecks(10)
+			records := 0
+			err := ds.Run(execution.ExecutionContext{Context: ctx},
+				func(_ execution.ProduceContext, record execution.Record) error {
+					// the parallel scan checks a context derived from ctx, which is cancelled while receiving
+					records++
+					if records == 100 {
+						ctx.cancel()
+					}
+					return nil
+				}, nil)
+			require.ErrorIs(t, err, context.Canceled)
+			require.ErrorContains(t, err, "query cancelled")
+			require.Less(t, records, result.Revisions)
+
+			// nothing computed by the cancelled query is kept, the next one reads the whole snapshot
+			require.NotEmpty(t, runDatasource(t, ds))
+		})
+	}
+}
+
+func TestScanTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	err := (&DatasourceExecuting{path: "data/basic.snapshot", fieldIndices: []int{0}}).Run(
+		execution.ExecutionContext{Context: ctx},
+		func(ctx execution.ProduceContext, record execution.Record) error {
+			t.Fatal("no record is produced after the timeout")
+			return nil
+		}, nil)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorContains(t, err, "query timed out")
+}
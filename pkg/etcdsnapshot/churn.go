@@ -0,0 +1,248 @@
+package etcdsnapshot
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	. "github.com/cube2222/octosql/execution"
+	"github.com/cube2222/octosql/octosql"
+	"github.com/cube2222/octosql/physical"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+const (
+	// a group is flagged as hot loop when the key written most in it was written at least hotLoopMinWrites times,
+	// with a median of at most hotLoopInterval between its writes
+	hotLoopMinWrites = 5
+	hotLoopInterval  = 10 * time.Second
+
+	medianWriteIntervalFieldIndex = 9
+	hotLoopFieldIndex             = 12
+)
+
+// churnSchemaFields is the schema of "?table=churn", one row per resource type, namespace and field manager with
+// the writes still retained in the snapshot
+func churnSchemaFields() []physical.SchemaField {
+	return []physical.SchemaField{
+		{
+			Name: "resourceType",
+			Type: octosql.TypeSum(octosql.Null, octosql.String),
+		},
+		{
+			Name: "namespace",
+			Type: octosql.TypeSum(octosql.Null, octosql.String),
+		},
+		{
+			// the manager of the latest managedFields entry, NULL for values without managedFields
+			Name: "fieldManager",
+			Type: octosql.TypeSum(octosql.Null, octosql.String),
+		},
+		{
+			// e.g. status, NULL for writes to the main resource
+			Name: "subresource",
+			Type: octosql.TypeSum(octosql.Null, octosql.String),
+		},
+		{
+			Name: "uniqueKeys",
+			Type: octosql.Int,
+		},
+		{
+			// revisions in the snapshot, deletions aren't counted
+			Name: "writes",
+			Type: octosql.Int,
+		},
+		{
+			Name: "bytesWritten",
+			Type: octosql.Int,
+		},
+		{
+			Name: "writesPerKey",
+			Type: octosql.Float,
+		},
+		{
+			// fraction of all writes in the snapshot
+			Name: "writeShare",
+			Type: octosql.Float,
+		},
+		{
+			// median seconds between two writes of the same key, estimated from the revision timeline
+			Name: "medianWriteInterval",
+			Type: octosql.TypeSum(octosql.Null, octosql.Float),
+		},
+		{
+			Name: "hotKey",
+			Type: octosql.String,
+		},
+		{
+			Name: "hotKeyWrites",
+			Type: octosql.Int,
+		},
+		{
+			// true when the hot key is rewritten every few seconds, like a controller updating status in a loop
+			Name: "hotLoop",
+			Type: octosql.Boolean,
+		},
+	}
+}
+
+type churnGroupKey struct {
+	resourceType string
+	namespace    string
+	fieldManager string
+	subresource  string
+}
+
+type churnGroup struct {
+	churnGroupKey
+	writes       int
+	bytesWritten int
+	keyWrites    map[string]int
+	// intervals are the seconds between a write and the previous write of the same key
+	intervals []float64
+}
+
+// hotKey returns the key written most in the group, ties go to the lexically smallest key
+func (g *churnGroup) hotKey() (string, int) {
+	var hotKey string
+	hotKeyWrites := 0
+	for key, writes := range g.keyWrites {
+		if writes > hotKeyWrites || (writes == hotKeyWrites && key < hotKey) {
+			hotKey, hotKeyWrites = key, writes
+		}
+	}
+	return hotKey, hotKeyWrites
+}
+
+// medianInterval returns the median of the intervals, false when there are none
+func (g *churnGroup) medianInterval() (float64, bool) {
+	if len(g.intervals) == 0 {
+		return 0, false
+	}
+	sort.Float64s(g.intervals)
+	mid := len(g.intervals) / 2
+	if len(g.intervals)%2 == 0 {
+		return (g.intervals[mid-1] + g.intervals[mid]) / 2, true
+	}
+	return g.intervals[mid], true
+}
+
+// selectsChurnIntervals returns whether a query on the churn table needs the revision timeline
+func selectsChurnIntervals(fieldIndices []int) bool {
+	for _, fi := range fieldIndices {
+		if fi == medianWriteIntervalFieldIndex || fi == hotLoopFieldIndex {
+			return true
+		}
+	}
+	return false
+}
+
+func produceChurnFromBackend(ctx ExecutionContext, produce ProduceFn, etcdBackend *snapshotBackend, fieldIndices []int, decrypter *decrypter, timeline *revisionTimeline) error {
+	groups := make(map[churnGroupKey]*churnGroup)
+	// lastWrite is the estimated time of the previous write of every key, only kept with a timeline
+	lastWrite := make(map[string]time.Time)
+	totalWrites := 0
+
+	kv := mvccpb.KeyValue{}
+	err := etcdBackend.forEachRevision(ctx, func(revision, val []byte) error {
+		if isTombstone(revision) {
+			return nil
+		}
+		if err := kv.Unmarshal(val); err != nil {
+			return fmt.Errorf("failed to unmarshal value: %w", err)
+		}
+
+		key := string(kv.Key)
+		keyValues := mapKeyToOctosql(key)
+		groupKey := churnGroupKey{resourceType: keyValues[3].Str, namespace: keyValues[4].Str}
+		if value, _, err := decrypter.decrypt(kv.Key, kv.Value); err == nil {
+			// values that aren't Kubernetes objects are grouped without field manager
+			if meta, err := decodeObjectMeta(value); err == nil {
+				groupKey.fieldManager = meta.FieldManager
+				groupKey.subresource = meta.FieldSubresource
+			}
+		}
+
+		g, ok := groups[groupKey]
+		if !ok {
+			g = &churnGroup{churnGroupKey: groupKey, keyWrites: make(map[string]int)}
+			groups[groupKey] = g
+		}
+		g.writes++
+		g.bytesWritten += len(kv.Value)
+		g.keyWrites[key]++
+		totalWrites++
+
+		if timeline != nil {
+			written, _, _ := timeline.estimate(kv.ModRevision)
+			if previous, ok := lastWrite[key]; ok && !written.IsZero() && !previous.IsZero() {
+				g.intervals = append(g.intervals, written.Sub(previous).Seconds())
+			}
+			lastWrite[key] = written
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sorted := make([]*churnGroup, 0, len(groups))
+	for _, g := range groups {
+		sorted = append(sorted, g)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.writes != b.writes {
+			return a.writes > b.writes
+		}
+		if a.resourceType != b.resourceType {
+			return a.resourceType < b.resourceType
+		}
+		if a.namespace != b.namespace {
+			return a.namespace < b.namespace
+		}
+		if a.fieldManager != b.fieldManager {
+			return a.fieldManager < b.fieldManager
+		}
+		return a.subresource < b.subresource
+	})
+	logger.Info("found churn groups", "writes", totalWrites, "groups", len(sorted))
+
+	for _, g := range sorted {
+		hotKey, hotKeyWrites := g.hotKey()
+		medianInterval := octosql.NewNull()
+		hotLoop := false
+		if interval, ok := g.medianInterval(); ok {
+			medianInterval = octosql.NewFloat(interval)
+			hotLoop = hotKeyWrites >= hotLoopMinWrites && interval <= hotLoopInterval.Seconds()
+		}
+
+		values := []octosql.Value{
+			nullableString(g.resourceType),
+			nullableString(g.namespace),
+			nullableString(g.fieldManager),
+			nullableString(g.subresource),
+			octosql.NewInt(len(g.keyWrites)),
+			octosql.NewInt(g.writes),
+			octosql.NewInt(g.bytesWritten),
+			octosql.NewFloat(float64(g.writes) / float64(len(g.keyWrites))),
+			octosql.NewFloat(float64(g.writes) / float64(totalWrites)),
+			medianInterval,
+			octosql.NewString(hotKey),
+			octosql.NewInt(hotKeyWrites),
+			octosql.NewBoolean(hotLoop),
+		}
+
+		var result []octosql.Value
+		for _, fi := range fieldIndices {
+			result = append(result, values[fi])
+		}
+
+		err := produce(ProduceFromExecutionContext(ctx), NewRecord(result, false, time.Time{}))
+		if err != nil {
+			logger.Debug("failed to produce record", "err", err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package etcdsnapshot
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cube2222/octosql/octosql"
+	"github.com/stretchr/testify/require"
+)
+
+// jsonLease is a Lease renewed by the manager at the given time
+func jsonLease(name, manager string, renewed time.Time) string {
+	return fmt.Sprintf(`{"apiVersion":"coordination.k8s.io/v1","kind":"Lease","metadata":{"name":%q,"namespace":"kube-system",
+		"managedFields":[{"manager":%q,"operation":"Update","time":%q}]},"spec":{"renewTime":%q}}`,
+		name, manager, renewed.Format(time.RFC3339), renewed.Format(time.RFC3339Nano))
+}
+
+func TestChurnTable(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	var revisions []testRevision
+	for i := 0; i < 6; i++ {
+		revisions = append(revisions, testRevision{
+			key:   "/registry/leases/kube-system/scheduler",
+			value: jsonLease("scheduler", "kube-scheduler", start.Add(time.Duration(2*i)*time.Second)),
+		})
+	}
+	revisions = append(revisions,
+		testRevision{key: "/registry/configmaps/default/settings", value: `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"settings",
+			"managedFields":[{"manager":"kubectl","operation":"Apply","time":"2024-05-01T09:00:00Z"},
+			{"manager":"operator","operation":"Update","subresource":"status","time":"2024-05-01T10:00:05Z"}]}}`},
+		testRevision{key: "/registry/configmaps/default/settings", deleted: true},
+		testRevision{key: "/registry/masterleases/10.0.0.1", value: "plain"},
+	)
+	path := writeTestSnapshot(t, revisions)
+
+	db := &Database{}
+	impl, schema, err := db.GetTable(context.Background(), path, map[string]string{"table": "churn"})
+	require.NoError(t, err)
+	require.Equal(t, 13, len(schema.Fields))
+	require.Equal(t, SchemaChurn, impl.(*etcdSnapshotDataSource).schema)
+
+	records := runDatasource(t, &DatasourceExecuting{path: path, fieldIndices: []int{0, 1, 2, 3, 4, 5, 7, 9, 10, 11, 12}, schema: SchemaChurn})
+	require.Equal(t, 3, len(records))
+	require.Equal(t, []octosql.Value{
+		octosql.NewString("leases"),
+		octosql.NewString("kube-system"),
+		octosql.NewString("kube-scheduler"),
+		octosql.NewNull(),
+		octosql.NewInt(1),
+		octosql.NewInt(6),
+		octosql.NewFloat(6),
+		octosql.NewFloat(2),
+		octosql.NewString("/registry/leases/kube-system/scheduler"),
+		octosql.NewInt(6),
+		octosql.NewBoolean(true),
+	}, records[0].Values)
+	// the deletion isn't a write, a single write has no interval
+	require.Equal(t, []octosql.Value{
+		octosql.NewString("configmaps"),
+		octosql.NewString("default"),
+		octosql.NewString("operator"),
+		octosql.NewString("status"),
+		octosql.NewInt(1),
+		octosql.NewInt(1),
+		octosql.NewFloat(1),
+		octosql.NewNull(),
+		octosql.NewString("/registry/configmaps/default/settings"),
+		octosql.NewInt(1),
+		octosql.NewBoolean(false),
+	}, records[1].Values)
+	require.Equal(t, octosql.NewString("masterleases"), records[2].Values[0])
+	require.Equal(t, octosql.NewNull(), records[2].Values[2])
+
+	// without the interval columns no timeline is needed
+	records = runDatasource(t, &DatasourceExecuting{path: path, fieldIndices: []int{5, 8}, schema: SchemaChurn})
+	require.Equal(t, []octosql.Value{octosql.NewInt(6), octosql.NewFloat(0.75)}, records[0].Values)
+}
+
+func TestChurnGroupMedianInterval(t *testing.T) {
+	g := &churnGroup{}
+	_, ok := g.medianInterval()
+	require.False(t, ok)
+
+	g.intervals = []float64{30, 2, 4}
+	median, ok := g.medianInterval()
+	require.True(t, ok)
+	require.Equal(t, 4.0, median)
+
+	g.intervals = append(g.intervals, 6)
+	median, _ = g.medianInterval()
+	require.Equal(t, 5.0, median)
+}
@@ -0,0 +1,199 @@
+package etcdsnapshot
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/server/v3/mvcc/buckets"
+)
+
+// CompactionOptions configure SimulateCompaction
+type CompactionOptions struct {
+	// Revision is the revision to compact at, zero compacts at the highest revision of the snapshot
+	Revision int64
+	// Target is the path the compacted and defragmented database is written to as snapshot, nothing is written
+	// when empty. The target must not exist.
+	Target string
+}
+
+// CompactionResult are the exact numbers of a compaction followed by a defrag
+type CompactionResult struct {
+	// Revision is the revision the snapshot was compacted at
+	Revision int64
+	// PreviousRevision is the revision of the last compaction of the snapshot, zero if it was never compacted
+	PreviousRevision int64
+
+	Revisions int
+	// DroppedRevisions includes the DroppedTombstones
+	DroppedRevisions  int
+	DroppedTombstones int
+	// RemovedKeys are the keys deleted before the compaction revision, no revision of them remains
+	RemovedKeys int
+	// DroppedBytes are the bytes of revision keys and values the compaction removes from the key bucket
+	DroppedBytes int64
+
+	PageSize int
+	// Size and SizeInUse are the ones of the snapshot, DefragSize and DefragSizeInUse the ones after the defrag
+	Size            int64
+	SizeInUse       int64
+	DefragSize      int64
+	DefragSizeInUse int64
+}
+
+// ReclaimedBytes is the size the database file shrinks by, a compaction only frees pages, the defrag returns them
+func (r *CompactionResult) ReclaimedBytes() int64 {
+	return r.Size - r.DefragSize
+}
+
+// ReclaimedPages is ReclaimedBytes in pages
+func (r *CompactionResult) ReclaimedPages() int64 {
+	if r.PageSize == 0 {
+		return 0
+	}
+	return r.ReclaimedBytes() / int64(r.PageSize)
+}
+
+// pendingRevision is the latest revision of a key at or below the compaction revision
+type pendingRevision struct {
+	revision string
+	size     int
+}
+
+// SimulateCompaction computes which revisions a compaction at a revision would drop and how much a defrag
+// reclaims afterward. etcd keeps every revision above the compaction revision and, of the ones at or below it,
+// only the latest of each key, unless that one is a deletion. The defrag is not estimated: the remaining
+// revisions are copied into a temporary database like etcd's defrag does, next to the target or in the
+// temporary directory, so there has to be space for the compacted database. The snapshot isn't changed.
+func SimulateCompaction(path string, opts CompactionOptions) (*CompactionResult, error) {
+	if opts.Target != "" {
+		if _, err := os.Stat(opts.Target); err == nil {
+			return nil, fmt.Errorf("target snapshot '%s' already exists", opts.Target)
+		}
+	}
+
+	backend, err := openSnapshotBackend(path)
+	if err != nil {
+		return nil, err
+	}
+	defer backend.Close()
+
+	result := &CompactionResult{
+		PageSize:  backend.db.Info().PageSize,
+		Size:      backend.Size(),
+		SizeInUse: backend.SizeInUse(),
+	}
+	err = backend.db.View(func(tx *bolt.Tx) error {
+		result.PreviousRevision = compactedRevision(tx)
+
+		dropped, err := compactRevisions(tx, opts.Revision, result)
+		if err != nil {
+			return err
+		}
+
+		dir, name := os.TempDir(), filepath.Base(path)
+		if opts.Target != "" {
+			dir, name = filepath.Dir(opts.Target), filepath.Base(opts.Target)
+		}
+		db, err := createTempDatabase(dir, name)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		keep := func(revision []byte) bool { return !dropped[string(revision)] }
+		if _, err := copyDatabase(tx, db.DB, keep, nil, result.Revision); err != nil {
+			return err
+		}
+
+		err = db.View(func(dbTx *bolt.Tx) error {
+			// same accounting as openSnapshotBackend
+			result.DefragSize = dbTx.Size()
+			result.DefragSizeInUse = result.DefragSize - int64(db.Stats().FreePageN)*int64(db.Info().PageSize)
+			return nil
+		})
+		if err != nil || opts.Target == "" {
+			return err
+		}
+		_, err = writeSnapshotFile(db.DB, opts.Target)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// compactRevisions returns the revisions of the key bucket a compaction at revision drops, zero compacts at the
+// highest revision. Like etcd, it refuses revisions that are compacted already or don't exist yet.
+func compactRevisions(tx *bolt.Tx, revision int64, result *CompactionResult) (map[string]bool, error) {
+	dropped := make(map[string]bool)
+	bucket := tx.Bucket(buckets.Key.Name())
+
+	// the key bucket is ordered by revision, the highest is the last
+	maxRevision := result.PreviousRevision
+	if bucket != nil {
+		if last, _ := bucket.Cursor().Last(); last != nil {
+			if main, _ := bytesToRev(last); main > maxRevision {
+				maxRevision = main
+			}
+		}
+	}
+	if revision == 0 {
+		revision = maxRevision
+	}
+	switch {
+	case revision > maxRevision:
+		return nil, fmt.Errorf("revision %d is higher than the highest revision %d of the snapshot", revision, maxRevision)
+	case revision <= result.PreviousRevision:
+		return nil, fmt.Errorf("revision %d is compacted already, the snapshot is compacted at %d", revision, result.PreviousRevision)
+	}
+	result.Revision = revision
+
+	if bucket == nil {
+		return dropped, nil
+	}
+
+	pending := make(map[string]pendingRevision)
+	// keys with a revision above the compaction revision
+	live := make(map[string]bool)
+	err := bucket.ForEach(func(rev, value []byte) error {
+		result.Revisions++
+		key, err := keyValueKey(value)
+		if err != nil {
+			return err
+		}
+		if main, _ := bytesToRev(rev); main > revision {
+			live[string(key)] = true
+			return nil
+		}
+
+		// a later revision at or below the compaction revision replaces the pending one of the key
+		if previous, ok := pending[string(key)]; ok {
+			dropped[previous.revision] = true
+			result.DroppedRevisions++
+			result.DroppedBytes += int64(previous.size)
+		}
+		pending[string(key)] = pendingRevision{revision: string(rev), size: len(rev) + len(value)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the remaining revision of a key is dropped as well when it is a deletion
+	for key, p := range pending {
+		if !isTombstone([]byte(p.revision)) {
+			continue
+		}
+		dropped[p.revision] = true
+		result.DroppedRevisions++
+		result.DroppedTombstones++
+		result.DroppedBytes += int64(p.size)
+		if !live[key] {
+			result.RemovedKeys++
+		}
+	}
+	return dropped, nil
+}
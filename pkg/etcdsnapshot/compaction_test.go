@@ -0,0 +1,119 @@
+package etcdsnapshot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func compactionTestSnapshot(t *testing.T) string {
+	return writeTestSnapshot(t, []testRevision{
+		{key: "a", value: "a1"},
+		{key: "b", value: "b1"},
+		{key: "a", value: "a2"},
+		{key: "c", value: "c1"},
+		{key: "b", deleted: true},
+		{key: "a", value: "a3"},
+		{key: "d", value: "d1"},
+		{key: "d", deleted: true},
+	})
+}
+
+func TestSimulateCompaction(t *testing.T) {
+	path := compactionTestSnapshot(t)
+
+	// revision 2 and 4 of a are replaced by 4 and 7, b is deleted at 6 and d at 9
+	result, err := SimulateCompaction(path, CompactionOptions{})
+	require.NoError(t, err)
+	require.Equal(t, int64(9), result.Revision)
+	require.Equal(t, int64(0), result.PreviousRevision)
+	require.Equal(t, 8, result.Revisions)
+	require.Equal(t, 6, result.DroppedRevisions)
+	require.Equal(t, 2, result.DroppedTombstones)
+	require.Equal(t, 2, result.RemovedKeys)
+	require.Positive(t, result.DroppedBytes)
+	require.Positive(t, result.DefragSize)
+	require.Equal(t, result.Size-result.DefragSize, result.ReclaimedBytes())
+
+	// revisions above the compaction revision stay, the deletion of d hasn't happened yet at 6
+	result, err = SimulateCompaction(path, CompactionOptions{Revision: 6})
+	require.NoError(t, err)
+	require.Equal(t, int64(6), result.Revision)
+	require.Equal(t, 3, result.DroppedRevisions)
+	require.Equal(t, 1, result.DroppedTombstones)
+	require.Equal(t, 1, result.RemovedKeys)
+}
+
+func TestSimulateCompactionWritesTarget(t *testing.T) {
+	path := compactionTestSnapshot(t)
+	target := filepath.Join(t.TempDir(), "compacted.snapshot")
+
+	result, err := SimulateCompaction(path, CompactionOptions{Revision: 6, Target: target})
+	require.NoError(t, err)
+	require.NoError(t, verifySnapshotHash(target))
+	info, err := os.Stat(target)
+	require.NoError(t, err)
+	require.Equal(t, result.DefragSize+32, info.Size())
+
+	rows := writtenKeys(t, target)
+	require.Len(t, rows, 5)
+	require.Equal(t, []interface{}{"a", 4, "a2"}, rows[0])
+	require.Equal(t, []interface{}{"c", 5, "c1"}, rows[1])
+	require.Equal(t, []interface{}{"a", 7, "a3"}, rows[2])
+
+	// the compaction is recorded, so it can't go back
+	_, err = SimulateCompaction(target, CompactionOptions{Revision: 5})
+	require.ErrorContains(t, err, "revision 5 is compacted already, the snapshot is compacted at 6")
+	// a2 is replaced by a3, d1 is deleted
+	result, err = SimulateCompaction(target, CompactionOptions{})
+	require.NoError(t, err)
+	require.Equal(t, int64(6), result.PreviousRevision)
+	require.Equal(t, 3, result.DroppedRevisions)
+
+	_, err = SimulateCompaction(path, CompactionOptions{Revision: 6, Target: target})
+	require.ErrorContains(t, err, "already exists")
+}
+
+func TestSimulateCompactionWithInvalidRevision(t *testing.T) {
+	_, err := SimulateCompaction(compactionTestSnapshot(t), CompactionOptions{Revision: 10})
+	require.ErrorContains(t, err, "revision 10 is higher than the highest revision 9 of the snapshot")
+}
+
+func TestSimulateCompactionWithNonexistentSource(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "nonexistent.snapshot")
+	target := filepath.Join(dir, "compacted.snapshot")
+	_, err := SimulateCompaction(source, CompactionOptions{Target: target})
+	require.ErrorContains(t, err, "does not exist")
+	require.NoFileExists(t, source)
+	require.NoFileExists(t, target)
+}
+
+func TestSimulateCompactionKeepsRevisions(t *testing.T) {
+	path := compactionTestSnapshot(t)
+
+	// a is written at 2, 4 and 7, b at 3 and deleted at 6, c at 5, d at 8 and deleted at 9
+	for revision, kept := range map[int64][]int{
+		2: {2, 3, 4, 5, 6, 7, 8, 9},
+		3: {2, 3, 4, 5, 6, 7, 8, 9},
+		4: {3, 4, 5, 6, 7, 8, 9},
+		5: {3, 4, 5, 6, 7, 8, 9},
+		6: {4, 5, 7, 8, 9},
+		7: {5, 7, 8, 9},
+		8: {5, 7, 8, 9},
+		9: {5, 7},
+	} {
+		target := filepath.Join(t.TempDir(), "compacted.snapshot")
+		result, err := SimulateCompaction(path, CompactionOptions{Revision: revision, Target: target})
+		require.NoError(t, err)
+		require.Equal(t, 8-len(kept), result.DroppedRevisions, "revision %d", revision)
+
+		var revisions []int
+		for _, row := range writtenKeys(t, target) {
+			revisions = append(revisions, row[1].(int))
+		}
+		require.Equal(t, kept, revisions, "revision %d", revision)
+	}
+}
@@ -0,0 +1,53 @@
+package etcdsnapshot
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultConfigPath returns octosql's configuration file, "~/.octosql/octosql.yml"
+func DefaultConfigPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".octosql", "octosql.yml"), nil
+}
+
+// LoadConfig reads the plugin's configuration from an octosql configuration file, it's the config of the database
+// of type "etcdsnapshot". A missing file or database is the default configuration, so the queries that run
+// in-process, without octosql, use the same configuration as the ones octosql runs.
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Config{}, nil
+	} else if err != nil {
+		return Config{}, fmt.Errorf("failed to read the octosql configuration: %w", err)
+	}
+
+	var file struct {
+		Databases []struct {
+			Name   string    `yaml:"name"`
+			Type   string    `yaml:"type"`
+			Config yaml.Node `yaml:"config"`
+		} `yaml:"databases"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return Config{}, fmt.Errorf("failed to parse the octosql configuration %s: %w", path, err)
+	}
+	var config Config
+	for _, database := range file.Databases {
+		if database.Type != "etcdsnapshot" || database.Config.IsZero() {
+			continue
+		}
+		if err := database.Config.Decode(&config); err != nil {
+			return Config{}, fmt.Errorf("invalid configuration of database '%s' in %s: %w", database.Name, path, err)
+		}
+		break
+	}
+	return config, nil
+}
@@ -0,0 +1,48 @@
+package etcdsnapshot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "octosql.yml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+databases:
+  - name: other
+    type: postgres
+    config:
+      host: localhost
+  - name: etcdsnapshot
+    type: etcdsnapshot
+    config:
+      index: true
+      redactKeys:
+        - /configmaps/
+      scanWorkers: 2
+`), 0644))
+
+	config, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, Config{Index: true, RedactKeys: []string{"/configmaps/"}, ScanWorkers: 2}, config)
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	dir := t.TempDir()
+	config, err := LoadConfig(filepath.Join(dir, "missing.yml"))
+	require.NoError(t, err)
+	require.Equal(t, Config{}, config)
+
+	path := filepath.Join(dir, "octosql.yml")
+	require.NoError(t, os.WriteFile(path, []byte("databases: []\n"), 0644))
+	config, err = LoadConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, Config{}, config)
+
+	require.NoError(t, os.WriteFile(path, []byte("databases:\n  - type: etcdsnapshot\n    config:\n      scanWorkers: many\n"), 0644))
+	_, err = LoadConfig(path)
+	require.ErrorContains(t, err, "invalid configuration")
+}
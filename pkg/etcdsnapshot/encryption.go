@@ -0,0 +1,228 @@
+package etcdsnapshot
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// encryptionPrefix starts every value the apiserver encrypted at rest, it's followed by
+	// "<provider>:<version>:<key name>:" and the ciphertext
+	encryptionPrefix = "k8s:enc:"
+
+	ProviderIdentity  = "identity"
+	ProviderAESCBC    = "aescbc"
+	ProviderAESGCM    = "aesgcm"
+	ProviderSecretbox = "secretbox"
+	ProviderKMS       = "kms"
+)
+
+// encryptionConfiguration is the part of the apiserver's EncryptionConfiguration that holds local keys, kms
+// providers can't be decrypted without the external plugin and are ignored
+type encryptionConfiguration struct {
+	Kind      string `yaml:"kind"`
+	Resources []struct {
+		Providers []struct {
+			AESCBC    *encryptionKeys `yaml:"aescbc"`
+			AESGCM    *encryptionKeys `yaml:"aesgcm"`
+			Secretbox *encryptionKeys `yaml:"secretbox"`
+		} `yaml:"providers"`
+	} `yaml:"resources"`
+}
+
+type encryptionKeys struct {
+	Keys []struct {
+		Name   string `yaml:"name"`
+		Secret string `yaml:"secret"`
+	} `yaml:"keys"`
+}
+
+// transformer decrypts the ciphertext following the prefix, the etcd key is the authenticated data of aesgcm
+type transformer func(etcdKey, data []byte) ([]byte, error)
+
+// decrypter turns values encrypted at rest back into the stored objects with the keys of an
+// EncryptionConfiguration
+type decrypter struct {
+	// transformers are keyed by "<provider>:<key name>", the same name may be used by several resources with
+	// different secrets, so all of them are tried
+	transformers map[string][]transformer
+}
+
+// newDecrypter loads the EncryptionConfiguration of cfg, or returns nil if none is configured
+func newDecrypter(cfg Config) (*decrypter, error) {
+	if cfg.EncryptionConfig == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(cfg.EncryptionConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption config: %w", err)
+	}
+	return parseEncryptionConfiguration(b)
+}
+
+func parseEncryptionConfiguration(b []byte) (*decrypter, error) {
+	var config encryptionConfiguration
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse encryption config: %w", err)
+	}
+	if config.Kind != "" && config.Kind != "EncryptionConfiguration" {
+		return nil, fmt.Errorf("unexpected kind '%s' in encryption config, expected EncryptionConfiguration", config.Kind)
+	}
+
+	d := &decrypter{transformers: make(map[string][]transformer)}
+	add := func(provider string, keys *encryptionKeys, newTransformer func(secret []byte) (transformer, error)) error {
+		if keys == nil {
+			return nil
+		}
+		for _, key := range keys.Keys {
+			secret, err := base64.StdEncoding.DecodeString(key.Secret)
+			if err != nil {
+				return fmt.Errorf("invalid secret of %s key '%s': %w", provider, key.Name, err)
+			}
+			t, err := newTransformer(secret)
+			if err != nil {
+				return fmt.Errorf("invalid secret of %s key '%s': %w", provider, key.Name, err)
+			}
+			name := provider + ":" + key.Name
+			d.transformers[name] = append(d.transformers[name], t)
+		}
+		return nil
+	}
+
+	for _, resource := range config.Resources {
+		for _, provider := range resource.Providers {
+			if err := add(ProviderAESCBC, provider.AESCBC, newAESCBCTransformer); err != nil {
+				return nil, err
+			}
+			if err := add(ProviderAESGCM, provider.AESGCM, newAESGCMTransformer); err != nil {
+				return nil, err
+			}
+			if err := add(ProviderSecretbox, provider.Secretbox, newSecretboxTransformer); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return d, nil
+}
+
+// parseEncryptedValue splits an encrypted value into provider, key name and ciphertext, ok is false for
+// values stored in plaintext
+func parseEncryptedValue(value []byte) (provider string, keyName string, data []byte, ok bool) {
+	if !bytes.HasPrefix(value, []byte(encryptionPrefix)) {
+		return "", "", nil, false
+	}
+	// <provider>:<version>:<key name>:<data>
+	parts := bytes.SplitN(value[len(encryptionPrefix):], []byte(":"), 4)
+	if len(parts) != 4 {
+		return "", "", nil, false
+	}
+	return string(parts[0]), string(parts[2]), parts[3], true
+}
+
+// encryptionProviderOf returns the provider that encrypted a value, identity for values stored in plaintext
+func encryptionProviderOf(value []byte) string {
+	provider, _, _, ok := parseEncryptedValue(value)
+	if !ok {
+		return ProviderIdentity
+	}
+	return provider
+}
+
+// decrypt returns the plaintext of a value and the provider that encrypted it. Plaintext values are returned
+// as they are, encrypted values without a matching key return an error.
+func (d *decrypter) decrypt(etcdKey, value []byte) ([]byte, string, error) {
+	provider, keyName, data, ok := parseEncryptedValue(value)
+	if !ok {
+		return value, ProviderIdentity, nil
+	}
+	if d == nil {
+		return nil, provider, fmt.Errorf("value is encrypted with %s, but no encryption config is set", provider)
+	}
+
+	transformers := d.transformers[provider+":"+keyName]
+	if len(transformers) == 0 {
+		return nil, provider, fmt.Errorf("no %s key named '%s' in the encryption config", provider, keyName)
+	}
+	var err error
+	for _, t := range transformers {
+		var plaintext []byte
+		plaintext, err = t(etcdKey, data)
+		if err == nil {
+			return plaintext, provider, nil
+		}
+	}
+	return nil, provider, fmt.Errorf("failed to decrypt with %s key '%s': %w", provider, keyName, err)
+}
+
+// newAESCBCTransformer decrypts a 16 byte IV followed by the PKCS#7 padded ciphertext
+func newAESCBCTransformer(secret []byte) (transformer, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	return func(_, data []byte) ([]byte, error) {
+		if len(data) < 2*aes.BlockSize || len(data)%aes.BlockSize != 0 {
+			return nil, fmt.Errorf("invalid aescbc ciphertext length %d", len(data))
+		}
+		plaintext := make([]byte, len(data)-aes.BlockSize)
+		cipher.NewCBCDecrypter(block, data[:aes.BlockSize]).CryptBlocks(plaintext, data[aes.BlockSize:])
+
+		padding := int(plaintext[len(plaintext)-1])
+		if padding == 0 || padding > aes.BlockSize {
+			return nil, fmt.Errorf("invalid aescbc padding")
+		}
+		for _, b := range plaintext[len(plaintext)-padding:] {
+			if int(b) != padding {
+				return nil, fmt.Errorf("invalid aescbc padding")
+			}
+		}
+		return plaintext[:len(plaintext)-padding], nil
+	}, nil
+}
+
+// newAESGCMTransformer decrypts a 12 byte nonce followed by the sealed data, authenticated with the etcd key
+func newAESGCMTransformer(secret []byte) (transformer, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return func(etcdKey, data []byte) ([]byte, error) {
+		if len(data) < aead.NonceSize() {
+			return nil, fmt.Errorf("invalid aesgcm ciphertext length %d", len(data))
+		}
+		return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], etcdKey)
+	}, nil
+}
+
+// newSecretboxTransformer decrypts a 24 byte nonce followed by the box, the secret must be 32 bytes
+func newSecretboxTransformer(secret []byte) (transformer, error) {
+	if len(secret) != 32 {
+		return nil, fmt.Errorf("secretbox keys must be 32 bytes, got %d", len(secret))
+	}
+	var key [32]byte
+	copy(key[:], secret)
+	return func(_, data []byte) ([]byte, error) {
+		if len(data) < 24 {
+			return nil, fmt.Errorf("invalid secretbox ciphertext length %d", len(data))
+		}
+		var nonce [24]byte
+		copy(nonce[:], data[:24])
+		plaintext, ok := secretbox.Open(nil, data[24:], &nonce, &key)
+		if !ok {
+			return nil, fmt.Errorf("secretbox authentication failed")
+		}
+		return plaintext, nil
+	}, nil
+}
@@ -0,0 +1,207 @@
+package etcdsnapshot
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cube2222/octosql/octosql"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+var (
+	testAESKey       = bytes.Repeat([]byte{0x42}, 32)
+	testSecretboxKey = bytes.Repeat([]byte{0x17}, 32)
+)
+
+const testEncryptionConfig = `apiVersion: apiserver.config.k8s.io/v1
+kind: EncryptionConfiguration
+resources:
+  - resources:
+      - secrets
+    providers:
+      - aesgcm:
+          keys:
+            - name: gcm1
+              secret: QkJCQkJCQkJCQkJCQkJCQkJCQkJCQkJCQkJCQkJCQkI=
+      - aescbc:
+          keys:
+            - name: cbc1
+              secret: QkJCQkJCQkJCQkJCQkJCQkJCQkJCQkJCQkJCQkJCQkI=
+      - secretbox:
+          keys:
+            - name: box1
+              secret: FxcXFxcXFxcXFxcXFxcXFxcXFxcXFxcXFxcXFxcXFxc=
+      - identity: {}
+`
+
+func encryptAESCBC(t *testing.T, keyName string, plaintext []byte) string {
+	block, err := aes.NewCipher(testAESKey)
+	require.NoError(t, err)
+
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	out := make([]byte, aes.BlockSize+len(padded))
+	_, err = rand.Read(out[:aes.BlockSize])
+	require.NoError(t, err)
+	cipher.NewCBCEncrypter(block, out[:aes.BlockSize]).CryptBlocks(out[aes.BlockSize:], padded)
+	return "k8s:enc:aescbc:v1:" + keyName + ":" + string(out)
+}
+
+func encryptAESGCM(t *testing.T, keyName, etcdKey string, plaintext []byte) string {
+	block, err := aes.NewCipher(testAESKey)
+	require.NoError(t, err)
+	aead, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	require.NoError(t, err)
+	return "k8s:enc:aesgcm:v1:" + keyName + ":" + string(aead.Seal(nonce, nonce, plaintext, []byte(etcdKey)))
+}
+
+func encryptSecretbox(t *testing.T, keyName string, plaintext []byte) string {
+	var key [32]byte
+	copy(key[:], testSecretboxKey)
+	var nonce [24]byte
+	_, err := rand.Read(nonce[:])
+	require.NoError(t, err)
+	return "k8s:enc:secretbox:v1:" + keyName + ":" + string(secretbox.Seal(nonce[:], plaintext, &nonce, &key))
+}
+
+func writeEncryptionConfig(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "encryption.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(testEncryptionConfig), 0600))
+	return path
+}
+
+func TestTestEncryptionConfigKeys(t *testing.T) {
+	// the secrets in testEncryptionConfig have to match the keys the fixtures are encrypted with
+	require.Contains(t, testEncryptionConfig, base64.StdEncoding.EncodeToString(testAESKey))
+	require.Contains(t, testEncryptionConfig, base64.StdEncoding.EncodeToString(testSecretboxKey))
+}
+
+func TestDecryptProviders(t *testing.T) {
+	d, err := newDecrypter(Config{EncryptionConfig: writeEncryptionConfig(t)})
+	require.NoError(t, err)
+
+	etcdKey := []byte("/registry/secrets/default/token")
+	plaintext := []byte(`{"kind":"Secret","data":{"token":"c2VjcmV0"}}`)
+	for provider, value := range map[string]string{
+		ProviderAESCBC:    encryptAESCBC(t, "cbc1", plaintext),
+		ProviderAESGCM:    encryptAESGCM(t, "gcm1", string(etcdKey), plaintext),
+		ProviderSecretbox: encryptSecretbox(t, "box1", plaintext),
+		ProviderIdentity:  string(plaintext),
+	} {
+		require.Equal(t, provider, encryptionProviderOf([]byte(value)))
+
+		decrypted, decryptedBy, err := d.decrypt(etcdKey, []byte(value))
+		require.NoError(t, err, provider)
+		require.Equal(t, provider, decryptedBy)
+		require.Equal(t, plaintext, decrypted, provider)
+	}
+}
+
+func TestDecryptFailures(t *testing.T) {
+	d, err := newDecrypter(Config{EncryptionConfig: writeEncryptionConfig(t)})
+	require.NoError(t, err)
+	etcdKey := []byte("/registry/secrets/default/token")
+
+	// unknown key name
+	_, provider, err := d.decrypt(etcdKey, []byte(encryptAESCBC(t, "rotated", []byte("x"))))
+	require.ErrorContains(t, err, "no aescbc key named 'rotated'")
+	require.Equal(t, ProviderAESCBC, provider)
+
+	// aesgcm authenticates the key, so a value copied to another key doesn't decrypt
+	_, _, err = d.decrypt([]byte("/registry/secrets/default/other"), []byte(encryptAESGCM(t, "gcm1", string(etcdKey), []byte("x"))))
+	require.Error(t, err)
+
+	// kms needs the external plugin
+	_, provider, err = d.decrypt(etcdKey, []byte("k8s:enc:kms:v2:vault:opaque"))
+	require.Error(t, err)
+	require.Equal(t, ProviderKMS, provider)
+
+	// without config, encrypted values can't be decrypted but still report their provider
+	var none *decrypter
+	_, provider, err = none.decrypt(etcdKey, []byte(encryptSecretbox(t, "box1", []byte("x"))))
+	require.ErrorContains(t, err, "no encryption config")
+	require.Equal(t, ProviderSecretbox, provider)
+}
+
+func TestNewDecrypterErrors(t *testing.T) {
+	d, err := newDecrypter(Config{})
+	require.NoError(t, err)
+	require.Nil(t, d)
+
+	_, err = newDecrypter(Config{EncryptionConfig: filepath.Join(t.TempDir(), "missing.yaml")})
+	require.ErrorContains(t, err, "failed to read encryption config")
+
+	_, err = parseEncryptionConfiguration([]byte("kind: Pod\n"))
+	require.ErrorContains(t, err, "unexpected kind 'Pod'")
+
+	_, err = parseEncryptionConfiguration([]byte("resources:\n- providers:\n  - secretbox:\n      keys:\n      - name: short\n        secret: c2hvcnQ=\n"))
+	require.ErrorContains(t, err, "secretbox keys must be 32 bytes")
+
+	_, err = parseEncryptionConfiguration([]byte("resources:\n- providers:\n  - aescbc:\n      keys:\n      - name: bad\n        secret: '!!'\n"))
+	require.ErrorContains(t, err, "invalid secret of aescbc key 'bad'")
+}
+
+func TestContentDecryptsValues(t *testing.T) {
+	configMap := `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"settings","namespace":"default"},"data":{"mode":"fast"}}`
+	secret := `{"apiVersion":"v1","kind":"Secret","metadata":{"name":"token","namespace":"default"},"data":{"token":"c2VjcmV0"}}`
+	path := writeTestSnapshot(t, []testRevision{
+		{key: "/registry/configmaps/default/settings", value: encryptAESGCM(t, "gcm1", "/registry/configmaps/default/settings", []byte(configMap))},
+		{key: "/registry/secrets/default/token", value: encryptSecretbox(t, "box1", []byte(secret))},
+		{key: "/registry/pods/default/plain", value: `{"kind":"Pod"}`},
+	})
+
+	// without the config the values stay encrypted, the provider is known anyway
+	records := runDatasource(t, &DatasourceExecuting{path: path, fieldIndices: []int{0, 12}})
+	require.Equal(t, 3, len(records))
+	require.Equal(t, octosql.NewString(ProviderAESGCM), records[0].Values[1])
+	require.Equal(t, octosql.NewString(ProviderSecretbox), records[1].Values[1])
+	require.Equal(t, octosql.NewString(ProviderIdentity), records[2].Values[1])
+
+	// decrypted Secrets are still redacted
+	config := Config{EncryptionConfig: writeEncryptionConfig(t)}
+	records = runDatasource(t, &DatasourceExecuting{path: path, fieldIndices: []int{0, 10, 12}, config: config})
+	require.Equal(t, octosql.NewString(configMap), records[0].Values[1])
+	require.Contains(t, records[1].Values[1].Str, `"name":"token"`)
+	require.NotContains(t, records[1].Values[1].Str, "c2VjcmV0")
+	require.Contains(t, records[1].Values[1].Str, "redacted hmac-sha256:")
+	require.Equal(t, octosql.NewString(`{"kind":"Pod"}`), records[2].Values[1])
+
+	// the index answers the provider without reading values
+	config.Index = true
+	config.IndexDir = t.TempDir()
+	records = runDatasource(t, &DatasourceExecuting{path: path, fieldIndices: []int{0, 12}, config: config})
+	require.Equal(t, octosql.NewString(ProviderAESGCM), records[0].Values[1])
+	require.Equal(t, octosql.NewString(ProviderIdentity), records[2].Values[1])
+}
+
+func TestOwnersDecryptsValues(t *testing.T) {
+	owner := ownerReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "web", UID: "deploy-uid", Controller: true}
+	path := writeTestSnapshot(t, []testRevision{
+		{key: "/registry/deployments/default/web", value: encryptAESCBC(t, "cbc1", []byte(protobufObject("apps/v1", "Deployment", "default", "web", "deploy-uid")))},
+		{key: "/registry/replicasets/default/web-5d8f", value: encryptSecretbox(t, "box1", []byte(protobufObject("apps/v1", "ReplicaSet", "default", "web-5d8f", "rs-uid", owner)))},
+	})
+
+	records := runDatasource(t, &DatasourceExecuting{
+		path:         path,
+		fieldIndices: []int{0, 11, 12},
+		schema:       SchemaOwners,
+		config:       Config{EncryptionConfig: writeEncryptionConfig(t)},
+	})
+	require.Equal(t, 1, len(records))
+	require.Equal(t, []octosql.Value{
+		octosql.NewString("/registry/replicasets/default/web-5d8f"),
+		octosql.NewString("/registry/deployments/default/web"),
+		octosql.NewBoolean(false),
+	}, records[0].Values)
+}
@@ -0,0 +1,456 @@
+package etcdsnapshot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/cube2222/octosql/execution"
+	"github.com/cube2222/octosql/octosql"
+	"github.com/cube2222/octosql/physical"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+// eventsSchemaFields is the schema of "?table=events", one row per Event in the latest revision of the snapshot
+func eventsSchemaFields() []physical.SchemaField {
+	return []physical.SchemaField{
+		{
+			Name: "key",
+			Type: octosql.String,
+		},
+		{
+			Name: "namespace",
+			Type: octosql.TypeSum(octosql.Null, octosql.String),
+		},
+		{
+			Name: "name",
+			Type: octosql.String,
+		},
+		{
+			// v1 or events.k8s.io/v1, depending on how the apiserver stored it
+			Name: "apiVersion",
+			Type: octosql.String,
+		},
+		{
+			Name: "reason",
+			Type: octosql.TypeSum(octosql.Null, octosql.String),
+		},
+		{
+			// Normal or Warning
+			Name: "type",
+			Type: octosql.TypeSum(octosql.Null, octosql.String),
+		},
+		{
+			Name: "message",
+			Type: octosql.TypeSum(octosql.Null, octosql.String),
+		},
+		{
+			Name: "involvedKind",
+			Type: octosql.TypeSum(octosql.Null, octosql.String),
+		},
+		{
+			Name: "involvedNamespace",
+			Type: octosql.TypeSum(octosql.Null, octosql.String),
+		},
+		{
+			Name: "involvedName",
+			Type: octosql.TypeSum(octosql.Null, octosql.String),
+		},
+		{
+			// how often the event occurred, from the series if there is one
+			Name: "count",
+			Type: octosql.Int,
+		},
+		{
+			Name: "firstTimestamp",
+			Type: octosql.TypeSum(octosql.Null, octosql.Time),
+		},
+		{
+			Name: "lastTimestamp",
+			Type: octosql.TypeSum(octosql.Null, octosql.Time),
+		},
+		{
+			// the reporting controller, or the source component of older events
+			Name: "reportingController",
+			Type: octosql.TypeSum(octosql.Null, octosql.String),
+		},
+		{
+			Name: "lease",
+			Type: octosql.Int,
+		},
+		{
+			// the TTL the lease was granted with in seconds, the apiserver's --event-ttl, NULL without lease
+			Name: "leaseTTL",
+			Type: octosql.TypeSum(octosql.Null, octosql.Int),
+		},
+		{
+			// size of the latest revision, which is freed once the lease expires and the key is compacted
+			Name: "valueSize",
+			Type: octosql.Int,
+		},
+	}
+}
+
+// event holds the columns of core/v1 and events.k8s.io Events, the latter's fields are mapped onto the former
+type event struct {
+	meta                objectMeta
+	reason              string
+	eventType           string
+	message             string
+	involvedKind        string
+	involvedNamespace   string
+	involvedName        string
+	count               int64
+	firstTimestamp      time.Time
+	lastTimestamp       time.Time
+	reportingController string
+
+	// only used to derive the columns above
+	seriesCount     int64
+	seriesLastTime  time.Time
+	eventTime       time.Time
+	sourceComponent string
+}
+
+// isEventKey returns whether the key is stored below the events resource, e.g. /registry/events/<namespace>/<name>
+func isEventKey(key string) bool {
+	parts := strings.Split(strings.TrimPrefix(key, "/"), "/")
+	return len(parts) == 4 && parts[1] == "events"
+}
+
+// decodeEvent decodes a JSON or protobuf encoded Event, other kinds return an error
+func decodeEvent(value []byte) (event, error) {
+	var e event
+	var err error
+	if bytes.HasPrefix(value, protobufPrefix) {
+		e, err = decodeProtobufEvent(value[len(protobufPrefix):])
+	} else if trimmed := bytes.TrimSpace(value); len(trimmed) > 0 && trimmed[0] == '{' {
+		e, err = decodeJSONEvent(trimmed)
+	} else {
+		err = fmt.Errorf("value is not a Kubernetes object")
+	}
+	if err != nil {
+		return event{}, err
+	}
+	if e.meta.Kind != "Event" {
+		return event{}, fmt.Errorf("unexpected kind %s, expected Event", e.meta.Kind)
+	}
+
+	// the newer fields win, the deprecated ones are only kept up to date by old clients
+	if e.seriesCount > 0 {
+		e.count = e.seriesCount
+	}
+	if e.count <= 0 {
+		e.count = 1
+	}
+	if e.firstTimestamp.IsZero() {
+		e.firstTimestamp = e.eventTime
+	}
+	if e.lastTimestamp.IsZero() {
+		e.lastTimestamp = e.seriesLastTime
+	}
+	if e.lastTimestamp.IsZero() {
+		e.lastTimestamp = e.eventTime
+	}
+	if e.lastTimestamp.IsZero() {
+		e.lastTimestamp = e.firstTimestamp
+	}
+	if e.reportingController == "" {
+		e.reportingController = e.sourceComponent
+	}
+	return e, nil
+}
+
+func decodeJSONEvent(value []byte) (event, error) {
+	type reference struct {
+		Kind      string `json:"kind"`
+		Namespace string `json:"namespace"`
+		Name      string `json:"name"`
+	}
+	// the fields of core/v1 and events.k8s.io don't overlap, so both decode into the same struct
+	var object struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+		Metadata   struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+			UID       string `json:"uid"`
+		} `json:"metadata"`
+		Reason          string    `json:"reason"`
+		Type            string    `json:"type"`
+		Message         string    `json:"message"`
+		Note            string    `json:"note"`
+		InvolvedObject  reference `json:"involvedObject"`
+		Regarding       reference `json:"regarding"`
+		Count           int64     `json:"count"`
+		DeprecatedCount int64     `json:"deprecatedCount"`
+		FirstTimestamp  time.Time `json:"firstTimestamp"`
+		LastTimestamp   time.Time `json:"lastTimestamp"`
+		DeprecatedFirst time.Time `json:"deprecatedFirstTimestamp"`
+		DeprecatedLast  time.Time `json:"deprecatedLastTimestamp"`
+		EventTime       time.Time `json:"eventTime"`
+		Series          struct {
+			Count            int64     `json:"count"`
+			LastObservedTime time.Time `json:"lastObservedTime"`
+		} `json:"series"`
+		Source struct {
+			Component string `json:"component"`
+		} `json:"source"`
+		DeprecatedSource struct {
+			Component string `json:"component"`
+		} `json:"deprecatedSource"`
+		ReportingComponent  string `json:"reportingComponent"`
+		ReportingController string `json:"reportingController"`
+	}
+	if err := json.Unmarshal(value, &object); err != nil {
+		return event{}, fmt.Errorf("failed to decode JSON event: %w", err)
+	}
+
+	e := event{
+		meta: objectMeta{
+			APIVersion: object.APIVersion,
+			Kind:       object.Kind,
+			Name:       object.Metadata.Name,
+			Namespace:  object.Metadata.Namespace,
+			UID:        object.Metadata.UID,
+		},
+		reason:              object.Reason,
+		eventType:           object.Type,
+		message:             firstNonEmpty(object.Message, object.Note),
+		involvedKind:        firstNonEmpty(object.InvolvedObject.Kind, object.Regarding.Kind),
+		involvedNamespace:   firstNonEmpty(object.InvolvedObject.Namespace, object.Regarding.Namespace),
+		involvedName:        firstNonEmpty(object.InvolvedObject.Name, object.Regarding.Name),
+		count:               object.Count,
+		firstTimestamp:      object.FirstTimestamp,
+		lastTimestamp:       object.LastTimestamp,
+		reportingController: firstNonEmpty(object.ReportingComponent, object.ReportingController),
+		seriesCount:         object.Series.Count,
+		seriesLastTime:      object.Series.LastObservedTime,
+		eventTime:           object.EventTime,
+		sourceComponent:     firstNonEmpty(object.Source.Component, object.DeprecatedSource.Component),
+	}
+	if e.count == 0 {
+		e.count = object.DeprecatedCount
+	}
+	if e.firstTimestamp.IsZero() {
+		e.firstTimestamp = object.DeprecatedFirst
+	}
+	if e.lastTimestamp.IsZero() {
+		e.lastTimestamp = object.DeprecatedLast
+	}
+	return e, nil
+}
+
+// decodeProtobufEvent decodes the core/v1 layout, or the events.k8s.io one if the type says so
+func decodeProtobufEvent(value []byte) (event, error) {
+	meta, err := decodeProtobufObjectMeta(value)
+	if err != nil {
+		return event{}, err
+	}
+	_, _, raw, err := unwrapProtobuf(value)
+	if err != nil {
+		return event{}, err
+	}
+
+	e := event{meta: meta}
+	if strings.HasPrefix(meta.APIVersion, "events.k8s.io/") {
+		err = decodeProtobufEventsEvent(raw, &e)
+	} else {
+		err = decodeProtobufCoreEvent(raw, &e)
+	}
+	if err != nil {
+		return event{}, fmt.Errorf("failed to decode protobuf event: %w", err)
+	}
+	return e, nil
+}
+
+// decodeProtobufCoreEvent decodes core/v1 Event: 2 involvedObject, 3 reason, 4 message, 5 source,
+// 6 firstTimestamp, 7 lastTimestamp, 8 count, 9 type, 10 eventTime, 11 series, 14 reportingComponent
+func decodeProtobufCoreEvent(raw []byte, e *event) error {
+	return forEachProtoField(raw, func(f protoField) error {
+		var err error
+		switch f.num {
+		case 2:
+			err = decodeProtobufObjectReference(f.bytes, e)
+		case 3:
+			e.reason = string(f.bytes)
+		case 4:
+			e.message = string(f.bytes)
+		case 5:
+			// EventSource: 1 component
+			err = forEachProtoField(f.bytes, func(f protoField) error {
+				if f.num == 1 {
+					e.sourceComponent = string(f.bytes)
+				}
+				return nil
+			})
+		case 6:
+			e.firstTimestamp, err = decodeProtobufTime(f.bytes)
+		case 7:
+			e.lastTimestamp, err = decodeProtobufTime(f.bytes)
+		case 8:
+			e.count = int64(int32(f.varint))
+		case 9:
+			e.eventType = string(f.bytes)
+		case 10:
+			e.eventTime, err = decodeProtobufTime(f.bytes)
+		case 11:
+			err = decodeProtobufEventSeries(f.bytes, e)
+		case 14:
+			e.reportingController = string(f.bytes)
+		}
+		return err
+	})
+}
+
+// decodeProtobufEventsEvent decodes events.k8s.io Event: 2 eventTime, 3 series, 4 reportingController,
+// 7 reason, 8 regarding, 10 note, 11 type, 12 deprecatedSource, 13 deprecatedFirstTimestamp,
+// 14 deprecatedLastTimestamp, 15 deprecatedCount
+func decodeProtobufEventsEvent(raw []byte, e *event) error {
+	return forEachProtoField(raw, func(f protoField) error {
+		var err error
+		switch f.num {
+		case 2:
+			e.eventTime, err = decodeProtobufTime(f.bytes)
+		case 3:
+			err = decodeProtobufEventSeries(f.bytes, e)
+		case 4:
+			e.reportingController = string(f.bytes)
+		case 7:
+			e.reason = string(f.bytes)
+		case 8:
+			err = decodeProtobufObjectReference(f.bytes, e)
+		case 10:
+			e.message = string(f.bytes)
+		case 11:
+			e.eventType = string(f.bytes)
+		case 12:
+			err = forEachProtoField(f.bytes, func(f protoField) error {
+				if f.num == 1 {
+					e.sourceComponent = string(f.bytes)
+				}
+				return nil
+			})
+		case 13:
+			e.firstTimestamp, err = decodeProtobufTime(f.bytes)
+		case 14:
+			e.lastTimestamp, err = decodeProtobufTime(f.bytes)
+		case 15:
+			e.count = int64(int32(f.varint))
+		}
+		return err
+	})
+}
+
+// decodeProtobufObjectReference decodes core/v1 ObjectReference: 1 kind, 2 namespace, 3 name
+func decodeProtobufObjectReference(b []byte, e *event) error {
+	return forEachProtoField(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			e.involvedKind = string(f.bytes)
+		case 2:
+			e.involvedNamespace = string(f.bytes)
+		case 3:
+			e.involvedName = string(f.bytes)
+		}
+		return nil
+	})
+}
+
+// decodeProtobufEventSeries decodes EventSeries: 1 count, 2 lastObservedTime
+func decodeProtobufEventSeries(b []byte, e *event) error {
+	return forEachProtoField(b, func(f protoField) error {
+		var err error
+		switch f.num {
+		case 1:
+			e.seriesCount = int64(int32(f.varint))
+		case 2:
+			e.seriesLastTime, err = decodeProtobufTime(f.bytes)
+		}
+		return err
+	})
+}
+
+func produceEventsFromBackend(ctx ExecutionContext, produce ProduceFn, etcdBackend *snapshotBackend, fieldIndices []int, decrypter *decrypter) error {
+	leaseTTLs, err := etcdBackend.leaseTTLs()
+	if err != nil {
+		return err
+	}
+
+	records, skipped := 0, 0
+	err = etcdBackend.forEachLatest(ctx, func(kv mvccpb.KeyValue) error {
+		if !isEventKey(string(kv.Key)) {
+			return nil
+		}
+
+		value, _, err := decrypter.decrypt(kv.Key, kv.Value)
+		if err != nil {
+			skipped++
+			return nil
+		}
+		e, err := decodeEvent(value)
+		if err != nil {
+			skipped++
+			return nil
+		}
+
+		leaseTTL := octosql.NewNull()
+		if ttl, ok := leaseTTLs[kv.Lease]; ok && kv.Lease != 0 {
+			leaseTTL = octosql.NewInt(int(ttl))
+		}
+
+		values := []octosql.Value{
+			octosql.NewString(string(kv.Key)),
+			nullableString(e.meta.Namespace),
+			octosql.NewString(e.meta.Name),
+			octosql.NewString(e.meta.APIVersion),
+			nullableString(e.reason),
+			nullableString(e.eventType),
+			nullableString(e.message),
+			nullableString(e.involvedKind),
+			nullableString(e.involvedNamespace),
+			nullableString(e.involvedName),
+			octosql.NewInt(int(e.count)),
+			nullableTime(e.firstTimestamp),
+			nullableTime(e.lastTimestamp),
+			nullableString(e.reportingController),
+			octosql.NewInt(int(kv.Lease)),
+			leaseTTL,
+			octosql.NewInt(len(kv.Value)),
+		}
+
+		var result []octosql.Value
+		for _, fi := range fieldIndices {
+			result = append(result, values[fi])
+		}
+
+		err = produce(ProduceFromExecutionContext(ctx), NewRecord(result, false, time.Time{}))
+		if err != nil {
+			logger.Debug("failed to produce record", "err", err)
+			return err
+		}
+		records++
+		return nil
+	})
+	logger.Info("found events", "events", records, "skipped", skipped)
+	return err
+}
+
+// nullableTime maps zero times to NULL
+func nullableTime(t time.Time) octosql.Value {
+	if t.IsZero() {
+		return octosql.NewNull()
+	}
+	return octosql.NewTime(t)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,179 @@
+package etcdsnapshot
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/cube2222/octosql/octosql"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/server/v3/mvcc/buckets"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// writeTestLeases adds leases with the given TTLs in seconds to a snapshot created by writeTestSnapshot
+func writeTestLeases(tb testing.TB, path string, ttls map[int64]int64) {
+	db, err := bolt.Open(path, 0600, nil)
+	require.NoError(tb, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(buckets.Lease.Name())
+		if err != nil {
+			return err
+		}
+		for id, ttl := range ttls {
+			var data []byte
+			data = protowire.AppendTag(data, 1, protowire.VarintType)
+			data = protowire.AppendVarint(data, uint64(id))
+			data = protowire.AppendTag(data, 2, protowire.VarintType)
+			data = protowire.AppendVarint(data, uint64(ttl))
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, uint64(id))
+			if err := bucket.Put(key, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(tb, err)
+}
+
+func appendProtoTime(b []byte, num protowire.Number, t time.Time) []byte {
+	var ts []byte
+	ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+	ts = protowire.AppendVarint(ts, uint64(t.Unix()))
+	return appendProtoMessage(b, num, ts)
+}
+
+// protobufCoreEvent encodes a core/v1 Event about a pod
+func protobufCoreEvent(namespace, name, reason, component string, count int, first, last time.Time) string {
+	var typeMeta []byte
+	typeMeta = appendProtoString(typeMeta, 1, "v1")
+	typeMeta = appendProtoString(typeMeta, 2, "Event")
+
+	var meta []byte
+	meta = appendProtoString(meta, 1, name)
+	meta = appendProtoString(meta, 3, namespace)
+
+	var involved []byte
+	involved = appendProtoString(involved, 1, "Pod")
+	involved = appendProtoString(involved, 2, namespace)
+	involved = appendProtoString(involved, 3, "web-abc")
+
+	var source []byte
+	source = appendProtoString(source, 1, component)
+
+	var raw []byte
+	raw = appendProtoMessage(raw, 1, meta)
+	raw = appendProtoMessage(raw, 2, involved)
+	raw = appendProtoString(raw, 3, reason)
+	raw = appendProtoString(raw, 4, "Back-off restarting failed container")
+	raw = appendProtoMessage(raw, 5, source)
+	raw = appendProtoTime(raw, 6, first)
+	raw = appendProtoTime(raw, 7, last)
+	raw = protowire.AppendTag(raw, 8, protowire.VarintType)
+	raw = protowire.AppendVarint(raw, uint64(count))
+	raw = appendProtoString(raw, 9, "Warning")
+
+	var unknown []byte
+	unknown = appendProtoMessage(unknown, 1, typeMeta)
+	unknown = appendProtoMessage(unknown, 2, raw)
+	return string(protobufPrefix) + string(unknown)
+}
+
+func TestIsEventKey(t *testing.T) {
+	require.True(t, isEventKey("/registry/events/default/web.17a"))
+	require.True(t, isEventKey("/kubernetes.io/events/default/web.17a"))
+	require.False(t, isEventKey("/registry/pods/default/events"))
+	require.False(t, isEventKey("/registry/events.k8s.io/default"))
+}
+
+func TestDecodeProtobufCoreEvent(t *testing.T) {
+	first := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	last := first.Add(time.Hour)
+	e, err := decodeEvent([]byte(protobufCoreEvent("default", "web.17a", "BackOff", "kubelet", 42, first, last)))
+	require.NoError(t, err)
+	require.Equal(t, "BackOff", e.reason)
+	require.Equal(t, "Warning", e.eventType)
+	require.Equal(t, "Pod", e.involvedKind)
+	require.Equal(t, "default", e.involvedNamespace)
+	require.Equal(t, "web-abc", e.involvedName)
+	require.Equal(t, int64(42), e.count)
+	require.Equal(t, first, e.firstTimestamp)
+	require.Equal(t, last, e.lastTimestamp)
+	// the source component stands in for the reporting controller of older events
+	require.Equal(t, "kubelet", e.reportingController)
+}
+
+func TestDecodeJSONEvents(t *testing.T) {
+	e, err := decodeEvent([]byte(`{"apiVersion":"v1","kind":"Event","metadata":{"name":"e1","namespace":"default"},
+		"involvedObject":{"kind":"Node","name":"worker-0"},"reason":"NodeReady","type":"Normal","count":3,
+		"firstTimestamp":"2024-05-01T10:00:00Z","lastTimestamp":null,"eventTime":null,"reportingComponent":"node-controller"}`))
+	require.NoError(t, err)
+	require.Equal(t, "Node", e.involvedKind)
+	require.Equal(t, int64(3), e.count)
+	require.Equal(t, "node-controller", e.reportingController)
+	// without lastTimestamp the event only happened once
+	require.Equal(t, e.firstTimestamp, e.lastTimestamp)
+
+	e, err = decodeEvent([]byte(`{"apiVersion":"events.k8s.io/v1","kind":"Event","metadata":{"name":"e2","namespace":"apps"},
+		"regarding":{"kind":"Deployment","namespace":"apps","name":"web"},"reason":"ScalingReplicaSet","type":"Normal",
+		"note":"Scaled up","eventTime":"2024-05-01T10:00:00.000000Z","reportingController":"deployment-controller",
+		"series":{"count":7,"lastObservedTime":"2024-05-01T11:30:00.000000Z"},"deprecatedCount":2}`))
+	require.NoError(t, err)
+	require.Equal(t, "Deployment", e.involvedKind)
+	require.Equal(t, "Scaled up", e.message)
+	require.Equal(t, "deployment-controller", e.reportingController)
+	require.Equal(t, int64(7), e.count)
+	require.Equal(t, time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), e.firstTimestamp)
+	require.Equal(t, time.Date(2024, 5, 1, 11, 30, 0, 0, time.UTC), e.lastTimestamp)
+
+	_, err = decodeEvent([]byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"p"}}`))
+	require.ErrorContains(t, err, "unexpected kind Pod")
+}
+
+func TestEventsTable(t *testing.T) {
+	first := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	path := writeTestSnapshot(t, []testRevision{
+		{key: "/registry/events/default/web.1", value: protobufCoreEvent("default", "web.1", "BackOff", "kubelet", 1, first, first), lease: 7},
+		{key: "/registry/events/default/web.1", value: protobufCoreEvent("default", "web.1", "BackOff", "kubelet", 5, first, first.Add(time.Minute)), lease: 7},
+		{key: "/registry/events/default/web.2", value: `{"apiVersion":"v1","kind":"Event","metadata":{"name":"web.2","namespace":"default"},"reason":"Pulled","type":"Normal","source":{"component":"kubelet"}}`, lease: 99},
+		{key: "/registry/events/default/gone", value: protobufCoreEvent("default", "gone", "BackOff", "kubelet", 1, first, first)},
+		{key: "/registry/events/default/gone", deleted: true},
+		{key: "/registry/pods/default/web-abc", value: protobufObject("v1", "Pod", "default", "web-abc", "pod-uid")},
+	})
+	writeTestLeases(t, path, map[int64]int64{7: 3600})
+
+	db := &Database{}
+	impl, schema, err := db.GetTable(context.Background(), path, map[string]string{"table": "events"})
+	require.NoError(t, err)
+	require.Equal(t, 17, len(schema.Fields))
+	require.Equal(t, SchemaEvents, impl.(*etcdSnapshotDataSource).schema)
+
+	records := runDatasource(t, &DatasourceExecuting{
+		path:         path,
+		fieldIndices: []int{0, 4, 10, 12, 13, 15},
+		schema:       SchemaEvents,
+	})
+	require.Equal(t, 2, len(records))
+	require.Equal(t, []octosql.Value{
+		octosql.NewString("/registry/events/default/web.1"),
+		octosql.NewString("BackOff"),
+		octosql.NewInt(5),
+		octosql.NewTime(first.Add(time.Minute)),
+		octosql.NewString("kubelet"),
+		octosql.NewInt(3600),
+	}, records[0].Values)
+	// the lease of the second event isn't in the lease bucket anymore
+	require.Equal(t, []octosql.Value{
+		octosql.NewString("/registry/events/default/web.2"),
+		octosql.NewString("Pulled"),
+		octosql.NewInt(1),
+		octosql.NewNull(),
+		octosql.NewString("kubelet"),
+		octosql.NewNull(),
+	}, records[1].Values)
+}
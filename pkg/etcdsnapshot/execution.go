@@ -1,21 +1,21 @@
 package etcdsnapshot
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/binary"
 	"fmt"
 	"math"
 	"os"
 	"path"
 	"strings"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
-	"go.etcd.io/etcd/server/v3/mvcc/buckets"
-
 	. "github.com/cube2222/octosql/execution"
 	"github.com/cube2222/octosql/octosql"
 	"go.etcd.io/etcd/api/v3/mvccpb"
-	"go.etcd.io/etcd/server/v3/mvcc/backend"
 )
 
 type DatasourceExecuting struct {
@@ -24,13 +24,19 @@ type DatasourceExecuting struct {
 	// those are the field indices we need to include in the result
 	fieldIndices []int
 	schema       Schema
+
+	config Config
+	// keyFilters are the pushed down predicates, every produced record must match all of them
+	keyFilters []keyFilter
+	// unordered allows a parallel scan to produce records out of revision order
+	unordered bool
 }
 
 func (d *DatasourceExecuting) Run(ctx ExecutionContext, produce ProduceFn, metaSend MetaSendFn) error {
 
 	stat, err := os.Stat(d.path)
 	if err != nil {
-		fmt.Printf("got an error while accessing db: %v\n", err)
+		logger.Error("failed to access the snapshot", "path", d.path, "err", err)
 		return err
 	}
 
@@ -39,53 +45,146 @@ func (d *DatasourceExecuting) Run(ctx ExecutionContext, produce ProduceFn, metaS
 		_, err = os.Stat(dbPath)
 		if err != nil {
 			if os.IsNotExist(err) {
-				fmt.Printf("found a dir, but no database file in 'member/snap/db': %v\n", err)
+				logger.Error("found a directory, but no database file in 'member/snap/db'", "path", d.path, "err", err)
 				return fmt.Errorf("db file not found in directory structure")
 			}
 
-			fmt.Printf("stat error with 'member/snap/db': %v\n", err)
+			logger.Error("failed to access 'member/snap/db'", "path", d.path, "err", err)
 			return err
 		}
 
 		// TODO(thomas): can we create the server instead, replay WAL and create a snapshot?
 
 		// the DB file itself is a bbolt snapshot, so we can directly read from it the same way
-		return produceFromBBoltBackend(ctx, produce, dbPath, d.fieldIndices, d.schema)
+		return d.produceFromBBoltBackend(ctx, produce, dbPath, true)
 	}
 
-	return produceFromBBoltBackend(ctx, produce, d.path, d.fieldIndices, d.schema)
+	return d.produceFromBBoltBackend(ctx, produce, d.path, false)
 }
 
-func produceFromBBoltBackend(ctx ExecutionContext, produce ProduceFn, snapshotPath string, fieldIndices []int, schema Schema) error {
-	etcdBackend := backend.NewDefaultBackend(snapshotPath)
-	defer etcdBackend.Close()
-	fmt.Printf("etcd backend read from [%s] with size %d bytes, in use: %d\n", snapshotPath, etcdBackend.Size(), etcdBackend.SizeInUse())
+func (d *DatasourceExecuting) produceFromBBoltBackend(ctx ExecutionContext, produce ProduceFn, snapshotPath string, dataDir bool) error {
+	cached, err := backends.acquire(snapshotPath)
+	if err != nil {
+		logger.Error("failed to open the snapshot", "path", snapshotPath, "err", err)
+		return err
+	}
+	defer backends.release(cached)
+	etcdBackend := cached.backend
+	logger.Debug("opened snapshot", "path", snapshotPath, "size", etcdBackend.Size(), "sizeInUse", etcdBackend.SizeInUse())
 
-	var err error
-	switch schema {
+	var index *snapshotIndex
+	if d.config.Index {
+		index, err = cached.snapshotIndex(ctx, d.config, dataDir)
+		if err != nil {
+			if err := checkContext(ctx); err != nil {
+				return err
+			}
+			// the index is only an optimization, the database can always be scanned instead
+			logger.Warn("not using the snapshot index", "err", err)
+			index = nil
+		}
+	}
+
+	produce = checkedProducer(produce, d.schema.fields(), d.fieldIndices)
+	switch d.schema {
 	case SchemaMeta:
-		err = produceMetaFromBackend(ctx, produce, etcdBackend, fieldIndices)
+		quota, quotaSource := d.config.quota()
+		err = produceMetaFromBackend(ctx, produce, cached, index, d.fieldIndices, quota, quotaSource)
 	case SchemaContent:
-		err = produceContentFromMvccStore(ctx, produce, etcdBackend, fieldIndices)
+		var timeline *revisionTimeline
+		if selectsTimeline(d.fieldIndices) {
+			timeline, err = cached.revisionTimeline(ctx, d.config)
+			if err != nil {
+				return err
+			}
+		}
+		if index != nil && !selectsValue(d.fieldIndices) {
+			err = produceContentFromIndex(ctx, produce, index, d.fieldIndices, d.keyFilters, timeline)
+		} else {
+			var redactor *redactor
+			redactor, err = newRedactor(d.config)
+			if err != nil {
+				return err
+			}
+			var decrypter *decrypter
+			decrypter, err = newDecrypter(d.config)
+			if err != nil {
+				return err
+			}
+			if !selectsValue(d.fieldIndices) {
+				// nothing to decrypt or redact
+				redactor = nil
+				decrypter = nil
+			}
+			err = produceContentFromMvccStore(ctx, produce, etcdBackend, d.fieldIndices, d.keyFilters, decrypter, redactor, timeline, d.config.scanWorkers(), !d.unordered, d.config.base64Values)
+		}
+	case SchemaOwners:
+		var decrypter *decrypter
+		decrypter, err = newDecrypter(d.config)
+		if err != nil {
+			return err
+		}
+		err = produceOwnersFromBackend(ctx, produce, etcdBackend, d.fieldIndices, decrypter)
+	case SchemaEvents:
+		var decrypter *decrypter
+		decrypter, err = newDecrypter(d.config)
+		if err != nil {
+			return err
+		}
+		err = produceEventsFromBackend(ctx, produce, etcdBackend, d.fieldIndices, decrypter)
+	case SchemaTimeline:
+		var timeline *revisionTimeline
+		timeline, err = cached.revisionTimeline(ctx, d.config)
+		if err != nil {
+			return err
+		}
+		err = produceTimelineFromBackend(ctx, produce, etcdBackend, timeline, d.fieldIndices)
+	case SchemaChurn:
+		var timeline *revisionTimeline
+		if selectsChurnIntervals(d.fieldIndices) {
+			timeline, err = cached.revisionTimeline(ctx, d.config)
+			if err != nil {
+				return err
+			}
+		}
+		var decrypter *decrypter
+		decrypter, err = newDecrypter(d.config)
+		if err != nil {
+			return err
+		}
+		err = produceChurnFromBackend(ctx, produce, etcdBackend, d.fieldIndices, decrypter, timeline)
+	case SchemaSizes:
+		err = produceSizesFromBackend(ctx, produce, etcdBackend, d.fieldIndices)
+	case SchemaTree:
+		err = produceTreeFromBackend(ctx, produce, etcdBackend, d.fieldIndices, d.config.treeDepth)
 	}
 
 	return err
 }
 
-func produceMetaFromBackend(ctx ExecutionContext, produce ProduceFn, etcdBackend backend.Backend, fieldIndices []int) error {
+func produceMetaFromBackend(ctx ExecutionContext, produce ProduceFn, cached *cachedBackend, index *snapshotIndex, fieldIndices []int, quota int64, quotaSource string) error {
 	// Get basic size information
-	size := etcdBackend.Size()
-	sizeInUse := etcdBackend.SizeInUse()
+	size := cached.backend.Size()
+	sizeInUse := cached.backend.SizeInUse()
 	sizeFree := size - sizeInUse
 
-	stats := calculateEtcdStats(etcdBackend)
+	// the stats are computed once per file version and shared by all queries on it, queries that only
+	// ask for sizes and quota don't need them at all
+	var stats EtcdStats
+	if selectsStats(fieldIndices) {
+		var err error
+		stats, err = cached.etcdStats(ctx, index)
+		if err != nil {
+			logger.Error("failed to calculate stats", "err", err)
+			return err
+		}
+	}
 
 	// Calculate derived metrics
 	fragmentationRatio := float64(sizeFree) / float64(size)
-	defaultQuota := int64(8 * 1024 * 1024 * 1024) // 8GB default
-	quotaUsageRatio := float64(size) / float64(defaultQuota)
+	quotaUsageRatio := float64(size) / float64(quota)
 	quotaUsagePercent := quotaUsageRatio * 100
-	quotaRemaining := defaultQuota - size
+	quotaRemaining := quota - size
 
 	values := []octosql.Value{
 		// Basic storage info
@@ -106,7 +205,7 @@ func produceMetaFromBackend(ctx ExecutionContext, produce ProduceFn, etcdBackend
 		octosql.NewFloat(stats.avgRevisionsPerKey),
 
 		// Storage quota info
-		octosql.NewInt(int(defaultQuota)),
+		octosql.NewInt(int(DefaultQuota)),
 		octosql.NewFloat(quotaUsageRatio),
 		octosql.NewFloat(quotaUsagePercent),
 		octosql.NewInt(int(quotaRemaining)),
@@ -123,6 +222,10 @@ func produceMetaFromBackend(ctx ExecutionContext, produce ProduceFn, etcdBackend
 		octosql.NewInt(stats.keysWithLeases),
 		octosql.NewInt(stats.activeLeases),
 		octosql.NewInt(stats.estimatedCompactionSavings),
+
+		// Effective storage quota
+		octosql.NewInt(int(quota)),
+		octosql.NewString(quotaSource),
 	}
 
 	// remove the fields we don't need for a given query
@@ -133,26 +236,48 @@ func produceMetaFromBackend(ctx ExecutionContext, produce ProduceFn, etcdBackend
 
 	err := produce(ProduceFromExecutionContext(ctx), NewRecord(result, false, time.Time{}))
 	if err != nil {
-		fmt.Printf("got an error while producing record: %v\n", err)
+		logger.Debug("failed to produce record", "err", err)
 		return err
 	}
 
 	return nil
 }
 
-func produceContentFromMvccStore(ctx ExecutionContext, produce ProduceFn, etcdBackend backend.Backend, fieldIndices []int) error {
-	keys, vals := etcdBackend.ReadTx().UnsafeRange(buckets.Key, revToBytes(0, 0), revToBytes(math.MaxInt64, math.MaxInt64), math.MaxInt64)
-	fmt.Printf("found %d records in snapshot\n", len(keys))
-
-	kv := mvccpb.KeyValue{}
-	for i := 0; i < len(keys); i++ {
-		err := kv.Unmarshal(vals[i])
+func produceContentFromMvccStore(ctx ExecutionContext, produce ProduceFn, etcdBackend *snapshotBackend, fieldIndices []int, keyFilters []keyFilter, decrypter *decrypter, redactor *redactor, timeline *revisionTimeline, workers int, ordered bool, base64Values bool) error {
+	// undecryptable values are kept as they're stored, they're only counted to not log every revision
+	var undecryptable atomic.Int64
+	encodeValue := valueString
+	if base64Values {
+		encodeValue = base64.StdEncoding.EncodeToString
+	}
+	decode := func(val []byte) ([]octosql.Value, bool, error) {
+		kv := mvccpb.KeyValue{}
+		err := kv.Unmarshal(val)
 		if err != nil {
-			fmt.Printf("got an error while unmarshaling value: %v\n", err)
-			return err
+			logger.Error("failed to unmarshal value", "err", err)
+			return nil, false, err
 		}
 
 		values := mapEtcdToOctosql(kv)
+		if !matchesKeyFilters(values, keyFilters) {
+			return nil, false, nil
+		}
+		if base64Values {
+			values[valueFieldIndex] = octosql.NewString(encodeValue(kv.Value))
+		}
+		if decrypter != nil && values[encryptionProviderFieldIndex].Str != ProviderIdentity {
+			plaintext, _, err := decrypter.decrypt(kv.Key, kv.Value)
+			if err != nil {
+				undecryptable.Add(1)
+			} else {
+				kv.Value = plaintext
+				values[valueFieldIndex] = octosql.NewString(encodeValue(plaintext))
+			}
+		}
+		if redacted, ok := redactor.redact(string(kv.Key), kv.Value); ok {
+			values[valueFieldIndex] = octosql.NewString(encodeValue(redacted))
+		}
+		values = append(values, timeline.estimateValues(kv.ModRevision)...)
 
 		// remove the fields we don't need for a given query
 		var result []octosql.Value
@@ -161,18 +286,143 @@ func produceContentFromMvccStore(ctx ExecutionContext, produce ProduceFn, etcdBa
 				result = append(result, values[fi])
 			}
 		}
+		return result, true, nil
+	}
+
+	records := 0
+	emit := func(row []octosql.Value) error {
+		err := produce(ProduceFromExecutionContext(ctx), NewRecord(row, false, time.Time{}))
+		if err != nil {
+			logger.Debug("failed to produce record", "err", err)
+			return err
+		}
+		records++
+		return nil
+	}
+
+	var err error
+	if workers > 1 {
+		err = scanParallel(ctx, etcdBackend, workers, ordered, decode, emit)
+	} else {
+		err = etcdBackend.forEachRevision(ctx, func(_, val []byte) error {
+			row, ok, err := decode(val)
+			if err != nil || !ok {
+				return err
+			}
+			return emit(row)
+		})
+	}
+	logger.Info("produced records from the snapshot", "records", records)
+	if n := undecryptable.Load(); n > 0 {
+		logger.Warn("could not decrypt values, they're returned as stored", "values", n)
+	}
+	return err
+}
+
+// produceContentFromIndex produces the content rows without the value column from the index
+func produceContentFromIndex(ctx ExecutionContext, produce ProduceFn, index *snapshotIndex, fieldIndices []int, keyFilters []keyFilter, timeline *revisionTimeline) error {
+	// the filters only depend on the key, so they're evaluated once per unique key
+	keyValues := make([][]octosql.Value, len(index.Keys))
+	for keyId := range index.Keys {
+		values := index.keyValues(int32(keyId))
+		if matchesKeyFilters(values, keyFilters) {
+			keyValues[keyId] = values
+		}
+	}
+
+	records := 0
+	for i, rev := range index.Revisions {
+		if i%cancelCheckEvery == 0 {
+			if err := checkContext(ctx); err != nil {
+				return err
+			}
+		}
+		key := keyValues[rev.Key]
+		if key == nil {
+			continue
+		}
+
+		values := append(key[:keyColumns:keyColumns],
+			octosql.NewInt(int(rev.CreateRevision)),
+			octosql.NewInt(int(rev.ModRevision)),
+			octosql.NewInt(int(rev.Version)),
+			octosql.NewInt(int(rev.Lease)),
+			octosql.NewNull(),
+			octosql.NewInt(int(rev.ValueSize)),
+			octosql.NewString(index.Strings[rev.Provider]),
+		)
+		values = append(values, timeline.estimateValues(rev.ModRevision)...)
+
+		var result []octosql.Value
+		for _, fi := range fieldIndices {
+			result = append(result, values[fi])
+		}
 
-		err = produce(ProduceFromExecutionContext(ctx), NewRecord(result, false, time.Time{}))
+		err := produce(ProduceFromExecutionContext(ctx), NewRecord(result, false, time.Time{}))
 		if err != nil {
-			fmt.Printf("got an error while producing record: %v\n", err)
+			logger.Debug("failed to produce record", "err", err)
 			return err
 		}
+		records++
 	}
+	logger.Info("produced records from the snapshot index", "records", records)
 	return nil
 }
 
+// selectsStats returns whether a query on the meta schema needs any of the key bucket statistics, which
+// are the compaction metrics (indices 5-10), value sizes and key distribution (indices 15-23)
+func selectsStats(fieldIndices []int) bool {
+	for _, fi := range fieldIndices {
+		if (fi >= 5 && fi <= 10) || (fi >= 15 && fi <= 23) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// valueFieldIndex is the position of the value column in the content schema
+	valueFieldIndex = 10
+	// encryptionProviderFieldIndex is the position of the encryptionProvider column in the content schema
+	encryptionProviderFieldIndex = 12
+	// estimatedModTimeFieldIndex is the first of the estimated time columns, which are the last in the schema
+	estimatedModTimeFieldIndex = 13
+)
+
+// selectsValue returns whether a query on the content schema needs the value column
+func selectsValue(fieldIndices []int) bool {
+	for _, fi := range fieldIndices {
+		if fi == valueFieldIndex {
+			return true
+		}
+	}
+	return false
+}
+
 func mapEtcdToOctosql(kv mvccpb.KeyValue) []octosql.Value {
-	skey := string(kv.Key)
+	values := mapKeyToOctosql(string(kv.Key))
+
+	values = append(values, octosql.NewInt(int(kv.CreateRevision)))
+	values = append(values, octosql.NewInt(int(kv.ModRevision)))
+	values = append(values, octosql.NewInt(int(kv.Version)))
+	values = append(values, octosql.NewInt(int(kv.Lease)))
+
+	// add the value and its size in bytes for the value, for easier sizing queries
+	values = append(values, octosql.NewString(valueString(kv.Value)), octosql.NewInt(len(kv.Value)))
+	values = append(values, octosql.NewString(encryptionProviderOf(kv.Value)))
+	return values
+}
+
+// valueString returns the value as string, values that aren't valid UTF-8 are returned as empty string
+func valueString(value []byte) string {
+	if utf8.Valid(value) {
+		return string(value)
+	}
+	return ""
+}
+
+// mapKeyToOctosql splits the key into the key, apiserverPrefix, apigroup, resourceType, namespace and name columns
+func mapKeyToOctosql(skey string) []octosql.Value {
 	keyPart := strings.Split(skey, "/")
 	// since the keypart usually starts with /, we can remove the zero length entry at 0
 	if len(keyPart) > 0 && keyPart[0] == "" {
@@ -217,7 +467,7 @@ func mapEtcdToOctosql(kv mvccpb.KeyValue) []octosql.Value {
 			octosql.NewString(keyPart[4]),
 		}
 	} else {
-		fmt.Printf("couldn't parse key [%s] into schema with len=[%d] split=%v, assuming null row\n", skey, len(keyPart), keyPart)
+		logger.Debug("couldn't parse key into schema, assuming null row", "key", skey, "segments", len(keyPart))
 		values = []octosql.Value{
 			octosql.NewString(skey),
 			octosql.NewNull(),
@@ -228,18 +478,6 @@ func mapEtcdToOctosql(kv mvccpb.KeyValue) []octosql.Value {
 		}
 	}
 
-	values = append(values, octosql.NewFloat(float64(kv.CreateRevision)))
-	values = append(values, octosql.NewFloat(float64(kv.ModRevision)))
-	values = append(values, octosql.NewFloat(float64(kv.Version)))
-	values = append(values, octosql.NewFloat(float64(kv.Lease)))
-
-	value := ""
-	if utf8.Valid(kv.Value) {
-		value = string(kv.Value)
-	}
-
-	// add the value and its size in bytes for the value, for easier sizing queries
-	values = append(values, octosql.NewString(value), octosql.NewInt(len(kv.Value)))
 	return values
 }
 
@@ -272,77 +510,122 @@ type EtcdStats struct {
 	estimatedCompactionSavings int
 }
 
-func calculateEtcdStats(etcdBackend backend.Backend) EtcdStats {
-	stats := EtcdStats{
-		minRevision:       math.MaxInt32,
-		smallestValueSize: math.MaxInt32,
+func calculateEtcdStats(ctx context.Context, etcdBackend *snapshotBackend) (EtcdStats, error) {
+	collector := newStatsCollector()
+	err := etcdBackend.forEachRevision(ctx, func(revision, val []byte) error {
+		kv := mvccpb.KeyValue{}
+		if err := kv.Unmarshal(val); err != nil {
+			return nil
+		}
+		collector.add(string(kv.Key), kv.ModRevision, len(kv.Value), kv.Lease, isTombstone(revision))
+		return nil
+	})
+	if err != nil {
+		return EtcdStats{}, err
 	}
 
-	totalValueSize := 0
-	uniqueLeases := make(map[int64]bool)
-	uniqueRevisions := make(map[int64]bool) // Track unique revision numbers
+	return collector.finish(), nil
+}
+
+// statsCollector accumulates EtcdStats revision by revision, so they can be computed from the key bucket
+// as well as from a snapshot index
+type statsCollector struct {
+	stats EtcdStats
+
+	revisions       int
+	totalValueSize  int
+	uniqueLeases    map[int64]bool
+	uniqueRevisions map[int64]bool // Track unique revision numbers
 
 	// Track total value sizes per key
-	keyValueSums := make(map[string]int)
-	keyRevisionCounts := make(map[string]int)
+	keyValueSums      map[string]int
+	keyRevisionCounts map[string]int
+	// keysDeleted tells per key whether its latest revision is a tombstone
+	keysDeleted map[string]bool
+	// leasedKeys are the keys with a lease attached to any of their revisions
+	leasedKeys map[string]bool
+}
 
-	keys, vals := etcdBackend.ReadTx().UnsafeRange(buckets.Key, revToBytes(0, 0), revToBytes(math.MaxInt64, math.MaxInt64), math.MaxInt64)
-	for i := 0; i < len(keys); i++ {
-		kv := mvccpb.KeyValue{}
-		if err := kv.Unmarshal(vals[i]); err != nil {
-			continue
-		}
+func newStatsCollector() *statsCollector {
+	return &statsCollector{
+		stats: EtcdStats{
+			minRevision:       math.MaxInt,
+			smallestValueSize: math.MaxInt,
+		},
+		uniqueLeases:      make(map[int64]bool),
+		uniqueRevisions:   make(map[int64]bool),
+		keyValueSums:      make(map[string]int),
+		keyRevisionCounts: make(map[string]int),
+		keysDeleted:       make(map[string]bool),
+		leasedKeys:        make(map[string]bool),
+	}
+}
 
-		stats.totalKeys++
+// add counts a revision, they have to be added in revision order. deleted is set for tombstones.
+func (c *statsCollector) add(key string, modRevision int64, valueSize int, lease int64, deleted bool) {
+	stats := &c.stats
+	c.revisions++
 
-		// Track unique revisions
-		uniqueRevisions[kv.ModRevision] = true
+	// Track unique revisions
+	c.uniqueRevisions[modRevision] = true
 
-		// Track revision ranges
-		if int(kv.ModRevision) > stats.maxRevision {
-			stats.maxRevision = int(kv.ModRevision)
-		}
-		if int(kv.CreateRevision) < stats.minRevision {
-			stats.minRevision = int(kv.ModRevision)
-		}
+	// Track revision ranges
+	if int(modRevision) > stats.maxRevision {
+		stats.maxRevision = int(modRevision)
+	}
+	if int(modRevision) < stats.minRevision {
+		stats.minRevision = int(modRevision)
+	}
 
-		// Track value sizes
-		valueSize := len(kv.Value)
-		totalValueSize += valueSize
-		if valueSize > stats.largestValueSize {
-			stats.largestValueSize = valueSize
-		}
-		if valueSize < stats.smallestValueSize {
-			stats.smallestValueSize = valueSize
-		}
+	// Track value sizes
+	c.totalValueSize += valueSize
+	if valueSize > stats.largestValueSize {
+		stats.largestValueSize = valueSize
+	}
+	if valueSize < stats.smallestValueSize {
+		stats.smallestValueSize = valueSize
+	}
 
-		// Track per-key sums and counts
-		key := string(kv.Key)
-		keyValueSums[key] += valueSize
-		keyRevisionCounts[key]++
+	// Track per-key sums and counts
+	c.keyValueSums[key] += valueSize
+	c.keyRevisionCounts[key]++
+	c.keysDeleted[key] = deleted
 
-		// Track leases
-		if kv.Lease != 0 {
-			stats.keysWithLeases++
-			uniqueLeases[kv.Lease] = true
-		}
+	// Track leases
+	if lease != 0 {
+		c.leasedKeys[key] = true
+		c.uniqueLeases[lease] = true
 	}
+}
+
+func (c *statsCollector) finish() EtcdStats {
+	stats := c.stats
 
 	// Calculate derived stats
-	stats.uniqueKeys = len(keyValueSums)
-	stats.activeLeases = len(uniqueLeases)
-	stats.totalValueSize = totalValueSize
-	stats.totalRevisions = len(uniqueRevisions) // Now correctly counts unique revisions
-
-	if stats.totalKeys > 0 {
-		stats.avgRevisionsPerKey = float64(stats.totalRevisions) / float64(stats.uniqueKeys) // Also fix this calculation
-		stats.averageValueSize = totalValueSize / stats.totalKeys
+	stats.uniqueKeys = len(c.keyValueSums)
+	for _, deleted := range c.keysDeleted {
+		if !deleted {
+			stats.totalKeys++
+		}
+	}
+	stats.keysWithLeases = len(c.leasedKeys)
+	stats.activeLeases = len(c.uniqueLeases)
+	stats.totalValueSize = c.totalValueSize
+	stats.totalRevisions = len(c.uniqueRevisions) // Now correctly counts unique revisions
+
+	if c.revisions > 0 {
+		stats.avgRevisionsPerKey = float64(stats.totalRevisions) / float64(stats.uniqueKeys)
+		stats.averageValueSize = c.totalValueSize / c.revisions
+	} else {
+		// there are no minimums in an empty database
+		stats.minRevision = 0
+		stats.smallestValueSize = 0
 	}
 
 	// Calculate compaction savings: sum of all values for keys with multiple revisions
 	compactionSavings := 0
-	for key, totalSize := range keyValueSums {
-		if keyRevisionCounts[key] > 1 {
+	for key, totalSize := range c.keyValueSums {
+		if c.keyRevisionCounts[key] > 1 {
 			stats.keysWithMultipleRevisions++
 			compactionSavings += totalSize
 		}
@@ -3,7 +3,11 @@ package etcdsnapshot
 import (
 	"context"
 	"fmt"
-	"math"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -12,6 +16,8 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.etcd.io/etcd/api/v3/mvccpb"
+
+	"github.com/tjungblu/octosql-plugin-etcdsnapshot/pkg/snapshotgen"
 )
 
 func TestMappingOfKeys(t *testing.T) {
@@ -30,12 +36,13 @@ func TestMappingOfKeys(t *testing.T) {
 				octosql.NewNull(),
 				octosql.NewNull(),
 				octosql.NewNull(),
-				octosql.NewFloat(0),
-				octosql.NewFloat(0),
-				octosql.NewFloat(0),
-				octosql.NewFloat(0),
+				octosql.NewInt(0),
+				octosql.NewInt(0),
+				octosql.NewInt(0),
+				octosql.NewInt(0),
 				octosql.NewString("some"),
 				octosql.NewInt(4),
+				octosql.NewString("identity"),
 			},
 		},
 		"tooMany": {
@@ -48,12 +55,13 @@ func TestMappingOfKeys(t *testing.T) {
 				octosql.NewNull(),
 				octosql.NewNull(),
 				octosql.NewNull(),
-				octosql.NewFloat(0),
-				octosql.NewFloat(0),
-				octosql.NewFloat(0),
-				octosql.NewFloat(0),
+				octosql.NewInt(0),
+				octosql.NewInt(0),
+				octosql.NewInt(0),
+				octosql.NewInt(0),
 				octosql.NewString("some"),
 				octosql.NewInt(4),
+				octosql.NewString("identity"),
 			},
 		},
 		"toplevel": {
@@ -66,12 +74,13 @@ func TestMappingOfKeys(t *testing.T) {
 				octosql.NewNull(),
 				octosql.NewNull(),
 				octosql.NewNull(),
-				octosql.NewFloat(0),
-				octosql.NewFloat(0),
-				octosql.NewFloat(0),
-				octosql.NewFloat(0),
+				octosql.NewInt(0),
+				octosql.NewInt(0),
+				octosql.NewInt(0),
+				octosql.NewInt(0),
 				octosql.NewString("some"),
 				octosql.NewInt(4),
+				octosql.NewString("identity"),
 			},
 		},
 		"three-fields": {
@@ -84,12 +93,13 @@ func TestMappingOfKeys(t *testing.T) {
 				octosql.NewString("2"),
 				octosql.NewNull(),
 				octosql.NewString("3"),
-				octosql.NewFloat(0),
-				octosql.NewFloat(0),
-				octosql.NewFloat(0),
-				octosql.NewFloat(0),
+				octosql.NewInt(0),
+				octosql.NewInt(0),
+				octosql.NewInt(0),
+				octosql.NewInt(0),
 				octosql.NewString("some"),
 				octosql.NewInt(4),
+				octosql.NewString("identity"),
 			},
 		},
 		"four-fields": {
@@ -102,12 +112,13 @@ func TestMappingOfKeys(t *testing.T) {
 				octosql.NewString("2"),
 				octosql.NewString("3"),
 				octosql.NewString("4"),
-				octosql.NewFloat(0),
-				octosql.NewFloat(0),
-				octosql.NewFloat(0),
-				octosql.NewFloat(0),
+				octosql.NewInt(0),
+				octosql.NewInt(0),
+				octosql.NewInt(0),
+				octosql.NewInt(0),
 				octosql.NewString("some-other"),
 				octosql.NewInt(10),
+				octosql.NewString("identity"),
 			},
 		},
 		"five-fields": {
@@ -120,12 +131,13 @@ func TestMappingOfKeys(t *testing.T) {
 				octosql.NewString("3"),
 				octosql.NewString("4"),
 				octosql.NewString("5"),
-				octosql.NewFloat(0),
-				octosql.NewFloat(0),
-				octosql.NewFloat(0),
-				octosql.NewFloat(0),
+				octosql.NewInt(0),
+				octosql.NewInt(0),
+				octosql.NewInt(0),
+				octosql.NewInt(0),
 				octosql.NewString("some-other"),
 				octosql.NewInt(10),
+				octosql.NewString("identity"),
 			},
 		},
 	}
@@ -163,12 +175,13 @@ func TestMappingOfKeysWithRevisions(t *testing.T) {
 				octosql.NewString("pods"),
 				octosql.NewString("default"),
 				octosql.NewString("test"),
-				octosql.NewFloat(100),
-				octosql.NewFloat(200),
-				octosql.NewFloat(1),
-				octosql.NewFloat(5),
+				octosql.NewInt(100),
+				octosql.NewInt(200),
+				octosql.NewInt(1),
+				octosql.NewInt(5),
 				octosql.NewString("podData"),
 				octosql.NewInt(7),
+				octosql.NewString("identity"),
 			},
 		},
 		"zeroRevisions": {
@@ -185,12 +198,13 @@ func TestMappingOfKeysWithRevisions(t *testing.T) {
 				octosql.NewNull(),
 				octosql.NewNull(),
 				octosql.NewNull(),
-				octosql.NewFloat(0),
-				octosql.NewFloat(0),
-				octosql.NewFloat(0),
-				octosql.NewFloat(0),
+				octosql.NewInt(0),
+				octosql.NewInt(0),
+				octosql.NewInt(0),
+				octosql.NewInt(0),
 				octosql.NewString("data"),
 				octosql.NewInt(4),
+				octosql.NewString("identity"),
 			},
 		},
 	}
@@ -280,10 +294,10 @@ func TestBasicSnapshot(t *testing.T) {
 				octosql.NewNull(),
 				octosql.NewNull(),
 				octosql.NewNull(),
-				octosql.NewFloat(2),
-				octosql.NewFloat(2),
-				octosql.NewFloat(1),
-				octosql.NewFloat(0),
+				octosql.NewInt(2),
+				octosql.NewInt(2),
+				octosql.NewInt(1),
+				octosql.NewInt(0),
 				octosql.NewString("b"),
 				octosql.NewInt(1),
 			}, false, time.Time{}),
@@ -296,10 +310,10 @@ func TestBasicSnapshot(t *testing.T) {
 				octosql.NewNull(),
 				octosql.NewNull(),
 				octosql.NewNull(),
-				octosql.NewFloat(3),
-				octosql.NewFloat(3),
-				octosql.NewFloat(1),
-				octosql.NewFloat(0),
+				octosql.NewInt(3),
+				octosql.NewInt(3),
+				octosql.NewInt(1),
+				octosql.NewInt(0),
 				octosql.NewString("c"),
 				octosql.NewInt(1),
 			}, false, time.Time{}),
@@ -311,10 +325,10 @@ func TestBasicSnapshot(t *testing.T) {
 				octosql.NewNull(),
 				octosql.NewNull(),
 				octosql.NewNull(),
-				octosql.NewFloat(4),
-				octosql.NewFloat(4),
-				octosql.NewFloat(1),
-				octosql.NewFloat(0),
+				octosql.NewInt(4),
+				octosql.NewInt(4),
+				octosql.NewInt(1),
+				octosql.NewInt(0),
 				octosql.NewString("e"),
 				octosql.NewInt(1),
 			}, false, time.Time{}),
@@ -443,7 +457,7 @@ func TestMetaTableSchemaOnly(t *testing.T) {
 	require.NoError(t, err)
 
 	// Verify schema has all expected fields
-	require.Equal(t, 24, len(schema.Fields))
+	require.Equal(t, 26, len(schema.Fields))
 
 	// Verify field names and types
 	expectedFields := []struct {
@@ -474,6 +488,8 @@ func TestMetaTableSchemaOnly(t *testing.T) {
 		{"keysWithLeases", octosql.Int},
 		{"activeLeases", octosql.Int},
 		{"estimatedCompactionSavings", octosql.Int},
+		{"quota", octosql.Int},
+		{"quotaSource", octosql.String},
 	}
 
 	for i, expected := range expectedFields {
@@ -569,7 +585,7 @@ func TestCalculateEtcdStatsMultipleRevisions(t *testing.T) {
 		[][]byte{val1, val2},
 	)
 
-	assert.Equal(t, 2, stats.totalKeys)      // 2 key-value pairs
+	assert.Equal(t, 1, stats.totalKeys)      // 1 key with 2 revisions
 	assert.Equal(t, 2, stats.totalRevisions) // 2 unique revisions: 100, 200
 	assert.Equal(t, 200, stats.maxRevision)
 	assert.Equal(t, 100, stats.minRevision)
@@ -642,6 +658,60 @@ func TestCalculateEtcdStatsWithLeases(t *testing.T) {
 	assert.Equal(t, 0, stats.estimatedCompactionSavings) // No keys with multiple revisions
 }
 
+func TestCalculateEtcdStatsCountsKeysOnce(t *testing.T) {
+	// the leased key is renewed, the deleted one ends with a tombstone
+	kvs := []struct {
+		kv      mvccpb.KeyValue
+		deleted bool
+	}{
+		{kv: mvccpb.KeyValue{Key: []byte("leased"), Value: []byte("v1"), CreateRevision: 2, ModRevision: 2, Version: 1, Lease: 7}},
+		{kv: mvccpb.KeyValue{Key: []byte("deleted"), Value: []byte("v1"), CreateRevision: 3, ModRevision: 3, Version: 1}},
+		{kv: mvccpb.KeyValue{Key: []byte("leased"), Value: []byte("v2"), CreateRevision: 2, ModRevision: 4, Version: 2, Lease: 7}},
+		{kv: mvccpb.KeyValue{Key: []byte("deleted")}, deleted: true},
+		{kv: mvccpb.KeyValue{Key: []byte("recreated"), Value: []byte("v1"), CreateRevision: 6, ModRevision: 6, Version: 1}},
+		{kv: mvccpb.KeyValue{Key: []byte("recreated")}, deleted: true},
+		{kv: mvccpb.KeyValue{Key: []byte("recreated"), Value: []byte("v2"), CreateRevision: 8, ModRevision: 8, Version: 1}},
+	}
+
+	var keys, vals [][]byte
+	for i, r := range kvs {
+		revision := revToBytes(int64(i+2), 0)
+		if r.deleted {
+			revision = append(revision, markTombstone)
+		}
+		data, err := r.kv.Marshal()
+		require.NoError(t, err)
+		keys = append(keys, revision)
+		vals = append(vals, data)
+	}
+
+	stats := calculateEtcdStatsFromKVs(keys, vals)
+	assert.Equal(t, 3, stats.uniqueKeys)
+	// only keys whose latest revision isn't a deletion are live
+	assert.Equal(t, 2, stats.totalKeys)
+	// both revisions of the leased key have the lease
+	assert.Equal(t, 1, stats.keysWithLeases)
+	assert.Equal(t, 1, stats.activeLeases)
+}
+
+func TestCalculateEtcdStatsMinRevisionAfterCompaction(t *testing.T) {
+	// the key was created before the compaction, only its later revision is left
+	kv := &mvccpb.KeyValue{
+		Key:            []byte("key1"),
+		Value:          []byte("value1"),
+		CreateRevision: 10,
+		ModRevision:    100,
+		Version:        5,
+	}
+	val, err := kv.Marshal()
+	require.NoError(t, err)
+
+	stats := calculateEtcdStatsFromKVs([][]byte{kv.Key}, [][]byte{val})
+	assert.Equal(t, 100, stats.minRevision)
+	assert.Equal(t, 100, stats.maxRevision)
+	assert.Equal(t, 0, stats.maxRevision-stats.minRevision)
+}
+
 // TestMetaTableFragmentationCalculations would test fragmentation calculations
 // but is commented out due to compilation issues with the Open function
 // and execution context that need to be resolved separately
@@ -688,7 +758,7 @@ func TestCalculateEtcdStatsRevisionCounting(t *testing.T) {
 
 	stats := calculateEtcdStatsFromKVs(keys, vals)
 
-	assert.Equal(t, 3, stats.totalKeys)
+	assert.Equal(t, 2, stats.totalKeys)
 	assert.Equal(t, 2, stats.totalRevisions) // Unique revisions: 100, 200
 	assert.Equal(t, 200, stats.maxRevision)
 	assert.Equal(t, 100, stats.minRevision)
@@ -761,87 +831,124 @@ func TestCalculateEtcdStatsEdgeCases(t *testing.T) {
 	})
 }
 
-// Helper function to test calculateEtcdStats without needing a real backend
+// calculateEtcdStatsFromKVs runs the stats collector of calculateEtcdStats without needing a real backend, keys
+// are the revisions of the values
 func calculateEtcdStatsFromKVs(keys, vals [][]byte) EtcdStats {
-	stats := EtcdStats{
-		minRevision:       math.MaxInt32,
-		smallestValueSize: math.MaxInt32,
-	}
-
-	totalValueSize := 0
-	uniqueLeases := make(map[int64]bool)
-	uniqueRevisions := make(map[int64]bool)
-
-	// Track total value sizes per key
-	keyValueSums := make(map[string]int)
-	keyRevisionCounts := make(map[string]int)
-
+	collector := newStatsCollector()
 	for i := 0; i < len(keys); i++ {
 		kv := mvccpb.KeyValue{}
 		if err := kv.Unmarshal(vals[i]); err != nil {
 			continue
 		}
+		collector.add(string(kv.Key), kv.ModRevision, len(kv.Value), kv.Lease, isTombstone(keys[i]))
+	}
+	return collector.finish()
+}
 
-		stats.totalKeys++
+// benchmarkNamespaces are the sizes of the generated benchmark snapshots in namespaces, with the default resource mix
+// every namespace has about 100 revisions and 230KB. ETCDSNAPSHOT_BENCH_NAMESPACES overrides them with a comma separated
+// list, e.g. 10000 for a snapshot of about 2.3GB.
+func benchmarkNamespaces(b *testing.B) []int {
+	sizes := os.Getenv("ETCDSNAPSHOT_BENCH_NAMESPACES")
+	if sizes == "" {
+		return []int{10, 100, 1000}
+	}
+	var namespaces []int
+	for _, size := range strings.Split(sizes, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(size))
+		require.NoError(b, err, "invalid ETCDSNAPSHOT_BENCH_NAMESPACES")
+		namespaces = append(namespaces, n)
+	}
+	return namespaces
+}
 
-		// Track unique revisions
-		uniqueRevisions[kv.ModRevision] = true
+// benchmarkSizes runs the benchmark on a generated snapshot of every size and reports rows/s, the revisions read per
+// second, and peak-RSS-MB, the peak resident memory of the benchmark, next to the allocations
+func benchmarkSizes(b *testing.B, run func(b *testing.B, backend *snapshotBackend)) {
+	for _, namespaces := range benchmarkNamespaces(b) {
+		cfg := snapshotgen.DefaultConfig()
+		cfg.Namespaces = namespaces
+		path := filepath.Join(b.TempDir(), fmt.Sprintf("generated-%d.snapshot", namespaces))
+		generated, err := snapshotgen.Generate(path, cfg)
+		require.NoError(b, err)
+		backend, err := openSnapshotBackend(path)
+		require.NoError(b, err)
+
+		b.Run(fmt.Sprintf("namespaces=%d", namespaces), func(b *testing.B) {
+			resetPeakRSS()
+			b.ReportAllocs()
+			b.ResetTimer()
+			run(b, backend)
+			b.StopTimer()
+
+			b.ReportMetric(float64(generated.Revisions)*float64(b.N)/b.Elapsed().Seconds(), "rows/s")
+			if peak, ok := peakRSS(); ok {
+				b.ReportMetric(float64(peak)/(1<<20), "peak-RSS-MB")
+			}
+		})
+		require.NoError(b, backend.Close())
+	}
+}
 
-		// Track revision ranges
-		if int(kv.ModRevision) > stats.maxRevision {
-			stats.maxRevision = int(kv.ModRevision)
-		}
-		if int(kv.ModRevision) < stats.minRevision {
-			stats.minRevision = int(kv.ModRevision)
-		}
+// resetPeakRSS resets the peak resident memory of the process to the current one, after returning the memory of
+// earlier benchmarks to the OS, only on Linux
+func resetPeakRSS() {
+	debug.FreeOSMemory()
+	_ = os.WriteFile("/proc/self/clear_refs", []byte("5"), 0)
+}
 
-		// Track value sizes
-		valueSize := len(kv.Value)
-		totalValueSize += valueSize
-		if valueSize > stats.largestValueSize {
-			stats.largestValueSize = valueSize
-		}
-		if valueSize < stats.smallestValueSize {
-			stats.smallestValueSize = valueSize
+// peakRSS returns the peak resident memory of the process in bytes, only on Linux
+func peakRSS() (int64, bool) {
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if fields := strings.Fields(line); len(fields) == 3 && fields[0] == "VmHWM:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			return kb * 1024, err == nil
 		}
+	}
+	return 0, false
+}
 
-		// Track per-key sums and counts
-		key := string(kv.Key)
-		keyValueSums[key] += valueSize
-		keyRevisionCounts[key]++
+func BenchmarkProduceContentFromMvccStore(b *testing.B) {
+	produce := func(ctx execution.ProduceContext, record execution.Record) error { return nil }
+	ctx := execution.ExecutionContext{Context: context.Background()}
+	fieldIndices := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
 
-		// Track leases
-		if kv.Lease != 0 {
-			stats.keysWithLeases++
-			uniqueLeases[kv.Lease] = true
+	benchmarkSizes(b, func(b *testing.B, backend *snapshotBackend) {
+		for i := 0; i < b.N; i++ {
+			require.NoError(b, produceContentFromMvccStore(ctx, produce, backend, fieldIndices, nil, nil, nil, nil, 1, true, false))
 		}
-	}
+	})
+}
 
-	// Calculate derived stats
-	stats.uniqueKeys = len(keyValueSums)
-	stats.activeLeases = len(uniqueLeases)
-	stats.totalValueSize = totalValueSize
-	stats.totalRevisions = len(uniqueRevisions)
-
-	if stats.totalKeys > 0 {
-		stats.avgRevisionsPerKey = float64(stats.totalRevisions) / float64(stats.uniqueKeys)
-		stats.averageValueSize = totalValueSize / stats.totalKeys
-	} else {
-		// Handle empty database case
-		stats.maxRevision = 0
-		stats.minRevision = 0
-		stats.smallestValueSize = 0
-	}
-
-	// Calculate compaction savings: sum of all values for keys with multiple revisions
-	compactionSavings := 0
-	for key, totalSize := range keyValueSums {
-		if keyRevisionCounts[key] > 1 {
-			stats.keysWithMultipleRevisions++
-			compactionSavings += totalSize
+func BenchmarkMapEtcdToOctosql(b *testing.B) {
+	benchmarkSizes(b, func(b *testing.B, backend *snapshotBackend) {
+		b.StopTimer()
+		var kvs []mvccpb.KeyValue
+		require.NoError(b, backend.forEachRevision(context.Background(), func(_, val []byte) error {
+			kv := mvccpb.KeyValue{}
+			require.NoError(b, kv.Unmarshal(val))
+			kvs = append(kvs, kv)
+			return nil
+		}))
+		b.StartTimer()
+
+		for i := 0; i < b.N; i++ {
+			for _, kv := range kvs {
+				mapEtcdToOctosql(kv)
+			}
 		}
-	}
-	stats.estimatedCompactionSavings = compactionSavings
+	})
+}
 
-	return stats
+func BenchmarkCalculateEtcdStats(b *testing.B) {
+	benchmarkSizes(b, func(b *testing.B, backend *snapshotBackend) {
+		for i := 0; i < b.N; i++ {
+			_, err := calculateEtcdStats(context.Background(), backend)
+			require.NoError(b, err)
+		}
+	})
 }
@@ -0,0 +1,287 @@
+package etcdsnapshot
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/cube2222/octosql/octosql"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+const (
+	// indexVersion must be bumped whenever the layout of snapshotIndex changes
+	indexVersion   = 3
+	indexExtension = ".etcdidx"
+	// indexCacheDir is the directory below os.UserCacheDir used when the index can't be stored next to the snapshot
+	indexCacheDir = "octosql-etcdsnapshot"
+	// nullString is the string id of a NULL key column
+	nullString = -1
+)
+
+// snapshotIndex holds everything of a snapshot except the values, so queries that don't select the value
+// column can be answered without reading and unmarshaling the key bucket
+type snapshotIndex struct {
+	// Strings is the table of all distinct key segments, keys refer to it by position
+	Strings []string
+	// Keys are the parsed key columns (key, apiserverPrefix, apigroup, resourceType, namespace, name) per unique key
+	Keys [][keyColumns]int32
+	// Revisions are in the same order as the key bucket
+	Revisions []indexedRevision
+}
+
+// keyColumns is the number of columns mapKeyToOctosql parses out of a key
+const keyColumns = 6
+
+type indexedRevision struct {
+	Key            int32
+	CreateRevision int64
+	ModRevision    int64
+	Version        int64
+	Lease          int64
+	ValueSize      int64
+	// Provider is the string id of the encryption provider
+	Provider int32
+	// Tombstone is set for the deletion of the key
+	Tombstone bool
+}
+
+// indexHeader is written in front of the index, a mismatching hash or version triggers a rebuild
+type indexHeader struct {
+	Version      int
+	SnapshotHash string
+}
+
+// buildSnapshotIndex scans the key bucket once and collects the columns of every revision
+func buildSnapshotIndex(ctx context.Context, etcdBackend *snapshotBackend) (*snapshotIndex, error) {
+	index := &snapshotIndex{}
+	stringIds := make(map[string]int32)
+	keyIds := make(map[string]int32)
+
+	internString := func(v octosql.Value) int32 {
+		if v.TypeID != octosql.TypeIDString {
+			return nullString
+		}
+		id, ok := stringIds[v.Str]
+		if !ok {
+			id = int32(len(index.Strings))
+			stringIds[v.Str] = id
+			index.Strings = append(index.Strings, v.Str)
+		}
+		return id
+	}
+
+	kv := mvccpb.KeyValue{}
+	err := etcdBackend.forEachRevision(ctx, func(revision, val []byte) error {
+		if err := kv.Unmarshal(val); err != nil {
+			return fmt.Errorf("failed to unmarshal value: %w", err)
+		}
+
+		skey := string(kv.Key)
+		keyId, ok := keyIds[skey]
+		if !ok {
+			var columns [keyColumns]int32
+			for i, v := range mapKeyToOctosql(skey) {
+				columns[i] = internString(v)
+			}
+			keyId = int32(len(index.Keys))
+			keyIds[skey] = keyId
+			index.Keys = append(index.Keys, columns)
+		}
+
+		index.Revisions = append(index.Revisions, indexedRevision{
+			Key:            keyId,
+			CreateRevision: kv.CreateRevision,
+			ModRevision:    kv.ModRevision,
+			Version:        kv.Version,
+			Lease:          kv.Lease,
+			ValueSize:      int64(len(kv.Value)),
+			Provider:       internString(octosql.NewString(encryptionProviderOf(kv.Value))),
+			Tombstone:      isTombstone(revision),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return index, nil
+}
+
+// keyValues returns the parsed key columns of a key in the same shape as mapKeyToOctosql
+func (x *snapshotIndex) keyValues(keyId int32) []octosql.Value {
+	values := make([]octosql.Value, keyColumns)
+	for i, id := range x.Keys[keyId] {
+		if id == nullString {
+			values[i] = octosql.NewNull()
+		} else {
+			values[i] = octosql.NewString(x.Strings[id])
+		}
+	}
+	return values
+}
+
+// etcdStats computes the same statistics as calculateEtcdStats without touching the database
+func (x *snapshotIndex) etcdStats() EtcdStats {
+	collector := newStatsCollector()
+	for _, rev := range x.Revisions {
+		collector.add(x.Strings[x.Keys[rev.Key][0]], rev.ModRevision, int(rev.ValueSize), rev.Lease, rev.Tombstone)
+	}
+	return collector.finish()
+}
+
+// snapshotHash identifies the content of a snapshot file cheaply: bbolt rewrites its meta pages on every
+// commit and etcdctl appends a sha256 of the database, so hashing those along with the size is enough to
+// detect a different or modified snapshot without reading all of it.
+func snapshotHash(path string, pageSize int) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	_ = binary.Write(h, binary.LittleEndian, stat.Size())
+
+	// the first two pages are the bbolt meta pages
+	if _, err := io.Copy(h, io.LimitReader(f, int64(2*pageSize))); err != nil {
+		return "", err
+	}
+
+	if stat.Size() > int64(2*pageSize+sha256.Size) {
+		tail := make([]byte, sha256.Size)
+		if _, err := f.ReadAt(tail, stat.Size()-sha256.Size); err != nil {
+			return "", err
+		}
+		h.Write(tail)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// indexLocations returns where the index of a snapshot may be stored, in order of preference. A configured
+// IndexDir takes precedence, otherwise the index is stored next to the snapshot and falls back to the user
+// cache directory. Data directories of an etcd member are never written to.
+func indexLocations(cfg Config, snapshotPath, hash string, dataDir bool) []string {
+	if cfg.IndexDir != "" {
+		return []string{filepath.Join(cfg.IndexDir, hash+indexExtension)}
+	}
+
+	var locations []string
+	if !dataDir {
+		locations = append(locations, snapshotPath+indexExtension)
+	}
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		locations = append(locations, filepath.Join(cacheDir, indexCacheDir, hash+indexExtension))
+	}
+	return locations
+}
+
+// loadOrBuildIndex returns the index stored for the snapshot or builds and stores a new one. Failing to
+// store the index isn't an error, the next query just builds it again.
+func loadOrBuildIndex(ctx context.Context, cfg Config, snapshotPath string, dataDir bool, etcdBackend *snapshotBackend) (*snapshotIndex, error) {
+	hash, err := snapshotHash(snapshotPath, etcdBackend.db.Info().PageSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash snapshot [%s]: %w", snapshotPath, err)
+	}
+
+	locations := indexLocations(cfg, snapshotPath, hash, dataDir)
+	for _, location := range locations {
+		index, err := readIndex(location, hash)
+		if err == nil {
+			logger.Info("loaded snapshot index", "location", location)
+			return index, nil
+		}
+		if !os.IsNotExist(err) {
+			logger.Warn("ignoring snapshot index", "location", location, "err", err)
+		}
+	}
+
+	index, err := buildSnapshotIndex(ctx, etcdBackend)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build snapshot index: %w", err)
+	}
+
+	for _, location := range locations {
+		err := writeIndex(location, hash, index)
+		if err == nil {
+			logger.Info("stored snapshot index", "location", location)
+			break
+		}
+		logger.Warn("could not store snapshot index", "location", location, "err", err)
+	}
+
+	return index, nil
+}
+
+func readIndex(path, hash string) (*snapshotIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	defer zr.Close()
+
+	dec := gob.NewDecoder(zr)
+	var header indexHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, fmt.Errorf("failed to decode index header: %w", err)
+	}
+	if header.Version != indexVersion || header.SnapshotHash != hash {
+		return nil, fmt.Errorf("index is outdated (version %d, hash %s)", header.Version, header.SnapshotHash)
+	}
+
+	index := &snapshotIndex{}
+	if err := dec.Decode(index); err != nil {
+		return nil, fmt.Errorf("failed to decode index: %w", err)
+	}
+	return index, nil
+}
+
+// writeIndex stores the index through a temporary file, so concurrent readers never see a partial index
+func writeIndex(path, hash string, index *snapshotIndex) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	zw := gzip.NewWriter(f)
+	enc := gob.NewEncoder(zw)
+	err = enc.Encode(indexHeader{Version: indexVersion, SnapshotHash: hash})
+	if err == nil {
+		err = enc.Encode(index)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
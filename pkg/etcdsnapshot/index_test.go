@@ -0,0 +1,156 @@
+package etcdsnapshot
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cube2222/octosql/execution"
+	"github.com/cube2222/octosql/octosql"
+	"github.com/stretchr/testify/require"
+)
+
+func runDatasource(t *testing.T, ds *DatasourceExecuting) []execution.Record {
+	var records []execution.Record
+	err := ds.Run(execution.ExecutionContext{
+		Context:         context.TODO(),
+		VariableContext: nil,
+	},
+		func(ctx execution.ProduceContext, record execution.Record) error {
+			records = append(records, record)
+			return nil
+		},
+		nil,
+	)
+	require.NoError(t, err)
+	return records
+}
+
+func TestBuildSnapshotIndex(t *testing.T) {
+	etcdBackend, err := openSnapshotBackend("data/basic.snapshot")
+	require.NoError(t, err)
+	defer etcdBackend.Close()
+
+	index, err := buildSnapshotIndex(context.Background(), etcdBackend)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(index.Revisions))
+	require.Equal(t, 3, len(index.Keys))
+
+	require.Equal(t, []octosql.Value{
+		octosql.NewString("a"),
+		octosql.NewNull(),
+		octosql.NewNull(),
+		octosql.NewNull(),
+		octosql.NewNull(),
+		octosql.NewNull(),
+	}, index.keyValues(index.Revisions[0].Key))
+	require.Equal(t, int64(2), index.Revisions[0].ModRevision)
+	require.Equal(t, int64(1), index.Revisions[0].ValueSize)
+
+	expected, err := calculateEtcdStats(context.Background(), etcdBackend)
+	require.NoError(t, err)
+	require.Equal(t, expected, index.etcdStats())
+}
+
+func TestIndexStoredNextToSnapshot(t *testing.T) {
+	path := copySnapshot(t)
+	ds := &DatasourceExecuting{
+		path:         path,
+		fieldIndices: []int{0, 6, 7, 8, 9, 11},
+		config:       Config{Index: true},
+	}
+
+	withIndex := runDatasource(t, ds)
+	_, err := os.Stat(path + indexExtension)
+	require.NoError(t, err)
+
+	ds.config.Index = false
+	require.Equal(t, runDatasource(t, ds), withIndex)
+}
+
+func TestIndexReusedAndRebuiltOnMismatch(t *testing.T) {
+	path := copySnapshot(t)
+	indexDir := t.TempDir()
+	cfg := Config{Index: true, IndexDir: indexDir}
+
+	etcdBackend, err := openSnapshotBackend(path)
+	require.NoError(t, err)
+	defer etcdBackend.Close()
+
+	built, err := loadOrBuildIndex(context.Background(), cfg, path, false, etcdBackend)
+	require.NoError(t, err)
+	files, err := filepath.Glob(filepath.Join(indexDir, "*"+indexExtension))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(files))
+
+	hash, err := snapshotHash(path, etcdBackend.db.Info().PageSize)
+	require.NoError(t, err)
+	loaded, err := readIndex(files[0], hash)
+	require.NoError(t, err)
+	require.Equal(t, built, loaded)
+
+	_, err = readIndex(files[0], "another snapshot")
+	require.Error(t, err)
+
+	// a stale index at the expected location is replaced
+	require.NoError(t, writeIndex(files[0], "another snapshot", &snapshotIndex{}))
+	rebuilt, err := loadOrBuildIndex(context.Background(), cfg, path, false, etcdBackend)
+	require.NoError(t, err)
+	require.Equal(t, built, rebuilt)
+	loaded, err = readIndex(files[0], hash)
+	require.NoError(t, err)
+	require.Equal(t, built, loaded)
+}
+
+func TestSnapshotHashChangesWithContent(t *testing.T) {
+	path := copySnapshot(t)
+	first, err := snapshotHash(path, 4096)
+	require.NoError(t, err)
+
+	again, err := snapshotHash(path, 4096)
+	require.NoError(t, err)
+	require.Equal(t, first, again)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0600))
+
+	changed, err := snapshotHash(path, 4096)
+	require.NoError(t, err)
+	require.NotEqual(t, first, changed)
+}
+
+func TestIndexLocations(t *testing.T) {
+	require.Equal(t, []string{filepath.Join("/idx", "abc"+indexExtension)},
+		indexLocations(Config{IndexDir: "/idx"}, "/backups/etcd.snapshot", "abc", false))
+
+	locations := indexLocations(Config{}, "/backups/etcd.snapshot", "abc", false)
+	require.Equal(t, "/backups/etcd.snapshot"+indexExtension, locations[0])
+
+	// data directories of a member are never written to
+	for _, location := range indexLocations(Config{}, "/var/lib/etcd/member/snap/db", "abc", true) {
+		require.NotContains(t, location, "/var/lib/etcd")
+	}
+}
+
+func TestIndexServesMetaQueries(t *testing.T) {
+	ds := &DatasourceExecuting{
+		path:         copySnapshot(t),
+		fieldIndices: []int{5, 7, 15, 20},
+		schema:       SchemaMeta,
+		config:       Config{Index: true, IndexDir: t.TempDir()},
+	}
+
+	records := runDatasource(t, ds)
+	require.Equal(t, []execution.Record{
+		execution.NewRecord([]octosql.Value{
+			octosql.NewInt(3),
+			octosql.NewInt(4),
+			octosql.NewInt(3),
+			octosql.NewInt(3),
+		}, false, time.Time{}),
+	}, records)
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package etcdsnapshot
+
+import (
+	"os"
+	"syscall"
+)
+
+func fileInode(stat os.FileInfo) uint64 {
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+		return uint64(sys.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,60 @@
+package etcdsnapshot
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+const (
+	// LogLevelEnv overrides Config.LogLevel, e.g. ETCDSNAPSHOT_LOG_LEVEL=debug
+	LogLevelEnv = "ETCDSNAPSHOT_LOG_LEVEL"
+	// LogFormatEnv overrides Config.LogFormat
+	LogFormatEnv = "ETCDSNAPSHOT_LOG_FORMAT"
+	// LogFileEnv overrides Config.LogFile
+	LogFileEnv = "ETCDSNAPSHOT_LOG_FILE"
+
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// logger is used by the whole plugin, stdout belongs to octosql. It's replaced by Creator with the configured one.
+var logger = func() *slog.Logger {
+	l, err := newLogger(Config{})
+	if err != nil {
+		// an invalid environment only takes effect once Creator reports it
+		return slog.New(slog.NewTextHandler(os.Stderr, nil))
+	}
+	return l
+}()
+
+// newLogger creates the logger configured by LogLevel, LogFormat and LogFile, the environment variables take
+// precedence over the configuration. Without a log file it writes to stderr.
+func newLogger(config Config) (*slog.Logger, error) {
+	levelName := firstNonEmpty(os.Getenv(LogLevelEnv), config.LogLevel, "info")
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(levelName)); err != nil {
+		return nil, fmt.Errorf("invalid log level '%s', expected debug, info, warn or error", levelName)
+	}
+
+	var out io.Writer = os.Stderr
+	if file := firstNonEmpty(os.Getenv(LogFileEnv), config.LogFile); file != "" {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log file: %w", err)
+		}
+		out = f
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	switch format := firstNonEmpty(os.Getenv(LogFormatEnv), config.LogFormat, LogFormatText); strings.ToLower(format) {
+	case LogFormatText:
+		return slog.New(slog.NewTextHandler(out, options)), nil
+	case LogFormatJSON:
+		return slog.New(slog.NewJSONHandler(out, options)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format '%s', expected %s or %s", format, LogFormatText, LogFormatJSON)
+	}
+}
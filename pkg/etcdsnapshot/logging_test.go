@@ -0,0 +1,61 @@
+package etcdsnapshot
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewLogger(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "plugin.log")
+	l, err := newLogger(Config{LogLevel: "warn", LogFormat: "json", LogFile: file})
+	require.NoError(t, err)
+	l.Info("not logged")
+	l.Warn("logged", "revisions", 3)
+
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 1)
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	require.Equal(t, "logged", record["msg"])
+	require.Equal(t, float64(3), record["revisions"])
+
+	_, err = newLogger(Config{LogLevel: "verbose"})
+	require.ErrorContains(t, err, "invalid log level 'verbose'")
+	_, err = newLogger(Config{LogFormat: "xml"})
+	require.ErrorContains(t, err, "invalid log format 'xml'")
+	_, err = newLogger(Config{LogFile: filepath.Join(t.TempDir(), "missing", "plugin.log")})
+	require.ErrorContains(t, err, "failed to open log file")
+}
+
+func TestNewLoggerFromEnvironment(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "plugin.log")
+	t.Setenv(LogLevelEnv, "debug")
+	t.Setenv(LogFormatEnv, "json")
+	t.Setenv(LogFileEnv, file)
+
+	// the environment takes precedence over the configuration
+	l, err := newLogger(Config{LogLevel: "error", LogFormat: "text"})
+	require.NoError(t, err)
+	l.Debug("logged")
+
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"msg":"logged"`)
+}
+
+func TestCreatorRejectsInvalidLogConfig(t *testing.T) {
+	previous := logger
+	defer func() { logger = previous }()
+
+	t.Setenv(LogLevelEnv, "verbose")
+	_, err := Creator(context.Background(), &mockConfigDecoder{})
+	require.ErrorContains(t, err, "invalid log level 'verbose'")
+}
@@ -0,0 +1,279 @@
+package etcdsnapshot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protobufPrefix marks values the apiserver stored with its protobuf serializer, the rest is a runtime.Unknown
+var protobufPrefix = []byte("k8s\x00")
+
+// objectMeta is the part of a Kubernetes object the derived tables need, decoded from either JSON or protobuf
+type objectMeta struct {
+	APIVersion      string
+	Kind            string
+	Name            string
+	Namespace       string
+	UID             string
+	OwnerReferences []ownerReference
+	// CreationTimestamp is when the object was created, ManagedFieldsTime the latest time of its managedFields
+	CreationTimestamp time.Time
+	ManagedFieldsTime time.Time
+	// FieldManager and FieldSubresource are of the managedFields entry with the latest time, which is the
+	// manager that wrote this revision
+	FieldManager     string
+	FieldSubresource string
+}
+
+// managedFieldsEntry is the part of a metav1.ManagedFieldsEntry we need
+type managedFieldsEntry struct {
+	Manager     string    `json:"manager"`
+	Subresource string    `json:"subresource"`
+	Time        time.Time `json:"time"`
+}
+
+// addManagedFieldsEntry keeps the latest managedFields entry, entries with the same time are ordered by the
+// apiserver so the last one wins
+func (m *objectMeta) addManagedFieldsEntry(entry managedFieldsEntry) {
+	if entry.Time.Before(m.ManagedFieldsTime) {
+		return
+	}
+	m.ManagedFieldsTime = entry.Time
+	m.FieldManager = entry.Manager
+	m.FieldSubresource = entry.Subresource
+}
+
+type ownerReference struct {
+	APIVersion         string `json:"apiVersion"`
+	Kind               string `json:"kind"`
+	Name               string `json:"name"`
+	UID                string `json:"uid"`
+	Controller         bool   `json:"controller"`
+	BlockOwnerDeletion bool   `json:"blockOwnerDeletion"`
+}
+
+// decodeObjectMeta decodes type and object metadata of a stored Kubernetes object. Values that are neither
+// protobuf nor a JSON object, like the plain strings of leases in the etcd namespace, return an error.
+func decodeObjectMeta(value []byte) (objectMeta, error) {
+	if bytes.HasPrefix(value, protobufPrefix) {
+		return decodeProtobufObjectMeta(value[len(protobufPrefix):])
+	}
+	if trimmed := bytes.TrimSpace(value); len(trimmed) > 0 && trimmed[0] == '{' {
+		return decodeJSONObjectMeta(trimmed)
+	}
+	return objectMeta{}, fmt.Errorf("value is not a Kubernetes object")
+}
+
+func decodeJSONObjectMeta(value []byte) (objectMeta, error) {
+	var object struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+		Metadata   struct {
+			Name              string               `json:"name"`
+			Namespace         string               `json:"namespace"`
+			UID               string               `json:"uid"`
+			OwnerReferences   []ownerReference     `json:"ownerReferences"`
+			CreationTimestamp time.Time            `json:"creationTimestamp"`
+			ManagedFields     []managedFieldsEntry `json:"managedFields"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(value, &object); err != nil {
+		return objectMeta{}, fmt.Errorf("failed to decode JSON object: %w", err)
+	}
+
+	meta := objectMeta{
+		APIVersion:        object.APIVersion,
+		Kind:              object.Kind,
+		Name:              object.Metadata.Name,
+		Namespace:         object.Metadata.Namespace,
+		UID:               object.Metadata.UID,
+		OwnerReferences:   object.Metadata.OwnerReferences,
+		CreationTimestamp: object.Metadata.CreationTimestamp,
+	}
+	for _, entry := range object.Metadata.ManagedFields {
+		meta.addManagedFieldsEntry(entry)
+	}
+	return meta, nil
+}
+
+// decodeProtobufObjectMeta reads the runtime.Unknown envelope and the ObjectMeta, which is the first field of
+// every built-in type. Only the fields we need are decoded, so we don't depend on the Kubernetes API types.
+func decodeProtobufObjectMeta(value []byte) (objectMeta, error) {
+	var meta objectMeta
+	var raw []byte
+	var err error
+	meta.APIVersion, meta.Kind, raw, err = unwrapProtobuf(value)
+	if err != nil {
+		return objectMeta{}, err
+	}
+
+	err = forEachProtoField(raw, func(f protoField) error {
+		if f.num != 1 {
+			return nil
+		}
+		// metav1.ObjectMeta: 1 name, 3 namespace, 5 uid, 8 creationTimestamp, 13 ownerReferences, 17 managedFields
+		return forEachProtoField(f.bytes, func(f protoField) error {
+			switch f.num {
+			case 8:
+				created, err := decodeProtobufTime(f.bytes)
+				if err != nil {
+					return err
+				}
+				meta.CreationTimestamp = created
+			case 17:
+				// metav1.ManagedFieldsEntry: 1 manager, 4 time, 8 subresource
+				var entry managedFieldsEntry
+				err := forEachProtoField(f.bytes, func(f protoField) error {
+					var err error
+					switch f.num {
+					case 1:
+						entry.Manager = string(f.bytes)
+					case 4:
+						entry.Time, err = decodeProtobufTime(f.bytes)
+					case 8:
+						entry.Subresource = string(f.bytes)
+					}
+					return err
+				})
+				if err != nil {
+					return err
+				}
+				meta.addManagedFieldsEntry(entry)
+			case 1:
+				meta.Name = string(f.bytes)
+			case 3:
+				meta.Namespace = string(f.bytes)
+			case 5:
+				meta.UID = string(f.bytes)
+			case 13:
+				ref, err := decodeProtobufOwnerReference(f.bytes)
+				if err != nil {
+					return err
+				}
+				meta.OwnerReferences = append(meta.OwnerReferences, ref)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return objectMeta{}, fmt.Errorf("failed to decode protobuf object: %w", err)
+	}
+
+	return meta, nil
+}
+
+// unwrapProtobuf reads the runtime.Unknown envelope, without the protobufPrefix, and returns the type and the
+// raw encoded object
+func unwrapProtobuf(value []byte) (apiVersion, kind string, raw []byte, err error) {
+	// runtime.Unknown: 1 typeMeta, 2 raw
+	err = forEachProtoField(value, func(f protoField) error {
+		switch f.num {
+		case 1:
+			// runtime.TypeMeta: 1 apiVersion, 2 kind
+			return forEachProtoField(f.bytes, func(f protoField) error {
+				switch f.num {
+				case 1:
+					apiVersion = string(f.bytes)
+				case 2:
+					kind = string(f.bytes)
+				}
+				return nil
+			})
+		case 2:
+			raw = f.bytes
+		}
+		return nil
+	})
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to decode protobuf envelope: %w", err)
+	}
+	return apiVersion, kind, raw, nil
+}
+
+// decodeProtobufOwnerReference decodes metav1.OwnerReference: 1 kind, 3 name, 4 uid, 5 apiVersion,
+// 6 controller, 7 blockOwnerDeletion
+func decodeProtobufOwnerReference(value []byte) (ownerReference, error) {
+	var ref ownerReference
+	err := forEachProtoField(value, func(f protoField) error {
+		switch f.num {
+		case 1:
+			ref.Kind = string(f.bytes)
+		case 3:
+			ref.Name = string(f.bytes)
+		case 4:
+			ref.UID = string(f.bytes)
+		case 5:
+			ref.APIVersion = string(f.bytes)
+		case 6:
+			ref.Controller = f.varint != 0
+		case 7:
+			ref.BlockOwnerDeletion = f.varint != 0
+		}
+		return nil
+	})
+	return ref, err
+}
+
+// decodeProtobufTime decodes metav1.Time and metav1.MicroTime: 1 seconds, 2 nanos
+func decodeProtobufTime(b []byte) (time.Time, error) {
+	var seconds, nanos int64
+	err := forEachProtoField(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			seconds = int64(f.varint)
+		case 2:
+			nanos = int64(int32(f.varint))
+		}
+		return nil
+	})
+	if err != nil || (seconds == 0 && nanos == 0) {
+		// an empty message is a null time
+		return time.Time{}, err
+	}
+	return time.Unix(seconds, nanos).UTC(), nil
+}
+
+// protoField is a length-delimited or varint field of a protobuf message
+type protoField struct {
+	num    protowire.Number
+	bytes  []byte
+	varint uint64
+}
+
+// forEachProtoField calls fn for every length-delimited and varint field of a protobuf message and skips
+// all others
+func forEachProtoField(b []byte, fn func(f protoField) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		f := protoField{num: num}
+		switch typ {
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			f.varint, n = protowire.ConsumeVarint(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if typ != protowire.BytesType && typ != protowire.VarintType {
+			continue
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
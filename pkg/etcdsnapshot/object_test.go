@@ -0,0 +1,138 @@
+package etcdsnapshot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func appendProtoString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendProtoMessage(b []byte, num protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
+
+func appendProtoBool(b []byte, num protowire.Number, v bool) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, protowire.EncodeBool(v))
+}
+
+// protobufObject encodes an object the way the apiserver stores built-in types, wrapped in runtime.Unknown
+func protobufObject(apiVersion, kind, namespace, name, uid string, owners ...ownerReference) string {
+	var typeMeta []byte
+	typeMeta = appendProtoString(typeMeta, 1, apiVersion)
+	typeMeta = appendProtoString(typeMeta, 2, kind)
+
+	var meta []byte
+	meta = appendProtoString(meta, 1, name)
+	meta = appendProtoString(meta, 3, namespace)
+	meta = appendProtoString(meta, 5, uid)
+	meta = protowire.AppendTag(meta, 7, protowire.VarintType)
+	meta = protowire.AppendVarint(meta, 3)
+	for _, owner := range owners {
+		var ref []byte
+		ref = appendProtoString(ref, 1, owner.Kind)
+		ref = appendProtoString(ref, 3, owner.Name)
+		ref = appendProtoString(ref, 4, owner.UID)
+		ref = appendProtoString(ref, 5, owner.APIVersion)
+		ref = appendProtoBool(ref, 6, owner.Controller)
+		ref = appendProtoBool(ref, 7, owner.BlockOwnerDeletion)
+		meta = appendProtoMessage(meta, 13, ref)
+	}
+
+	var raw []byte
+	raw = appendProtoMessage(raw, 1, meta)
+	// the spec, which is skipped
+	raw = appendProtoMessage(raw, 2, []byte{0x0a, 0x01, 'x'})
+
+	var unknown []byte
+	unknown = appendProtoMessage(unknown, 1, typeMeta)
+	unknown = appendProtoMessage(unknown, 2, raw)
+	unknown = appendProtoString(unknown, 4, "application/vnd.kubernetes.protobuf")
+	return string(protobufPrefix) + string(unknown)
+}
+
+func TestDecodeJSONObjectMeta(t *testing.T) {
+	meta, err := decodeObjectMeta([]byte(`{"apiVersion":"argoproj.io/v1alpha1","kind":"Application","metadata":{"name":"app",
+		"namespace":"gitops","uid":"u1","ownerReferences":[{"apiVersion":"argoproj.io/v1alpha1","kind":"ApplicationSet",
+		"name":"set","uid":"u0","controller":true}]},"spec":{}}`))
+	require.NoError(t, err)
+	require.Equal(t, objectMeta{
+		APIVersion: "argoproj.io/v1alpha1",
+		Kind:       "Application",
+		Name:       "app",
+		Namespace:  "gitops",
+		UID:        "u1",
+		OwnerReferences: []ownerReference{
+			{APIVersion: "argoproj.io/v1alpha1", Kind: "ApplicationSet", Name: "set", UID: "u0", Controller: true},
+		},
+	}, meta)
+}
+
+func TestDecodeProtobufObjectMeta(t *testing.T) {
+	owner := ownerReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web-5d8f", UID: "rs-uid", Controller: true, BlockOwnerDeletion: true}
+	meta, err := decodeObjectMeta([]byte(protobufObject("v1", "Pod", "default", "web-5d8f-abc", "pod-uid", owner)))
+	require.NoError(t, err)
+	require.Equal(t, objectMeta{
+		APIVersion:      "v1",
+		Kind:            "Pod",
+		Name:            "web-5d8f-abc",
+		Namespace:       "default",
+		UID:             "pod-uid",
+		OwnerReferences: []ownerReference{owner},
+	}, meta)
+}
+
+func TestDecodeObjectMetaRejectsOtherValues(t *testing.T) {
+	for _, value := range []string{"", "b", "/registry/leases/kube-system/x", "[1,2]"} {
+		_, err := decodeObjectMeta([]byte(value))
+		require.Error(t, err, value)
+	}
+
+	_, err := decodeObjectMeta(append(append([]byte{}, protobufPrefix...), 0x0a, 0xff))
+	require.Error(t, err)
+}
+
+func TestDecodeProtobufObjectMetaTimes(t *testing.T) {
+	created := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	var applied []byte
+	applied = appendProtoString(applied, 1, "kubectl")
+	applied = appendProtoTime(applied, 4, created.Add(time.Minute))
+
+	var status []byte
+	status = appendProtoString(status, 1, "operator")
+	status = appendProtoTime(status, 4, created.Add(time.Hour))
+	status = appendProtoString(status, 8, "status")
+
+	var meta []byte
+	meta = appendProtoString(meta, 1, "settings")
+	meta = appendProtoTime(meta, 8, created)
+	meta = appendProtoMessage(meta, 17, status)
+	meta = appendProtoMessage(meta, 17, applied)
+
+	var typeMeta []byte
+	typeMeta = appendProtoString(typeMeta, 1, "v1")
+	typeMeta = appendProtoString(typeMeta, 2, "ConfigMap")
+
+	var raw []byte
+	raw = appendProtoMessage(raw, 1, meta)
+
+	var unknown []byte
+	unknown = appendProtoMessage(unknown, 1, typeMeta)
+	unknown = appendProtoMessage(unknown, 2, raw)
+
+	decoded, err := decodeObjectMeta(append(append([]byte{}, protobufPrefix...), unknown...))
+	require.NoError(t, err)
+	require.Equal(t, created, decoded.CreationTimestamp)
+	require.Equal(t, created.Add(time.Hour), decoded.ManagedFieldsTime)
+	// the latest entry wrote the revision, not the last one
+	require.Equal(t, "operator", decoded.FieldManager)
+	require.Equal(t, "status", decoded.FieldSubresource)
+}
@@ -0,0 +1,151 @@
+package etcdsnapshot
+
+import (
+	"time"
+
+	. "github.com/cube2222/octosql/execution"
+	"github.com/cube2222/octosql/octosql"
+	"github.com/cube2222/octosql/physical"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+// ownersSchemaFields is the schema of "?table=owners", one row per owner reference of the latest revision of
+// every object in the snapshot
+func ownersSchemaFields() []physical.SchemaField {
+	return []physical.SchemaField{
+		{
+			// the key of the owned object
+			Name: "key",
+			Type: octosql.String,
+		},
+		{
+			Name: "namespace",
+			Type: octosql.TypeSum(octosql.Null, octosql.String),
+		},
+		{
+			Name: "kind",
+			Type: octosql.String,
+		},
+		{
+			Name: "name",
+			Type: octosql.String,
+		},
+		{
+			Name: "uid",
+			Type: octosql.String,
+		},
+		{
+			Name: "ownerApiVersion",
+			Type: octosql.String,
+		},
+		{
+			Name: "ownerKind",
+			Type: octosql.String,
+		},
+		{
+			Name: "ownerName",
+			Type: octosql.String,
+		},
+		{
+			Name: "ownerUid",
+			Type: octosql.String,
+		},
+		{
+			// whether the owner is the managing controller of the object
+			Name: "controller",
+			Type: octosql.Boolean,
+		},
+		{
+			Name: "blockOwnerDeletion",
+			Type: octosql.Boolean,
+		},
+		{
+			// the key of the owner, NULL when it isn't in the snapshot
+			Name: "ownerKey",
+			Type: octosql.TypeSum(octosql.Null, octosql.String),
+		},
+		{
+			// true when no object with the owner uid exists in the snapshot
+			Name: "dangling",
+			Type: octosql.Boolean,
+		},
+	}
+}
+
+type ownedObject struct {
+	key  string
+	meta objectMeta
+}
+
+func produceOwnersFromBackend(ctx ExecutionContext, produce ProduceFn, etcdBackend *snapshotBackend, fieldIndices []int, decrypter *decrypter) error {
+	// the owners have to be known before the edges can be flagged, so all objects are collected first
+	keysByUid := make(map[string]string)
+	var owned []ownedObject
+	skipped := 0
+	err := etcdBackend.forEachLatest(ctx, func(kv mvccpb.KeyValue) error {
+
+		value, _, err := decrypter.decrypt(kv.Key, kv.Value)
+		if err != nil {
+			skipped++
+			return nil
+		}
+		meta, err := decodeObjectMeta(value)
+		if err != nil {
+			skipped++
+			return nil
+		}
+		if meta.UID != "" {
+			keysByUid[meta.UID] = string(kv.Key)
+		}
+		if len(meta.OwnerReferences) > 0 {
+			owned = append(owned, ownedObject{key: string(kv.Key), meta: meta})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("found objects with owners", "objects", len(owned), "skipped", skipped)
+
+	for _, object := range owned {
+		for _, ref := range object.meta.OwnerReferences {
+			ownerKey, found := keysByUid[ref.UID]
+			values := []octosql.Value{
+				octosql.NewString(object.key),
+				nullableString(object.meta.Namespace),
+				octosql.NewString(object.meta.Kind),
+				octosql.NewString(object.meta.Name),
+				octosql.NewString(object.meta.UID),
+				octosql.NewString(ref.APIVersion),
+				octosql.NewString(ref.Kind),
+				octosql.NewString(ref.Name),
+				octosql.NewString(ref.UID),
+				octosql.NewBoolean(ref.Controller),
+				octosql.NewBoolean(ref.BlockOwnerDeletion),
+				nullableString(ownerKey),
+				octosql.NewBoolean(!found),
+			}
+
+			var result []octosql.Value
+			for _, fi := range fieldIndices {
+				result = append(result, values[fi])
+			}
+
+			err := produce(ProduceFromExecutionContext(ctx), NewRecord(result, false, time.Time{}))
+			if err != nil {
+				logger.Debug("failed to produce record", "err", err)
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// nullableString maps empty strings to NULL
+func nullableString(s string) octosql.Value {
+	if s == "" {
+		return octosql.NewNull()
+	}
+	return octosql.NewString(s)
+}
@@ -0,0 +1,88 @@
+package etcdsnapshot
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cube2222/octosql/octosql"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOwnersTable(t *testing.T) {
+	deploymentOwner := ownerReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "web", UID: "deploy-uid", Controller: true, BlockOwnerDeletion: true}
+	replicaSetOwner := ownerReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web-5d8f", UID: "rs-uid", Controller: true, BlockOwnerDeletion: true}
+	goneOwner := ownerReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web-old", UID: "gone-uid", Controller: true}
+
+	path := writeTestSnapshot(t, []testRevision{
+		{key: "/registry/deployments/default/web", value: protobufObject("apps/v1", "Deployment", "default", "web", "deploy-uid")},
+		{key: "/registry/replicasets/default/web-5d8f", value: protobufObject("apps/v1", "ReplicaSet", "default", "web-5d8f", "rs-uid", deploymentOwner)},
+		{key: "/registry/pods/default/web-5d8f-abc", value: protobufObject("v1", "Pod", "default", "web-5d8f-abc", "pod-uid", replicaSetOwner)},
+		{key: "/registry/pods/default/web-old-xyz", value: protobufObject("v1", "Pod", "default", "web-old-xyz", "orphan-uid", goneOwner)},
+		{key: "/registry/example.com/widgets/default/w", value: `{"apiVersion":"example.com/v1","kind":"Widget","metadata":{"name":"w","namespace":"default","uid":"w-uid","ownerReferences":[{"apiVersion":"apps/v1","kind":"Deployment","name":"web","uid":"deploy-uid"}]}}`},
+		// deleted objects and plain values don't take part in the graph
+		{key: "/registry/pods/default/deleted", value: protobufObject("v1", "Pod", "default", "deleted", "deleted-uid", replicaSetOwner)},
+		{key: "/registry/pods/default/deleted", deleted: true},
+		{key: "/registry/masterleases/10.0.0.1", value: "plain"},
+	})
+
+	db := &Database{}
+	impl, schema, err := db.GetTable(context.Background(), path, map[string]string{"table": "owners"})
+	require.NoError(t, err)
+	require.Equal(t, 13, len(schema.Fields))
+	require.Equal(t, SchemaOwners, impl.(*etcdSnapshotDataSource).schema)
+
+	records := runDatasource(t, &DatasourceExecuting{
+		path:         path,
+		fieldIndices: []int{0, 2, 6, 8, 9, 11, 12},
+		schema:       SchemaOwners,
+	})
+
+	var rows [][]octosql.Value
+	for _, record := range records {
+		rows = append(rows, record.Values)
+	}
+	require.Equal(t, [][]octosql.Value{
+		{
+			octosql.NewString("/registry/example.com/widgets/default/w"),
+			octosql.NewString("Widget"),
+			octosql.NewString("Deployment"),
+			octosql.NewString("deploy-uid"),
+			octosql.NewBoolean(false),
+			octosql.NewString("/registry/deployments/default/web"),
+			octosql.NewBoolean(false),
+		},
+		{
+			octosql.NewString("/registry/pods/default/web-5d8f-abc"),
+			octosql.NewString("Pod"),
+			octosql.NewString("ReplicaSet"),
+			octosql.NewString("rs-uid"),
+			octosql.NewBoolean(true),
+			octosql.NewString("/registry/replicasets/default/web-5d8f"),
+			octosql.NewBoolean(false),
+		},
+		{
+			octosql.NewString("/registry/pods/default/web-old-xyz"),
+			octosql.NewString("Pod"),
+			octosql.NewString("ReplicaSet"),
+			octosql.NewString("gone-uid"),
+			octosql.NewBoolean(true),
+			octosql.NewNull(),
+			octosql.NewBoolean(true),
+		},
+		{
+			octosql.NewString("/registry/replicasets/default/web-5d8f"),
+			octosql.NewString("ReplicaSet"),
+			octosql.NewString("Deployment"),
+			octosql.NewString("deploy-uid"),
+			octosql.NewBoolean(true),
+			octosql.NewString("/registry/deployments/default/web"),
+			octosql.NewBoolean(false),
+		},
+	}, rows)
+}
+
+func TestUnknownTable(t *testing.T) {
+	_, _, err := Database{}.GetTable(context.Background(), "data/basic.snapshot", map[string]string{"table": "nope"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unknown table 'nope'")
+}
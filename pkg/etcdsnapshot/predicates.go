@@ -0,0 +1,60 @@
+package etcdsnapshot
+
+import (
+	"strings"
+
+	"github.com/cube2222/octosql/octosql"
+	"github.com/cube2222/octosql/physical"
+)
+
+// keyFilter is a pushed down equality predicate on one of the parsed key columns
+type keyFilter struct {
+	// column is the index into the content schema, one of the first keyColumns fields
+	column int
+	value  string
+}
+
+// keyFilterFromPredicate converts predicates of the form "column = 'constant'" on the key columns into a
+// keyFilter. Anything else is left to octosql to evaluate.
+func keyFilterFromPredicate(predicate physical.Expression, schemaFields []physical.SchemaField) (keyFilter, bool) {
+	if predicate.ExpressionType != physical.ExpressionTypeFunctionCall || predicate.FunctionCall.Name != "=" {
+		return keyFilter{}, false
+	}
+	args := predicate.FunctionCall.Arguments
+	if len(args) != 2 {
+		return keyFilter{}, false
+	}
+
+	variable, constant := args[0], args[1]
+	if variable.ExpressionType != physical.ExpressionTypeVariable {
+		variable, constant = constant, variable
+	}
+	if variable.ExpressionType != physical.ExpressionTypeVariable || !variable.Variable.IsLevel0 ||
+		constant.ExpressionType != physical.ExpressionTypeConstant || constant.Constant.Value.TypeID != octosql.TypeIDString {
+		return keyFilter{}, false
+	}
+
+	// variables may be qualified with the table alias
+	name := variable.Variable.Name
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+
+	for i := 0; i < keyColumns && i < len(schemaFields); i++ {
+		if schemaFields[i].Name == name {
+			return keyFilter{column: i, value: constant.Constant.Value.Str}, true
+		}
+	}
+	return keyFilter{}, false
+}
+
+// matchesKeyFilters checks the parsed key columns, as returned by mapKeyToOctosql, against all filters
+func matchesKeyFilters(keyValues []octosql.Value, filters []keyFilter) bool {
+	for _, f := range filters {
+		v := keyValues[f.column]
+		if v.TypeID != octosql.TypeIDString || v.Str != f.value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package etcdsnapshot
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cube2222/octosql/octosql"
+	"github.com/cube2222/octosql/physical"
+	"github.com/stretchr/testify/require"
+)
+
+func equals(name string, value octosql.Value) physical.Expression {
+	return physical.Expression{
+		ExpressionType: physical.ExpressionTypeFunctionCall,
+		FunctionCall: &physical.FunctionCall{
+			Name: "=",
+			Arguments: []physical.Expression{
+				{ExpressionType: physical.ExpressionTypeVariable, Variable: &physical.Variable{Name: name, IsLevel0: true}},
+				{ExpressionType: physical.ExpressionTypeConstant, Constant: &physical.Constant{Value: value}},
+			},
+		},
+	}
+}
+
+func contentDataSource(t *testing.T) *etcdSnapshotDataSource {
+	impl, _, err := Database{}.GetTable(context.TODO(), "data/basic.snapshot", map[string]string{})
+	require.NoError(t, err)
+	return impl.(*etcdSnapshotDataSource)
+}
+
+func TestKeyFilterFromPredicate(t *testing.T) {
+	fields := contentDataSource(t).schemaFields
+
+	filter, ok := keyFilterFromPredicate(equals("namespace", octosql.NewString("default")), fields)
+	require.True(t, ok)
+	require.Equal(t, keyFilter{column: 4, value: "default"}, filter)
+
+	filter, ok = keyFilterFromPredicate(equals("t.key", octosql.NewString("a")), fields)
+	require.True(t, ok)
+	require.Equal(t, keyFilter{column: 0, value: "a"}, filter)
+
+	// constant on the left hand side
+	swapped := equals("name", octosql.NewString("console"))
+	args := swapped.FunctionCall.Arguments
+	args[0], args[1] = args[1], args[0]
+	filter, ok = keyFilterFromPredicate(swapped, fields)
+	require.True(t, ok)
+	require.Equal(t, keyFilter{column: 5, value: "console"}, filter)
+
+	_, ok = keyFilterFromPredicate(equals("valueSize", octosql.NewString("1")), fields)
+	require.False(t, ok)
+	_, ok = keyFilterFromPredicate(equals("namespace", octosql.NewInt(1)), fields)
+	require.False(t, ok)
+
+	notEqual := equals("namespace", octosql.NewString("default"))
+	notEqual.FunctionCall.Name = "!="
+	_, ok = keyFilterFromPredicate(notEqual, fields)
+	require.False(t, ok)
+}
+
+func TestPushDownKeyPredicates(t *testing.T) {
+	ds := contentDataSource(t)
+	namespace := equals("namespace", octosql.NewString("default"))
+	size := equals("valueSize", octosql.NewInt(1))
+
+	rejected, pushedDown, changed := ds.PushDownPredicates([]physical.Expression{namespace, size}, []physical.Expression{})
+	require.True(t, changed)
+	require.Equal(t, []physical.Expression{size}, rejected)
+	require.Equal(t, []physical.Expression{namespace}, pushedDown)
+
+	rejected, pushedDown, changed = ds.PushDownPredicates(rejected, pushedDown)
+	require.False(t, changed)
+	require.Equal(t, []physical.Expression{size}, rejected)
+	require.Equal(t, []physical.Expression{namespace}, pushedDown)
+}
+
+func TestPushedDownKeyFiltersApply(t *testing.T) {
+	for _, cfg := range []Config{{}, {Index: true, IndexDir: t.TempDir()}} {
+		records := runDatasource(t, &DatasourceExecuting{
+			path:         copySnapshot(t),
+			fieldIndices: []int{0, 7},
+			config:       cfg,
+			keyFilters:   []keyFilter{{column: 0, value: "b"}},
+		})
+		require.Equal(t, 1, len(records))
+		require.Equal(t, octosql.NewString("b"), records[0].Values[0])
+	}
+}
+
+func TestMatchesKeyFilters(t *testing.T) {
+	values := mapKeyToOctosql("/kubernetes.io/pods/default/nginx")
+	require.True(t, matchesKeyFilters(values, nil))
+	require.True(t, matchesKeyFilters(values, []keyFilter{{column: 3, value: "pods"}, {column: 4, value: "default"}}))
+	require.False(t, matchesKeyFilters(values, []keyFilter{{column: 4, value: "kube-system"}}))
+	// NULL never equals a string
+	require.False(t, matchesKeyFilters(values, []keyFilter{{column: 2, value: ""}}))
+}
@@ -0,0 +1,59 @@
+package etcdsnapshot
+
+import (
+	"fmt"
+
+	. "github.com/cube2222/octosql/execution"
+	"github.com/cube2222/octosql/octosql"
+	"github.com/cube2222/octosql/physical"
+)
+
+// checkedProducer wraps produce so that every record is verified against the schema before it's passed on,
+// a producer that drifts from the declared schema fails the query instead of handing octosql values it doesn't
+// expect. fieldIndices are the selected fields, indices out of the schema have no field to check against and are
+// left out of the check.
+func checkedProducer(produce ProduceFn, fields []physical.SchemaField, fieldIndices []int) ProduceFn {
+	var selected []physical.SchemaField
+	for _, fi := range fieldIndices {
+		if fi >= 0 && fi < len(fields) {
+			selected = append(selected, fields[fi])
+		}
+	}
+
+	return func(ctx ProduceContext, record Record) error {
+		if err := checkRecord(selected, record.Values); err != nil {
+			return err
+		}
+		return produce(ctx, record)
+	}
+}
+
+// checkRecord returns an error when the values don't match the fields in number or type
+func checkRecord(fields []physical.SchemaField, values []octosql.Value) error {
+	if len(values) != len(fields) {
+		return fmt.Errorf("produced a record with %d values for %d fields", len(values), len(fields))
+	}
+	for i, field := range fields {
+		if !typeMatches(values[i], field.Type) {
+			return fmt.Errorf("produced a value of type %s for field '%s' of type %s", octosql.Type{TypeID: values[i].TypeID}, field.Name, field.Type)
+		}
+	}
+	return nil
+}
+
+// typeMatches returns true if the value can be of the type, a value matches a union if it matches any of its
+// alternatives
+func typeMatches(value octosql.Value, t octosql.Type) bool {
+	switch t.TypeID {
+	case octosql.TypeIDAny:
+		return true
+	case octosql.TypeIDUnion:
+		for _, alternative := range t.Union.Alternatives {
+			if typeMatches(value, alternative) {
+				return true
+			}
+		}
+		return false
+	}
+	return value.TypeID == t.TypeID
+}
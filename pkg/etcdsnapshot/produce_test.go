@@ -0,0 +1,118 @@
+package etcdsnapshot
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cube2222/octosql/execution"
+	"github.com/cube2222/octosql/octosql"
+	"github.com/cube2222/octosql/physical"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tjungblu/octosql-plugin-etcdsnapshot/pkg/snapshotgen"
+)
+
+func TestTypeMatches(t *testing.T) {
+	require.True(t, typeMatches(octosql.NewInt(1), octosql.Int))
+	require.False(t, typeMatches(octosql.NewFloat(1), octosql.Int))
+	require.False(t, typeMatches(octosql.NewNull(), octosql.String))
+
+	nullableString := octosql.TypeSum(octosql.Null, octosql.String)
+	require.True(t, typeMatches(octosql.NewNull(), nullableString))
+	require.True(t, typeMatches(octosql.NewString("a"), nullableString))
+	require.False(t, typeMatches(octosql.NewInt(1), nullableString))
+
+	require.True(t, typeMatches(octosql.NewTime(time.Now()), octosql.Any))
+}
+
+func TestCheckedProducer(t *testing.T) {
+	fields := []physical.SchemaField{
+		{Name: "name", Type: octosql.String},
+		{Name: "revision", Type: octosql.Int},
+	}
+	var produced []execution.Record
+	produce := checkedProducer(func(ctx execution.ProduceContext, record execution.Record) error {
+		produced = append(produced, record)
+		return nil
+	}, fields, []int{1, 99})
+
+	// the out of range index has no field and isn't checked
+	record := execution.NewRecord([]octosql.Value{octosql.NewInt(3)}, false, time.Time{})
+	require.NoError(t, produce(execution.ProduceContext{}, record))
+	require.Equal(t, []execution.Record{record}, produced)
+
+	err := produce(execution.ProduceContext{}, execution.NewRecord([]octosql.Value{octosql.NewFloat(3)}, false, time.Time{}))
+	require.ErrorContains(t, err, "for field 'revision'")
+	err = produce(execution.ProduceContext{}, execution.NewRecord([]octosql.Value{octosql.NewInt(3), octosql.NewInt(4)}, false, time.Time{}))
+	require.ErrorContains(t, err, "produced a record with 2 values for 1 fields")
+	require.Len(t, produced, 1)
+
+	// errors of the wrapped producer are passed on as they are
+	expectedErr := fmt.Errorf("produce error")
+	produce = checkedProducer(func(ctx execution.ProduceContext, record execution.Record) error {
+		return expectedErr
+	}, fields, []int{0})
+	require.Equal(t, expectedErr, produce(execution.ProduceContext{}, execution.NewRecord([]octosql.Value{octosql.NewString("a")}, false, time.Time{})))
+}
+
+func TestSchemaFieldsMatchTables(t *testing.T) {
+	db := &Database{}
+	for table, schema := range map[string]Schema{
+		"content":  SchemaContent,
+		"meta":     SchemaMeta,
+		"owners":   SchemaOwners,
+		"events":   SchemaEvents,
+		"timeline": SchemaTimeline,
+		"churn":    SchemaChurn,
+		"sizes":    SchemaSizes,
+		"tree":     SchemaTree,
+	} {
+		impl, tableSchema, err := db.GetTable(context.Background(), "data/basic.snapshot", map[string]string{"table": table})
+		require.NoError(t, err)
+		require.Equal(t, schema, impl.(*etcdSnapshotDataSource).schema, table)
+		require.Equal(t, tableSchema.Fields, schema.fields(), table)
+	}
+}
+
+// TestTablesProduceTheirSchema reads every field of every table of a generated snapshot, the values have to be
+// of the types the schema declares
+func TestTablesProduceTheirSchema(t *testing.T) {
+	cfg := snapshotgen.DefaultConfig()
+	cfg.Namespaces = 2
+	path := filepath.Join(t.TempDir(), "generated.snapshot")
+	_, err := snapshotgen.Generate(path, cfg)
+	require.NoError(t, err)
+
+	for _, schema := range []Schema{SchemaContent, SchemaMeta, SchemaOwners, SchemaEvents, SchemaTimeline, SchemaChurn, SchemaSizes, SchemaTree} {
+		fields := schema.fields()
+		var fieldIndices []int
+		for i := range fields {
+			fieldIndices = append(fieldIndices, i)
+		}
+
+		for _, index := range []bool{false, true} {
+			records := runDatasource(t, &DatasourceExecuting{
+				path:         path,
+				fieldIndices: fieldIndices,
+				schema:       schema,
+				config:       Config{Index: index, IndexDir: t.TempDir()},
+			})
+			require.NotEmpty(t, records, "schema %d", schema)
+			for _, record := range records {
+				require.NoError(t, checkRecord(fields, record.Values), "schema %d", schema)
+			}
+		}
+	}
+
+	// the content table without the value is read from the index
+	records := runDatasource(t, &DatasourceExecuting{
+		path:         path,
+		fieldIndices: []int{0, 6, 7, 8, 9, 11},
+		schema:       SchemaContent,
+		config:       Config{Index: true, IndexDir: t.TempDir()},
+	})
+	require.NotEmpty(t, records)
+}
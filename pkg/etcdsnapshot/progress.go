@@ -0,0 +1,117 @@
+package etcdsnapshot
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// ProgressMessage is the message of the log records a running scan reports its progress with
+	ProgressMessage = "scan progress"
+	// ProgressFinishedMessage is logged when a scan that reported progress is done
+	ProgressFinishedMessage = "scan finished"
+)
+
+var (
+	// progressInterval is how often a running scan logs its progress, scans that finish sooner don't log any
+	progressInterval = 2 * time.Second
+	// progressCheckEvery is the number of revisions between looking at the clock
+	progressCheckEvery int64 = 1024
+)
+
+// Progress is how far a scan of a snapshot got, it's passed to the ProgressFunc of the query's context
+type Progress struct {
+	Snapshot   string
+	Revisions  int64
+	Bytes      int64
+	TotalBytes int64
+	Percent    int
+	ETA        time.Duration
+	// Finished is set on the last report of a scan
+	Finished bool
+}
+
+// ProgressFunc receives the progress of the scans of a query, it's called from the goroutine scanning the snapshot
+type ProgressFunc func(Progress)
+
+type progressKey struct{}
+
+// WithProgress returns a context that makes the scans of the queries run with it report their progress to fn
+// instead of logging it. A nil fn discards the progress.
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// scanProgress counts the revisions and bytes a scan of the key bucket has read. The bytes are the sizes of the
+// revisions and values without the page overhead, so the total is only reached at the end of the scan and the
+// ETA is an estimate. It isn't safe for concurrent use, only the goroutine iterating the bucket calls add.
+type scanProgress struct {
+	path       string
+	totalBytes int64
+	// reporting is set if the query's context has a ProgressFunc, report then receives the progress instead of the log
+	report    ProgressFunc
+	reporting bool
+
+	start     time.Time
+	next      time.Time
+	revisions int64
+	bytes     int64
+	logged    bool
+}
+
+func newScanProgress(ctx context.Context, path string, totalBytes int64) *scanProgress {
+	now := time.Now()
+	report, reporting := ctx.Value(progressKey{}).(ProgressFunc)
+	return &scanProgress{path: path, totalBytes: totalBytes, report: report, reporting: reporting, start: now, next: now.Add(progressInterval)}
+}
+
+func (p *scanProgress) add(revision, value []byte) {
+	p.revisions++
+	p.bytes += int64(len(revision) + len(value))
+	if p.revisions%progressCheckEvery != 0 {
+		return
+	}
+	if now := time.Now(); !now.Before(p.next) {
+		p.log(now)
+		p.next = now.Add(progressInterval)
+	}
+}
+
+func (p *scanProgress) log(now time.Time) {
+	fraction := 0.0
+	if p.totalBytes > 0 {
+		fraction = float64(p.bytes) / float64(p.totalBytes)
+	}
+	// the page overhead isn't counted, only finish reports a complete scan
+	fraction = min(fraction, 0.99)
+	var eta time.Duration
+	if fraction > 0 {
+		eta = time.Duration(float64(now.Sub(p.start)) * (1 - fraction) / fraction).Round(time.Second)
+	}
+	p.logged = true
+	if p.reporting {
+		if p.report != nil {
+			p.report(Progress{Snapshot: p.path, Revisions: p.revisions, Bytes: p.bytes, TotalBytes: p.totalBytes,
+				Percent: int(fraction * 100), ETA: eta})
+		}
+		return
+	}
+	logger.Info(ProgressMessage, "snapshot", p.path, "revisions", p.revisions, "bytes", p.bytes,
+		"totalBytes", p.totalBytes, "percent", int(fraction*100), "eta", eta)
+}
+
+// finish logs the end of a scan that reported progress before
+func (p *scanProgress) finish() {
+	if !p.logged {
+		return
+	}
+	if p.reporting {
+		if p.report != nil {
+			p.report(Progress{Snapshot: p.path, Revisions: p.revisions, Bytes: p.bytes, TotalBytes: p.totalBytes,
+				Percent: 100, Finished: true})
+		}
+		return
+	}
+	logger.Info(ProgressFinishedMessage, "snapshot", p.path, "revisions", p.revisions, "bytes", p.bytes,
+		"totalBytes", p.totalBytes, "percent", 100, "duration", time.Since(p.start).Round(time.Millisecond))
+}
@@ -0,0 +1,111 @@
+package etcdsnapshot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// captureLog replaces the logger with one writing JSON records into the returned buffer
+func captureLog(t *testing.T) *bytes.Buffer {
+	previous := logger
+	t.Cleanup(func() { logger = previous })
+	var out bytes.Buffer
+	logger = slog.New(slog.NewJSONHandler(&out, nil))
+	return &out
+}
+
+func logRecords(t *testing.T, out *bytes.Buffer, msg string) []map[string]interface{} {
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var record map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		if record["msg"] == msg {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func TestScanProgress(t *testing.T) {
+	out := captureLog(t)
+	interval, checkEvery := progressInterval, progressCheckEvery
+	defer func() { progressInterval, progressCheckEvery = interval, checkEvery }()
+	progressInterval, progressCheckEvery = 0, 1
+
+	etcdBackend, err := openSnapshotBackend("data/basic.snapshot")
+	require.NoError(t, err)
+	defer etcdBackend.Close()
+	require.NoError(t, etcdBackend.forEachRevision(context.Background(), func(revision, value []byte) error { return nil }))
+
+	progress := logRecords(t, out, ProgressMessage)
+	require.Len(t, progress, 3)
+	for i, record := range progress {
+		require.Equal(t, "data/basic.snapshot", record["snapshot"])
+		require.Equal(t, float64(i+1), record["revisions"])
+		require.Equal(t, float64(etcdBackend.SizeInUse()), record["totalBytes"])
+		require.Less(t, record["percent"], float64(100))
+	}
+	finished := logRecords(t, out, ProgressFinishedMessage)
+	require.Len(t, finished, 1)
+	require.Equal(t, float64(3), finished[0]["revisions"])
+	require.Equal(t, float64(100), finished[0]["percent"])
+}
+
+func TestScanProgressOfShortScans(t *testing.T) {
+	out := captureLog(t)
+
+	// nothing is logged before the interval passed
+	p := newScanProgress(context.Background(), "snapshot", 100)
+	for i := int64(0); i < progressCheckEvery; i++ {
+		p.add([]byte("rev"), []byte("value"))
+	}
+	p.finish()
+	require.Empty(t, out.String())
+	require.Equal(t, 8*progressCheckEvery, p.bytes)
+}
+
+func TestScanProgressETA(t *testing.T) {
+	out := captureLog(t)
+	p := newScanProgress(context.Background(), "snapshot", 100)
+	p.bytes = 25
+	p.log(p.start.Add(10 * time.Second))
+
+	// a quarter took 10s, the other three quarters take 30s
+	record := logRecords(t, out, ProgressMessage)[0]
+	require.Equal(t, float64(25), record["percent"])
+	require.Equal(t, float64(30*time.Second), record["eta"])
+}
+
+func TestScanProgressReportsToContext(t *testing.T) {
+	out := captureLog(t)
+	interval, checkEvery := progressInterval, progressCheckEvery
+	defer func() { progressInterval, progressCheckEvery = interval, checkEvery }()
+	progressInterval, progressCheckEvery = 0, 1
+
+	etcdBackend, err := openSnapshotBackend("data/basic.snapshot")
+	require.NoError(t, err)
+	defer etcdBackend.Close()
+	var reports []Progress
+	ctx := WithProgress(context.Background(), func(p Progress) { reports = append(reports, p) })
+	require.NoError(t, etcdBackend.forEachRevision(ctx, func(revision, value []byte) error { return nil }))
+
+	// the progress goes to the context instead of the log
+	require.Empty(t, out.String())
+	require.Len(t, reports, 4)
+	require.Equal(t, "data/basic.snapshot", reports[0].Snapshot)
+	require.Equal(t, int64(1), reports[0].Revisions)
+	require.False(t, reports[2].Finished)
+	require.Equal(t, Progress{Snapshot: "data/basic.snapshot", Revisions: 3, Bytes: reports[3].Bytes,
+		TotalBytes: etcdBackend.SizeInUse(), Percent: 100, Finished: true}, reports[3])
+
+	// a nil func discards the progress
+	require.NoError(t, etcdBackend.forEachRevision(WithProgress(context.Background(), nil), func(revision, value []byte) error { return nil }))
+	require.Empty(t, out.String())
+}
@@ -0,0 +1,224 @@
+package etcdsnapshot
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// RedactHash replaces redacted values with their HMAC-SHA256 under a random key of the process, so equal
+	// values can still be correlated within a query, but a value can't be guessed by hashing candidates
+	RedactHash = "hash"
+	// RedactLength replaces redacted values with their length only
+	RedactLength = "length"
+)
+
+// hashKey is the HMAC key of RedactHash, random per process. octosql starts the plugin once per query, so
+// hashes are only comparable within the same query.
+var hashKey = func() []byte {
+	key := make([]byte, 32)
+	// never fails since Go 1.24
+	_, _ = rand.Read(key)
+	return key
+}()
+
+// secretsPattern matches the keys of Secrets, which are always redacted unless redaction is disabled
+var secretsPattern = regexp.MustCompile(`/secrets/`)
+
+// redactor masks the data of objects whose key matches one of its patterns. Objects that can be decoded keep
+// their metadata and only lose the contents of data, stringData and binaryData, anything else is replaced as
+// a whole.
+type redactor struct {
+	patterns []*regexp.Regexp
+	mode     string
+	key      []byte
+}
+
+// newRedactor returns the redactor configured in cfg, or nil if redaction is disabled
+func newRedactor(cfg Config) (*redactor, error) {
+	if cfg.DisableRedaction {
+		return nil, nil
+	}
+
+	r := &redactor{patterns: []*regexp.Regexp{secretsPattern}, mode: RedactHash, key: hashKey}
+	switch cfg.RedactMode {
+	case "", RedactHash:
+	case RedactLength:
+		r.mode = RedactLength
+	default:
+		return nil, fmt.Errorf("invalid redactMode '%s', expected %s or %s", cfg.RedactMode, RedactHash, RedactLength)
+	}
+
+	for _, pattern := range cfg.RedactKeys {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redactKeys pattern '%s': %w", pattern, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+func (r *redactor) matches(key string) bool {
+	if r == nil {
+		return false
+	}
+	for _, re := range r.patterns {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact returns the value with its data masked and whether the key matched at all
+func (r *redactor) redact(key string, value []byte) ([]byte, bool) {
+	if !r.matches(key) {
+		return value, false
+	}
+
+	var redacted []byte
+	var err error
+	if bytes.HasPrefix(value, protobufPrefix) {
+		redacted, err = r.redactProtobuf(value)
+	} else if trimmed := bytes.TrimSpace(value); len(trimmed) > 0 && trimmed[0] == '{' {
+		redacted, err = r.redactJSON(trimmed)
+	} else {
+		err = fmt.Errorf("value is not a Kubernetes object")
+	}
+	if err != nil {
+		// never fall back to the original value
+		return []byte(r.mask(value)), true
+	}
+	return redacted, true
+}
+
+// mask returns the replacement of a single secret value
+func (r *redactor) mask(value []byte) string {
+	if r.mode == RedactLength {
+		return fmt.Sprintf("<redacted %d bytes>", len(value))
+	}
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write(value)
+	return "<redacted hmac-sha256:" + hex.EncodeToString(mac.Sum(nil)) + ">"
+}
+
+// redactedFields are the maps holding the payload of Secrets and ConfigMaps
+var redactedFields = []string{"data", "stringData", "binaryData"}
+
+func (r *redactor) redactJSON(value []byte) ([]byte, error) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(value, &object); err != nil {
+		return nil, err
+	}
+
+	for _, field := range redactedFields {
+		raw, ok := object[field]
+		if !ok {
+			continue
+		}
+
+		var data map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &data); err != nil {
+			// not a map, so we don't know what's in there
+			masked, _ := json.Marshal(r.mask(raw))
+			object[field] = masked
+			continue
+		}
+		for k, v := range data {
+			// hash the decoded string, so the hash doesn't depend on JSON escaping
+			var s string
+			if err := json.Unmarshal(v, &s); err != nil {
+				s = string(v)
+			}
+			data[k], _ = json.Marshal(r.mask([]byte(s)))
+		}
+		object[field], _ = json.Marshal(data)
+	}
+
+	return json.Marshal(object)
+}
+
+// redactProtobuf rewrites the data maps of protobuf encoded Secrets (data 2, stringData 4) and ConfigMaps
+// (data 2, binaryData 3). Other kinds don't have a known layout and are masked as a whole.
+func (r *redactor) redactProtobuf(value []byte) ([]byte, error) {
+	meta, err := decodeObjectMeta(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var mapFields map[protowire.Number]bool
+	switch meta.Kind {
+	case "Secret":
+		mapFields = map[protowire.Number]bool{2: true, 4: true}
+	case "ConfigMap":
+		mapFields = map[protowire.Number]bool{2: true, 3: true}
+	default:
+		return nil, fmt.Errorf("unknown protobuf layout of kind %s", meta.Kind)
+	}
+
+	// runtime.Unknown: the object is in field 2, everything else is kept
+	unknown, err := rewriteProtoFields(value[len(protobufPrefix):], func(f protoField) ([]byte, error) {
+		if f.num != 2 {
+			return nil, nil
+		}
+		return rewriteProtoFields(f.bytes, func(f protoField) ([]byte, error) {
+			if !mapFields[f.num] {
+				return nil, nil
+			}
+			// map entry: 1 key, 2 value
+			return rewriteProtoFields(f.bytes, func(f protoField) ([]byte, error) {
+				if f.num != 2 {
+					return nil, nil
+				}
+				return []byte(r.mask(f.bytes)), nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append([]byte{}, protobufPrefix...), unknown...), nil
+}
+
+// rewriteProtoFields copies a protobuf message and replaces the contents of the length-delimited fields for
+// which fn returns a non-nil value
+func rewriteProtoFields(b []byte, fn func(f protoField) ([]byte, error)) ([]byte, error) {
+	var out []byte
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		m := protowire.ConsumeFieldValue(num, typ, b[n:])
+		if m < 0 {
+			return nil, protowire.ParseError(m)
+		}
+		field := b[:n+m]
+		b = b[n+m:]
+
+		if typ == protowire.BytesType {
+			v, _ := protowire.ConsumeBytes(field[n:])
+			replacement, err := fn(protoField{num: num, bytes: v})
+			if err != nil {
+				return nil, err
+			}
+			if replacement != nil {
+				out = protowire.AppendTag(out, num, protowire.BytesType)
+				out = protowire.AppendBytes(out, replacement)
+				continue
+			}
+		}
+		out = append(out, field...)
+	}
+	return out, nil
+}
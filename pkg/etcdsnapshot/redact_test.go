@@ -0,0 +1,205 @@
+package etcdsnapshot
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func protobufMapEntry(key, value string) []byte {
+	var entry []byte
+	entry = appendProtoString(entry, 1, key)
+	return appendProtoString(entry, 2, value)
+}
+
+// protobufSecret encodes a v1 Secret with a data and a type field
+func protobufSecret(name string, data map[string]string) []byte {
+	var typeMeta []byte
+	typeMeta = appendProtoString(typeMeta, 1, "v1")
+	typeMeta = appendProtoString(typeMeta, 2, "Secret")
+
+	var meta []byte
+	meta = appendProtoString(meta, 1, name)
+	meta = appendProtoString(meta, 3, "default")
+
+	var raw []byte
+	raw = appendProtoMessage(raw, 1, meta)
+	for k, v := range data {
+		raw = appendProtoMessage(raw, 2, protobufMapEntry(k, v))
+	}
+	raw = appendProtoString(raw, 3, "Opaque")
+
+	var unknown []byte
+	unknown = appendProtoMessage(unknown, 1, typeMeta)
+	unknown = appendProtoMessage(unknown, 2, raw)
+	return append(append([]byte{}, protobufPrefix...), unknown...)
+}
+
+func hmacMask(s string) string {
+	mac := hmac.New(sha256.New, hashKey)
+	mac.Write([]byte(s))
+	return "<redacted hmac-sha256:" + hex.EncodeToString(mac.Sum(nil)) + ">"
+}
+
+func TestNewRedactor(t *testing.T) {
+	r, err := newRedactor(Config{})
+	require.NoError(t, err)
+	require.True(t, r.matches("/registry/secrets/default/token"))
+	require.False(t, r.matches("/registry/configmaps/default/settings"))
+
+	r, err = newRedactor(Config{RedactKeys: []string{"/configmaps/"}})
+	require.NoError(t, err)
+	require.True(t, r.matches("/registry/secrets/default/token"))
+	require.True(t, r.matches("/registry/configmaps/default/settings"))
+
+	r, err = newRedactor(Config{DisableRedaction: true})
+	require.NoError(t, err)
+	require.Nil(t, r)
+	require.False(t, r.matches("/registry/secrets/default/token"))
+
+	_, err = newRedactor(Config{RedactKeys: []string{"("}})
+	require.Error(t, err)
+	_, err = newRedactor(Config{RedactMode: "rot13"})
+	require.Error(t, err)
+}
+
+func TestRedactJSON(t *testing.T) {
+	r, err := newRedactor(Config{})
+	require.NoError(t, err)
+
+	value := []byte(`{"apiVersion":"v1","kind":"Secret","metadata":{"name":"token"},"data":{"password":"aHVudGVyMg=="},"stringData":{"user":"admin"},"type":"Opaque"}`)
+	redacted, ok := r.redact("/registry/secrets/default/token", value)
+	require.True(t, ok)
+	require.NotContains(t, string(redacted), "aHVudGVyMg==")
+	require.NotContains(t, string(redacted), "admin")
+
+	var object struct {
+		Kind       string            `json:"kind"`
+		Data       map[string]string `json:"data"`
+		StringData map[string]string `json:"stringData"`
+		Type       string            `json:"type"`
+	}
+	require.NoError(t, json.Unmarshal(redacted, &object))
+	require.Equal(t, "Secret", object.Kind)
+	require.Equal(t, "Opaque", object.Type)
+	require.Equal(t, map[string]string{"password": hmacMask("aHVudGVyMg==")}, object.Data)
+	require.Equal(t, map[string]string{"user": hmacMask("admin")}, object.StringData)
+
+	// the hash is keyed, a plain sha256 of a guessed value doesn't match it
+	sum := sha256.Sum256([]byte("admin"))
+	require.NotContains(t, string(redacted), hex.EncodeToString(sum[:]))
+
+	// keys that don't match are returned untouched
+	unchanged, ok := r.redact("/registry/configmaps/default/settings", value)
+	require.False(t, ok)
+	require.Equal(t, value, unchanged)
+}
+
+func TestRedactLengthMode(t *testing.T) {
+	r, err := newRedactor(Config{RedactMode: RedactLength, RedactKeys: []string{"/configmaps/"}})
+	require.NoError(t, err)
+
+	redacted, ok := r.redact("/registry/configmaps/default/settings", []byte(`{"kind":"ConfigMap","data":{"config.yaml":"a: b"}}`))
+	require.True(t, ok)
+	require.JSONEq(t, `{"kind":"ConfigMap","data":{"config.yaml":"<redacted 4 bytes>"}}`, string(redacted))
+}
+
+func TestRedactProtobufSecret(t *testing.T) {
+	r, err := newRedactor(Config{})
+	require.NoError(t, err)
+
+	redacted, ok := r.redact("/registry/secrets/default/token", protobufSecret("token", map[string]string{"password": "hunter2"}))
+	require.True(t, ok)
+	require.NotContains(t, string(redacted), "hunter2")
+	require.Contains(t, string(redacted), hmacMask("hunter2"))
+	require.Contains(t, string(redacted), "Opaque")
+
+	// the metadata is still readable
+	meta, err := decodeObjectMeta(redacted)
+	require.NoError(t, err)
+	require.Equal(t, "Secret", meta.Kind)
+	require.Equal(t, "token", meta.Name)
+}
+
+func TestRedactUnknownValuesAsAWhole(t *testing.T) {
+	r, err := newRedactor(Config{RedactKeys: []string{"^/custom/"}})
+	require.NoError(t, err)
+
+	redacted, ok := r.redact("/custom/value", []byte("plain secret"))
+	require.True(t, ok)
+	require.Equal(t, hmacMask("plain secret"), string(redacted))
+
+	// protobuf of an unknown kind can't be rewritten selectively
+	value := []byte(protobufObject("v1", "Pod", "default", "p", "uid"))
+	redacted, ok = r.redact("/custom/pod", value)
+	require.True(t, ok)
+	require.Equal(t, hmacMask(string(value)), string(redacted))
+}
+
+func TestRewriteProtoFieldsKeepsOtherFields(t *testing.T) {
+	var message []byte
+	message = appendProtoString(message, 1, "keep")
+	message = protowire.AppendTag(message, 2, protowire.VarintType)
+	message = protowire.AppendVarint(message, 42)
+	message = appendProtoString(message, 3, "replace")
+
+	rewritten, err := rewriteProtoFields(message, func(f protoField) ([]byte, error) {
+		if f.num == 3 {
+			return []byte(strings.ToUpper(string(f.bytes))), nil
+		}
+		return nil, nil
+	})
+	require.NoError(t, err)
+
+	var expected []byte
+	expected = appendProtoString(expected, 1, "keep")
+	expected = protowire.AppendTag(expected, 2, protowire.VarintType)
+	expected = protowire.AppendVarint(expected, 42)
+	expected = appendProtoString(expected, 3, "REPLACE")
+	require.Equal(t, expected, rewritten)
+}
+
+func TestContentRedactsSecrets(t *testing.T) {
+	path := writeTestSnapshot(t, []testRevision{
+		{key: "/registry/secrets/default/token", value: `{"kind":"Secret","data":{"password":"aHVudGVyMg=="}}`},
+		{key: "/registry/configmaps/default/settings", value: `{"kind":"ConfigMap","data":{"a":"b"}}`},
+	})
+
+	records := runDatasource(t, &DatasourceExecuting{path: path, fieldIndices: []int{0, 10, 11}})
+	require.Equal(t, 2, len(records))
+	require.NotContains(t, records[0].Values[1].Str, "aHVudGVyMg==")
+	require.Equal(t, len(`{"kind":"Secret","data":{"password":"aHVudGVyMg=="}}`), records[0].Values[2].Int)
+	require.Equal(t, `{"kind":"ConfigMap","data":{"a":"b"}}`, records[1].Values[1].Str)
+
+	records = runDatasource(t, &DatasourceExecuting{path: path, fieldIndices: []int{0, 10}, config: Config{DisableRedaction: true}})
+	require.Equal(t, `{"kind":"Secret","data":{"password":"aHVudGVyMg=="}}`, records[0].Values[1].Str)
+}
+
+func TestContentBase64Values(t *testing.T) {
+	path := writeTestSnapshot(t, []testRevision{
+		{key: "/registry/secrets/default/token", value: `{"kind":"Secret","data":{"password":"aHVudGVyMg=="}}`},
+		{key: "/registry/configmaps/default/settings", value: "k8s\x00\xff\xfe"},
+	})
+
+	config, err := Config{}.withTableOptions(map[string]string{"value": "base64"})
+	require.NoError(t, err)
+	records := runDatasource(t, &DatasourceExecuting{path: path, fieldIndices: []int{0, 10}, config: config})
+	require.Equal(t, 2, len(records))
+
+	// secrets are still redacted, values that aren't valid UTF-8 are kept
+	secret, err := base64.StdEncoding.DecodeString(records[0].Values[1].Str)
+	require.NoError(t, err)
+	require.Contains(t, string(secret), "redacted hmac-sha256:")
+	require.NotContains(t, string(secret), "aHVudGVyMg==")
+	require.Equal(t, base64.StdEncoding.EncodeToString([]byte("k8s\x00\xff\xfe")), records[1].Values[1].Str)
+
+	_, err = Config{}.withTableOptions(map[string]string{"value": "hex"})
+	require.ErrorContains(t, err, "invalid value for option 'value'")
+}
@@ -0,0 +1,137 @@
+package etcdsnapshot
+
+import (
+	"context"
+	"sync"
+
+	"github.com/cube2222/octosql/octosql"
+)
+
+// scanChunkSize is the number of revisions a worker decodes at once
+const scanChunkSize = 1024
+
+// revisionDecoder turns the raw value of a revision into a row, ok is false when the row is filtered out
+type revisionDecoder func(value []byte) (row []octosql.Value, ok bool, err error)
+
+type scanChunk struct {
+	seq    int
+	values [][]byte
+	rows   [][]octosql.Value
+	err    error
+}
+
+// scanParallel decodes the key bucket with a pool of workers and hands the rows to emit on the calling
+// goroutine. The bucket is read in chunks, at most twice as many chunks as workers are in flight, so a slow
+// emit holds back the reader instead of buffering the whole snapshot. With ordered set, rows are emitted in
+// revision order, otherwise chunks are emitted as soon as they're decoded.
+func scanParallel(ctx context.Context, etcdBackend *snapshotBackend, workers int, ordered bool, decode revisionDecoder, emit func(row []octosql.Value) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+
+	// a slot is taken for every chunk read and given back once the chunk is emitted
+	slots := make(chan struct{}, 2*workers)
+	jobs := make(chan *scanChunk)
+	results := make(chan *scanChunk)
+
+	var readErr error
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		defer close(results)
+
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				scanWorker(ctx, jobs, results, decode)
+			}()
+		}
+
+		// the values point into the mmap of the database and are only valid while the transaction is open,
+		// so the transaction only ends after all workers are done with them
+		readErr = etcdBackend.forEachChunk(ctx, scanChunkSize, func(seq int, values [][]byte) error {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return checkContext(ctx)
+			}
+			select {
+			case jobs <- &scanChunk{seq: seq, values: values}:
+				return nil
+			case <-ctx.Done():
+				return checkContext(ctx)
+			}
+		}, func() {
+			close(jobs)
+			wg.Wait()
+		})
+	}()
+
+	// stop the reader and workers and wait for the transaction to close before returning
+	defer func() {
+		cancel()
+		<-readerDone
+	}()
+
+	pending := make(map[int]*scanChunk)
+	next := 0
+	emitChunk := func(chunk *scanChunk) error {
+		if chunk.err != nil {
+			return chunk.err
+		}
+		for _, row := range chunk.rows {
+			if err := emit(row); err != nil {
+				return err
+			}
+		}
+		<-slots
+		return checkContext(ctx)
+	}
+
+	for chunk := range results {
+		if !ordered {
+			if err := emitChunk(chunk); err != nil {
+				return err
+			}
+			continue
+		}
+
+		pending[chunk.seq] = chunk
+		for pending[next] != nil {
+			chunk := pending[next]
+			delete(pending, next)
+			next++
+			if err := emitChunk(chunk); err != nil {
+				return err
+			}
+		}
+	}
+
+	<-readerDone
+	if readErr != nil {
+		return readErr
+	}
+	return checkContext(ctx)
+}
+
+func scanWorker(ctx context.Context, jobs <-chan *scanChunk, results chan<- *scanChunk, decode revisionDecoder) {
+	for chunk := range jobs {
+		for _, value := range chunk.values {
+			row, ok, err := decode(value)
+			if err != nil {
+				chunk.err = err
+				break
+			}
+			if ok {
+				chunk.rows = append(chunk.rows, row)
+			}
+		}
+		chunk.values = nil
+
+		select {
+		case results <- chunk:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
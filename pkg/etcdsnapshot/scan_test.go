@@ -0,0 +1,227 @@
+package etcdsnapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/cube2222/octosql/execution"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/server/v3/mvcc/buckets"
+
+	"github.com/tjungblu/octosql-plugin-etcdsnapshot/pkg/snapshotgen"
+)
+
+// writeSyntheticSnapshot creates a database with the given number of revisions spread over pods in a few namespaces
+func writeSyntheticSnapshot(tb testing.TB, revisions int) string {
+	path := filepath.Join(tb.TempDir(), "synthetic.snapshot")
+	db, err := bolt.Open(path, 0600, nil)
+	require.NoError(tb, err)
+	defer db.Close()
+
+	value := make([]byte, 512)
+	for i := range value {
+		value[i] = 'x'
+	}
+
+	for start := 0; start < revisions; start += 10000 {
+		err = db.Update(func(tx *bolt.Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists(buckets.Key.Name())
+			if err != nil {
+				return err
+			}
+			for rev := start + 1; rev <= start+10000 && rev <= revisions; rev++ {
+				kv := mvccpb.KeyValue{
+					Key:            []byte(fmt.Sprintf("/kubernetes.io/pods/ns-%d/pod-%d", rev%10, rev%1000)),
+					CreateRevision: int64(rev),
+					ModRevision:    int64(rev),
+					Version:        1,
+					Value:          value,
+				}
+				data, err := kv.Marshal()
+				if err != nil {
+					return err
+				}
+				if err := bucket.Put(revToBytes(int64(rev), 0), data); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		require.NoError(tb, err)
+	}
+	return path
+}
+
+func scanModRevisions(t *testing.T, path string, workers int, ordered bool) []int {
+	records := runDatasource(t, &DatasourceExecuting{
+		path:         path,
+		fieldIndices: []int{7},
+		config:       Config{ScanWorkers: workers},
+		unordered:    !ordered,
+	})
+
+	var revisions []int
+	for _, record := range records {
+		revisions = append(revisions, record.Values[0].Int)
+	}
+	return revisions
+}
+
+func TestParallelScanPreservesOrder(t *testing.T) {
+	path := writeSyntheticSnapshot(t, 5*scanChunkSize+17)
+
+	sequential := scanModRevisions(t, path, 1, true)
+	require.Equal(t, 5*scanChunkSize+17, len(sequential))
+	require.True(t, sort.IntsAreSorted(sequential))
+
+	require.Equal(t, sequential, scanModRevisions(t, path, 4, true))
+
+	unordered := scanModRevisions(t, path, 4, false)
+	sort.Ints(unordered)
+	require.Equal(t, sequential, unordered)
+}
+
+func TestParallelScanAppliesKeyFilters(t *testing.T) {
+	records := runDatasource(t, &DatasourceExecuting{
+		path:         writeSyntheticSnapshot(t, 3*scanChunkSize),
+		fieldIndices: []int{4},
+		config:       Config{ScanWorkers: 4},
+		keyFilters:   []keyFilter{{column: 4, value: "ns-3"}},
+	})
+	require.Equal(t, 3*scanChunkSize/10, len(records))
+}
+
+func TestParallelScanStopsOnProduceError(t *testing.T) {
+	ds := &DatasourceExecuting{
+		path:         writeSyntheticSnapshot(t, 10*scanChunkSize),
+		fieldIndices: []int{0},
+		config:       Config{ScanWorkers: 4},
+	}
+
+	produceErr := errors.New("produce error")
+	produced := 0
+	err := ds.Run(execution.ExecutionContext{Context: context.TODO()},
+		func(ctx execution.ProduceContext, record execution.Record) error {
+			produced++
+			if produced == 10 {
+				return produceErr
+			}
+			return nil
+		}, nil)
+	require.ErrorIs(t, err, produceErr)
+	require.Equal(t, 10, produced)
+}
+
+func TestParallelScanHonorsCancellation(t *testing.T) {
+	ds := &DatasourceExecuting{
+		path:         writeSyntheticSnapshot(t, 10*scanChunkSize),
+		fieldIndices: []int{0},
+		config:       Config{ScanWorkers: 4},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	produced := 0
+	err := ds.Run(execution.ExecutionContext{Context: ctx},
+		func(ctx execution.ProduceContext, record execution.Record) error {
+			produced++
+			if produced == 1 {
+				cancel()
+			}
+			return nil
+		}, nil)
+	require.ErrorIs(t, err, context.Canceled)
+	// the chunk in progress is finished, but no further chunks are produced
+	require.LessOrEqual(t, produced, scanChunkSize)
+}
+
+func TestConfigWithTableOptions(t *testing.T) {
+	cfg, err := Config{}.withTableOptions(map[string]string{"index": "true", "workers": "3"})
+	require.NoError(t, err)
+	require.Equal(t, Config{Index: true, ScanWorkers: 3}, cfg)
+	require.Equal(t, 3, cfg.scanWorkers())
+
+	_, err = Config{}.withTableOptions(map[string]string{"workers": "0"})
+	require.Error(t, err)
+	_, err = Config{}.withTableOptions(map[string]string{"index": "maybe"})
+	require.Error(t, err)
+}
+
+func benchmarkContentScan(b *testing.B, workers int, ordered bool) {
+	path := writeSyntheticSnapshot(b, 200000)
+	ds := &DatasourceExecuting{
+		path:         path,
+		fieldIndices: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+		config:       Config{ScanWorkers: workers},
+		unordered:    !ordered,
+	}
+	produce := func(ctx execution.ProduceContext, record execution.Record) error { return nil }
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		require.NoError(b, ds.Run(execution.ExecutionContext{Context: context.Background()}, produce, nil))
+	}
+}
+
+func BenchmarkContentScanSequential(b *testing.B) { benchmarkContentScan(b, 1, true) }
+func BenchmarkContentScanParallel(b *testing.B)   { benchmarkContentScan(b, 0, true) }
+func BenchmarkContentScanUnordered(b *testing.B)  { benchmarkContentScan(b, 0, false) }
+
+// generateBenchmarkSnapshot generates a Kubernetes-shaped snapshot of 200 namespaces with the default resource mix,
+// compacted at the given revision unless it is zero
+func generateBenchmarkSnapshot(b *testing.B, name string, compactRevision int64) (string, *snapshotgen.Result) {
+	cfg := snapshotgen.DefaultConfig()
+	cfg.Namespaces = 200
+	cfg.CompactRevision = compactRevision
+	path := filepath.Join(b.TempDir(), name)
+	result, err := snapshotgen.Generate(path, cfg)
+	require.NoError(b, err)
+	return path, result
+}
+
+func benchmarkGenerated(b *testing.B, schema Schema, fieldIndices []int) {
+	path, _ := generateBenchmarkSnapshot(b, "generated.snapshot", 0)
+	ds := &DatasourceExecuting{
+		path:         path,
+		fieldIndices: fieldIndices,
+		schema:       schema,
+	}
+	produce := func(ctx execution.ProduceContext, record execution.Record) error { return nil }
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		require.NoError(b, ds.Run(execution.ExecutionContext{Context: context.Background()}, produce, nil))
+	}
+}
+
+func BenchmarkContentScanGenerated(b *testing.B) {
+	benchmarkGenerated(b, SchemaContent, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11})
+}
+func BenchmarkMetaGenerated(b *testing.B)   { benchmarkGenerated(b, SchemaMeta, []int{0, 5, 6, 7}) }
+func BenchmarkOwnersGenerated(b *testing.B) { benchmarkGenerated(b, SchemaOwners, []int{0, 11, 12}) }
+
+// BenchmarkDiffGenerated reads both sides of a diff like the queries of the engine's CompareSnapshots, the key,
+// createRevision and modRevision of a snapshot and of the same snapshot compacted at its highest revision
+func BenchmarkDiffGenerated(b *testing.B) {
+	full, result := generateBenchmarkSnapshot(b, "full.snapshot", 0)
+	compacted, _ := generateBenchmarkSnapshot(b, "compacted.snapshot", result.MaxRevision)
+
+	var rows int
+	produce := func(ctx execution.ProduceContext, record execution.Record) error {
+		rows++
+		return nil
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, path := range []string{full, compacted} {
+			ds := &DatasourceExecuting{path: path, fieldIndices: []int{0, 6, 7}}
+			require.NoError(b, ds.Run(execution.ExecutionContext{Context: context.Background()}, produce, nil))
+		}
+	}
+	b.ReportMetric(float64(rows)/float64(b.N), "rows/op")
+}
@@ -0,0 +1,228 @@
+package etcdsnapshot
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"time"
+
+	. "github.com/cube2222/octosql/execution"
+	"github.com/cube2222/octosql/octosql"
+	"github.com/cube2222/octosql/physical"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+const (
+	// SizesLatest are the revisions that are the current value of a key, SizesHistorical the ones replaced by a
+	// later revision or a deletion, they're what a compaction reclaims
+	SizesLatest     = "latest"
+	SizesHistorical = "historical"
+)
+
+// sizesSchemaFields is the schema of "?table=sizes", a log-scale histogram of value sizes per resource type and
+// for latest and historical revisions separately, one row per non-empty bucket. The group columns are repeated
+// on every bucket of the group.
+func sizesSchemaFields() []physical.SchemaField {
+	return []physical.SchemaField{
+		{
+			Name: "resourceType",
+			Type: octosql.TypeSum(octosql.Null, octosql.String),
+		},
+		{
+			// latest or historical
+			Name: "revisions",
+			Type: octosql.String,
+		},
+		{
+			// the buckets are powers of two, bucketMin is the smallest value size in the bucket
+			Name: "bucketMin",
+			Type: octosql.Int,
+		},
+		{
+			// exclusive, the next bucket starts at bucketMax
+			Name: "bucketMax",
+			Type: octosql.Int,
+		},
+		{
+			Name: "count",
+			Type: octosql.Int,
+		},
+		{
+			Name: "bytes",
+			Type: octosql.Int,
+		},
+		{
+			// fraction of the group's bytes in the bucket
+			Name: "byteShare",
+			Type: octosql.Float,
+		},
+		{
+			Name: "groupCount",
+			Type: octosql.Int,
+		},
+		{
+			Name: "groupBytes",
+			Type: octosql.Int,
+		},
+		{
+			Name: "p50",
+			Type: octosql.Int,
+		},
+		{
+			Name: "p90",
+			Type: octosql.Int,
+		},
+		{
+			Name: "p99",
+			Type: octosql.Int,
+		},
+		{
+			Name: "max",
+			Type: octosql.Int,
+		},
+	}
+}
+
+type sizeGroupKey struct {
+	resourceType string
+	latest       bool
+}
+
+type sizeGroup struct {
+	sizeGroupKey
+	sizes []int
+	bytes int
+}
+
+// sizeBucket returns the power of two bucket of a value size, empty values have a bucket of their own
+func sizeBucket(size int) (int, int) {
+	if size == 0 {
+		return 0, 1
+	}
+	upper := 1 << bits.Len(uint(size))
+	return upper / 2, upper
+}
+
+// percentile returns the nearest-rank percentile of sorted sizes
+func percentile(sorted []int, p float64) int {
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// latestSize is the current revision of a key, it becomes historical with the next revision or deletion of the key
+type latestSize struct {
+	resourceType string
+	size         int
+}
+
+func produceSizesFromBackend(ctx ExecutionContext, produce ProduceFn, etcdBackend *snapshotBackend, fieldIndices []int) error {
+	groups := make(map[sizeGroupKey]*sizeGroup)
+	add := func(resourceType string, latest bool, size int) {
+		groupKey := sizeGroupKey{resourceType: resourceType, latest: latest}
+		g, ok := groups[groupKey]
+		if !ok {
+			g = &sizeGroup{sizeGroupKey: groupKey}
+			groups[groupKey] = g
+		}
+		g.sizes = append(g.sizes, size)
+		g.bytes += size
+	}
+
+	latest := make(map[string]latestSize)
+	revisions := 0
+	err := etcdBackend.forEachRevision(ctx, func(revision, val []byte) error {
+		// not reused, Unmarshal keeps the value of the previous revision when the value is empty
+		kv := mvccpb.KeyValue{}
+		if err := kv.Unmarshal(val); err != nil {
+			return fmt.Errorf("failed to unmarshal value: %w", err)
+		}
+
+		key := string(kv.Key)
+		if previous, ok := latest[key]; ok {
+			add(previous.resourceType, false, previous.size)
+		}
+		// deletions have no value, they only end the history of the key
+		if isTombstone(revision) {
+			delete(latest, key)
+			return nil
+		}
+		latest[key] = latestSize{resourceType: mapKeyToOctosql(key)[3].Str, size: len(kv.Value)}
+		revisions++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, l := range latest {
+		add(l.resourceType, true, l.size)
+	}
+
+	sorted := make([]*sizeGroup, 0, len(groups))
+	for _, g := range groups {
+		sorted = append(sorted, g)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.bytes != b.bytes {
+			return a.bytes > b.bytes
+		}
+		if a.resourceType != b.resourceType {
+			return a.resourceType < b.resourceType
+		}
+		return a.latest && !b.latest
+	})
+	logger.Info("found size groups", "revisions", revisions, "groups", len(sorted))
+
+	for _, g := range sorted {
+		sort.Ints(g.sizes)
+		revisionsOf := SizesHistorical
+		if g.latest {
+			revisionsOf = SizesLatest
+		}
+
+		for start := 0; start < len(g.sizes); {
+			bucketMin, bucketMax := sizeBucket(g.sizes[start])
+			count, bytes := 0, 0
+			for ; start < len(g.sizes) && g.sizes[start] < bucketMax; start++ {
+				count++
+				bytes += g.sizes[start]
+			}
+			byteShare := 0.0
+			if g.bytes > 0 {
+				byteShare = float64(bytes) / float64(g.bytes)
+			}
+
+			values := []octosql.Value{
+				nullableString(g.resourceType),
+				octosql.NewString(revisionsOf),
+				octosql.NewInt(bucketMin),
+				octosql.NewInt(bucketMax),
+				octosql.NewInt(count),
+				octosql.NewInt(bytes),
+				octosql.NewFloat(byteShare),
+				octosql.NewInt(len(g.sizes)),
+				octosql.NewInt(g.bytes),
+				octosql.NewInt(percentile(g.sizes, 0.5)),
+				octosql.NewInt(percentile(g.sizes, 0.9)),
+				octosql.NewInt(percentile(g.sizes, 0.99)),
+				octosql.NewInt(g.sizes[len(g.sizes)-1]),
+			}
+
+			var result []octosql.Value
+			for _, fi := range fieldIndices {
+				result = append(result, values[fi])
+			}
+
+			err := produce(ProduceFromExecutionContext(ctx), NewRecord(result, false, time.Time{}))
+			if err != nil {
+				logger.Debug("failed to produce record", "err", err)
+				return err
+			}
+		}
+	}
+	return nil
+}
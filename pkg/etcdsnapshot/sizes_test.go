@@ -0,0 +1,100 @@
+package etcdsnapshot
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cube2222/octosql/octosql"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tjungblu/octosql-plugin-etcdsnapshot/pkg/snapshotgen"
+)
+
+func TestSizesTable(t *testing.T) {
+	path := writeTestSnapshot(t, []testRevision{
+		{key: "/registry/pods/default/a", value: strings.Repeat("a", 100)},
+		{key: "/registry/pods/default/b", value: strings.Repeat("b", 50)},
+		{key: "/registry/configmaps/default/settings", value: strings.Repeat("s", 1000)},
+		{key: "/registry/pods/default/a", value: strings.Repeat("a", 3000)},
+		{key: "/registry/pods/default/b", deleted: true},
+		{key: "/registry/pods/default/empty", value: ""},
+		{key: "nullrow", value: "abc"},
+	})
+
+	db := &Database{}
+	impl, schema, err := db.GetTable(context.Background(), path, map[string]string{"table": "sizes"})
+	require.NoError(t, err)
+	require.Equal(t, 13, len(schema.Fields))
+	require.Equal(t, SchemaSizes, impl.(*etcdSnapshotDataSource).schema)
+
+	records := runDatasource(t, &DatasourceExecuting{
+		path:         path,
+		fieldIndices: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+		schema:       SchemaSizes,
+	})
+
+	row := func(resourceType octosql.Value, revisions string, bucketMin, bucketMax, count, bytes int, byteShare float64, groupCount, groupBytes, p50, p90, p99, max int) []octosql.Value {
+		return []octosql.Value{
+			resourceType, octosql.NewString(revisions), octosql.NewInt(bucketMin), octosql.NewInt(bucketMax),
+			octosql.NewInt(count), octosql.NewInt(bytes), octosql.NewFloat(byteShare), octosql.NewInt(groupCount),
+			octosql.NewInt(groupBytes), octosql.NewInt(p50), octosql.NewInt(p90), octosql.NewInt(p99), octosql.NewInt(max),
+		}
+	}
+	var rows [][]octosql.Value
+	for _, record := range records {
+		rows = append(rows, record.Values)
+	}
+	// groups by bytes, buckets by size; the first revision of a and the deleted b are historical
+	require.Equal(t, [][]octosql.Value{
+		row(octosql.NewString("pods"), SizesLatest, 0, 1, 1, 0, 0, 2, 3000, 0, 3000, 3000, 3000),
+		row(octosql.NewString("pods"), SizesLatest, 2048, 4096, 1, 3000, 1, 2, 3000, 0, 3000, 3000, 3000),
+		row(octosql.NewString("configmaps"), SizesLatest, 512, 1024, 1, 1000, 1, 1, 1000, 1000, 1000, 1000, 1000),
+		row(octosql.NewString("pods"), SizesHistorical, 32, 64, 1, 50, 50.0/150, 2, 150, 50, 100, 100, 100),
+		row(octosql.NewString("pods"), SizesHistorical, 64, 128, 1, 100, 100.0/150, 2, 150, 50, 100, 100, 100),
+		row(octosql.NewNull(), SizesLatest, 2, 4, 1, 3, 1, 1, 3, 3, 3, 3, 3),
+	}, rows)
+}
+
+func TestSizeBucket(t *testing.T) {
+	for size, expected := range map[int][2]int{
+		0:    {0, 1},
+		1:    {1, 2},
+		3:    {2, 4},
+		4:    {4, 8},
+		1023: {512, 1024},
+		1024: {1024, 2048},
+	} {
+		bucketMin, bucketMax := sizeBucket(size)
+		require.Equal(t, expected, [2]int{bucketMin, bucketMax}, size)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var sizes []int
+	for i := 1; i <= 200; i++ {
+		sizes = append(sizes, i)
+	}
+	require.Equal(t, 100, percentile(sizes, 0.5))
+	require.Equal(t, 180, percentile(sizes, 0.9))
+	require.Equal(t, 198, percentile(sizes, 0.99))
+	require.Equal(t, 7, percentile([]int{7}, 0.99))
+}
+
+func TestSizesOfGeneratedSnapshot(t *testing.T) {
+	cfg := snapshotgen.DefaultConfig()
+	cfg.Namespaces = 2
+	path := filepath.Join(t.TempDir(), "generated.snapshot")
+	result, err := snapshotgen.Generate(path, cfg)
+	require.NoError(t, err)
+
+	records := runDatasource(t, &DatasourceExecuting{path: path, fieldIndices: []int{1, 4}, schema: SchemaSizes})
+	counts := make(map[string]int)
+	for _, record := range records {
+		counts[record.Values[0].Str] += record.Values[1].Int
+	}
+	// every object that isn't deleted has a latest revision, all other revisions except the deletions are historical
+	require.Equal(t, result.Objects-result.Tombstones, counts[SizesLatest])
+	require.Equal(t, result.Revisions-result.Tombstones-counts[SizesLatest], counts[SizesHistorical])
+}
@@ -3,6 +3,8 @@ package etcdsnapshot
 import (
 	"context"
 	"fmt"
+	"runtime"
+	"strconv"
 
 	"github.com/cube2222/octosql/execution"
 	"github.com/cube2222/octosql/octosql"
@@ -13,20 +15,96 @@ import (
 type Schema int
 
 const (
-	SchemaContent Schema = iota
-	SchemaMeta    Schema = iota
+	SchemaContent  Schema = iota
+	SchemaMeta     Schema = iota
+	SchemaOwners   Schema = iota
+	SchemaEvents   Schema = iota
+	SchemaTimeline Schema = iota
+	SchemaChurn    Schema = iota
+	SchemaSizes    Schema = iota
+	SchemaTree     Schema = iota
 )
 
 type etcdSnapshotDataSource struct {
 	path         string
 	schema       Schema
 	schemaFields []physical.SchemaField
+	config       Config
+	unordered    bool
 }
 
 type Config struct {
+	// Index enables the persistent index, which is built on the first query of a snapshot and lets later queries
+	// that don't select the value skip reading the database. It can also be enabled per table with "?index=true".
+	Index bool `yaml:"index"`
+	// IndexDir is where indexes are stored, by default they're placed next to the snapshot or, if that isn't
+	// writable, in the user cache directory
+	IndexDir string `yaml:"indexDir"`
+	// ScanWorkers is the number of goroutines decoding the database in parallel, it defaults to GOMAXPROCS
+	// and can be overridden per table with "?workers=N". A value of one scans sequentially.
+	ScanWorkers int `yaml:"scanWorkers"`
+	// Quota is the storage quota of the cluster in bytes, as set with --quota-backend-bytes. It can be
+	// overridden per table with "?quota=N" and defaults to etcd's 8GB.
+	Quota int64 `yaml:"quota"`
+
+	// DisableRedaction turns off the masking of Secrets and the RedactKeys, only use it for trusted local analysis
+	DisableRedaction bool `yaml:"disableRedaction"`
+	// RedactKeys are regular expressions for keys whose values are redacted in addition to "/secrets/",
+	// e.g. "/configmaps/"
+	RedactKeys []string `yaml:"redactKeys"`
+	// RedactMode is how redacted values are replaced, "hash" (default) with their HMAC-SHA256 under a random
+	// key of the process or "length" with their length only
+	RedactMode string `yaml:"redactMode"`
+
+	// EncryptionConfig is the path to the apiserver's EncryptionConfiguration, its aescbc, aesgcm and secretbox
+	// keys are used to decrypt values that were encrypted at rest
+	EncryptionConfig string `yaml:"encryptionConfig"`
+
+	// LogLevel is the level of the plugin's log, "debug", "info" (default), "warn" or "error"
+	LogLevel string `yaml:"logLevel"`
+	// LogFormat is "text" (default) or "json"
+	LogFormat string `yaml:"logFormat"`
+	// LogFile is where the log is appended to instead of stderr
+	LogFile string `yaml:"logFile"`
+
+	// quotaSource is set when the quota was given as table option
+	quotaSource string
+	// treeDepth limits the depth of the tree table, it's only set per table with "?depth=N", zero is unlimited
+	treeDepth int
+	// base64Values returns the raw bytes of the value column base64 encoded, it's only set per table with
+	// "?value=base64" and keeps protobuf values that aren't valid UTF-8
+	base64Values bool
+}
+
+const (
+	// DefaultQuota is etcd's default --quota-backend-bytes
+	DefaultQuota = int64(8 * 1024 * 1024 * 1024)
+
+	QuotaSourceDefault = "default"
+	QuotaSourceConfig  = "config"
+	QuotaSourceOption  = "option"
+)
+
+// quota returns the storage quota to report usage against and where it was configured
+func (c Config) quota() (int64, string) {
+	if c.Quota <= 0 {
+		return DefaultQuota, QuotaSourceDefault
+	}
+	if c.quotaSource != "" {
+		return c.Quota, c.quotaSource
+	}
+	return c.Quota, QuotaSourceConfig
+}
+
+func (c Config) scanWorkers() int {
+	if c.ScanWorkers > 0 {
+		return c.ScanWorkers
+	}
+	return runtime.GOMAXPROCS(0)
 }
 
 type Database struct {
+	config Config
 }
 
 func Creator(ctx context.Context, configUntyped plugins.ConfigDecoder) (physical.Database, error) {
@@ -34,7 +112,18 @@ func Creator(ctx context.Context, configUntyped plugins.ConfigDecoder) (physical
 	if err := configUntyped.Decode(&cfg); err != nil {
 		return nil, err
 	}
-	return &Database{}, nil
+	return NewDatabase(cfg)
+}
+
+// NewDatabase returns the plugin's database with the given configuration, for running queries on it in-process, see
+// the sqlengine package. It replaces the plugin's logger with the configured one like Creator does.
+func NewDatabase(config Config) (*Database, error) {
+	l, err := newLogger(config)
+	if err != nil {
+		return nil, err
+	}
+	logger = l
+	return &Database{config: config}, nil
 }
 
 func (d Database) ListTables(ctx context.Context) ([]string, error) {
@@ -42,125 +131,191 @@ func (d Database) ListTables(ctx context.Context) ([]string, error) {
 }
 
 func (d Database) GetTable(ctx context.Context, name string, options map[string]string) (physical.DatasourceImplementation, physical.Schema, error) {
-	if _, ok := options["meta"]; ok {
-		schemaFields := []physical.SchemaField{
-			// Basic storage info (indices 0-2)
-			{
-				// size of the entire database file
-				Name: "size",
-				Type: octosql.Int,
-			},
-			{
-				// how many bytes of "size" are in use
-				Name: "sizeInUse",
-				Type: octosql.Int,
-			},
-			{
-				// how much space is considered free, meaning "size - sizeInUse".
-				Name: "sizeFree",
-				Type: octosql.Int,
-			},
-
-			// Defragmentation metrics (indices 3-4)
-			{
-				Name: "fragmentationRatio",
-				Type: octosql.Float,
-			},
-			{
-				Name: "fragmentationBytes",
-				Type: octosql.Int,
-			},
-
-			// Compaction metrics (indices 5-10)
-			{
-				Name: "totalKeys",
-				Type: octosql.Int,
-			},
-			{
-				Name: "totalRevisions",
-				Type: octosql.Int,
-			},
-			{
-				Name: "maxRevision",
-				Type: octosql.Int,
-			},
-			{
-				Name: "minRevision",
-				Type: octosql.Int,
-			},
-			{
-				Name: "revisionRange",
-				Type: octosql.Int,
-			},
-			{
-				Name: "avgRevisionsPerKey",
-				Type: octosql.Float,
-			},
-
-			// Storage quota info (indices 11-14)
-			{
-				Name: "defaultQuota",
-				Type: octosql.Int,
-			},
-			{
-				Name: "quotaUsageRatio",
-				Type: octosql.Float,
-			},
-			{
-				Name: "quotaUsagePercent",
-				Type: octosql.Float,
-			},
-			{
-				Name: "quotaRemaining",
-				Type: octosql.Int,
-			},
-
-			// Value size statistics (indices 15-18)
-			{
-				Name: "totalValueSize",
-				Type: octosql.Int,
-			},
-			{
-				Name: "averageValueSize",
-				Type: octosql.Int,
-			},
-			{
-				Name: "largestValueSize",
-				Type: octosql.Int,
-			},
-			{
-				Name: "smallestValueSize",
-				Type: octosql.Int,
-			},
-
-			// Key distribution (indices 19-23)
-			{
-				Name: "keysWithMultipleRevisions",
-				Type: octosql.Int,
-			},
-			{
-				Name: "uniqueKeys",
-				Type: octosql.Int,
-			},
-			{
-				Name: "keysWithLeases",
-				Type: octosql.Int,
-			},
-			{
-				Name: "activeLeases",
-				Type: octosql.Int,
-			},
-			{
-				Name: "estimatedCompactionSavings",
-				Type: octosql.Int,
-			},
-		}
+	config, err := d.config.withTableOptions(options)
+	if err != nil {
+		return nil, physical.Schema{}, err
+	}
+	if _, err := newRedactor(config); err != nil {
+		return nil, physical.Schema{}, err
+	}
+	if _, err := newDecrypter(config); err != nil {
+		return nil, physical.Schema{}, err
+	}
+	// rows are produced in revision order unless the table is read with "?ordered=false"
+	unordered := options["ordered"] == "false"
+
+	// derived tables are selected with "?table=<name>", the meta table predates that and keeps its own option
+	switch table := options["table"]; table {
+	case "", "content", "meta":
+	case "owners":
+		schemaFields := ownersSchemaFields()
+		return &etcdSnapshotDataSource{path: name, schemaFields: schemaFields, schema: SchemaOwners, config: config},
+			physical.NewSchema(schemaFields, -1, physical.WithNoRetractions(true)), nil
+	case "events":
+		schemaFields := eventsSchemaFields()
+		return &etcdSnapshotDataSource{path: name, schemaFields: schemaFields, schema: SchemaEvents, config: config},
+			physical.NewSchema(schemaFields, -1, physical.WithNoRetractions(true)), nil
+	case "timeline":
+		schemaFields := timelineSchemaFields()
+		return &etcdSnapshotDataSource{path: name, schemaFields: schemaFields, schema: SchemaTimeline, config: config},
+			physical.NewSchema(schemaFields, -1, physical.WithNoRetractions(true)), nil
+	case "churn":
+		schemaFields := churnSchemaFields()
+		return &etcdSnapshotDataSource{path: name, schemaFields: schemaFields, schema: SchemaChurn, config: config},
+			physical.NewSchema(schemaFields, -1, physical.WithNoRetractions(true)), nil
+	case "sizes":
+		schemaFields := sizesSchemaFields()
+		return &etcdSnapshotDataSource{path: name, schemaFields: schemaFields, schema: SchemaSizes, config: config},
+			physical.NewSchema(schemaFields, -1, physical.WithNoRetractions(true)), nil
+	case "tree":
+		schemaFields := treeSchemaFields()
+		return &etcdSnapshotDataSource{path: name, schemaFields: schemaFields, schema: SchemaTree, config: config},
+			physical.NewSchema(schemaFields, -1, physical.WithNoRetractions(true)), nil
+	default:
+		return nil, physical.Schema{}, fmt.Errorf("unknown table '%s', expected one of content, meta, owners, events, timeline, churn, sizes or tree", table)
+	}
 
-		return &etcdSnapshotDataSource{path: name, schemaFields: schemaFields, schema: SchemaMeta},
+	if _, ok := options["meta"]; ok || options["table"] == "meta" {
+		schemaFields := metaSchemaFields()
+		return &etcdSnapshotDataSource{path: name, schemaFields: schemaFields, schema: SchemaMeta, config: config, unordered: unordered},
 			physical.NewSchema(schemaFields, -1, physical.WithNoRetractions(true)), nil
 	}
 
-	schemaFields := []physical.SchemaField{
+	schemaFields := contentSchemaFields()
+	return &etcdSnapshotDataSource{path: name, schemaFields: schemaFields, schema: SchemaContent, config: config, unordered: unordered}, physical.NewSchema(schemaFields, -1, physical.WithNoRetractions(true)), nil
+}
+
+// metaSchemaFields is the schema of "?meta=true" and "?table=meta", a single row of database statistics
+func metaSchemaFields() []physical.SchemaField {
+	return []physical.SchemaField{
+		// Basic storage info (indices 0-2)
+		{
+			// size of the entire database file
+			Name: "size",
+			Type: octosql.Int,
+		},
+		{
+			// how many bytes of "size" are in use
+			Name: "sizeInUse",
+			Type: octosql.Int,
+		},
+		{
+			// how much space is considered free, meaning "size - sizeInUse".
+			Name: "sizeFree",
+			Type: octosql.Int,
+		},
+
+		// Defragmentation metrics (indices 3-4)
+		{
+			Name: "fragmentationRatio",
+			Type: octosql.Float,
+		},
+		{
+			Name: "fragmentationBytes",
+			Type: octosql.Int,
+		},
+
+		// Compaction metrics (indices 5-10)
+		{
+			Name: "totalKeys",
+			Type: octosql.Int,
+		},
+		{
+			Name: "totalRevisions",
+			Type: octosql.Int,
+		},
+		{
+			Name: "maxRevision",
+			Type: octosql.Int,
+		},
+		{
+			Name: "minRevision",
+			Type: octosql.Int,
+		},
+		{
+			Name: "revisionRange",
+			Type: octosql.Int,
+		},
+		{
+			Name: "avgRevisionsPerKey",
+			Type: octosql.Float,
+		},
+
+		// Storage quota info (indices 11-14)
+		{
+			Name: "defaultQuota",
+			Type: octosql.Int,
+		},
+		{
+			Name: "quotaUsageRatio",
+			Type: octosql.Float,
+		},
+		{
+			Name: "quotaUsagePercent",
+			Type: octosql.Float,
+		},
+		{
+			Name: "quotaRemaining",
+			Type: octosql.Int,
+		},
+
+		// Value size statistics (indices 15-18)
+		{
+			Name: "totalValueSize",
+			Type: octosql.Int,
+		},
+		{
+			Name: "averageValueSize",
+			Type: octosql.Int,
+		},
+		{
+			Name: "largestValueSize",
+			Type: octosql.Int,
+		},
+		{
+			Name: "smallestValueSize",
+			Type: octosql.Int,
+		},
+
+		// Key distribution (indices 19-23)
+		{
+			Name: "keysWithMultipleRevisions",
+			Type: octosql.Int,
+		},
+		{
+			Name: "uniqueKeys",
+			Type: octosql.Int,
+		},
+		{
+			Name: "keysWithLeases",
+			Type: octosql.Int,
+		},
+		{
+			Name: "activeLeases",
+			Type: octosql.Int,
+		},
+		{
+			Name: "estimatedCompactionSavings",
+			Type: octosql.Int,
+		},
+
+		// Effective storage quota (indices 24-25)
+		{
+			// the quota the usage fields are computed against
+			Name: "quota",
+			Type: octosql.Int,
+		},
+		{
+			// where the quota came from: "default", "config" or "option"
+			Name: "quotaSource",
+			Type: octosql.String,
+		},
+	}
+}
+
+// contentSchemaFields is the schema of the default table, one row per revision
+func contentSchemaFields() []physical.SchemaField {
+	return []physical.SchemaField{
 		{
 			// that's the full key
 			Name: "key",
@@ -205,7 +360,8 @@ func (d Database) GetTable(ctx context.Context, name string, options map[string]
 			Name: "lease",
 			Type: octosql.Int,
 		},
-		// this should always be the last entry in this definition listing
+		// the positions of value and the columns after it are the *FieldIndex constants in execution.go, new
+		// columns are appended at the end
 		{
 			Name: "value",
 			Type: octosql.String,
@@ -214,16 +370,97 @@ func (d Database) GetTable(ctx context.Context, name string, options map[string]
 			Name: "valueSize",
 			Type: octosql.Int,
 		},
+		{
+			// the provider that encrypted the value at rest, e.g. "aescbc" or "identity" for plaintext
+			Name: "encryptionProvider",
+			Type: octosql.String,
+		},
+		{
+			// wall-clock time of modRevision, estimated from timestamps in the objects, see "?table=timeline"
+			Name: "estimatedModTime",
+			Type: octosql.TypeSum(octosql.Null, octosql.Time),
+		},
+		{
+			// the earliest time modRevision can have been written at according to the timestamps
+			Name: "estimatedModTimeMin",
+			Type: octosql.TypeSum(octosql.Null, octosql.Time),
+		},
+		{
+			// the latest time modRevision can have been written at according to the timestamps
+			Name: "estimatedModTimeMax",
+			Type: octosql.TypeSum(octosql.Null, octosql.Time),
+		},
 	}
+}
 
-	return &etcdSnapshotDataSource{path: name, schemaFields: schemaFields, schema: SchemaContent}, physical.NewSchema(schemaFields, -1, physical.WithNoRetractions(true)), nil
+// fields returns the schema fields of the table
+func (s Schema) fields() []physical.SchemaField {
+	switch s {
+	case SchemaContent:
+		return contentSchemaFields()
+	case SchemaMeta:
+		return metaSchemaFields()
+	case SchemaOwners:
+		return ownersSchemaFields()
+	case SchemaEvents:
+		return eventsSchemaFields()
+	case SchemaTimeline:
+		return timelineSchemaFields()
+	case SchemaChurn:
+		return churnSchemaFields()
+	case SchemaSizes:
+		return sizesSchemaFields()
+	case SchemaTree:
+		return treeSchemaFields()
+	}
+	return nil
+}
 
+// withTableOptions overrides the configuration with the options given after the table name, e.g. "?index=true"
+func (c Config) withTableOptions(options map[string]string) (Config, error) {
+	if index, ok := options["index"]; ok {
+		enabled, err := strconv.ParseBool(index)
+		if err != nil {
+			return c, fmt.Errorf("invalid value for option 'index': %w", err)
+		}
+		c.Index = enabled
+	}
+	if workers, ok := options["workers"]; ok {
+		n, err := strconv.Atoi(workers)
+		if err != nil || n < 1 {
+			return c, fmt.Errorf("invalid value for option 'workers': %s", workers)
+		}
+		c.ScanWorkers = n
+	}
+	if quota, ok := options["quota"]; ok {
+		n, err := strconv.ParseInt(quota, 10, 64)
+		if err != nil || n < 1 {
+			return c, fmt.Errorf("invalid value for option 'quota', expected a size in bytes: %s", quota)
+		}
+		c.Quota = n
+		c.quotaSource = QuotaSourceOption
+	}
+	if depth, ok := options["depth"]; ok {
+		n, err := strconv.Atoi(depth)
+		if err != nil || n < 1 {
+			return c, fmt.Errorf("invalid value for option 'depth': %s", depth)
+		}
+		c.treeDepth = n
+	}
+	if encoding, ok := options["value"]; ok {
+		switch encoding {
+		case "string":
+		case "base64":
+			c.base64Values = true
+		default:
+			return c, fmt.Errorf("invalid value for option 'value', expected string or base64: %s", encoding)
+		}
+	}
+	return c, nil
 }
 
 func (i *etcdSnapshotDataSource) Materialize(ctx context.Context, env physical.Environment, schema physical.Schema, pushedDownPredicates []physical.Expression) (execution.Node, error) {
-	fmt.Printf("etcd query predicates %v\n", pushedDownPredicates)
-	fmt.Printf("etcd query env %v\n", env)
-	fmt.Printf("etcd query schema %v\n", schema)
+	logger.Debug("materializing query", "predicates", fmt.Sprint(pushedDownPredicates), "env", fmt.Sprint(env), "schema", fmt.Sprint(schema))
 
 	var fieldIndices []int
 	// this is a silly n^2 loop, but we don't have that many columns for it to matter
@@ -236,14 +473,36 @@ func (i *etcdSnapshotDataSource) Materialize(ctx context.Context, env physical.E
 		}
 	}
 
-	fmt.Printf("etcd query resolved indices %v for schema %d\n", fieldIndices, i.schema)
+	var keyFilters []keyFilter
+	for _, predicate := range pushedDownPredicates {
+		// PushDownPredicates only accepts predicates that convert
+		filter, _ := keyFilterFromPredicate(predicate, i.schemaFields)
+		keyFilters = append(keyFilters, filter)
+	}
+
+	logger.Debug("resolved field indices", "fieldIndices", fieldIndices, "schema", int(i.schema))
 	return &DatasourceExecuting{
 		path:         i.path,
 		fieldIndices: fieldIndices,
 		schema:       i.schema,
+		config:       i.config,
+		keyFilters:   keyFilters,
+		unordered:    i.unordered,
 	}, nil
 }
 
+// PushDownPredicates accepts equality checks of the key columns against string constants, those are evaluated
+// on the parsed key before anything else is decoded, or answered from the index directly
 func (i *etcdSnapshotDataSource) PushDownPredicates(newPredicates, pushedDownPredicates []physical.Expression) (rejected, pushedDown []physical.Expression, changed bool) {
-	return newPredicates, []physical.Expression{}, false
+	rejected = []physical.Expression{}
+	pushedDown = append([]physical.Expression{}, pushedDownPredicates...)
+	for _, predicate := range newPredicates {
+		if _, ok := keyFilterFromPredicate(predicate, i.schemaFields); ok && i.schema == SchemaContent {
+			pushedDown = append(pushedDown, predicate)
+			changed = true
+		} else {
+			rejected = append(rejected, predicate)
+		}
+	}
+	return rejected, pushedDown, changed
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"testing"
 
+	"github.com/cube2222/octosql/execution"
 	"github.com/cube2222/octosql/octosql"
 	"github.com/cube2222/octosql/physical"
 	"github.com/stretchr/testify/require"
@@ -38,7 +39,7 @@ func TestDatabaseGetTableWithMetaOption(t *testing.T) {
 	require.True(t, ok)
 	require.Equal(t, "test.snapshot", etcdDS.path)
 	require.Equal(t, SchemaMeta, etcdDS.schema)
-	require.Equal(t, 24, len(etcdDS.schemaFields))
+	require.Equal(t, 26, len(etcdDS.schemaFields))
 
 	// Check first few schema fields for meta
 	expectedFields := []struct {
@@ -91,7 +92,7 @@ func TestDatabaseGetTableWithoutMetaOption(t *testing.T) {
 	require.True(t, ok)
 	require.Equal(t, "test.snapshot", etcdDS.path)
 	require.Equal(t, SchemaContent, etcdDS.schema)
-	require.Equal(t, 12, len(etcdDS.schemaFields))
+	require.Equal(t, 16, len(etcdDS.schemaFields))
 
 	// Check schema fields for content
 	expectedFields := []struct {
@@ -110,6 +111,10 @@ func TestDatabaseGetTableWithoutMetaOption(t *testing.T) {
 		{"lease", octosql.Int},
 		{"value", octosql.String},
 		{"valueSize", octosql.Int},
+		{"encryptionProvider", octosql.String},
+		{"estimatedModTime", octosql.TypeSum(octosql.Null, octosql.Time)},
+		{"estimatedModTimeMin", octosql.TypeSum(octosql.Null, octosql.Time)},
+		{"estimatedModTimeMax", octosql.TypeSum(octosql.Null, octosql.Time)},
 	}
 
 	for i, field := range etcdDS.schemaFields {
@@ -239,3 +244,56 @@ func (m *mockConfigDecoder) Decode(v interface{}) error {
 	// In real usage, this would decode the config
 	return nil
 }
+
+func TestQuotaSources(t *testing.T) {
+	quota, source := Config{}.quota()
+	require.Equal(t, DefaultQuota, quota)
+	require.Equal(t, QuotaSourceDefault, source)
+
+	quota, source = Config{Quota: 2 << 30}.quota()
+	require.Equal(t, int64(2<<30), quota)
+	require.Equal(t, QuotaSourceConfig, source)
+
+	cfg, err := Config{Quota: 2 << 30}.withTableOptions(map[string]string{"quota": "17179869184"})
+	require.NoError(t, err)
+	quota, source = cfg.quota()
+	require.Equal(t, int64(16<<30), quota)
+	require.Equal(t, QuotaSourceOption, source)
+
+	_, err = Config{}.withTableOptions(map[string]string{"quota": "8GB"})
+	require.Error(t, err)
+	_, err = Config{}.withTableOptions(map[string]string{"quota": "-1"})
+	require.Error(t, err)
+}
+
+func TestMetaQuotaFromTableOption(t *testing.T) {
+	db := &Database{config: Config{Quota: 4 << 30}}
+	impl, schema, err := db.GetTable(context.Background(), "data/basic.snapshot", map[string]string{"meta": "true", "quota": "1048576"})
+	require.NoError(t, err)
+
+	node, err := impl.Materialize(context.Background(), physical.Environment{}, schema, nil)
+	require.NoError(t, err)
+
+	var records []execution.Record
+	err = node.Run(execution.ExecutionContext{Context: context.TODO()},
+		func(ctx execution.ProduceContext, record execution.Record) error {
+			records = append(records, record)
+			return nil
+		}, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+
+	values := records[0].Values
+	size := values[0].Int
+	require.Equal(t, int(DefaultQuota), values[11].Int)
+	require.InDelta(t, float64(size)/1048576*100, values[13].Float, 1e-9)
+	require.Equal(t, 1048576-size, values[14].Int)
+	require.Equal(t, 1048576, values[24].Int)
+	require.Equal(t, QuotaSourceOption, values[25].Str)
+}
+
+func TestSelectsStats(t *testing.T) {
+	require.False(t, selectsStats([]int{0, 1, 2, 3, 4, 11, 12, 13, 14, 24, 25}))
+	require.True(t, selectsStats([]int{0, 5}))
+	require.True(t, selectsStats([]int{23}))
+}
@@ -0,0 +1,359 @@
+package etcdsnapshot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	. "github.com/cube2222/octosql/execution"
+	"github.com/cube2222/octosql/octosql"
+	"github.com/cube2222/octosql/physical"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+// timelineSchemaFields is the schema of "?table=timeline", one row per minute of estimated wall-clock time
+func timelineSchemaFields() []physical.SchemaField {
+	return []physical.SchemaField{
+		{
+			Name: "minute",
+			Type: octosql.Time,
+		},
+		{
+			Name: "firstRevision",
+			Type: octosql.Int,
+		},
+		{
+			Name: "lastRevision",
+			Type: octosql.Int,
+		},
+		{
+			// lastRevision - firstRevision + 1, which includes the revisions removed by compaction since
+			Name: "writes",
+			Type: octosql.Int,
+		},
+		{
+			Name: "writesPerSecond",
+			Type: octosql.Float,
+		},
+		{
+			// revisions of the minute still in the snapshot
+			Name: "storedRevisions",
+			Type: octosql.Int,
+		},
+		{
+			Name: "storedBytes",
+			Type: octosql.Int,
+		},
+		{
+			// timestamps found in objects of this minute, the more there are the better the estimate
+			Name: "anchors",
+			Type: octosql.Int,
+		},
+	}
+}
+
+// timeAnchor ties a revision to a timestamp found in the object written at it
+type timeAnchor struct {
+	revision int64
+	time     time.Time
+	// exact anchors were written right at their time, the others only tell that the revision was written at or
+	// after it
+	exact bool
+}
+
+// revisionTimeline maps revisions to wall-clock time by interpolating between the anchors. Revisions only
+// ever grow, so every anchor is also a lower bound for all later revisions and every exact anchor an upper
+// bound for all earlier ones.
+type revisionTimeline struct {
+	// anchors are sorted by revision, lower is the running maximum of their times
+	anchors []timeAnchor
+	lower   []time.Time
+
+	// exactRevisions and exactTimes hold one exact anchor per revision, upper is the minimum of the times from
+	// there on
+	exactRevisions []int64
+	exactTimes     []time.Time
+	upper          []time.Time
+}
+
+func newRevisionTimeline(anchors []timeAnchor) *revisionTimeline {
+	sort.Slice(anchors, func(i, j int) bool {
+		if anchors[i].revision != anchors[j].revision {
+			return anchors[i].revision < anchors[j].revision
+		}
+		return anchors[i].time.Before(anchors[j].time)
+	})
+
+	t := &revisionTimeline{anchors: anchors, lower: make([]time.Time, len(anchors))}
+	for i, a := range anchors {
+		t.lower[i] = a.time
+		if i > 0 && t.lower[i-1].After(a.time) {
+			t.lower[i] = t.lower[i-1]
+		}
+		if !a.exact {
+			continue
+		}
+		if n := len(t.exactRevisions); n > 0 && t.exactRevisions[n-1] == a.revision {
+			// anchors of the same revision are sorted by time, the latest wins
+			t.exactTimes[n-1] = a.time
+			continue
+		}
+		t.exactRevisions = append(t.exactRevisions, a.revision)
+		t.exactTimes = append(t.exactTimes, a.time)
+	}
+
+	t.upper = make([]time.Time, len(t.exactTimes))
+	for i := len(t.exactTimes) - 1; i >= 0; i-- {
+		t.upper[i] = t.exactTimes[i]
+		if i+1 < len(t.upper) && t.upper[i+1].Before(t.upper[i]) {
+			t.upper[i] = t.upper[i+1]
+		}
+	}
+	return t
+}
+
+// estimate returns the estimated wall-clock time of a revision along with its bounds, zero times are unknown
+func (t *revisionTimeline) estimate(revision int64) (estimate, lower, upper time.Time) {
+	if t == nil {
+		return
+	}
+
+	if i := sort.Search(len(t.anchors), func(i int) bool { return t.anchors[i].revision > revision }); i > 0 {
+		lower = t.lower[i-1]
+	}
+	next := sort.Search(len(t.exactRevisions), func(i int) bool { return t.exactRevisions[i] >= revision })
+	if next < len(t.exactRevisions) {
+		upper = t.upper[next]
+	}
+
+	switch {
+	case next < len(t.exactRevisions) && t.exactRevisions[next] == revision:
+		estimate = t.exactTimes[next]
+	case next > 0 && next < len(t.exactRevisions):
+		prevRevision, prevTime := t.exactRevisions[next-1], t.exactTimes[next-1]
+		nextRevision, nextTime := t.exactRevisions[next], t.exactTimes[next]
+		fraction := float64(revision-prevRevision) / float64(nextRevision-prevRevision)
+		estimate = prevTime.Add(time.Duration(fraction * float64(nextTime.Sub(prevTime))))
+	case next < len(t.exactRevisions):
+		estimate = t.exactTimes[next]
+	case next > 0:
+		estimate = t.exactTimes[next-1]
+	default:
+		estimate = lower
+	}
+
+	if !lower.IsZero() && !upper.IsZero() && upper.Before(lower) {
+		// the anchors contradict each other, e.g. because of clock skew between the clients that wrote them
+		upper = lower
+	}
+	if !lower.IsZero() && estimate.Before(lower) {
+		estimate = lower
+	}
+	if !upper.IsZero() && estimate.After(upper) {
+		estimate = upper
+	}
+	return estimate, lower, upper
+}
+
+// estimateValues returns the estimatedModTime, estimatedModTimeMin and estimatedModTimeMax columns
+func (t *revisionTimeline) estimateValues(revision int64) []octosql.Value {
+	estimate, lower, upper := t.estimate(revision)
+	return []octosql.Value{nullableTime(estimate), nullableTime(lower), nullableTime(upper)}
+}
+
+// objectAnchors returns the anchors found in the value of a revision: the creation timestamp dates the create
+// revision, event and Lease timestamps are set by the client right before writing and date the revision itself,
+// the managedFields only tell the revision isn't older than them.
+func objectAnchors(kv mvccpb.KeyValue, value []byte) []timeAnchor {
+	meta, err := decodeObjectMeta(value)
+	if err != nil {
+		return nil
+	}
+
+	var anchors []timeAnchor
+	if !meta.CreationTimestamp.IsZero() {
+		anchors = append(anchors, timeAnchor{revision: kv.CreateRevision, time: meta.CreationTimestamp, exact: true})
+	}
+	if !meta.ManagedFieldsTime.IsZero() {
+		anchors = append(anchors, timeAnchor{revision: kv.ModRevision, time: meta.ManagedFieldsTime})
+	}
+
+	var written time.Time
+	switch meta.Kind {
+	case "Event":
+		if e, err := decodeEvent(value); err == nil {
+			written = e.lastTimestamp
+		}
+	case "Lease":
+		written, _ = decodeLeaseRenewTime(value)
+	}
+	if !written.IsZero() {
+		anchors = append(anchors, timeAnchor{revision: kv.ModRevision, time: written, exact: true})
+	}
+	return anchors
+}
+
+// decodeLeaseRenewTime returns spec.renewTime of a coordination.k8s.io Lease
+func decodeLeaseRenewTime(value []byte) (time.Time, error) {
+	if !bytes.HasPrefix(value, protobufPrefix) {
+		var lease struct {
+			Spec struct {
+				RenewTime time.Time `json:"renewTime"`
+			} `json:"spec"`
+		}
+		if err := json.Unmarshal(bytes.TrimSpace(value), &lease); err != nil {
+			return time.Time{}, fmt.Errorf("failed to decode JSON lease: %w", err)
+		}
+		return lease.Spec.RenewTime, nil
+	}
+
+	_, _, raw, err := unwrapProtobuf(value[len(protobufPrefix):])
+	if err != nil {
+		return time.Time{}, err
+	}
+	var renewTime time.Time
+	// Lease: 2 spec, LeaseSpec: 4 renewTime
+	err = forEachProtoField(raw, func(f protoField) error {
+		if f.num != 2 {
+			return nil
+		}
+		return forEachProtoField(f.bytes, func(f protoField) error {
+			if f.num != 4 {
+				return nil
+			}
+			var err error
+			renewTime, err = decodeProtobufTime(f.bytes)
+			return err
+		})
+	})
+	return renewTime, err
+}
+
+// buildRevisionTimeline collects the anchors of every revision in the key bucket
+func buildRevisionTimeline(ctx context.Context, etcdBackend *snapshotBackend, decrypter *decrypter) (*revisionTimeline, error) {
+	var anchors []timeAnchor
+	kv := mvccpb.KeyValue{}
+	err := etcdBackend.forEachRevision(ctx, func(revision, val []byte) error {
+		if isTombstone(revision) {
+			return nil
+		}
+		if err := kv.Unmarshal(val); err != nil {
+			return fmt.Errorf("failed to unmarshal value: %w", err)
+		}
+		value, _, err := decrypter.decrypt(kv.Key, kv.Value)
+		if err != nil {
+			return nil
+		}
+		anchors = append(anchors, objectAnchors(kv, value)...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("found timestamps to estimate revision times from", "timestamps", len(anchors))
+	return newRevisionTimeline(anchors), nil
+}
+
+// selectsTimeline returns whether a query on the content schema needs any of the estimated time columns
+func selectsTimeline(fieldIndices []int) bool {
+	for _, fi := range fieldIndices {
+		if fi >= estimatedModTimeFieldIndex {
+			return true
+		}
+	}
+	return false
+}
+
+type timelineMinute struct {
+	minute          time.Time
+	firstRevision   int64
+	lastRevision    int64
+	storedRevisions int
+	storedBytes     int
+	anchors         int
+}
+
+func produceTimelineFromBackend(ctx ExecutionContext, produce ProduceFn, etcdBackend *snapshotBackend, timeline *revisionTimeline, fieldIndices []int) error {
+	minutes := make(map[time.Time]*timelineMinute)
+	minuteOf := func(revision int64) *timelineMinute {
+		estimate, _, _ := timeline.estimate(revision)
+		if estimate.IsZero() {
+			return nil
+		}
+		minute := estimate.Truncate(time.Minute)
+		m, ok := minutes[minute]
+		if !ok {
+			m = &timelineMinute{minute: minute, firstRevision: revision, lastRevision: revision}
+			minutes[minute] = m
+		}
+		if revision < m.firstRevision {
+			m.firstRevision = revision
+		}
+		if revision > m.lastRevision {
+			m.lastRevision = revision
+		}
+		return m
+	}
+
+	skipped := 0
+	kv := mvccpb.KeyValue{}
+	err := etcdBackend.forEachRevision(ctx, func(_, val []byte) error {
+		if err := kv.Unmarshal(val); err != nil {
+			return fmt.Errorf("failed to unmarshal value: %w", err)
+		}
+		m := minuteOf(kv.ModRevision)
+		if m == nil {
+			skipped++
+			return nil
+		}
+		m.storedRevisions++
+		m.storedBytes += len(kv.Value)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, anchor := range timeline.anchors {
+		if m := minuteOf(anchor.revision); m != nil {
+			m.anchors++
+		}
+	}
+	if skipped > 0 {
+		logger.Warn("no timestamps to estimate the time of revisions from", "revisions", skipped)
+	}
+
+	sorted := make([]*timelineMinute, 0, len(minutes))
+	for _, m := range minutes {
+		sorted = append(sorted, m)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].minute.Before(sorted[j].minute) })
+
+	for _, m := range sorted {
+		writes := m.lastRevision - m.firstRevision + 1
+		values := []octosql.Value{
+			octosql.NewTime(m.minute),
+			octosql.NewInt(int(m.firstRevision)),
+			octosql.NewInt(int(m.lastRevision)),
+			octosql.NewInt(int(writes)),
+			octosql.NewFloat(float64(writes) / 60),
+			octosql.NewInt(m.storedRevisions),
+			octosql.NewInt(m.storedBytes),
+			octosql.NewInt(m.anchors),
+		}
+
+		var result []octosql.Value
+		for _, fi := range fieldIndices {
+			result = append(result, values[fi])
+		}
+
+		err := produce(ProduceFromExecutionContext(ctx), NewRecord(result, false, time.Time{}))
+		if err != nil {
+			logger.Debug("failed to produce record", "err", err)
+			return err
+		}
+	}
+	return nil
+}
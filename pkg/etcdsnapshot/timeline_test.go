@@ -0,0 +1,131 @@
+package etcdsnapshot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cube2222/octosql/octosql"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+var timelineStart = time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+func TestRevisionTimelineEstimate(t *testing.T) {
+	timeline := newRevisionTimeline([]timeAnchor{
+		{revision: 30, time: timelineStart.Add(3 * time.Minute), exact: true},
+		{revision: 10, time: timelineStart.Add(time.Minute), exact: true},
+		// managedFields of revision 25 tell it's not older than 2:50
+		{revision: 25, time: timelineStart.Add(170 * time.Second)},
+	})
+
+	estimate, lower, upper := timeline.estimate(10)
+	require.Equal(t, timelineStart.Add(time.Minute), estimate)
+	require.Equal(t, timelineStart.Add(time.Minute), lower)
+	require.Equal(t, timelineStart.Add(time.Minute), upper)
+
+	// interpolated between 10 and 30
+	estimate, lower, upper = timeline.estimate(20)
+	require.Equal(t, timelineStart.Add(2*time.Minute), estimate)
+	require.Equal(t, timelineStart.Add(time.Minute), lower)
+	require.Equal(t, timelineStart.Add(3*time.Minute), upper)
+
+	// the interpolation would say 2:36, but 26 can't be written before 25
+	estimate, lower, _ = timeline.estimate(26)
+	require.Equal(t, timelineStart.Add(170*time.Second), lower)
+	require.Equal(t, lower, estimate)
+	estimate, _, _ = timeline.estimate(11)
+	require.Equal(t, timelineStart.Add(66*time.Second), estimate)
+
+	// before the first and after the last anchor one of the bounds is unknown
+	estimate, lower, upper = timeline.estimate(5)
+	require.Equal(t, timelineStart.Add(time.Minute), estimate)
+	require.True(t, lower.IsZero())
+	require.Equal(t, timelineStart.Add(time.Minute), upper)
+
+	estimate, lower, upper = timeline.estimate(40)
+	require.Equal(t, timelineStart.Add(3*time.Minute), estimate)
+	require.Equal(t, timelineStart.Add(3*time.Minute), lower)
+	require.True(t, upper.IsZero())
+
+	var none *revisionTimeline
+	require.Equal(t, []octosql.Value{octosql.NewNull(), octosql.NewNull(), octosql.NewNull()}, none.estimateValues(1))
+}
+
+func TestRevisionTimelineContradictingAnchors(t *testing.T) {
+	// a client with a clock running ahead wrote revision 10
+	timeline := newRevisionTimeline([]timeAnchor{
+		{revision: 10, time: timelineStart.Add(time.Hour), exact: true},
+		{revision: 20, time: timelineStart, exact: true},
+	})
+
+	estimate, lower, upper := timeline.estimate(15)
+	require.Equal(t, timelineStart.Add(time.Hour), lower)
+	require.Equal(t, lower, upper)
+	require.Equal(t, lower, estimate)
+}
+
+func TestObjectAnchors(t *testing.T) {
+	kv := mvccpb.KeyValue{Key: []byte("/registry/configmaps/default/settings"), CreateRevision: 5, ModRevision: 9}
+	anchors := objectAnchors(kv, []byte(`{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"settings",
+		"creationTimestamp":"2024-05-01T10:00:00Z","managedFields":[{"manager":"kubectl","time":"2024-05-01T10:05:00Z"},
+		{"manager":"operator","time":"2024-05-01T10:07:00Z"}]}}`))
+	require.Equal(t, []timeAnchor{
+		{revision: 5, time: timelineStart, exact: true},
+		{revision: 9, time: timelineStart.Add(7 * time.Minute)},
+	}, anchors)
+
+	kv = mvccpb.KeyValue{Key: []byte("/registry/leases/kube-system/scheduler"), CreateRevision: 2, ModRevision: 40}
+	anchors = objectAnchors(kv, []byte(`{"apiVersion":"coordination.k8s.io/v1","kind":"Lease","metadata":{"name":"scheduler"},
+		"spec":{"holderIdentity":"node-1","renewTime":"2024-05-01T10:30:00.123456Z"}}`))
+	require.Equal(t, []timeAnchor{
+		{revision: 40, time: timelineStart.Add(30*time.Minute + 123456*time.Microsecond), exact: true},
+	}, anchors)
+
+	kv = mvccpb.KeyValue{Key: []byte("/registry/events/default/web.1"), CreateRevision: 7, ModRevision: 8}
+	anchors = objectAnchors(kv, []byte(protobufCoreEvent("default", "web.1", "BackOff", "kubelet", 2, timelineStart, timelineStart.Add(time.Minute))))
+	require.Equal(t, []timeAnchor{{revision: 8, time: timelineStart.Add(time.Minute), exact: true}}, anchors)
+
+	require.Empty(t, objectAnchors(kv, []byte("plain")))
+}
+
+func TestTimelineTable(t *testing.T) {
+	event := func(name string, last time.Duration) string {
+		return protobufCoreEvent("default", name, "BackOff", "kubelet", 1, timelineStart, timelineStart.Add(last))
+	}
+	path := writeTestSnapshot(t, []testRevision{
+		{key: "/registry/events/default/a", value: event("a", 0)},
+		{key: "/registry/pods/default/p1", value: "plain"},
+		{key: "/registry/events/default/b", value: event("b", 10*time.Second)},
+		{key: "/registry/pods/default/p2", value: "plain"},
+		{key: "/registry/events/default/c", value: event("c", 2*time.Minute)},
+	})
+
+	db := &Database{}
+	_, schema, err := db.GetTable(context.Background(), path, map[string]string{"table": "timeline"})
+	require.NoError(t, err)
+	require.Equal(t, 8, len(schema.Fields))
+
+	records := runDatasource(t, &DatasourceExecuting{path: path, fieldIndices: []int{0, 1, 2, 3, 5, 7}, schema: SchemaTimeline})
+	var rows [][]octosql.Value
+	for _, record := range records {
+		rows = append(rows, record.Values)
+	}
+	// revision 5 is interpolated between 4 at 10:00:10 and 6 at 10:02:00, which puts it into 10:01
+	require.Equal(t, [][]octosql.Value{
+		{octosql.NewTime(timelineStart), octosql.NewInt(2), octosql.NewInt(4), octosql.NewInt(3), octosql.NewInt(3), octosql.NewInt(2)},
+		{octosql.NewTime(timelineStart.Add(time.Minute)), octosql.NewInt(5), octosql.NewInt(5), octosql.NewInt(1), octosql.NewInt(1), octosql.NewInt(0)},
+		{octosql.NewTime(timelineStart.Add(2 * time.Minute)), octosql.NewInt(6), octosql.NewInt(6), octosql.NewInt(1), octosql.NewInt(1), octosql.NewInt(1)},
+	}, rows)
+
+	// the content table has the same estimates per revision
+	records = runDatasource(t, &DatasourceExecuting{path: path, fieldIndices: []int{7, 13, 14, 15}})
+	require.Equal(t, 5, len(records))
+	require.Equal(t, []octosql.Value{
+		octosql.NewInt(3),
+		octosql.NewTime(timelineStart.Add(5 * time.Second)),
+		octosql.NewTime(timelineStart),
+		octosql.NewTime(timelineStart.Add(10 * time.Second)),
+	}, records[1].Values)
+}
@@ -0,0 +1,242 @@
+package etcdsnapshot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/cube2222/octosql/execution"
+	"github.com/cube2222/octosql/octosql"
+	"github.com/cube2222/octosql/physical"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+// treeRoot is the prefix of the root of the tree, all keys are below it
+const treeRoot = "/"
+
+// treeSchemaFields is the schema of "?table=tree", one row per key prefix like du, the keys are split at every
+// slash regardless of their layout
+func treeSchemaFields() []physical.SchemaField {
+	return []physical.SchemaField{
+		{
+			// "/" for the root, the prefix of a key is the key up to one of its slashes or the key itself
+			Name: "prefix",
+			Type: octosql.String,
+		},
+		{
+			// NULL for the root
+			Name: "parent",
+			Type: octosql.TypeSum(octosql.Null, octosql.String),
+		},
+		{
+			// the last segment of the prefix, empty for the root
+			Name: "segment",
+			Type: octosql.String,
+		},
+		{
+			// 0 for the root, 1 for "/registry"
+			Name: "depth",
+			Type: octosql.Int,
+		},
+		{
+			Name: "children",
+			Type: octosql.Int,
+		},
+		{
+			// true when the prefix is a key itself
+			Name: "isKey",
+			Type: octosql.Boolean,
+		},
+		{
+			// keys below the prefix that aren't deleted
+			Name: "keys",
+			Type: octosql.Int,
+		},
+		{
+			// revisions below the prefix, including deletions
+			Name: "revisions",
+			Type: octosql.Int,
+		},
+		{
+			// value sizes of the latest revisions of the keys
+			Name: "latestBytes",
+			Type: octosql.Int,
+		},
+		{
+			// value sizes of the revisions replaced or deleted since, which a compaction reclaims
+			Name: "historicalBytes",
+			Type: octosql.Int,
+		},
+		{
+			// latestBytes and historicalBytes
+			Name: "bytes",
+			Type: octosql.Int,
+		},
+	}
+}
+
+type treeNode struct {
+	prefix  string
+	parent  *treeNode
+	segment string
+	depth   int
+	isKey   bool
+
+	children        []*treeNode
+	keys            int
+	revisions       int
+	latestBytes     int
+	historicalBytes int
+}
+
+// keyTree aggregates the revisions at every prefix of their keys, up to maxDepth if it's positive
+type keyTree struct {
+	root     *treeNode
+	nodes    map[string]*treeNode
+	maxDepth int
+}
+
+func newKeyTree(maxDepth int) *keyTree {
+	root := &treeNode{prefix: treeRoot}
+	return &keyTree{root: root, nodes: map[string]*treeNode{treeRoot: root}, maxDepth: maxDepth}
+}
+
+// path returns the nodes of the prefixes of a key from the root down, creating the missing ones
+func (t *keyTree) path(key string) []*treeNode {
+	path := []*treeNode{t.root}
+	parent := t.root
+	start := 0
+	if strings.HasPrefix(key, "/") {
+		start = 1
+	}
+	for i := start; i <= len(key); i++ {
+		if i < len(key) && key[i] != '/' {
+			continue
+		}
+		if t.maxDepth > 0 && parent.depth == t.maxDepth {
+			break
+		}
+		prefix := key[:i]
+		node, ok := t.nodes[prefix]
+		if !ok {
+			node = &treeNode{prefix: prefix, parent: parent, segment: key[start:i], depth: parent.depth + 1}
+			parent.children = append(parent.children, node)
+			t.nodes[prefix] = node
+		}
+		path = append(path, node)
+		parent = node
+		start = i + 1
+	}
+	if key == treeRoot {
+		// the key "/" is the root itself
+		path = path[:1]
+	}
+	// below maxDepth the key itself isn't part of the tree
+	if last := path[len(path)-1]; last.prefix == key {
+		last.isKey = true
+	}
+	return path
+}
+
+// sortedChildren returns the children with the most bytes first
+func (n *treeNode) sortedChildren() []*treeNode {
+	sort.Slice(n.children, func(i, j int) bool {
+		a, b := n.children[i], n.children[j]
+		if a.latestBytes+a.historicalBytes != b.latestBytes+b.historicalBytes {
+			return a.latestBytes+a.historicalBytes > b.latestBytes+b.historicalBytes
+		}
+		return a.prefix < b.prefix
+	})
+	return n.children
+}
+
+// latestTreeValue is the current revision of a key, it becomes historical with the next revision or deletion
+type latestTreeValue struct {
+	path []*treeNode
+	size int
+}
+
+func produceTreeFromBackend(ctx ExecutionContext, produce ProduceFn, etcdBackend *snapshotBackend, fieldIndices []int, maxDepth int) error {
+	tree := newKeyTree(maxDepth)
+	latest := make(map[string]latestTreeValue)
+
+	err := etcdBackend.forEachRevision(ctx, func(revision, val []byte) error {
+		// not reused, Unmarshal keeps the value of the previous revision when the value is empty
+		kv := mvccpb.KeyValue{}
+		if err := kv.Unmarshal(val); err != nil {
+			return fmt.Errorf("failed to unmarshal value: %w", err)
+		}
+
+		key := string(kv.Key)
+		previous, ok := latest[key]
+		path := previous.path
+		if !ok {
+			path = tree.path(key)
+		}
+		for _, node := range path {
+			node.revisions++
+			if ok {
+				node.historicalBytes += previous.size
+			}
+		}
+
+		if isTombstone(revision) {
+			delete(latest, key)
+		} else {
+			latest[key] = latestTreeValue{path: path, size: len(kv.Value)}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, l := range latest {
+		for _, node := range l.path {
+			node.keys++
+			node.latestBytes += l.size
+		}
+	}
+	logger.Info("found key prefixes", "keys", tree.root.keys, "prefixes", len(tree.nodes))
+
+	// depth-first, so every prefix comes right after its parent
+	stack := []*treeNode{tree.root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		children := node.sortedChildren()
+		for i := len(children) - 1; i >= 0; i-- {
+			stack = append(stack, children[i])
+		}
+
+		parent := octosql.NewNull()
+		if node.parent != nil {
+			parent = octosql.NewString(node.parent.prefix)
+		}
+		values := []octosql.Value{
+			octosql.NewString(node.prefix),
+			parent,
+			octosql.NewString(node.segment),
+			octosql.NewInt(node.depth),
+			octosql.NewInt(len(node.children)),
+			octosql.NewBoolean(node.isKey),
+			octosql.NewInt(node.keys),
+			octosql.NewInt(node.revisions),
+			octosql.NewInt(node.latestBytes),
+			octosql.NewInt(node.historicalBytes),
+			octosql.NewInt(node.latestBytes + node.historicalBytes),
+		}
+
+		var result []octosql.Value
+		for _, fi := range fieldIndices {
+			result = append(result, values[fi])
+		}
+
+		err := produce(ProduceFromExecutionContext(ctx), NewRecord(result, false, time.Time{}))
+		if err != nil {
+			logger.Debug("failed to produce record", "err", err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package etcdsnapshot
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/cube2222/octosql/octosql"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tjungblu/octosql-plugin-etcdsnapshot/pkg/snapshotgen"
+)
+
+func treeTestSnapshot(t *testing.T) string {
+	return writeTestSnapshot(t, []testRevision{
+		{key: "/registry/pods/default/a", value: "aa"},
+		{key: "/registry/pods/default/a", value: "aaaa"},
+		{key: "/registry/pods/kube-system/b", value: "bbb"},
+		{key: "/registry/example.com/widgets/default/w", value: "w"},
+		{key: "/registry/pods/kube-system/b", deleted: true},
+		{key: "compact_rev_key", value: "x"},
+	})
+}
+
+// treeRow is a row of the tree table without the segment
+func treeRow(prefix string, parent octosql.Value, depth, children int, isKey bool, keys, revisions, latestBytes, historicalBytes int) []octosql.Value {
+	return []octosql.Value{
+		octosql.NewString(prefix), parent, octosql.NewInt(depth), octosql.NewInt(children), octosql.NewBoolean(isKey),
+		octosql.NewInt(keys), octosql.NewInt(revisions), octosql.NewInt(latestBytes), octosql.NewInt(historicalBytes),
+		octosql.NewInt(latestBytes + historicalBytes),
+	}
+}
+
+func treeRows(t *testing.T, path string, config Config) [][]octosql.Value {
+	records := runDatasource(t, &DatasourceExecuting{
+		path:         path,
+		fieldIndices: []int{0, 1, 3, 4, 5, 6, 7, 8, 9, 10},
+		schema:       SchemaTree,
+		config:       config,
+	})
+	var rows [][]octosql.Value
+	for _, record := range records {
+		rows = append(rows, record.Values)
+	}
+	return rows
+}
+
+func TestTreeTable(t *testing.T) {
+	path := treeTestSnapshot(t)
+
+	db := &Database{}
+	impl, schema, err := db.GetTable(context.Background(), path, map[string]string{"table": "tree"})
+	require.NoError(t, err)
+	require.Equal(t, 11, len(schema.Fields))
+	require.Equal(t, SchemaTree, impl.(*etcdSnapshotDataSource).schema)
+
+	s := octosql.NewString
+	// depth-first with the most bytes first, the deleted b only has historical bytes
+	require.Equal(t, [][]octosql.Value{
+		treeRow("/", octosql.NewNull(), 0, 2, false, 3, 6, 6, 5),
+		treeRow("/registry", s("/"), 1, 2, false, 2, 5, 5, 5),
+		treeRow("/registry/pods", s("/registry"), 2, 2, false, 1, 4, 4, 5),
+		treeRow("/registry/pods/default", s("/registry/pods"), 3, 1, false, 1, 2, 4, 2),
+		treeRow("/registry/pods/default/a", s("/registry/pods/default"), 4, 0, true, 1, 2, 4, 2),
+		treeRow("/registry/pods/kube-system", s("/registry/pods"), 3, 1, false, 0, 2, 0, 3),
+		treeRow("/registry/pods/kube-system/b", s("/registry/pods/kube-system"), 4, 0, true, 0, 2, 0, 3),
+		treeRow("/registry/example.com", s("/registry"), 2, 1, false, 1, 1, 1, 0),
+		treeRow("/registry/example.com/widgets", s("/registry/example.com"), 3, 1, false, 1, 1, 1, 0),
+		treeRow("/registry/example.com/widgets/default", s("/registry/example.com/widgets"), 4, 1, false, 1, 1, 1, 0),
+		treeRow("/registry/example.com/widgets/default/w", s("/registry/example.com/widgets/default"), 5, 0, true, 1, 1, 1, 0),
+		treeRow("compact_rev_key", s("/"), 1, 0, true, 1, 1, 1, 0),
+	}, treeRows(t, path, Config{}))
+
+	records := runDatasource(t, &DatasourceExecuting{path: path, fieldIndices: []int{2}, schema: SchemaTree})
+	require.Equal(t, octosql.NewString(""), records[0].Values[0])
+	require.Equal(t, octosql.NewString("registry"), records[1].Values[0])
+	require.Equal(t, octosql.NewString("compact_rev_key"), records[11].Values[0])
+}
+
+func TestTreeTableWithDepth(t *testing.T) {
+	path := treeTestSnapshot(t)
+
+	db := &Database{}
+	impl, _, err := db.GetTable(context.Background(), path, map[string]string{"table": "tree", "depth": "2"})
+	require.NoError(t, err)
+	config := impl.(*etcdSnapshotDataSource).config
+	require.Equal(t, 2, config.treeDepth)
+
+	// the deeper prefixes are aggregated into the ones at the maximum depth
+	s := octosql.NewString
+	require.Equal(t, [][]octosql.Value{
+		treeRow("/", octosql.NewNull(), 0, 2, false, 3, 6, 6, 5),
+		treeRow("/registry", s("/"), 1, 2, false, 2, 5, 5, 5),
+		treeRow("/registry/pods", s("/registry"), 2, 0, false, 1, 4, 4, 5),
+		treeRow("/registry/example.com", s("/registry"), 2, 0, false, 1, 1, 1, 0),
+		treeRow("compact_rev_key", s("/"), 1, 0, true, 1, 1, 1, 0),
+	}, treeRows(t, path, config))
+
+	_, _, err = db.GetTable(context.Background(), path, map[string]string{"table": "tree", "depth": "0"})
+	require.ErrorContains(t, err, "invalid value for option 'depth': 0")
+}
+
+func TestKeyTreePath(t *testing.T) {
+	tree := newKeyTree(0)
+	var prefixes []string
+	for _, node := range tree.path("/a//b/") {
+		prefixes = append(prefixes, node.prefix+"|"+node.segment)
+	}
+	// empty segments are kept, the key is split at every slash
+	require.Equal(t, []string{"/|", "/a|a", "/a/|", "/a//b|b", "/a//b/|"}, prefixes)
+	require.True(t, tree.nodes["/a//b/"].isKey)
+	require.False(t, tree.nodes["/a//b"].isKey)
+
+	// the key "/" is the root
+	require.Len(t, tree.path("/"), 1)
+	require.True(t, tree.root.isKey)
+}
+
+func TestTreeOfGeneratedSnapshot(t *testing.T) {
+	cfg := snapshotgen.DefaultConfig()
+	cfg.Namespaces = 2
+	path := filepath.Join(t.TempDir(), "generated.snapshot")
+	result, err := snapshotgen.Generate(path, cfg)
+	require.NoError(t, err)
+
+	rows := treeRows(t, path, Config{treeDepth: 2})
+	require.Equal(t, treeRow("/", octosql.NewNull(), 0, 1, false, result.Objects-result.Tombstones, result.Revisions,
+		rows[0][7].Int, rows[0][8].Int), rows[0])
+	// the resource types below /registry add up to it
+	keys, revisions, bytes := 0, 0, 0
+	for _, row := range rows[2:] {
+		require.Equal(t, octosql.NewString("/registry"), row[1])
+		keys += row[5].Int
+		revisions += row[6].Int
+		bytes += row[9].Int
+	}
+	require.Equal(t, []int{result.Objects - result.Tombstones, result.Revisions, rows[0][9].Int}, []int{keys, revisions, bytes})
+}
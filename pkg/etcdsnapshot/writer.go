@@ -0,0 +1,398 @@
+package etcdsnapshot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/server/v3/mvcc/buckets"
+)
+
+var (
+	// the compaction revisions in the meta bucket, as named by etcd's mvcc store
+	scheduledCompactKeyName = []byte("scheduledCompactRev")
+	finishedCompactKeyName  = []byte("finishedCompactRev")
+)
+
+// defragLimit is the number of puts per write transaction when copying a database, the same as etcd's defrag uses
+const defragLimit = 10000
+
+// WriteOptions select the keys WriteSnapshot copies and how their values change. A key is kept when it passes
+// all selections that are set.
+type WriteOptions struct {
+	// IncludePrefixes keep only the keys starting with one of them
+	IncludePrefixes []string
+	// ExcludePrefixes drop the keys starting with one of them
+	ExcludePrefixes []string
+	// Keys keep only the listed keys, e.g. the result of a SQL query
+	Keys map[string]bool
+	// Values replace the value of the latest revision of their key, e.g. to fix a corrupted object
+	Values map[string][]byte
+}
+
+// keeps returns whether the key passes the selection
+func (o WriteOptions) keeps(key string) bool {
+	if o.Keys != nil && !o.Keys[key] {
+		return false
+	}
+	for _, prefix := range o.ExcludePrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return false
+		}
+	}
+	if len(o.IncludePrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range o.IncludePrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteResult describes a snapshot written by WriteSnapshot
+type WriteResult struct {
+	KeptKeys    int
+	DroppedKeys int
+	// ReplacedValues is the number of kept keys whose value was replaced
+	ReplacedValues int
+	// CompactRevision is the revision the target is compacted at, the highest revision of the source
+	CompactRevision int64
+	Size            int64
+}
+
+// WriteSnapshot writes the selected keys of the source snapshot to a new snapshot at target, which must not exist.
+// The target is compacted at the highest revision of the source: it only holds the latest revision of every key
+// that isn't deleted, and the compaction revision keeps etcd from reusing revisions after a restore. All other
+// buckets, like the meta bucket with the consistent index, leases and auth, are copied as they are. Like
+// "etcdctl snapshot save" the database is followed by its sha256, which "etcdutl snapshot restore" verifies.
+func WriteSnapshot(source, target string, opts WriteOptions) (*WriteResult, error) {
+	if _, err := os.Stat(target); err == nil {
+		return nil, fmt.Errorf("target snapshot '%s' already exists", target)
+	}
+
+	sourceBackend, err := openSnapshotBackend(source)
+	if err != nil {
+		return nil, err
+	}
+	defer sourceBackend.Close()
+
+	result := &WriteResult{}
+	err = sourceBackend.db.View(func(tx *bolt.Tx) error {
+		result.CompactRevision = compactedRevision(tx)
+
+		// only the keys are needed to select the latest revisions, the values are read when they're copied
+		latest := make(map[string][]byte)
+		if keyBucket := tx.Bucket(buckets.Key.Name()); keyBucket != nil {
+			err := keyBucket.ForEach(func(revision, value []byte) error {
+				key, err := keyValueKey(value)
+				if err != nil {
+					return err
+				}
+				if main, _ := bytesToRev(revision); main > result.CompactRevision {
+					result.CompactRevision = main
+				}
+				if isTombstone(revision) {
+					delete(latest, string(key))
+				} else {
+					latest[string(key)] = revision
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		kept := make(map[string]bool, len(latest))
+		for key, revision := range latest {
+			if !opts.keeps(key) {
+				result.DroppedKeys++
+				continue
+			}
+			kept[string(revision)] = true
+		}
+		result.KeptKeys = len(kept)
+
+		db, err := createTempDatabase(filepath.Dir(target), filepath.Base(target))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		keep := func(revision []byte) bool { return kept[string(revision)] }
+		if result.ReplacedValues, err = copyDatabase(tx, db.DB, keep, opts.Values, result.CompactRevision); err != nil {
+			return err
+		}
+		result.Size, err = writeSnapshotFile(db.DB, target)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// compactedRevision returns the revision of the last finished compaction, zero if the database was never compacted
+func compactedRevision(tx *bolt.Tx) int64 {
+	meta := tx.Bucket(buckets.Meta.Name())
+	if meta == nil {
+		return 0
+	}
+	finished := meta.Get(finishedCompactKeyName)
+	if len(finished) < revBytesLen {
+		return 0
+	}
+	main, _ := bytesToRev(finished)
+	return main
+}
+
+// tempDatabase is a database built next to its destination, the file is removed on close
+type tempDatabase struct {
+	*bolt.DB
+}
+
+func createTempDatabase(dir, name string) (*tempDatabase, error) {
+	f, err := os.CreateTemp(dir, "."+name+".build.*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary database: %w", err)
+	}
+	_ = f.Close()
+
+	db, err := bolt.Open(f.Name(), 0600, &bolt.Options{NoSync: true})
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return nil, fmt.Errorf("failed to open temporary database: %w", err)
+	}
+	return &tempDatabase{DB: db}, nil
+}
+
+func (d *tempDatabase) Close() error {
+	err := d.DB.Close()
+	if removeErr := os.Remove(d.Path()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// copyDatabase copies the database of tx to dst the way etcd's defrag does: bucket by bucket in order, in write
+// transactions of defragLimit puts with a fill percent of 0.9, so the size of dst is the one after a defrag. Only
+// the revisions of the key bucket that keep returns true for are copied, values are replaced by the ones of their
+// key, and the meta bucket is marked compacted at compactRevision. It returns the number of replaced values.
+func copyDatabase(tx *bolt.Tx, dst *bolt.DB, keep func(revision []byte) bool, values map[string][]byte, compactRevision int64) (int, error) {
+	w := &batchWriter{db: dst}
+	defer w.rollback()
+
+	replaced := 0
+	hasMeta := false
+	err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if err := w.bucket(name); err != nil {
+			return err
+		}
+
+		switch {
+		case bytes.Equal(name, buckets.Key.Name()):
+			return b.ForEach(func(revision, value []byte) error {
+				if !keep(revision) {
+					return nil
+				}
+				if len(values) > 0 {
+					var changed bool
+					var err error
+					if value, changed, err = replaceValue(value, values); err != nil {
+						return err
+					}
+					if changed {
+						replaced++
+					}
+				}
+				return w.put(revision, value)
+			})
+		case bytes.Equal(name, buckets.Meta.Name()):
+			hasMeta = true
+			err := b.ForEach(func(k, v []byte) error {
+				if bytes.Equal(k, scheduledCompactKeyName) || bytes.Equal(k, finishedCompactKeyName) {
+					return nil
+				}
+				return w.put(k, v)
+			})
+			if err != nil {
+				return err
+			}
+			return putCompactRevision(w, compactRevision)
+		default:
+			return b.ForEach(func(k, v []byte) error {
+				// etcd's buckets are flat, nested buckets have a nil value
+				if v == nil {
+					return fmt.Errorf("unexpected nested bucket [%s] in bucket [%s]", k, name)
+				}
+				return w.put(k, v)
+			})
+		}
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy database: %w", err)
+	}
+
+	// a snapshot without meta bucket still has to record the compaction
+	if !hasMeta {
+		if err := w.bucket(buckets.Meta.Name()); err != nil {
+			return 0, err
+		}
+		if err := putCompactRevision(w, compactRevision); err != nil {
+			return 0, err
+		}
+	}
+	return replaced, w.commit()
+}
+
+// replaceValue returns the value with the replacement for its key, if there is one
+func replaceValue(value []byte, values map[string][]byte) ([]byte, bool, error) {
+	key, err := keyValueKey(value)
+	if err != nil {
+		return nil, false, err
+	}
+	replacement, ok := values[string(key)]
+	if !ok {
+		return value, false, nil
+	}
+
+	kv := mvccpb.KeyValue{}
+	if err := kv.Unmarshal(value); err != nil {
+		return nil, false, fmt.Errorf("failed to unmarshal value of key [%s]: %w", key, err)
+	}
+	kv.Value = replacement
+	if value, err = kv.Marshal(); err != nil {
+		return nil, false, fmt.Errorf("failed to marshal value of key [%s]: %w", key, err)
+	}
+	return value, true, nil
+}
+
+// putCompactRevision records a finished compaction at the revision in the current bucket, which is the meta bucket
+func putCompactRevision(w *batchWriter, revision int64) error {
+	if revision == 0 {
+		return nil
+	}
+	rev := revToBytes(revision, 0)
+	if err := w.put(finishedCompactKeyName, rev); err != nil {
+		return err
+	}
+	return w.put(scheduledCompactKeyName, rev)
+}
+
+// batchWriter puts keys into a bucket of a database and commits every defragLimit puts
+type batchWriter struct {
+	db    *bolt.DB
+	tx    *bolt.Tx
+	name  []byte
+	b     *bolt.Bucket
+	count int
+}
+
+// bucket creates the bucket the following puts go to
+func (w *batchWriter) bucket(name []byte) error {
+	if w.tx == nil {
+		tx, err := w.db.Begin(true)
+		if err != nil {
+			return err
+		}
+		w.tx = tx
+	}
+	b, err := w.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return fmt.Errorf("failed to create bucket [%s]: %w", name, err)
+	}
+	b.FillPercent = 0.9
+	w.name, w.b = name, b
+	return nil
+}
+
+func (w *batchWriter) put(k, v []byte) error {
+	w.count++
+	if w.count > defragLimit {
+		if err := w.commit(); err != nil {
+			return err
+		}
+		if err := w.bucket(w.name); err != nil {
+			return err
+		}
+		w.count = 0
+	}
+	return w.b.Put(k, v)
+}
+
+func (w *batchWriter) commit() error {
+	if w.tx == nil {
+		return nil
+	}
+	err := w.tx.Commit()
+	w.tx = nil
+	if err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+func (w *batchWriter) rollback() {
+	if w.tx != nil {
+		_ = w.tx.Rollback()
+		w.tx = nil
+	}
+}
+
+// writeSnapshotFile streams the database to path followed by its sha256, the way the etcd server sends a snapshot
+func writeSnapshotFile(db *bolt.DB, path string) (int64, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temporary snapshot: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := sha256.New()
+	var size int64
+	err = db.View(func(tx *bolt.Tx) error {
+		size, err = tx.WriteTo(io.MultiWriter(f, h))
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if _, err := f.Write(h.Sum(nil)); err != nil {
+		return 0, fmt.Errorf("failed to write snapshot hash: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return 0, fmt.Errorf("failed to close snapshot: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return 0, fmt.Errorf("failed to rename snapshot: %w", err)
+	}
+	return size + sha256.Size, nil
+}
+
+// verifySnapshotHash checks the sha256 that follows the database in a snapshot, like "etcdutl snapshot restore"
+// does: a snapshot has one when its size is 32 bytes over a multiple of 512
+func verifySnapshotHash(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data)%512 != sha256.Size {
+		return fmt.Errorf("snapshot has no sha256")
+	}
+	sum := sha256.Sum256(data[:len(data)-sha256.Size])
+	if !bytes.Equal(sum[:], data[len(data)-sha256.Size:]) {
+		return fmt.Errorf("snapshot sha256 doesn't match")
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package etcdsnapshot
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/server/v3/mvcc/buckets"
+)
+
+// writtenKeys reads the key, modRevision and value of every revision of a written snapshot
+func writtenKeys(t *testing.T, path string) [][]interface{} {
+	var rows [][]interface{}
+	for _, record := range runDatasource(t, &DatasourceExecuting{path: path, fieldIndices: []int{0, 7, 10}}) {
+		rows = append(rows, []interface{}{record.Values[0].Str, record.Values[1].Int, record.Values[2].Str})
+	}
+	return rows
+}
+
+func TestWriteSnapshot(t *testing.T) {
+	source := writeTestSnapshot(t, []testRevision{
+		{key: "/registry/pods/default/a", value: "a1"},
+		{key: "/registry/pods/default/b", value: "b1"},
+		{key: "/registry/pods/default/a", value: "a2"},
+		{key: "/registry/configmaps/default/c", value: "c1"},
+		{key: "/registry/pods/default/b", deleted: true},
+		{key: "/registry/events/default/e", value: "e1"},
+	})
+
+	target := filepath.Join(t.TempDir(), "written.snapshot")
+	result, err := WriteSnapshot(source, target, WriteOptions{})
+	require.NoError(t, err)
+	require.Equal(t, &WriteResult{KeptKeys: 3, CompactRevision: 7, Size: result.Size}, result)
+	require.NoError(t, verifySnapshotHash(target))
+
+	// only the latest revision of the keys that aren't deleted remain, in revision order
+	require.Equal(t, [][]interface{}{
+		{"/registry/pods/default/a", 4, "a2"},
+		{"/registry/configmaps/default/c", 5, "c1"},
+		{"/registry/events/default/e", 7, "e1"},
+	}, writtenKeys(t, target))
+
+	backend, err := openSnapshotBackend(target)
+	require.NoError(t, err)
+	defer backend.Close()
+	require.NoError(t, backend.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(buckets.Meta.Name())
+		require.NotNil(t, meta)
+		require.Equal(t, revToBytes(7, 0), meta.Get(scheduledCompactKeyName))
+		require.Equal(t, revToBytes(7, 0), meta.Get(finishedCompactKeyName))
+		return nil
+	}))
+
+	_, err = WriteSnapshot(source, target, WriteOptions{})
+	require.ErrorContains(t, err, "already exists")
+}
+
+func TestWriteSnapshotSelection(t *testing.T) {
+	source := writeTestSnapshot(t, []testRevision{
+		{key: "/registry/pods/default/a", value: "a1"},
+		{key: "/registry/pods/kube-system/b", value: "b1"},
+		{key: "/registry/configmaps/default/c", value: "c1"},
+		{key: "/registry/events/default/e", value: "e1"},
+	})
+
+	tests := []struct {
+		name     string
+		opts     WriteOptions
+		expected [][]interface{}
+		replaced int
+	}{
+		{
+			name: "include prefixes",
+			opts: WriteOptions{IncludePrefixes: []string{"/registry/pods/", "/registry/configmaps/"}},
+			expected: [][]interface{}{
+				{"/registry/pods/default/a", 2, "a1"},
+				{"/registry/pods/kube-system/b", 3, "b1"},
+				{"/registry/configmaps/default/c", 4, "c1"},
+			},
+		},
+		{
+			name: "exclude prefixes win over include prefixes",
+			opts: WriteOptions{IncludePrefixes: []string{"/registry/pods/"}, ExcludePrefixes: []string{"/registry/pods/kube-system/"}},
+			expected: [][]interface{}{
+				{"/registry/pods/default/a", 2, "a1"},
+			},
+		},
+		{
+			name: "keys",
+			opts: WriteOptions{Keys: map[string]bool{"/registry/events/default/e": true, "/registry/missing": true}},
+			expected: [][]interface{}{
+				{"/registry/events/default/e", 5, "e1"},
+			},
+		},
+		{
+			name: "replaced values",
+			opts: WriteOptions{ExcludePrefixes: []string{"/registry/pods/"}, Values: map[string][]byte{"/registry/configmaps/default/c": []byte("fixed")}},
+			expected: [][]interface{}{
+				{"/registry/configmaps/default/c", 4, "fixed"},
+				{"/registry/events/default/e", 5, "e1"},
+			},
+			replaced: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := filepath.Join(t.TempDir(), "written.snapshot")
+			result, err := WriteSnapshot(source, target, tt.opts)
+			require.NoError(t, err)
+			require.Equal(t, len(tt.expected), result.KeptKeys)
+			require.Equal(t, 4-len(tt.expected), result.DroppedKeys)
+			require.Equal(t, tt.replaced, result.ReplacedValues)
+			require.NoError(t, verifySnapshotHash(target))
+			require.Equal(t, tt.expected, writtenKeys(t, target))
+		})
+	}
+}
+
+func TestWriteSnapshotCopiesBuckets(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "written.snapshot")
+	_, err := WriteSnapshot("data/basic.snapshot", target, WriteOptions{})
+	require.NoError(t, err)
+	require.NoError(t, verifySnapshotHash(target))
+
+	source, err := openSnapshotBackend("data/basic.snapshot")
+	require.NoError(t, err)
+	defer source.Close()
+	written, err := openSnapshotBackend(target)
+	require.NoError(t, err)
+	defer written.Close()
+
+	require.NoError(t, source.db.View(func(sourceTx *bolt.Tx) error {
+		return written.db.View(func(writtenTx *bolt.Tx) error {
+			return sourceTx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				bucket := writtenTx.Bucket(name)
+				require.NotNil(t, bucket, "bucket %s", name)
+				if string(name) == string(buckets.Key.Name()) {
+					return nil
+				}
+				return b.ForEach(func(k, v []byte) error {
+					if string(name) == string(buckets.Meta.Name()) && (string(k) == string(scheduledCompactKeyName) || string(k) == string(finishedCompactKeyName)) {
+						return nil
+					}
+					require.Equal(t, v, bucket.Get(k), "key %s of bucket %s", k, name)
+					return nil
+				})
+			})
+		})
+	}))
+	require.Equal(t, writtenKeys(t, "data/basic.snapshot"), writtenKeys(t, target))
+}
+
+func TestWriteSnapshotWithNonexistentSource(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "nonexistent.snapshot")
+	target := filepath.Join(dir, "written.snapshot")
+	_, err := WriteSnapshot(source, target, WriteOptions{})
+	require.ErrorContains(t, err, "does not exist")
+	require.NoFileExists(t, source)
+	require.NoFileExists(t, target)
+}
@@ -0,0 +1,61 @@
+package mcp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"github.com/tjungblu/octosql-plugin-etcdsnapshot/pkg/query"
+)
+
+// progressMiddleware sends the scan progress of the queries a tool runs as progress notifications, if the
+// client asked for them with a progress token
+func progressMiddleware(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		mcpServer := server.ServerFromContext(ctx)
+		if request.Params.Meta == nil || request.Params.Meta.ProgressToken == nil || mcpServer == nil {
+			return next(ctx, request)
+		}
+
+		token := request.Params.Meta.ProgressToken
+		notifier := &progressNotifier{send: func(progress float64, message string) {
+			// progress is best effort, a client that went away gets the tool result as error anyway
+			_ = mcpServer.SendNotificationToClient(ctx, "notifications/progress", map[string]any{
+				"progressToken": token,
+				"progress":      progress,
+				"message":       message,
+			})
+		}}
+		return next(query.WithProgress(ctx, notifier.report), request)
+	}
+}
+
+// progressNotifier turns the progress of the scans into notifications. A tool can run several queries that
+// each scan the snapshot, the bytes of the finished scans are added up so the progress never goes back.
+type progressNotifier struct {
+	send func(progress float64, message string)
+
+	mu       sync.Mutex
+	finished float64
+	last     float64
+}
+
+func (n *progressNotifier) report(p query.Progress) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	progress := n.finished + float64(p.Bytes)
+	message := fmt.Sprintf("scanned %d revisions of %s, %d%%, about %s left", p.Revisions, p.Snapshot, p.Percent, p.ETA)
+	if p.Finished {
+		n.finished += float64(p.Bytes)
+		message = fmt.Sprintf("scanned %d revisions of %s", p.Revisions, p.Snapshot)
+	}
+	// progress of scans running at the same time can arrive out of order
+	if progress <= n.last {
+		return
+	}
+	n.last = progress
+	n.send(progress, message)
+}
@@ -0,0 +1,33 @@
+package mcp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tjungblu/octosql-plugin-etcdsnapshot/pkg/query"
+)
+
+func TestProgressNotifier(t *testing.T) {
+	type notification struct {
+		progress float64
+		message  string
+	}
+	var sent []notification
+	notifier := &progressNotifier{send: func(progress float64, message string) {
+		sent = append(sent, notification{progress, message})
+	}}
+
+	notifier.report(query.Progress{Snapshot: "a.snapshot", Revisions: 10, Bytes: 100, Percent: 10, ETA: 9 * time.Second})
+	notifier.report(query.Progress{Snapshot: "a.snapshot", Revisions: 50, Bytes: 500, Finished: true})
+	// the second query of the tool continues where the first one ended
+	notifier.report(query.Progress{Snapshot: "a.snapshot", Revisions: 20, Bytes: 200, Percent: 40, ETA: 3 * time.Second})
+	// older progress isn't sent again
+	notifier.report(query.Progress{Snapshot: "a.snapshot", Revisions: 10, Bytes: 100, Percent: 20})
+
+	require.Equal(t, []notification{
+		{100, "scanned 10 revisions of a.snapshot, 10%, about 9s left"},
+		{500, "scanned 50 revisions of a.snapshot"},
+		{700, "scanned 20 revisions of a.snapshot, 40%, about 3s left"},
+	}, sent)
+}
@@ -0,0 +1,136 @@
+package mcp
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+func (s *Server) registerPrompts() {
+	s.mcpServer.AddPrompt(
+		mcp.NewPrompt("why_is_etcd_large",
+			mcp.WithPromptDescription("Investigate what consumes the space of an etcd snapshot and whether compaction or defragmentation would help"),
+			mcp.WithArgument("snapshot",
+				mcp.ArgumentDescription("Absolute path to the snapshot file"),
+				mcp.RequiredArgument(),
+			),
+		),
+		s.handleWhyIsEtcdLargePrompt,
+	)
+
+	s.mcpServer.AddPrompt(
+		mcp.NewPrompt("what_changed_between_backups",
+			mcp.WithPromptDescription("Explain which objects were added, removed or modified between two etcd backups"),
+			mcp.WithArgument("snapshot1",
+				mcp.ArgumentDescription("Absolute path to the older snapshot file"),
+				mcp.RequiredArgument(),
+			),
+			mcp.WithArgument("snapshot2",
+				mcp.ArgumentDescription("Absolute path to the newer snapshot file"),
+				mcp.RequiredArgument(),
+			),
+		),
+		s.handleWhatChangedPrompt,
+	)
+
+	s.mcpServer.AddPrompt(
+		mcp.NewPrompt("investigate_namespace",
+			mcp.WithPromptDescription("Summarize the objects, storage use and churn of a single namespace"),
+			mcp.WithArgument("snapshot",
+				mcp.ArgumentDescription("Absolute path to the snapshot file"),
+				mcp.RequiredArgument(),
+			),
+			mcp.WithArgument("namespace",
+				mcp.ArgumentDescription("Namespace to investigate"),
+				mcp.RequiredArgument(),
+			),
+		),
+		s.handleInvestigateNamespacePrompt,
+	)
+}
+
+func (s *Server) handleWhyIsEtcdLargePrompt(ctx context.Context, request mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+	snapshot, err := promptArgument(request, "snapshot")
+	if err != nil {
+		return nil, err
+	}
+
+	text := fmt.Sprintf(`Find out why the etcd database in the snapshot %[1]s is as large as it is.
+
+1. Read the resource %[2]s or call get_snapshot_metadata to get size, sizeInUse, fragmentation and quota usage.
+2. Call analyze_storage_health to see whether defragmentation or compaction would reclaim space.
+3. Call analyze_namespaces and analyze_cluster with analysis_type 'performance' to find the namespaces, keys and
+   resource types with the most bytes and revisions.
+4. Use query_etcd for follow-up questions, e.g. 'SELECT resourceType, SUM(valueSize) AS S FROM {{SNAPSHOT}} t GROUP BY resourceType ORDER BY S DESC LIMIT 10'.
+
+Separate space held by live objects from space held by old revisions and free pages, and finish with concrete,
+prioritized recommendations.`, snapshot, metaResourceURI(snapshot))
+
+	return mcp.NewGetPromptResult("Why is etcd large",
+		[]mcp.PromptMessage{mcp.NewPromptMessage(mcp.RoleUser, mcp.NewTextContent(text))},
+	), nil
+}
+
+func (s *Server) handleWhatChangedPrompt(ctx context.Context, request mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+	snapshot1, err := promptArgument(request, "snapshot1")
+	if err != nil {
+		return nil, err
+	}
+	snapshot2, err := promptArgument(request, "snapshot2")
+	if err != nil {
+		return nil, err
+	}
+
+	text := fmt.Sprintf(`Explain what changed in the cluster between the backup %[1]s (older) and %[2]s (newer).
+
+1. Call compare_snapshots with diff_type 'added' and 'removed' to find created and deleted keys.
+2. Call compare_snapshots with diff_type 'added_revisions' to find objects that were modified.
+3. Compare the resources %[3]s and %[4]s to see how size and revisions evolved.
+4. Read individual objects through the etcd://<snapshot>/keys/<key> resources when the change needs more context.
+
+Group the changes by namespace and resource type, call out anything unusual such as mass deletions or runaway
+updates, and keep the summary short.`, snapshot1, snapshot2, metaResourceURI(snapshot1), metaResourceURI(snapshot2))
+
+	return mcp.NewGetPromptResult("What changed between backups",
+		[]mcp.PromptMessage{mcp.NewPromptMessage(mcp.RoleUser, mcp.NewTextContent(text))},
+	), nil
+}
+
+func (s *Server) handleInvestigateNamespacePrompt(ctx context.Context, request mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+	snapshot, err := promptArgument(request, "snapshot")
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := promptArgument(request, "namespace")
+	if err != nil {
+		return nil, err
+	}
+
+	text := fmt.Sprintf(`Investigate the namespace '%[2]s' in the etcd snapshot %[1]s.
+
+1. Read the resource etcd://%[3]s/namespaces/%[4]s to list its objects.
+2. Use query_etcd to find the largest objects and the keys with the most revisions in this namespace.
+3. Read suspicious objects through the etcd://%[3]s/keys/<key> resources.
+
+Summarize what runs in the namespace, how much etcd storage it uses and whether any controller writes excessively.`,
+		snapshot, namespace, url.PathEscape(snapshot), url.PathEscape(namespace))
+
+	return mcp.NewGetPromptResult("Investigate namespace",
+		[]mcp.PromptMessage{mcp.NewPromptMessage(mcp.RoleUser, mcp.NewTextContent(text))},
+	), nil
+}
+
+func promptArgument(request mcp.GetPromptRequest, name string) (string, error) {
+	value := request.Params.Arguments[name]
+	if value == "" {
+		return "", fmt.Errorf("prompt %s requires the argument '%s'", request.Params.Name, name)
+	}
+	return value, nil
+}
+
+// metaResourceURI returns the meta resource of a snapshot, with the path encoded as a single segment
+func metaResourceURI(snapshot string) string {
+	return fmt.Sprintf("etcd://%s/meta", url.PathEscape(snapshot))
+}
@@ -0,0 +1,48 @@
+package mcp
+
+import (
+	"testing"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListPrompts(t *testing.T) {
+	s := newTestServer(t)
+
+	msg := handle(t, s, `{"jsonrpc":"2.0","id":1,"method":"prompts/list"}`)
+	resp, ok := msg.(mcp.JSONRPCResponse)
+	require.True(t, ok, "unexpected response %+v", msg)
+
+	result, ok := resp.Result.(mcp.ListPromptsResult)
+	require.True(t, ok)
+
+	var names []string
+	for _, p := range result.Prompts {
+		names = append(names, p.Name)
+	}
+	require.ElementsMatch(t, []string{"why_is_etcd_large", "what_changed_between_backups", "investigate_namespace"}, names)
+}
+
+func TestGetWhatChangedPrompt(t *testing.T) {
+	s := newTestServer(t)
+
+	msg := handle(t, s, `{"jsonrpc":"2.0","id":1,"method":"prompts/get","params":{"name":"what_changed_between_backups","arguments":{"snapshot1":"/backups/a.snapshot","snapshot2":"/backups/b.snapshot"}}}`)
+	resp, ok := msg.(mcp.JSONRPCResponse)
+	require.True(t, ok, "unexpected response %+v", msg)
+
+	result, ok := resp.Result.(mcp.GetPromptResult)
+	require.True(t, ok)
+	require.Len(t, result.Messages, 1)
+	text := result.Messages[0].Content.(mcp.TextContent).Text
+	require.Contains(t, text, "/backups/a.snapshot")
+	require.Contains(t, text, "etcd://%2Fbackups%2Fb.snapshot/meta")
+}
+
+func TestGetPromptWithMissingArgument(t *testing.T) {
+	s := newTestServer(t)
+
+	msg := handle(t, s, `{"jsonrpc":"2.0","id":1,"method":"prompts/get","params":{"name":"why_is_etcd_large","arguments":{}}}`)
+	_, ok := msg.(mcp.JSONRPCError)
+	require.True(t, ok, "unexpected response %+v", msg)
+}
@@ -0,0 +1,228 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// Resource URIs embed the absolute snapshot path as a single, percent-encoded segment, for example
+// etcd://%2Fbackups%2Fa.snapshot/keys/kubernetes.io/pods/default/nginx
+const (
+	schemaResourceURI         = "etcd://schema"
+	metaResourceTemplate      = "etcd://{snapshot}/meta"
+	keyResourceTemplate       = "etcd://{snapshot}/keys{+key}"
+	resourceTypeTemplate      = "etcd://{snapshot}/resources/{resourceType}"
+	namespaceResourceTemplate = "etcd://{snapshot}/namespaces/{namespace}"
+)
+
+const schemaDocument = `# etcd snapshot schema
+
+Content table, "SELECT * FROM <snapshot>", one row per revision of a key:
+
+| column              | type        | description                                                  |
+|---------------------|-------------|--------------------------------------------------------------|
+| key                 | String      | the full etcd key                                            |
+| apiserverPrefix     | NULL/String | prefix configured in the apiserver, e.g. kubernetes.io       |
+| apigroup            | NULL/String | API group, e.g. cloudcredential.openshift.io                 |
+| resourceType        | NULL/String | resource, e.g. pods, services, deployments                   |
+| namespace           | NULL/String | namespace of the object                                      |
+| name                | NULL/String | name of the object                                           |
+| createRevision      | Int         | revision of the last creation of this key                    |
+| modRevision         | Int         | revision of this modification                                |
+| version             | Int         | version of the key, reset to zero on deletion                |
+| lease               | Int         | attached lease id, zero means no lease                       |
+| value               | String      | the value, usually JSON or protobuf                          |
+| valueSize           | Int         | size of the value in bytes                                   |
+| encryptionProvider  | String      | provider that encrypted the value at rest, identity if plain |
+| estimatedModTime    | NULL/Time   | wall-clock time of modRevision estimated from object times   |
+| estimatedModTimeMin | NULL/Time   | earliest time modRevision can have been written at           |
+| estimatedModTimeMax | NULL/Time   | latest time modRevision can have been written at             |
+
+Meta table, "SELECT * FROM <snapshot>?meta=true", a single row with storage, fragmentation,
+revision, quota, value size and lease statistics of the bbolt database. Usage is reported against
+the quota in bytes given with "?meta=true&quota=<bytes>", the plugin configuration or etcd's 8GB
+default, the "quota" and "quotaSource" columns tell which one was used.
+
+Owners table, "SELECT * FROM <snapshot>?table=owners", one row per owner reference of the latest
+revision of every object: key, namespace, kind, name, uid, ownerApiVersion, ownerKind, ownerName,
+ownerUid, controller, blockOwnerDeletion, ownerKey (NULL if the owner isn't in the snapshot) and
+dangling (true if no object with the owner uid exists).
+
+Events table, "SELECT * FROM <snapshot>?table=events", one row per core/v1 or events.k8s.io Event
+in the latest revision: key, namespace, name, apiVersion, reason, type, message, involvedKind,
+involvedNamespace, involvedName, count, firstTimestamp, lastTimestamp, reportingController, lease,
+leaseTTL (TTL in seconds the lease was granted with, NULL without lease) and valueSize.
+
+Timeline table, "SELECT * FROM <snapshot>?table=timeline", one row per minute of estimated
+wall-clock time: minute, firstRevision, lastRevision, writes, writesPerSecond, storedRevisions,
+storedBytes and anchors (the number of object timestamps the estimate is based on).
+
+Churn table, "SELECT * FROM <snapshot>?table=churn", one row per resource type, namespace and
+field manager of the retained revisions: resourceType, namespace, fieldManager, subresource,
+uniqueKeys, writes, bytesWritten, writesPerKey, writeShare, medianWriteInterval (seconds),
+hotKey, hotKeyWrites and hotLoop (hot key rewritten every few seconds).
+
+Sizes table, "SELECT * FROM <snapshot>?table=sizes", a power of two histogram of value sizes per
+resource type and revisions (latest, or historical for replaced and deleted ones), one row per
+non-empty bucket: resourceType, revisions, bucketMin, bucketMax (exclusive), count, bytes,
+byteShare (of the group's bytes), and the group's groupCount, groupBytes, p50, p90, p99 and max.
+
+Tree table, "SELECT * FROM <snapshot>?table=tree&depth=<N>", one row per key prefix split at every
+slash, depth-first with the largest children first, like du: prefix ("/" for the root), parent
+(NULL for the root), segment, depth, children, isKey, keys (not deleted), revisions, latestBytes,
+historicalBytes (of replaced and deleted revisions) and bytes. depth is optional and limits the rows.
+`
+
+func (s *Server) registerResources() {
+	s.mcpServer.AddResource(
+		mcp.NewResource(schemaResourceURI, "etcd snapshot schema",
+			mcp.WithResourceDescription("Columns of the content and meta tables that can be queried with query_etcd"),
+			mcp.WithMIMEType("text/markdown"),
+		),
+		s.handleSchemaResource,
+	)
+
+	s.mcpServer.AddResourceTemplate(
+		mcp.NewResourceTemplate(metaResourceTemplate, "Snapshot metadata",
+			mcp.WithTemplateDescription("The meta row of a snapshot: sizes, fragmentation, revisions, quota usage and leases. 'snapshot' is the percent-encoded absolute path."),
+			mcp.WithTemplateMIMEType("application/json"),
+		),
+		s.handleMetaResource,
+	)
+
+	s.mcpServer.AddResourceTemplate(
+		mcp.NewResourceTemplate(keyResourceTemplate, "Key value",
+			mcp.WithTemplateDescription("Latest revision and value of a single key, e.g. etcd://%2Fpath%2Fa.snapshot/keys/kubernetes.io/pods/default/nginx"),
+			mcp.WithTemplateMIMEType("application/json"),
+		),
+		s.handleKeyResource,
+	)
+
+	s.mcpServer.AddResourceTemplate(
+		mcp.NewResourceTemplate(resourceTypeTemplate, "Keys by resource type",
+			mcp.WithTemplateDescription("All keys of a resource type (e.g. pods, configmaps) with namespace, name and revision count"),
+			mcp.WithTemplateMIMEType("application/json"),
+		),
+		s.handleResourceTypeResource,
+	)
+
+	s.mcpServer.AddResourceTemplate(
+		mcp.NewResourceTemplate(namespaceResourceTemplate, "Keys by namespace",
+			mcp.WithTemplateDescription("All keys in a namespace with resource type, name and revision count"),
+			mcp.WithTemplateMIMEType("application/json"),
+		),
+		s.handleNamespaceResource,
+	)
+}
+
+func (s *Server) handleSchemaResource(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+	return []mcp.ResourceContents{
+		mcp.TextResourceContents{URI: request.Params.URI, MIMEType: "text/markdown", Text: schemaDocument},
+	}, nil
+}
+
+func (s *Server) handleMetaResource(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+	snapshot, err := templateArgument(request, "snapshot")
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := s.queryEngine.ExecuteQuery(ctx, "SELECT * FROM {{SNAPSHOT}}?meta=true", snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("metadata query failed: %w", err)
+	}
+	if len(result.Data) == 0 {
+		return nil, fmt.Errorf("no metadata found for snapshot %s", snapshot)
+	}
+
+	return jsonContents(request.Params.URI, result.Data[0])
+}
+
+func (s *Server) handleKeyResource(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+	snapshot, err := templateArgument(request, "snapshot")
+	if err != nil {
+		return nil, err
+	}
+	key, err := templateArgument(request, "key")
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := s.queryEngine.GetKey(ctx, snapshot, key)
+	if err != nil {
+		return nil, fmt.Errorf("key query failed: %w", err)
+	}
+	if len(result.Data) == 0 {
+		return nil, fmt.Errorf("key %s not found in snapshot %s", key, snapshot)
+	}
+
+	return jsonContents(request.Params.URI, result.Data[0])
+}
+
+func (s *Server) handleResourceTypeResource(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+	snapshot, err := templateArgument(request, "snapshot")
+	if err != nil {
+		return nil, err
+	}
+	resourceType, err := templateArgument(request, "resourceType")
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := s.queryEngine.ListResourceType(ctx, snapshot, resourceType)
+	if err != nil {
+		return nil, fmt.Errorf("resource type listing failed: %w", err)
+	}
+
+	return jsonContents(request.Params.URI, result.Data)
+}
+
+func (s *Server) handleNamespaceResource(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+	snapshot, err := templateArgument(request, "snapshot")
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := templateArgument(request, "namespace")
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := s.queryEngine.ListNamespace(ctx, snapshot, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("namespace listing failed: %w", err)
+	}
+
+	return jsonContents(request.Params.URI, result.Data)
+}
+
+// templateArgument returns a variable matched from the resource URI template. mcp-go hands them over
+// already percent-decoded, as []string for templates and as string when a client passes them directly.
+func templateArgument(request mcp.ReadResourceRequest, name string) (string, error) {
+	var value string
+	switch v := request.Params.Arguments[name].(type) {
+	case string:
+		value = v
+	case []string:
+		value = strings.Join(v, "")
+	}
+
+	if value == "" {
+		return "", fmt.Errorf("resource uri %s is missing '%s'", request.Params.URI, name)
+	}
+	return value, nil
+}
+
+func jsonContents(uri string, v interface{}) ([]mcp.ResourceContents, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode resource %s: %w", uri, err)
+	}
+
+	return []mcp.ResourceContents{
+		mcp.TextResourceContents{URI: uri, MIMEType: "application/json", Text: string(data)},
+	}, nil
+}
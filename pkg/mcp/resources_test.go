@@ -0,0 +1,82 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T) *Server {
+	server, err := NewServer(Config{Name: "test-server", Version: "1.0.0"})
+	require.NoError(t, err)
+	return server
+}
+
+func handle(t *testing.T, s *Server, request string) mcp.JSONRPCMessage {
+	return s.mcpServer.HandleMessage(context.Background(), json.RawMessage(request))
+}
+
+func TestListResourceTemplates(t *testing.T) {
+	s := newTestServer(t)
+
+	msg := handle(t, s, `{"jsonrpc":"2.0","id":1,"method":"resources/templates/list"}`)
+	resp, ok := msg.(mcp.JSONRPCResponse)
+	require.True(t, ok, "unexpected response %+v", msg)
+
+	result, ok := resp.Result.(mcp.ListResourceTemplatesResult)
+	require.True(t, ok)
+
+	var templates []string
+	for _, tmpl := range result.ResourceTemplates {
+		templates = append(templates, tmpl.URITemplate.Raw())
+	}
+	require.ElementsMatch(t, []string{metaResourceTemplate, keyResourceTemplate, resourceTypeTemplate, namespaceResourceTemplate}, templates)
+}
+
+func TestReadSchemaResource(t *testing.T) {
+	s := newTestServer(t)
+
+	msg := handle(t, s, `{"jsonrpc":"2.0","id":1,"method":"resources/read","params":{"uri":"etcd://schema"}}`)
+	resp, ok := msg.(mcp.JSONRPCResponse)
+	require.True(t, ok, "unexpected response %+v", msg)
+
+	result, ok := resp.Result.(mcp.ReadResourceResult)
+	require.True(t, ok)
+	require.Len(t, result.Contents, 1)
+	text := result.Contents[0].(mcp.TextResourceContents)
+	require.Contains(t, text.Text, "createRevision")
+	require.Equal(t, "text/markdown", text.MIMEType)
+}
+
+func TestReadKeyResourceRequiresAbsoluteSnapshot(t *testing.T) {
+	s := newTestServer(t)
+
+	// the template matches, the relative snapshot path is then rejected by the query engine
+	msg := handle(t, s, `{"jsonrpc":"2.0","id":1,"method":"resources/read","params":{"uri":"etcd://relative.snapshot/keys/kubernetes.io/pods/default/nginx"}}`)
+	errResp, ok := msg.(mcp.JSONRPCError)
+	require.True(t, ok, "unexpected response %+v", msg)
+	require.Contains(t, errResp.Error.Message, "snapshot path must be absolute")
+}
+
+func TestTemplateArgument(t *testing.T) {
+	request := mcp.ReadResourceRequest{}
+	request.Params.URI = "etcd://%2Ftmp%2Fa.snapshot/keys/kubernetes.io/pods/default/nginx"
+	request.Params.Arguments = map[string]any{
+		"snapshot": []string{"/tmp/a.snapshot"},
+		"key":      "/kubernetes.io/pods/default/nginx",
+	}
+
+	snapshot, err := templateArgument(request, "snapshot")
+	require.NoError(t, err)
+	require.Equal(t, "/tmp/a.snapshot", snapshot)
+
+	key, err := templateArgument(request, "key")
+	require.NoError(t, err)
+	require.Equal(t, "/kubernetes.io/pods/default/nginx", key)
+
+	_, err = templateArgument(request, "namespace")
+	require.Error(t, err)
+}
@@ -2,7 +2,14 @@ package mcp
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/mark3labs/mcp-go/server"
@@ -14,6 +21,24 @@ type Config struct {
 	Name        string
 	Version     string
 	Description string
+
+	// Transport is one of TransportStdio (default), TransportStreamableHTTP or TransportSSE
+	Transport string
+	// Addr is the listen address for the HTTP transports, defaults to DefaultAddr. Addresses other than
+	// loopback need an AuthToken.
+	Addr string
+	// AuthToken, when set, is required as bearer token on every HTTP request
+	AuthToken string
+	// RulesFile is an optional YAML file changing the built-in health rules, see query.LoadRules
+	RulesFile string
+	// ExportDir is the absolute path of the directory export_manifests writes below, the tool is disabled without
+	ExportDir string
+	// Index makes the queries of the tools use the persistent snapshot index of the plugin, so the queries an
+	// analysis runs one after the other don't all scan the snapshot
+	Index bool
+	// QueryTimeout limits every query a tool runs, zero is unlimited. A tool call can set a deadline of its own
+	// for all its queries with the "timeout_seconds" argument instead.
+	QueryTimeout time.Duration
 }
 
 // Server represents the MCP server
@@ -25,17 +50,30 @@ type Server struct {
 
 // NewServer creates a new MCP server
 func NewServer(config Config) (*Server, error) {
+	if config.ExportDir != "" && !filepath.IsAbs(config.ExportDir) {
+		return nil, fmt.Errorf("export directory must be an absolute path, got: '%s'", config.ExportDir)
+	}
+
 	// Initialize query engine
-	queryEngine, err := query.NewEngine()
+	rules, err := query.LoadRules(config.RulesFile)
+	if err != nil {
+		return nil, err
+	}
+	queryEngine, err := query.NewEngineWithRules(rules)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create query engine: %w", err)
 	}
+	queryEngine = queryEngine.WithTimeout(config.QueryTimeout).WithIndex(config.Index)
 
-	// Create MCP server with tools capability
+	// Create MCP server with tools, resources and prompts capability
 	mcpServer := server.NewMCPServer(
 		config.Name,
 		config.Version,
 		server.WithToolCapabilities(true),
+		server.WithResourceCapabilities(false, false),
+		server.WithPromptCapabilities(false),
+		server.WithToolHandlerMiddleware(progressMiddleware),
+		server.WithToolHandlerMiddleware(timeoutMiddleware),
 	)
 
 	s := &Server{
@@ -44,16 +82,37 @@ func NewServer(config Config) (*Server, error) {
 		mcpServer:   mcpServer,
 	}
 
-	// Register our tools
+	// Register our tools, resources and prompts
 	s.registerTools()
+	s.registerResources()
+	s.registerPrompts()
 
 	return s, nil
 }
 
-// Start starts the MCP server
+// Start starts the MCP server with the configured transport. The HTTP transports
+// shut down gracefully once the context is cancelled.
 func (s *Server) Start(ctx context.Context) error {
-	// Start the server using stdio transport
-	return server.ServeStdio(s.mcpServer)
+	switch s.config.Transport {
+	case "", TransportStdio:
+		// Start the server using stdio transport
+		return server.ServeStdio(s.mcpServer)
+	case TransportStreamableHTTP, TransportSSE:
+		addr := s.config.Addr
+		if addr == "" {
+			addr = DefaultAddr
+		}
+		if err := checkListenAddr(addr, s.config.AuthToken); err != nil {
+			return err
+		}
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		return s.serveHTTP(ctx, listener)
+	default:
+		return fmt.Errorf("unsupported transport: %s", s.config.Transport)
+	}
 }
 
 func (s *Server) registerTools() {
@@ -70,7 +129,7 @@ func (s *Server) registerTools() {
 		),
 	)
 
-	s.mcpServer.AddTool(queryTool, s.handleQueryEtcd)
+	s.addTool(queryTool, s.handleQueryEtcd)
 
 	// Register analyze_cluster tool
 	analyzeTool := mcp.NewTool("analyze_cluster",
@@ -86,7 +145,7 @@ func (s *Server) registerTools() {
 		),
 	)
 
-	s.mcpServer.AddTool(analyzeTool, s.handleAnalyzeCluster)
+	s.addTool(analyzeTool, s.handleAnalyzeCluster)
 
 	// Register find_resources tool
 	findTool := mcp.NewTool("find_resources",
@@ -107,7 +166,7 @@ func (s *Server) registerTools() {
 		),
 	)
 
-	s.mcpServer.AddTool(findTool, s.handleFindResources)
+	s.addTool(findTool, s.handleFindResources)
 
 	// Register compare_snapshots tool
 	compareTool := mcp.NewTool("compare_snapshots",
@@ -127,7 +186,7 @@ func (s *Server) registerTools() {
 		),
 	)
 
-	s.mcpServer.AddTool(compareTool, s.handleCompareSnapshots)
+	s.addTool(compareTool, s.handleCompareSnapshots)
 
 	// Register namespace_analysis tool
 	namespaceTool := mcp.NewTool("analyze_namespaces",
@@ -140,9 +199,12 @@ func (s *Server) registerTools() {
 			mcp.Description("Number of top namespaces to return (default: 10)"),
 			mcp.DefaultString("10"),
 		),
+		mcp.WithString("quota",
+			mcp.Description("Storage quota of the cluster in bytes, as set with --quota-backend-bytes (optional). Defaults to the plugin configuration or etcd's 8GB."),
+		),
 	)
 
-	s.mcpServer.AddTool(namespaceTool, s.handleNamespaceAnalysis)
+	s.addTool(namespaceTool, s.handleNamespaceAnalysis)
 
 	// Register get_snapshot_metadata tool
 	metadataTool := mcp.NewTool("get_snapshot_metadata",
@@ -151,9 +213,12 @@ func (s *Server) registerTools() {
 			mcp.Required(),
 			mcp.Description("Absolute path to the snapshot file to analyze (e.g., '/path/to/snapshot.db'). Relative paths are not supported."),
 		),
+		mcp.WithString("quota",
+			mcp.Description("Storage quota of the cluster in bytes, as set with --quota-backend-bytes (optional). Defaults to the plugin configuration or etcd's 8GB."),
+		),
 	)
 
-	s.mcpServer.AddTool(metadataTool, s.handleGetSnapshotMetadata)
+	s.addTool(metadataTool, s.handleGetSnapshotMetadata)
 
 	// Register analyze_storage_health tool
 	healthTool := mcp.NewTool("analyze_storage_health",
@@ -162,9 +227,73 @@ func (s *Server) registerTools() {
 			mcp.Required(),
 			mcp.Description("Absolute path to the snapshot file to analyze (e.g., '/path/to/snapshot.db'). Relative paths are not supported."),
 		),
+		mcp.WithString("quota",
+			mcp.Description("Storage quota of the cluster in bytes, as set with --quota-backend-bytes (optional). Defaults to the plugin configuration or etcd's 8GB."),
+		),
+	)
+
+	s.addTool(healthTool, s.handleAnalyzeStorageHealth)
+
+	// Register analyze_churn tool
+	churnTool := mcp.NewTool("analyze_churn",
+		mcp.WithDescription("Analyze write amplification and churn: aggregates the revisions retained in the snapshot per resource type, namespace and field manager (from managedFields), with writes per key, bytes written and the median interval between writes. Flags hot loops such as controllers updating status every few seconds."),
+		mcp.WithString("snapshot",
+			mcp.Required(),
+			mcp.Description("Absolute path to the snapshot file to analyze (e.g., '/path/to/snapshot.db'). Relative paths are not supported."),
+		),
+		mcp.WithString("limit",
+			mcp.Description("Number of top writers to return (default: 10)"),
+			mcp.DefaultString("10"),
+		),
+	)
+
+	s.addTool(churnTool, s.handleAnalyzeChurn)
+
+	// Register check_health tool
+	checkHealthTool := mcp.NewTool("check_health",
+		mcp.WithDescription("Check an etcd snapshot against all health rules at once, covering storage, quota, fragmentation, revisions, namespaces and churn. Returns a list of findings, each with rule id, severity, subject, observed value, threshold, message and remediation."),
+		mcp.WithString("snapshot",
+			mcp.Required(),
+			mcp.Description("Absolute path to the snapshot file to check (e.g., '/path/to/snapshot.db'). Relative paths are not supported."),
+		),
+		mcp.WithString("quota",
+			mcp.Description("Storage quota of the cluster in bytes, as set with --quota-backend-bytes (optional). Defaults to the plugin configuration or etcd's 8GB."),
+		),
 	)
 
-	s.mcpServer.AddTool(healthTool, s.handleAnalyzeStorageHealth)
+	s.addTool(checkHealthTool, s.handleCheckHealth)
+
+	// Register export_manifests tool
+	exportTool := mcp.NewTool("export_manifests",
+		mcp.WithDescription("Export the latest revision of matching keys as Kubernetes manifests into a directory tree <output_dir>/<group>/<resource>/<namespace>/<name>.yaml below the export directory of the server, e.g. to restore custom resources from a backup. Takes the filters of find_resources, all optional. The built-in types like Secrets, ConfigMaps or Deployments are decoded from protobuf, custom resources are exported as stored. Keys of other protobuf types are listed as skipped, and the export fails when all matching keys are skipped. Existing manifests aren't overwritten. Redacted Secret data stays redacted."),
+		mcp.WithString("snapshot",
+			mcp.Required(),
+			mcp.Description("Absolute path to the snapshot file to export from (e.g., '/path/to/snapshot.db'). Relative paths are not supported."),
+		),
+		mcp.WithString("output_dir",
+			mcp.Required(),
+			mcp.Description("Directory to write the manifests to, relative to the export directory of the server, it is created if missing"),
+		),
+		mcp.WithString("resource_type",
+			mcp.Description("Kubernetes resource type to export (optional), e.g. 'deployments' or 'applications'"),
+		),
+		mcp.WithString("namespace",
+			mcp.Description("Namespace to export from (optional)"),
+		),
+		mcp.WithString("name",
+			mcp.Description("Name of the resources to export (optional)"),
+		),
+		mcp.WithString("format",
+			mcp.Description("Format of the manifests: 'yaml' (default) or 'json'"),
+			mcp.Enum("yaml", "json"),
+			mcp.DefaultString("yaml"),
+		),
+		mcp.WithBoolean("strip_server_fields",
+			mcp.Description("Remove the status and the metadata set by the apiserver, like uid, resourceVersion and managedFields, so the manifests can be applied to another cluster (default: false)"),
+		),
+	)
+
+	s.addTool(exportTool, s.handleExportManifests)
 }
 
 func (s *Server) handleQueryEtcd(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
@@ -266,7 +395,9 @@ func (s *Server) handleNamespaceAnalysis(ctx context.Context, request mcp.CallTo
 
 	limit := request.GetString("limit", "10")
 
-	result, err := s.queryEngine.GetNamespaceAnalysis(ctx, snapshot, limit)
+	quota := request.GetString("quota", "")
+
+	result, err := s.queryEngine.GetNamespaceAnalysis(ctx, snapshot, limit, quota)
 	if err != nil {
 		return mcp.NewToolResultError(fmt.Sprintf("Namespace analysis failed: %v", err)), nil
 	}
@@ -280,7 +411,9 @@ func (s *Server) handleGetSnapshotMetadata(ctx context.Context, request mcp.Call
 		return mcp.NewToolResultError(err.Error()), nil
 	}
 
-	result, err := s.queryEngine.GetSnapshotMetadata(ctx, snapshot)
+	quota := request.GetString("quota", "")
+
+	result, err := s.queryEngine.GetSnapshotMetadata(ctx, snapshot, quota)
 	if err != nil {
 		return mcp.NewToolResultError(fmt.Sprintf("Snapshot metadata retrieval failed: %v", err)), nil
 	}
@@ -294,10 +427,123 @@ func (s *Server) handleAnalyzeStorageHealth(ctx context.Context, request mcp.Cal
 		return mcp.NewToolResultError(err.Error()), nil
 	}
 
-	result, err := s.queryEngine.AnalyzeStorageHealth(ctx, snapshot)
+	quota := request.GetString("quota", "")
+
+	result, err := s.queryEngine.AnalyzeStorageHealth(ctx, snapshot, quota)
 	if err != nil {
 		return mcp.NewToolResultError(fmt.Sprintf("Storage health analysis failed: %v", err)), nil
 	}
 
 	return mcp.NewToolResultText(fmt.Sprintf("Storage health analysis completed successfully:\n%+v", result)), nil
 }
+
+func (s *Server) handleAnalyzeChurn(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	snapshot, err := request.RequireString("snapshot")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	limit := request.GetString("limit", "10")
+
+	result, err := s.queryEngine.GetChurnAnalysis(ctx, snapshot, limit)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Churn analysis failed: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(fmt.Sprintf("Churn analysis completed successfully:\n%+v", result)), nil
+}
+
+func (s *Server) handleCheckHealth(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	snapshot, err := request.RequireString("snapshot")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	quota := request.GetString("quota", "")
+
+	result, err := s.queryEngine.CheckHealth(ctx, snapshot, quota)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Health check failed: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(fmt.Sprintf("%s:\n%+v", result.Summary, result)), nil
+}
+
+func (s *Server) handleExportManifests(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	snapshot, err := request.RequireString("snapshot")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	outputDir, err := request.RequireString("output_dir")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	outputDir, err = exportOutputDir(s.config.ExportDir, outputDir)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	result, err := s.queryEngine.ExportManifests(ctx, snapshot, query.ExportOptions{
+		ResourceType:      request.GetString("resource_type", ""),
+		Namespace:         request.GetString("namespace", ""),
+		Name:              request.GetString("name", ""),
+		Dir:               outputDir,
+		Format:            request.GetString("format", "yaml"),
+		StripServerFields: request.GetBool("strip_server_fields", false),
+	})
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Manifest export failed: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(fmt.Sprintf("%s:\n%+v", result.Summary, result)), nil
+}
+
+// exportOutputDir returns the directory below the export directory the client asked to export to. Clients can
+// only write below the export directory, an absolute path has to be inside of it too. Symlinks are resolved before
+// the check, so a link below the export directory can't point the export elsewhere.
+func exportOutputDir(exportDir, outputDir string) (string, error) {
+	if exportDir == "" {
+		return "", fmt.Errorf("exporting manifests is disabled, start the server with -export-dir to enable it")
+	}
+	dir := outputDir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(exportDir, dir)
+	}
+
+	root, err := resolveSymlinks(exportDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve export directory %s: %w", exportDir, err)
+	}
+	dir, err = resolveSymlinks(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve output directory '%s': %w", outputDir, err)
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("output directory '%s' is outside of the export directory %s", outputDir, exportDir)
+	}
+	return filepath.Join(root, rel), nil
+}
+
+// resolveSymlinks resolves the symlinks of the deepest existing ancestor of path and appends the rest, which doesn't
+// exist yet. A dangling link is refused, creating the directory would follow it.
+func resolveSymlinks(path string) (string, error) {
+	path = filepath.Clean(path)
+	var missing []string
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, missing...)...), nil
+		}
+		parent := filepath.Dir(path)
+		if !errors.Is(err, fs.ErrNotExist) || parent == path {
+			return "", err
+		}
+		if _, err := os.Lstat(path); err == nil {
+			return "", fmt.Errorf("%s is a dangling symlink", path)
+		}
+		missing = append([]string{filepath.Base(path)}, missing...)
+		path = parent
+	}
+}
@@ -1,6 +1,8 @@
 package mcp
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -63,3 +65,76 @@ func TestNewMetadataTools(t *testing.T) {
 	// Verify that the server was created with the new tools
 	require.NotNil(t, server.mcpServer)
 }
+
+func TestNewServerWithRulesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("rules:\n- id: fragmentation\n  threshold: 0.5\n"), 0600))
+
+	server, err := NewServer(Config{Name: "test-server", RulesFile: path})
+	require.NoError(t, err)
+	for _, rule := range server.queryEngine.Rules() {
+		if rule.ID == "fragmentation" {
+			require.Equal(t, 0.5, rule.Threshold)
+		}
+	}
+
+	require.NoError(t, os.WriteFile(path, []byte("rules:\n- id: fragmentation\n  severity: fatal\n"), 0600))
+	_, err = NewServer(Config{Name: "test-server", RulesFile: path})
+	require.ErrorContains(t, err, "invalid severity")
+}
+
+func TestExportOutputDir(t *testing.T) {
+	_, err := exportOutputDir("", "restore")
+	require.ErrorContains(t, err, "exporting manifests is disabled")
+
+	for outputDir, expected := range map[string]string{
+		"":                   "/srv/exports",
+		"restore":            "/srv/exports/restore",
+		"a/../b":             "/srv/exports/b",
+		"/srv/exports/a":     "/srv/exports/a",
+		"/srv/exports/./a/b": "/srv/exports/a/b",
+	} {
+		dir, err := exportOutputDir("/srv/exports/", outputDir)
+		require.NoError(t, err, outputDir)
+		require.Equal(t, expected, dir, outputDir)
+	}
+
+	for _, outputDir := range []string{"..", "../etc", "a/../../etc", "/etc", "/srv/exports-other", "/srv"} {
+		_, err := exportOutputDir("/srv/exports", outputDir)
+		require.ErrorContains(t, err, "is outside of the export directory", outputDir)
+	}
+}
+
+func TestExportOutputDirResolvesSymlinks(t *testing.T) {
+	base := t.TempDir()
+	exportDir := filepath.Join(base, "exports")
+	outside := filepath.Join(base, "outside")
+	require.NoError(t, os.MkdirAll(filepath.Join(exportDir, "restore"), 0700))
+	require.NoError(t, os.Mkdir(outside, 0700))
+	require.NoError(t, os.Symlink(outside, filepath.Join(exportDir, "escape")))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "missing"), filepath.Join(exportDir, "dangling")))
+	require.NoError(t, os.Symlink(filepath.Join(exportDir, "restore"), filepath.Join(base, "inside")))
+
+	for _, outputDir := range []string{"escape", "escape/a/b", filepath.Join(exportDir, "escape", "a")} {
+		_, err := exportOutputDir(exportDir, outputDir)
+		require.ErrorContains(t, err, "is outside of the export directory", outputDir)
+	}
+	_, err := exportOutputDir(exportDir, "dangling/a")
+	require.ErrorContains(t, err, "is a dangling symlink")
+
+	root, err := filepath.EvalSymlinks(exportDir)
+	require.NoError(t, err)
+	// links pointing inside are fine, and so is an export directory behind a link
+	dir, err := exportOutputDir(exportDir, filepath.Join(base, "inside", "a"))
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(root, "restore", "a"), dir)
+	require.NoError(t, os.Symlink(exportDir, filepath.Join(base, "link")))
+	dir, err = exportOutputDir(filepath.Join(base, "link"), "restore")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(root, "restore"), dir)
+}
+
+func TestNewServerWithRelativeExportDir(t *testing.T) {
+	_, err := NewServer(Config{Name: "test-server", ExportDir: "exports"})
+	require.ErrorContains(t, err, "export directory must be an absolute path")
+}
@@ -0,0 +1,32 @@
+package mcp
+
+import (
+	"context"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// timeoutArgument is the optional argument of every tool that limits how long the tool call may run
+const timeoutArgument = "timeout_seconds"
+
+// addTool registers a tool with the timeout argument added to its input schema
+func (s *Server) addTool(tool mcp.Tool, handler server.ToolHandlerFunc) {
+	mcp.WithNumber(timeoutArgument,
+		mcp.Description("Optional limit in seconds for the queries of this call, instead of the server's default query timeout. Large snapshots can take minutes to scan."),
+	)(&tool)
+	s.mcpServer.AddTool(tool, handler)
+}
+
+// timeoutMiddleware gives the queries of a tool call the deadline asked for with the timeout argument
+func timeoutMiddleware(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		if seconds := request.GetFloat(timeoutArgument, 0); seconds > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(seconds*float64(time.Second)))
+			defer cancel()
+		}
+		return next(ctx, request)
+	}
+}
@@ -0,0 +1,64 @@
+package mcp
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToolsHaveTimeoutArgument(t *testing.T) {
+	s := newTestServer(t)
+
+	msg := handle(t, s, `{"jsonrpc":"2.0","id":1,"method":"tools/list"}`)
+	resp, ok := msg.(mcp.JSONRPCResponse)
+	require.True(t, ok, "unexpected response %+v", msg)
+	result, ok := resp.Result.(mcp.ListToolsResult)
+	require.True(t, ok)
+
+	require.NotEmpty(t, result.Tools)
+	for _, tool := range result.Tools {
+		require.Contains(t, tool.InputSchema.Properties, timeoutArgument, tool.Name)
+		require.NotContains(t, tool.InputSchema.Required, timeoutArgument, tool.Name)
+	}
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	var deadline time.Time
+	var hasDeadline bool
+	handler := timeoutMiddleware(func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		deadline, hasDeadline = ctx.Deadline()
+		return nil, nil
+	})
+
+	_, err := handler(context.Background(), mcp.CallToolRequest{})
+	require.NoError(t, err)
+	require.False(t, hasDeadline)
+
+	request := mcp.CallToolRequest{}
+	request.Params.Arguments = map[string]any{timeoutArgument: 30.0}
+	_, err = handler(context.Background(), request)
+	require.NoError(t, err)
+	require.True(t, hasDeadline)
+	require.WithinDuration(t, time.Now().Add(30*time.Second), deadline, time.Second)
+}
+
+func TestToolCallTimesOut(t *testing.T) {
+	snapshot, err := filepath.Abs("../etcdsnapshot/data/basic.snapshot")
+	require.NoError(t, err)
+
+	s := newTestServer(t)
+	start := time.Now()
+	msg := handle(t, s, `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"query_etcd","arguments":{"query":"SELECT COUNT(*) FROM {{SNAPSHOT}}","snapshot":"`+snapshot+`","timeout_seconds":0.000000001}}}`)
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	resp, ok := msg.(mcp.JSONRPCResponse)
+	require.True(t, ok, "unexpected response %+v", msg)
+	result, ok := resp.Result.(mcp.CallToolResult)
+	require.True(t, ok)
+	require.True(t, result.IsError)
+	require.Contains(t, result.Content[0].(mcp.TextContent).Text, "query timed out: context deadline exceeded")
+}
@@ -0,0 +1,123 @@
+package mcp
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mark3labs/mcp-go/server"
+)
+
+const (
+	// TransportStdio serves a single client over stdin/stdout, this is the default
+	TransportStdio = "stdio"
+	// TransportStreamableHTTP serves many clients over the streamable HTTP transport on "/mcp"
+	TransportStreamableHTTP = "http"
+	// TransportSSE serves many clients over the legacy SSE transport on "/sse" and "/message"
+	TransportSSE = "sse"
+
+	// DefaultAddr is the listen address of the HTTP transports, only reachable from the same host
+	DefaultAddr = "127.0.0.1:8080"
+
+	// shutdownTimeout is how long in-flight requests get to finish once the context is cancelled
+	shutdownTimeout = 10 * time.Second
+)
+
+// httpTransport is implemented by both the streamable HTTP and the SSE server of mcp-go
+type httpTransport interface {
+	http.Handler
+	Shutdown(ctx context.Context) error
+}
+
+// serveHTTP serves the configured HTTP transport on the given listener until the context is cancelled.
+// All sessions are handled by the same MCPServer and thus share the single query engine of this server.
+func (s *Server) serveHTTP(ctx context.Context, listener net.Listener) error {
+	httpServer := &http.Server{
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	var transport httpTransport
+	switch s.config.Transport {
+	case TransportStreamableHTTP:
+		transport = server.NewStreamableHTTPServer(s.mcpServer, server.WithStreamableHTTPServer(httpServer))
+	case TransportSSE:
+		transport = server.NewSSEServer(s.mcpServer, server.WithHTTPServer(httpServer))
+	default:
+		return fmt.Errorf("unsupported http transport: %s", s.config.Transport)
+	}
+	httpServer.Handler = withBearerToken(s.config.AuthToken, transport)
+
+	if s.config.AuthToken == "" {
+		log.Printf("warning: serving MCP over %s on %s without a bearer token", s.config.Transport, listener.Addr())
+	} else {
+		log.Printf("serving MCP over %s on %s", s.config.Transport, listener.Addr())
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- httpServer.Serve(listener)
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// the transports close their open sessions before shutting down the underlying http server
+	if err := transport.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down MCP server: %w", err)
+	}
+
+	if err := <-errChan; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// checkListenAddr refuses to serve the tools, which read and write files on the host, on other interfaces than
+// loopback without a bearer token
+func checkListenAddr(addr, token string) error {
+	if token != "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %s: %w", addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("refusing to listen on %s without a bearer token, set one or listen on a loopback address like %s", addr, DefaultAddr)
+}
+
+// withBearerToken rejects all requests that do not carry "Authorization: Bearer <token>".
+// An empty token disables the check.
+func withBearerToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := []byte(strings.TrimSpace(r.Header.Get("Authorization")))
+		if subtle.ConstantTimeCompare(given, expected) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="etcd-snapshot-analyzer"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,165 @@
+package mcp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const initializeRequest = `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"protocolVersion":"2025-03-26","capabilities":{},"clientInfo":{"name":"test","version":"1.0.0"}}}`
+
+func startHTTPServer(t *testing.T, transport, token string) (string, context.CancelFunc, chan error) {
+	server, err := NewServer(Config{
+		Name:      "test-server",
+		Version:   "1.0.0",
+		Transport: transport,
+		AuthToken: token,
+	})
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.serveHTTP(ctx, listener)
+	}()
+
+	return "http://" + listener.Addr().String(), cancel, errChan
+}
+
+func postInitialize(t *testing.T, url, token string) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(initializeRequest))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestStreamableHTTPTransport(t *testing.T) {
+	url, cancel, errChan := startHTTPServer(t, TransportStreamableHTTP, "")
+
+	resp := postInitialize(t, url+"/mcp", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotEmpty(t, resp.Header.Get("Mcp-Session-Id"))
+
+	cancel()
+	select {
+	case err := <-errChan:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not shut down after cancellation")
+	}
+}
+
+func TestStreamableHTTPTransportConcurrentSessions(t *testing.T) {
+	url, cancel, errChan := startHTTPServer(t, TransportStreamableHTTP, "")
+	defer func() {
+		cancel()
+		require.NoError(t, <-errChan)
+	}()
+
+	sessions := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		resp := postInitialize(t, url+"/mcp", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		sessions[resp.Header.Get("Mcp-Session-Id")] = true
+	}
+	require.Len(t, sessions, 3)
+}
+
+func TestStreamableHTTPTransportBearerToken(t *testing.T) {
+	url, cancel, errChan := startHTTPServer(t, TransportStreamableHTTP, "secret")
+	defer func() {
+		cancel()
+		require.NoError(t, <-errChan)
+	}()
+
+	resp := postInitialize(t, url+"/mcp", "")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = postInitialize(t, url+"/mcp", "wrong")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = postInitialize(t, url+"/mcp", "secret")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestSSETransportShutdownWithOpenStream(t *testing.T) {
+	url, cancel, errChan := startHTTPServer(t, TransportSSE, "secret")
+
+	req, err := http.NewRequest(http.MethodGet, url+"/sse", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	cancel()
+	select {
+	case err := <-errChan:
+		require.NoError(t, err)
+	case <-time.After(shutdownTimeout):
+		t.Fatal("server did not shut down with an open SSE stream")
+	}
+}
+
+func TestStartWithUnsupportedTransport(t *testing.T) {
+	server, err := NewServer(Config{Name: "test-server", Version: "1.0.0", Transport: "carrier-pigeon"})
+	require.NoError(t, err)
+
+	err = server.Start(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unsupported transport")
+}
+
+func TestWithBearerToken(t *testing.T) {
+	handler := withBearerToken("token", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.NotEmpty(t, rec.Header().Get("WWW-Authenticate"))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+}
+
+func TestCheckListenAddr(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:8080", "localhost:8080", "[::1]:8080"} {
+		require.NoError(t, checkListenAddr(addr, ""), addr)
+	}
+	for _, addr := range []string{":8080", "0.0.0.0:8080", "192.168.1.10:8080", "[::]:8080", "example.com:8080"} {
+		require.ErrorContains(t, checkListenAddr(addr, ""), "without a bearer token", addr)
+		require.NoError(t, checkListenAddr(addr, "token"), addr)
+	}
+	require.ErrorContains(t, checkListenAddr("8080", ""), "invalid listen address")
+}
+
+func TestStartRefusesPublicAddrWithoutToken(t *testing.T) {
+	server, err := NewServer(Config{Name: "test-server", Version: "1.0.0", Transport: TransportStreamableHTTP, Addr: ":0"})
+	require.NoError(t, err)
+
+	err = server.Start(context.Background())
+	require.ErrorContains(t, err, "refusing to listen on :0 without a bearer token")
+}
@@ -2,16 +2,29 @@ package query
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/cube2222/octosql/physical"
+	"github.com/tjungblu/octosql-plugin-etcdsnapshot/pkg/etcdsnapshot"
+	"github.com/tjungblu/octosql-plugin-etcdsnapshot/pkg/sqlengine"
 )
 
-// Engine wraps the octosql plugin functionality
+// Engine runs the queries in-process on the plugin's database. It holds no per-query state and
+// is safe for concurrent use, so all MCP sessions share a single instance.
 type Engine struct {
+	rules []Rule
+	// db is the plugin's database with the configuration of octosql's config file
+	db physical.Database
+	// timeout limits the queries whose context has no deadline of its own, zero is unlimited
+	timeout time.Duration
+	// index makes the queries use the persistent snapshot index of the plugin
+	index bool
 }
 
 // QueryResult represents the result of a query
@@ -27,11 +40,68 @@ type AnalysisResult struct {
 	Summary  string                 `json:"summary"`
 	Details  map[string]interface{} `json:"details"`
 	Insights []string               `json:"insights"`
+	// Findings are the rules that fired, Insights holds their messages
+	Findings []Finding `json:"findings"`
 }
 
-// NewEngine creates a new query engine
+// defaultQuota is etcd's default --quota-backend-bytes, the size thresholds of the insights are chosen for it
+// and scaled to the quota of the analyzed cluster
+const defaultQuota = 8 * 1024 * 1024 * 1024
+
+// NewEngine creates a new query engine with the built-in rules
 func NewEngine() (*Engine, error) {
-	return &Engine{}, nil
+	return newEngine(DefaultRules())
+}
+
+// NewEngineWithRules creates a new query engine that checks the given rules, see LoadRules
+func NewEngineWithRules(rules []Rule) (*Engine, error) {
+	if err := validateRules(rules); err != nil {
+		return nil, err
+	}
+	return newEngine(rules)
+}
+
+// newEngine configures the plugin like octosql would, from the etcdsnapshot database in "~/.octosql/octosql.yml",
+// so redaction, decryption and the index work the same without octosql
+func newEngine(rules []Rule) (*Engine, error) {
+	var config etcdsnapshot.Config
+	if path, err := etcdsnapshot.DefaultConfigPath(); err == nil {
+		if config, err = etcdsnapshot.LoadConfig(path); err != nil {
+			return nil, err
+		}
+	}
+	// the plugin logs to the stderr of the command or server now, only its warnings unless configured otherwise
+	if config.LogLevel == "" {
+		config.LogLevel = "warn"
+	}
+	db, err := etcdsnapshot.NewDatabase(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid plugin configuration: %w", err)
+	}
+	return &Engine{rules: rules, db: db}, nil
+}
+
+// WithTimeout returns a copy of the engine whose queries fail once they ran for longer than timeout, unless
+// their context has a deadline already. Zero disables the timeout.
+func (e *Engine) WithTimeout(timeout time.Duration) *Engine {
+	engine := *e
+	engine.timeout = timeout
+	return &engine
+}
+
+// WithIndex returns a copy of the engine whose queries use the persistent index of the plugin. The queries of the
+// engine already share the open snapshot, its statistics and its timeline, the index carries over to the next
+// process: the first query builds it, the following ones answer the meta table and the queries that don't select
+// the value from it instead of scanning the snapshot again.
+func (e *Engine) WithIndex(index bool) *Engine {
+	engine := *e
+	engine.index = index
+	return &engine
+}
+
+// Rules returns the rules the engine checks
+func (e *Engine) Rules() []Rule {
+	return e.rules
 }
 
 // ExecuteQuery executes a SQL query against an etcd snapshot
@@ -41,70 +111,82 @@ func (e *Engine) ExecuteQuery(ctx context.Context, query string, snapshot string
 		if err != nil {
 			return nil, err
 		}
-		query = strings.ReplaceAll(query, "{{SNAPSHOT}}", snapshotPath)
+		query = snapshotTable(query, snapshotPath, e.index)
 	}
 
-	cmd := exec.CommandContext(ctx, "octosql", query, "--output", "json")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			return nil, fmt.Errorf("failed to execute query: exit code %d, query: %s, output: %s", exitErr.ExitCode(), query, string(output))
-		}
-		return nil, fmt.Errorf("failed to execute query: %w, query: %s, output: %s", err, query, string(output))
+	var timeout time.Duration
+	if _, ok := ctx.Deadline(); !ok && e.timeout > 0 {
+		timeout = e.timeout
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
-	// Parse newline-delimited JSON output
-	var result QueryResult
-	var data []map[string]interface{}
-	var columns []string               // Preserve order of columns as they first appear
-	columnSet := make(map[string]bool) // Track which columns we've seen to avoid duplicates
-
-	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
-
-	for _, line := range lines {
-		if line == "" {
-			continue
-		}
+	// the scans report their progress to the caller, if it asked for it, instead of logging it
+	ctx = etcdsnapshot.WithProgress(ctx, pluginProgress(progressFromContext(ctx)))
 
-		var row map[string]interface{}
-		if err := json.Unmarshal([]byte(line), &row); err != nil {
-			return nil, fmt.Errorf("failed to parse JSON output from octosql: %w (raw output: %s)", err, string(output))
+	rows, err := sqlengine.Execute(ctx, e.db, query)
+	if err != nil {
+		if err := contextError(ctx, timeout); err != nil {
+			return nil, err
 		}
+		return nil, fmt.Errorf("failed to execute query: %w, query: %s", err, query)
+	}
 
-		// Collect column names from this row, preserving order
-		for col := range row {
-			if !columnSet[col] {
-				columns = append(columns, col)
-				columnSet[col] = true
-			}
+	data := make([]map[string]interface{}, len(rows.Rows))
+	for i, row := range rows.Rows {
+		data[i] = make(map[string]interface{}, len(row))
+		for j, v := range row {
+			data[i][rows.Columns[j]] = resultValue(v)
 		}
-
-		data = append(data, row)
 	}
+	return &QueryResult{Data: data, Columns: rows.Columns, Count: len(data)}, nil
+}
 
-	result = QueryResult{
-		Data:    data,
-		Columns: columns,
-		Count:   len(data),
-	}
+// resultValue converts a value of the SQL engine the way octosql's JSON output has it, numbers are float64 and
+// times RFC 3339 strings
+func resultValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int64:
+		return float64(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case time.Duration:
+		return v.String()
+	}
+	return v
+}
 
-	return &result, nil
+// contextError returns an error saying whether the query timed out or was cancelled once ctx is done, timeout
+// is the engine's timeout if it applied to the query
+func contextError(ctx context.Context, timeout time.Duration) error {
+	err := ctx.Err()
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.DeadlineExceeded) && timeout > 0:
+		return fmt.Errorf("query timed out after %s: %w", timeout, err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("query timed out: %w", err)
+	default:
+		return fmt.Errorf("query cancelled: %w", err)
+	}
 }
 
 // GetClusterOverview provides a high-level cluster overview
 func (e *Engine) GetClusterOverview(ctx context.Context, snapshot string) (*AnalysisResult, error) {
 	queries := []string{
 		"SELECT COUNT(*) as total_resources FROM {{SNAPSHOT}}",
-		"SELECT resourceType, COUNT(*) as count FROM {{SNAPSHOT}} GROUP BY resourceType ORDER BY count DESC LIMIT 10",
+		resourceTypesQuery,
 		"SELECT namespace, COUNT(*) as count FROM {{SNAPSHOT}} WHERE namespace IS NOT NULL GROUP BY namespace ORDER BY count DESC LIMIT 10",
 		"SELECT namespace, SUM(valueSize) as total_size FROM {{SNAPSHOT}} WHERE namespace IS NOT NULL GROUP BY namespace ORDER BY total_size DESC LIMIT 5",
 	}
 
+	in := e.newRuleInput(ctx, snapshot, "")
 	details := make(map[string]interface{})
-	insights := []string{}
 
 	for i, query := range queries {
-		result, err := e.ExecuteQuery(ctx, query, snapshot)
+		result, err := in.query(query)
 		if err != nil {
 			return nil, fmt.Errorf("failed to execute overview query %d: %w", i, err)
 		}
@@ -113,45 +195,30 @@ func (e *Engine) GetClusterOverview(ctx context.Context, snapshot string) (*Anal
 		case 0:
 			details["total_resources"] = result.Data
 		case 1:
-			details["resource_types"] = result.Data
-			if len(result.Data) > 0 {
-				if count, ok := result.Data[0]["count"].(float64); ok && count > 1000 {
-					insights = append(insights, fmt.Sprintf("High resource count detected: %.0f total resources", count))
-				}
-			}
+			details["resource_types"] = firstRows(result.Data, 10)
 		case 2:
 			details["namespaces"] = result.Data
 		case 3:
 			details["namespace_sizes"] = result.Data
-			if len(result.Data) > 0 {
-				if size, ok := result.Data[0]["total_size"].(float64); ok && size > 10000000 {
-					insights = append(insights, fmt.Sprintf("Large namespace detected: %.2f MB", size/1000000))
-				}
-			}
 		}
 	}
 
-	return &AnalysisResult{
-		Type:     "overview",
-		Summary:  "Cluster overview analysis completed",
-		Details:  details,
-		Insights: insights,
-	}, nil
+	return e.analysisResult(in, AnalysisOverview, "Cluster overview analysis completed", details)
 }
 
 // GetResourceAnalysis performs resource analysis
 func (e *Engine) GetResourceAnalysis(ctx context.Context, snapshot string) (*AnalysisResult, error) {
 	queries := []string{
-		"SELECT resourceType, COUNT(*) as count FROM {{SNAPSHOT}} GROUP BY resourceType ORDER BY count DESC",
+		resourceTypesQuery,
 		"SELECT namespace, COUNT(*) as count FROM {{SNAPSHOT}} WHERE resourceType = 'pods' GROUP BY namespace ORDER BY count DESC LIMIT 10",
 		"SELECT namespace, COUNT(*) as count FROM {{SNAPSHOT}} WHERE resourceType = 'services' GROUP BY namespace ORDER BY count DESC LIMIT 10",
 	}
 
+	in := e.newRuleInput(ctx, snapshot, "")
 	details := make(map[string]interface{})
-	insights := []string{}
 
 	for i, query := range queries {
-		result, err := e.ExecuteQuery(ctx, query, snapshot)
+		result, err := in.query(query)
 		if err != nil {
 			return nil, fmt.Errorf("failed to execute resource query %d: %w", i, err)
 		}
@@ -166,110 +233,165 @@ func (e *Engine) GetResourceAnalysis(ctx context.Context, snapshot string) (*Ana
 		}
 	}
 
-	insights = append(insights, "Resource analysis shows cluster resource distribution")
-
-	return &AnalysisResult{
-		Type:     "resources",
-		Summary:  "Resource analysis completed",
-		Details:  details,
-		Insights: insights,
-	}, nil
+	return e.analysisResult(in, AnalysisResources, "Resource analysis completed", details)
 }
 
 // GetPerformanceAnalysis performs performance analysis
 func (e *Engine) GetPerformanceAnalysis(ctx context.Context, snapshot string) (*AnalysisResult, error) {
+	in := e.newRuleInput(ctx, snapshot, "")
 	details := make(map[string]interface{})
-	insights := []string{}
 
 	// Get maximum revision
-	maxRevisionResult, err := e.ExecuteQuery(ctx, "SELECT MAX(createRevision) as max_revision FROM {{SNAPSHOT}} t", snapshot)
+	maxRevisionResult, err := in.query("SELECT MAX(createRevision) as max_revision FROM {{SNAPSHOT}} t")
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute max revision query: %w", err)
 	}
 	details["max_revision"] = maxRevisionResult.Data
 
 	// Find keys with multiple revisions and their total impact
-	multiRevisionKeysResult, err := e.ExecuteQuery(ctx,
-		"SELECT t.key, COUNT(*) as revision_count, SUM(valueSize) as total_size, AVG(valueSize) as avg_size FROM {{SNAPSHOT}} t GROUP BY t.key ORDER BY total_size DESC LIMIT 10",
-		snapshot)
+	multiRevisionKeysResult, err := in.query(multiRevisionKeysQuery)
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute multi-revision keys query: %w", err)
 	}
 	details["multi_revision_keys"] = multiRevisionKeysResult.Data
 
-	// Generate insights for high-churn keys
-	for _, row := range multiRevisionKeysResult.Data {
-		if revCount, ok := row["revision_count"].(float64); ok && revCount > 5 {
-			if totalSize, ok := row["total_size"].(float64); ok && totalSize > 100000 {
-				if key, ok := row["key"].(string); ok {
-					insights = append(insights, fmt.Sprintf("High-churn key detected: '%s' has %.0f revisions totaling %.2f KB", key, revCount, totalSize/1024))
-				}
-			}
-		}
-	}
-
 	// Find the most frequently modified keys
-	mostModifiedKeysResult, err := e.ExecuteQuery(ctx,
-		"SELECT t.key, COUNT(*) as revision_count, MIN(createRevision) as first_revision, MAX(modRevision) as last_revision FROM {{SNAPSHOT}} t GROUP BY t.key ORDER BY revision_count DESC LIMIT 10",
-		snapshot)
+	mostModifiedKeysResult, err := in.query(mostModifiedKeysQuery)
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute most modified keys query: %w", err)
 	}
 	details["most_modified_keys"] = mostModifiedKeysResult.Data
 
-	// Generate insights for excessive modifications
-	if len(mostModifiedKeysResult.Data) > 0 {
-		if count, ok := mostModifiedKeysResult.Data[0]["revision_count"].(float64); ok && count > 10 {
-			insights = append(insights, fmt.Sprintf("Excessive key modifications detected: %.0f revisions for top key", count))
-		}
-	}
-
 	// Find the largest single values (potential bloat)
-	largestValuesResult, err := e.ExecuteQuery(ctx,
-		"SELECT t.key, valueSize, modRevision FROM {{SNAPSHOT}} t ORDER BY valueSize DESC LIMIT 10",
-		snapshot)
+	largestValuesResult, err := in.query("SELECT t.key, valueSize, modRevision FROM {{SNAPSHOT}} t ORDER BY valueSize DESC LIMIT 10")
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute largest values query: %w", err)
 	}
 	details["largest_values"] = largestValuesResult.Data
 
-	// Generate insights for large values
-	if len(largestValuesResult.Data) > 0 {
-		if size, ok := largestValuesResult.Data[0]["valueSize"].(float64); ok && size > 1000000 {
-			insights = append(insights, fmt.Sprintf("Large value detected: %.2f MB", size/1000000))
-		}
+	return e.analysisResult(in, AnalysisPerformance, "Performance analysis completed with focus on revision patterns and storage impact", details)
+}
+
+// GetChurnAnalysis aggregates the writes retained in the snapshot per resource type, namespace and field manager
+// and flags controllers rewriting objects in a hot loop. The churn table is read once, the views and the rules are
+// derived from its rows.
+func (e *Engine) GetChurnAnalysis(ctx context.Context, snapshot string, limit string) (*AnalysisResult, error) {
+	n, err := strconv.Atoi(limit)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid limit '%s', expected a positive number", limit)
 	}
 
-	// Add summary insights
-	if len(details["multi_revision_keys"].([]map[string]interface{})) > 0 {
-		insights = append(insights, "Multiple keys have multiple revisions - consider investigating write patterns")
+	in := e.newRuleInput(ctx, snapshot, "")
+	result, err := in.query(churnGroupsQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute churn query: %w", err)
+	}
+	details := map[string]interface{}{
+		"churn_groups":     firstRows(result.Data, n),
+		"by_resource_type": firstRows(churnByResourceType(result.Data), n),
+		"by_field_manager": firstRows(churnByFieldManager(result.Data), n),
+		"hot_loops":        churnHotLoops(result.Data),
 	}
 
-	return &AnalysisResult{
-		Type:     "performance",
-		Summary:  "Performance analysis completed with focus on revision patterns and storage impact",
-		Details:  details,
-		Insights: insights,
-	}, nil
+	return e.analysisResult(in, AnalysisChurn, fmt.Sprintf("Churn analysis completed for the top %d writers", n), details)
 }
 
 // FindResources finds specific resources
 func (e *Engine) FindResources(ctx context.Context, resourceType, namespace, name, snapshot string) (*QueryResult, error) {
-	query := fmt.Sprintf("SELECT * FROM {{SNAPSHOT}} WHERE resourceType = '%s'", resourceType)
+	query := "SELECT * FROM {{SNAPSHOT}} WHERE resourceType = " + quoteString(resourceType)
+	if filters := resourceFilters("", namespace, name); filters != "" {
+		query += " AND " + filters
+	}
+	query += " ORDER BY createRevision DESC"
 
+	return e.ExecuteQuery(ctx, query, snapshot)
+}
+
+// resourceFilters returns the conditions matching the given resource type, namespace and name, empty ones
+// match everything
+func resourceFilters(resourceType, namespace, name string) string {
+	var filters []string
+	if resourceType != "" {
+		filters = append(filters, "resourceType = "+quoteString(resourceType))
+	}
 	if namespace != "" {
-		query += fmt.Sprintf(" AND namespace = '%s'", namespace)
+		filters = append(filters, "namespace = "+quoteString(namespace))
 	}
-
 	if name != "" {
-		query += fmt.Sprintf(" AND name = '%s'", name)
+		filters = append(filters, "name = "+quoteString(name))
 	}
+	return strings.Join(filters, " AND ")
+}
 
-	query += " ORDER BY createRevision DESC"
+// GetKey returns the latest revision of a single key including its value
+func (e *Engine) GetKey(ctx context.Context, snapshot, key string) (*QueryResult, error) {
+	query := fmt.Sprintf(`
+		SELECT t.key, resourceType, namespace, name, createRevision, modRevision, version, lease, valueSize, value
+		FROM {{SNAPSHOT}} t
+		WHERE t.key = %s
+		ORDER BY modRevision DESC
+		LIMIT 1`, quoteString(key))
 
 	return e.ExecuteQuery(ctx, query, snapshot)
 }
 
+// ListNamespace lists the latest revision of every key in a namespace, without values
+func (e *Engine) ListNamespace(ctx context.Context, snapshot, namespace string) (*QueryResult, error) {
+	query := fmt.Sprintf(`
+		SELECT t.key, resourceType, name, MAX(modRevision) as modRevision, COUNT(*) as revisions
+		FROM {{SNAPSHOT}} t
+		WHERE namespace = %s
+		GROUP BY t.key, resourceType, name
+		ORDER BY resourceType, name`, quoteString(namespace))
+
+	return e.ExecuteQuery(ctx, query, snapshot)
+}
+
+// ListResourceType lists every key of a resource type, without values
+func (e *Engine) ListResourceType(ctx context.Context, snapshot, resourceType string) (*QueryResult, error) {
+	query := fmt.Sprintf(`
+		SELECT t.key, namespace, name, MAX(modRevision) as modRevision, COUNT(*) as revisions
+		FROM {{SNAPSHOT}} t
+		WHERE resourceType = %s
+		GROUP BY t.key, namespace, name
+		ORDER BY namespace, name`, quoteString(resourceType))
+
+	return e.ExecuteQuery(ctx, query, snapshot)
+}
+
+// ListLeases lists the leases attached to keys, with the revisions and bytes they hold per resource type
+func (e *Engine) ListLeases(ctx context.Context, snapshot string) (*QueryResult, error) {
+	query := `
+		SELECT lease, resourceType, COUNT(*) as revisions, SUM(valueSize) as bytes
+		FROM {{SNAPSHOT}} t
+		WHERE lease <> 0
+		GROUP BY lease, resourceType
+		ORDER BY revisions DESC, lease`
+
+	return e.ExecuteQuery(ctx, query, snapshot)
+}
+
+// MatchingKeys returns the keys with at least one revision matching the SQL condition, e.g.
+// "namespace = 'default' AND resourceType = 'configmaps'". The table is aliased t, like in ExecuteQuery.
+func (e *Engine) MatchingKeys(ctx context.Context, snapshot, where string) (map[string]bool, error) {
+	if strings.TrimSpace(where) == "" {
+		return nil, fmt.Errorf("condition must not be empty")
+	}
+	query := fmt.Sprintf("SELECT t.key FROM {{SNAPSHOT}} t WHERE (%s) GROUP BY t.key", where)
+
+	result, err := e.ExecuteQuery(ctx, query, snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the matching keys: %w", err)
+	}
+	keys := make(map[string]bool, len(result.Data))
+	for _, row := range result.Data {
+		if key, ok := row["key"].(string); ok {
+			keys[key] = true
+		}
+	}
+	return keys, nil
+}
+
 // CompareSnapshots compares two snapshots
 func (e *Engine) CompareSnapshots(ctx context.Context, snapshot1, snapshot2, diffType string) (*AnalysisResult, error) {
 	snapshot1Path, err := e.resolveSnapshot(snapshot1)
@@ -370,301 +492,273 @@ func (e *Engine) diffKeys(ctx context.Context, sourceSnapshot, targetSnapshot st
 }
 
 // GetNamespaceAnalysis analyzes namespace usage patterns
-func (e *Engine) GetNamespaceAnalysis(ctx context.Context, snapshot string, limit string) (*AnalysisResult, error) {
-	// Query for namespace storage usage
-	query := fmt.Sprintf(`
-		SELECT namespace, COUNT(*) as object_count, SUM(valueSize) as total_size_bytes, AVG(valueSize) as avg_size_bytes
-		FROM {{SNAPSHOT}} t 
-		WHERE namespace IS NOT NULL 
-		GROUP BY namespace 
-		ORDER BY total_size_bytes DESC 
-		LIMIT %s`, limit)
+func (e *Engine) GetNamespaceAnalysis(ctx context.Context, snapshot string, limit string, quota string) (*AnalysisResult, error) {
+	n, err := strconv.Atoi(limit)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid limit '%s', expected a positive number", limit)
+	}
 
-	result, err := e.ExecuteQuery(ctx, query, snapshot)
+	in := e.newRuleInput(ctx, snapshot, quota)
+
+	// Query for namespace storage usage
+	result, err := in.query(namespaceUsageQuery)
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute namespace analysis query: %w", err)
 	}
 
 	// Query for resource type distribution in top namespaces
-	resourceQuery := `
-		SELECT namespace, resourceType, COUNT(*) as count, SUM(valueSize) as total_size
-		FROM {{SNAPSHOT}} t 
-		WHERE namespace IS NOT NULL 
-		GROUP BY namespace, resourceType 
-		ORDER BY namespace, total_size DESC`
-
-	resourceResult, err := e.ExecuteQuery(ctx, resourceQuery, snapshot)
+	resourceResult, err := in.query(resourceDistributionQuery)
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute resource distribution query: %w", err)
 	}
 
 	details := make(map[string]interface{})
-	insights := []string{}
-
-	// Process namespace usage data
 	if len(result.Data) > 0 {
-		details["namespace_usage"] = result.Data
-
-		// Generate insights
-		if totalSize, ok := result.Data[0]["total_size_bytes"].(float64); ok {
-			if totalSize > 100*1024*1024 { // > 100MB
-				if namespace, ok := result.Data[0]["namespace"].(string); ok {
-					insights = append(insights, fmt.Sprintf("Namespace '%s' consumes %.2f MB of etcd storage", namespace, totalSize/(1024*1024)))
-				}
-			}
-		}
-
-		// Check for high object counts
-		if objectCount, ok := result.Data[0]["object_count"].(float64); ok {
-			if objectCount > 1000 {
-				if namespace, ok := result.Data[0]["namespace"].(string); ok {
-					insights = append(insights, fmt.Sprintf("Namespace '%s' has %.0f objects - consider monitoring for resource bloat", namespace, objectCount))
-				}
-			}
-		}
+		details["namespace_usage"] = firstRows(result.Data, n)
 	}
-
-	// Process resource distribution
 	if len(resourceResult.Data) > 0 {
 		details["resource_distribution"] = resourceResult.Data
-
-		// Check for resource type concentrations
-		resourceCounts := make(map[string]int)
-		for _, row := range resourceResult.Data {
-			if resourceType, ok := row["resourceType"].(string); ok {
-				resourceCounts[resourceType]++
-			}
-		}
-
-		for resourceType, count := range resourceCounts {
-			if count > 5 {
-				insights = append(insights, fmt.Sprintf("Resource type '%s' appears in %d namespaces", resourceType, count))
-			}
-		}
 	}
 
-	return &AnalysisResult{
-		Type:     "namespace_analysis",
-		Summary:  fmt.Sprintf("Namespace analysis completed for top %s namespaces", limit),
-		Details:  details,
-		Insights: insights,
-	}, nil
+	return e.analysisResult(in, AnalysisNamespaces, fmt.Sprintf("Namespace analysis completed for top %s namespaces", limit), details)
 }
 
-// GetSnapshotMetadata retrieves comprehensive metadata about an etcd snapshot
-func (e *Engine) GetSnapshotMetadata(ctx context.Context, snapshot string) (*AnalysisResult, error) {
-	// Query the metadata schema - need to add the meta option to access metadata
-	query := "SELECT * FROM {{SNAPSHOT}}?meta=true"
-
-	result, err := e.ExecuteQuery(ctx, query, snapshot)
+// GetSnapshotMetadata retrieves comprehensive metadata about an etcd snapshot. The quota in bytes is optional,
+// without it the quota configured in the plugin or etcd's default is used.
+func (e *Engine) GetSnapshotMetadata(ctx context.Context, snapshot string, quota string) (*AnalysisResult, error) {
+	in := e.newRuleInput(ctx, snapshot, quota)
+	metadata, err := in.metadata()
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute metadata query: %w", err)
+		return nil, err
 	}
 
 	details := make(map[string]interface{})
-	insights := []string{}
-
-	if len(result.Data) > 0 {
-		metadata := result.Data[0]
-		details["metadata"] = metadata
-
-		// Generate insights based on metadata
-		if size, ok := metadata["size"].(float64); ok {
-			if sizeInUse, ok := metadata["sizeInUse"].(float64); ok {
-				details["storage_summary"] = map[string]interface{}{
-					"total_size_mb":    size / (1024 * 1024),
-					"used_size_mb":     sizeInUse / (1024 * 1024),
-					"free_size_mb":     (size - sizeInUse) / (1024 * 1024),
-					"usage_percentage": (sizeInUse / size) * 100,
-				}
-
-				if size > 1024*1024*1024 { // > 1GB
-					insights = append(insights, fmt.Sprintf("Large etcd snapshot: %.2f GB total size", size/(1024*1024*1024)))
-				}
-			}
-		}
+	details["metadata"] = metadata
 
-		if fragRatio, ok := metadata["fragmentationRatio"].(float64); ok {
-			if fragRatio > 0.3 {
-				insights = append(insights, fmt.Sprintf("High fragmentation detected: %.1f%% - consider defragmentation", fragRatio*100))
-			}
-		}
-
-		if quotaUsage, ok := metadata["quotaUsagePercent"].(float64); ok {
-			if quotaUsage > 80 {
-				insights = append(insights, fmt.Sprintf("High quota usage: %.1f%% - monitor for approaching limits", quotaUsage))
-			}
-		}
-
-		if totalKeys, ok := metadata["totalKeys"].(float64); ok {
-			if totalRevisions, ok := metadata["totalRevisions"].(float64); ok {
-				avgRevPerKey := totalRevisions / totalKeys
-				if avgRevPerKey > 5 {
-					insights = append(insights, fmt.Sprintf("High revision density: %.1f revisions per key - investigate write patterns", avgRevPerKey))
-				}
-			}
-		}
+	quotaBytes, _ := metadata["quota"].(float64)
+	details["quota"] = map[string]interface{}{
+		"bytes":  quotaBytes,
+		"source": metadata["quotaSource"],
+	}
 
-		if keysWithMultipleRevisions, ok := metadata["keysWithMultipleRevisions"].(float64); ok {
-			if uniqueKeys, ok := metadata["uniqueKeys"].(float64); ok {
-				multiRevRatio := keysWithMultipleRevisions / uniqueKeys
-				if multiRevRatio > 0.5 {
-					insights = append(insights, fmt.Sprintf("High revision churn: %.1f%% of keys have multiple revisions", multiRevRatio*100))
-				}
+	if size, ok := metadata["size"].(float64); ok {
+		if sizeInUse, ok := metadata["sizeInUse"].(float64); ok {
+			details["storage_summary"] = map[string]interface{}{
+				"total_size_mb":    size / (1024 * 1024),
+				"used_size_mb":     sizeInUse / (1024 * 1024),
+				"free_size_mb":     (size - sizeInUse) / (1024 * 1024),
+				"usage_percentage": (sizeInUse / size) * 100,
 			}
 		}
 	}
 
-	return &AnalysisResult{
-		Type:     "metadata",
-		Summary:  "Snapshot metadata retrieved with storage and performance insights",
-		Details:  details,
-		Insights: insights,
-	}, nil
+	return e.analysisResult(in, AnalysisMetadata, "Snapshot metadata retrieved with storage and performance insights", details)
 }
 
-// AnalyzeStorageHealth performs comprehensive storage health analysis using metadata
-func (e *Engine) AnalyzeStorageHealth(ctx context.Context, snapshot string) (*AnalysisResult, error) {
-	// Get metadata first
-	metadataResult, err := e.GetSnapshotMetadata(ctx, snapshot)
+// AnalyzeStorageHealth performs comprehensive storage health analysis using metadata, the quota is
+// optional like for GetSnapshotMetadata
+func (e *Engine) AnalyzeStorageHealth(ctx context.Context, snapshot string, quota string) (*AnalysisResult, error) {
+	in := e.newRuleInput(ctx, snapshot, quota)
+	metadataDetails, err := in.metadata()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get metadata for health analysis: %w", err)
 	}
 
 	details := make(map[string]interface{})
-	insights := []string{}
-	recommendations := []string{}
-
-	// Extract metadata for analysis
-	if metadataDetails, ok := metadataResult.Details["metadata"].(map[string]interface{}); ok {
-		details["raw_metadata"] = metadataDetails
-
-		// Storage efficiency analysis
-		storageHealth := make(map[string]interface{})
-		if size, ok := metadataDetails["size"].(float64); ok {
-			if sizeInUse, ok := metadataDetails["sizeInUse"].(float64); ok {
-				efficiency := (sizeInUse / size) * 100
-				storageHealth["storage_efficiency_percent"] = efficiency
-				storageHealth["wasted_space_mb"] = (size - sizeInUse) / (1024 * 1024)
-
-				if efficiency < 70 {
-					insights = append(insights, fmt.Sprintf("Poor storage efficiency: %.1f%% - significant wasted space", efficiency))
-					recommendations = append(recommendations, "Consider running etcd defragmentation to reclaim wasted space")
-				}
-			}
-		}
-
-		// Fragmentation analysis
-		if fragRatio, ok := metadataDetails["fragmentationRatio"].(float64); ok {
-			if fragBytes, ok := metadataDetails["fragmentationBytes"].(float64); ok {
-				storageHealth["fragmentation_ratio"] = fragRatio
-				storageHealth["fragmentation_mb"] = fragBytes / (1024 * 1024)
+	details["raw_metadata"] = metadataDetails
 
-				if fragRatio > 0.2 {
-					insights = append(insights, fmt.Sprintf("Fragmentation concern: %.1f%% fragmented (%.2f MB)", fragRatio*100, fragBytes/(1024*1024)))
-					recommendations = append(recommendations, "Schedule regular defragmentation to improve performance")
-				}
-			}
+	// Storage efficiency analysis
+	storageHealth := make(map[string]interface{})
+	if size, ok := metadataDetails["size"].(float64); ok {
+		if sizeInUse, ok := metadataDetails["sizeInUse"].(float64); ok {
+			storageHealth["storage_efficiency_percent"] = (sizeInUse / size) * 100
+			storageHealth["wasted_space_mb"] = (size - sizeInUse) / (1024 * 1024)
 		}
+	}
 
-		// Quota health
-		quotaHealth := make(map[string]interface{})
-		if quotaUsage, ok := metadataDetails["quotaUsagePercent"].(float64); ok {
-			if quotaRemaining, ok := metadataDetails["quotaRemaining"].(float64); ok {
-				quotaHealth["usage_percent"] = quotaUsage
-				quotaHealth["remaining_mb"] = quotaRemaining / (1024 * 1024)
-
-				if quotaUsage > 85 {
-					insights = append(insights, fmt.Sprintf("Critical quota usage: %.1f%% - immediate attention required", quotaUsage))
-					recommendations = append(recommendations, "Urgent: Investigate large objects and consider quota increase")
-				} else if quotaUsage > 70 {
-					insights = append(insights, fmt.Sprintf("High quota usage: %.1f%% - monitor closely", quotaUsage))
-					recommendations = append(recommendations, "Monitor quota usage and plan for potential increase")
-				}
-			}
+	// Fragmentation analysis
+	if fragRatio, ok := metadataDetails["fragmentationRatio"].(float64); ok {
+		if fragBytes, ok := metadataDetails["fragmentationBytes"].(float64); ok {
+			storageHealth["fragmentation_ratio"] = fragRatio
+			storageHealth["fragmentation_mb"] = fragBytes / (1024 * 1024)
 		}
+	}
 
-		// Revision health
-		revisionHealth := make(map[string]interface{})
-		if totalKeys, ok := metadataDetails["totalKeys"].(float64); ok {
-			if totalRevisions, ok := metadataDetails["totalRevisions"].(float64); ok {
-				if avgRevPerKey, ok := metadataDetails["avgRevisionsPerKey"].(float64); ok {
-					revisionHealth["total_keys"] = totalKeys
-					revisionHealth["total_revisions"] = totalRevisions
-					revisionHealth["avg_revisions_per_key"] = avgRevPerKey
-
-					if avgRevPerKey > 10 {
-						insights = append(insights, fmt.Sprintf("Excessive revision buildup: %.1f avg revisions per key", avgRevPerKey))
-						recommendations = append(recommendations, "Consider more aggressive compaction policy to reduce revision history")
-					}
-				}
-			}
+	// Quota health
+	quotaHealth := make(map[string]interface{})
+	quotaBytes, _ := metadataDetails["quota"].(float64)
+	quotaHealth["quota_mb"] = quotaBytes / (1024 * 1024)
+	quotaHealth["quota_source"] = metadataDetails["quotaSource"]
+	if quotaUsage, ok := metadataDetails["quotaUsagePercent"].(float64); ok {
+		if quotaRemaining, ok := metadataDetails["quotaRemaining"].(float64); ok {
+			quotaHealth["usage_percent"] = quotaUsage
+			quotaHealth["remaining_mb"] = quotaRemaining / (1024 * 1024)
 		}
+	}
 
-		if keysWithMultipleRevisions, ok := metadataDetails["keysWithMultipleRevisions"].(float64); ok {
-			if uniqueKeys, ok := metadataDetails["uniqueKeys"].(float64); ok {
-				multiRevRatio := (keysWithMultipleRevisions / uniqueKeys) * 100
-				revisionHealth["keys_with_multiple_revisions_percent"] = multiRevRatio
-
-				if multiRevRatio > 60 {
-					insights = append(insights, fmt.Sprintf("High revision churn: %.1f%% of keys have multiple revisions", multiRevRatio))
-					recommendations = append(recommendations, "Investigate write patterns causing high revision churn")
-				}
+	// Revision health
+	revisionHealth := make(map[string]interface{})
+	if totalKeys, ok := metadataDetails["totalKeys"].(float64); ok {
+		if totalRevisions, ok := metadataDetails["totalRevisions"].(float64); ok {
+			if avgRevPerKey, ok := metadataDetails["avgRevisionsPerKey"].(float64); ok {
+				revisionHealth["total_keys"] = totalKeys
+				revisionHealth["total_revisions"] = totalRevisions
+				revisionHealth["avg_revisions_per_key"] = avgRevPerKey
 			}
 		}
+	}
 
-		// Value size analysis
-		valueSizeHealth := make(map[string]interface{})
-		if avgValueSize, ok := metadataDetails["averageValueSize"].(float64); ok {
-			if largestValueSize, ok := metadataDetails["largestValueSize"].(float64); ok {
-				valueSizeHealth["average_value_size_bytes"] = avgValueSize
-				valueSizeHealth["largest_value_size_mb"] = largestValueSize / (1024 * 1024)
-
-				if largestValueSize > 10*1024*1024 { // > 10MB
-					insights = append(insights, fmt.Sprintf("Large value detected: %.2f MB - investigate potential data bloat", largestValueSize/(1024*1024)))
-					recommendations = append(recommendations, "Investigate large values and consider data optimization")
-				}
-			}
+	if keysWithMultipleRevisions, ok := metadataDetails["keysWithMultipleRevisions"].(float64); ok {
+		if uniqueKeys, ok := metadataDetails["uniqueKeys"].(float64); ok {
+			revisionHealth["keys_with_multiple_revisions_percent"] = (keysWithMultipleRevisions / uniqueKeys) * 100
 		}
+	}
 
-		// Lease health
-		if keysWithLeases, ok := metadataDetails["keysWithLeases"].(float64); ok {
-			if activeLeases, ok := metadataDetails["activeLeases"].(float64); ok {
-				leaseHealth := map[string]interface{}{
-					"keys_with_leases": keysWithLeases,
-					"active_leases":    activeLeases,
-				}
-				details["lease_health"] = leaseHealth
-
-				if activeLeases > 1000 {
-					insights = append(insights, fmt.Sprintf("High lease count: %.0f active leases - monitor for lease accumulation", activeLeases))
-				}
-			}
+	// Value size analysis
+	valueSizeHealth := make(map[string]interface{})
+	if avgValueSize, ok := metadataDetails["averageValueSize"].(float64); ok {
+		if largestValueSize, ok := metadataDetails["largestValueSize"].(float64); ok {
+			valueSizeHealth["average_value_size_bytes"] = avgValueSize
+			valueSizeHealth["largest_value_size_mb"] = largestValueSize / (1024 * 1024)
 		}
+	}
 
-		// Compaction savings estimate
-		if compactionSavings, ok := metadataDetails["estimatedCompactionSavings"].(float64); ok {
-			if compactionSavings > 100*1024*1024 { // > 100MB
-				insights = append(insights, fmt.Sprintf("Significant compaction potential: %.2f MB could be saved", compactionSavings/(1024*1024)))
-				recommendations = append(recommendations, "Run compaction to reclaim space and improve performance")
+	// Lease health
+	if keysWithLeases, ok := metadataDetails["keysWithLeases"].(float64); ok {
+		if activeLeases, ok := metadataDetails["activeLeases"].(float64); ok {
+			details["lease_health"] = map[string]interface{}{
+				"keys_with_leases": keysWithLeases,
+				"active_leases":    activeLeases,
 			}
 		}
+	}
+
+	details["storage_health"] = storageHealth
+	details["quota_health"] = quotaHealth
+	details["revision_health"] = revisionHealth
+	details["value_size_health"] = valueSizeHealth
+
+	result, err := e.analysisResult(in, AnalysisStorageHealth, "Storage health analysis completed", details)
+	if err != nil {
+		return nil, err
+	}
+	details["recommendations"] = recommendationsOf(result.Findings)
+	return result, nil
+}
+
+// CheckHealth evaluates every enabled rule against the snapshot, the quota is optional like for
+// GetSnapshotMetadata
+func (e *Engine) CheckHealth(ctx context.Context, snapshot string, quota string) (*AnalysisResult, error) {
+	return e.checkHealth(e.newRuleInput(ctx, snapshot, quota))
+}
+
+func (e *Engine) checkHealth(in *ruleInput) (*AnalysisResult, error) {
+	findings, err := e.evaluateRules(in, "")
+	if err != nil {
+		return nil, err
+	}
 
-		details["storage_health"] = storageHealth
-		details["quota_health"] = quotaHealth
-		details["revision_health"] = revisionHealth
-		details["value_size_health"] = valueSizeHealth
+	counts := make(map[Severity]int)
+	for _, f := range findings {
+		counts[f.Severity]++
 	}
 
-	details["recommendations"] = recommendations
 	return &AnalysisResult{
-		Type:     "storage_health",
-		Summary:  "Storage health analysis completed",
+		Type:    "health",
+		Summary: fmt.Sprintf("Health check completed with %d critical, %d warning and %d info findings", counts[SeverityCritical], counts[SeverityWarning], counts[SeverityInfo]),
+		Details: map[string]interface{}{
+			"recommendations": recommendationsOf(findings),
+		},
+		Insights: insightsOf(findings),
+		Findings: findings,
+	}, nil
+}
+
+// analysisResult evaluates the rules of an analysis on its input and returns the result with the findings
+func (e *Engine) analysisResult(in *ruleInput, analysis, summary string, details map[string]interface{}) (*AnalysisResult, error) {
+	findings, err := e.evaluateRules(in, analysis)
+	if err != nil {
+		return nil, err
+	}
+	return &AnalysisResult{
+		Type:     analysisTypes[analysis],
+		Summary:  summary,
 		Details:  details,
-		Insights: insights,
+		Insights: insightsOf(findings),
+		Findings: findings,
 	}, nil
 }
 
+// analysisTypes maps the analyses to the type of their result, which predates the rules
+var analysisTypes = map[string]string{
+	AnalysisOverview:      "overview",
+	AnalysisResources:     "resources",
+	AnalysisPerformance:   "performance",
+	AnalysisNamespaces:    "namespace_analysis",
+	AnalysisMetadata:      "metadata",
+	AnalysisStorageHealth: "storage_health",
+	AnalysisChurn:         "churn",
+}
+
+// firstRows returns at most n rows
+func firstRows(rows []map[string]interface{}, n int) []map[string]interface{} {
+	if len(rows) > n {
+		return rows[:n]
+	}
+	return rows
+}
+
+// snapshotQuota returns the quota in bytes the snapshot is analyzed against, which is the given quota or the
+// one reported by the plugin
+func (e *Engine) snapshotQuota(ctx context.Context, snapshot string, quota string) (float64, error) {
+	table, err := metaTable(quota)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := e.ExecuteQuery(ctx, "SELECT quota FROM "+table, snapshot)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query the quota: %w", err)
+	}
+	if len(result.Data) == 0 {
+		return 0, fmt.Errorf("no metadata found for snapshot %s", snapshot)
+	}
+
+	quotaBytes, _ := result.Data[0]["quota"].(float64)
+	return quotaBytes, nil
+}
+
+// snapshotTable replaces {{SNAPSHOT}} in the query with the path of the snapshot, with the index option when
+// index is set. Options given after {{SNAPSHOT}}, like "?table=churn", are kept.
+func snapshotTable(query, snapshotPath string, index bool) string {
+	if index {
+		query = strings.ReplaceAll(query, "{{SNAPSHOT}}?", snapshotPath+"?index=true&")
+		snapshotPath += "?index=true"
+	}
+	return strings.ReplaceAll(query, "{{SNAPSHOT}}", snapshotPath)
+}
+
+// metaTable returns the meta table of {{SNAPSHOT}}, overriding the quota when one is given
+func metaTable(quota string) (string, error) {
+	if quota == "" {
+		return "{{SNAPSHOT}}?meta=true", nil
+	}
+
+	n, err := strconv.ParseInt(quota, 10, 64)
+	if err != nil || n < 1 {
+		return "", fmt.Errorf("invalid quota '%s', expected a size in bytes", quota)
+	}
+	return fmt.Sprintf("{{SNAPSHOT}}?meta=true&quota=%d", n), nil
+}
+
+// scaleToQuota scales a size threshold chosen for etcd's default quota to the quota of the cluster
+func scaleToQuota(threshold, quota float64) float64 {
+	if quota <= 0 {
+		return threshold
+	}
+	return threshold * quota / defaultQuota
+}
+
 // resolveSnapshot resolves the snapshot path
 func (e *Engine) resolveSnapshot(snapshot string) (string, error) {
 	if snapshot == "" {
@@ -683,3 +777,8 @@ func (e *Engine) resolveSnapshot(snapshot string) (string, error) {
 
 	return snapshot, nil
 }
+
+// quoteString turns s into a SQL string literal, escaping embedded single quotes
+func quoteString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -6,8 +6,13 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/cube2222/octosql/execution"
+	"github.com/cube2222/octosql/octosql"
+	"github.com/cube2222/octosql/physical"
 	"github.com/stretchr/testify/require"
+	"github.com/tjungblu/octosql-plugin-etcdsnapshot/pkg/etcdsnapshot"
 )
 
 func TestNewEngine(t *testing.T) {
@@ -200,13 +205,9 @@ func TestFindResourcesWithNoResults(t *testing.T) {
 	require.NotNil(t, result)
 	require.Equal(t, 0, result.Count)
 
-	// Data and Columns might be nil for empty results, which is acceptable
-	if result.Data != nil {
-		require.Empty(t, result.Data)
-	}
-	if result.Columns != nil {
-		require.Empty(t, result.Columns)
-	}
+	// the columns are known without rows
+	require.Empty(t, result.Data)
+	require.Contains(t, result.Columns, "key")
 }
 
 func TestFindResourcesQueryConstruction(t *testing.T) {
@@ -262,7 +263,7 @@ func TestGetNamespaceAnalysisStructure(t *testing.T) {
 		t.Skip("Test snapshot not found, skipping integration test")
 	}
 
-	result, err := engine.GetNamespaceAnalysis(context.Background(), snapshotPath, "5")
+	result, err := engine.GetNamespaceAnalysis(context.Background(), snapshotPath, "5", "")
 	require.NoError(t, err)
 
 	// Check structure
@@ -341,7 +342,7 @@ func TestGetSnapshotMetadataStructure(t *testing.T) {
 		t.Skip("Test snapshot not found, skipping integration test")
 	}
 
-	result, err := engine.GetSnapshotMetadata(context.Background(), snapshotPath)
+	result, err := engine.GetSnapshotMetadata(context.Background(), snapshotPath, "")
 	require.NoError(t, err)
 
 	// Check structure
@@ -373,7 +374,7 @@ func TestGetSnapshotMetadataWithInvalidSnapshot(t *testing.T) {
 	engine, err := NewEngine()
 	require.NoError(t, err)
 
-	_, err = engine.GetSnapshotMetadata(context.Background(), "/nonexistent/path.snapshot")
+	_, err = engine.GetSnapshotMetadata(context.Background(), "/nonexistent/path.snapshot", "")
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "does not exist")
 }
@@ -388,7 +389,7 @@ func TestGetSnapshotMetadataInsights(t *testing.T) {
 		t.Skip("Test snapshot not found, skipping integration test")
 	}
 
-	result, err := engine.GetSnapshotMetadata(context.Background(), snapshotPath)
+	result, err := engine.GetSnapshotMetadata(context.Background(), snapshotPath, "")
 	require.NoError(t, err)
 
 	// Check that insights are generated based on metadata
@@ -423,7 +424,7 @@ func TestAnalyzeStorageHealthStructure(t *testing.T) {
 		t.Skip("Test snapshot not found, skipping integration test")
 	}
 
-	result, err := engine.AnalyzeStorageHealth(context.Background(), snapshotPath)
+	result, err := engine.AnalyzeStorageHealth(context.Background(), snapshotPath, "")
 	require.NoError(t, err)
 
 	// Check structure
@@ -479,7 +480,7 @@ func TestAnalyzeStorageHealthWithInvalidSnapshot(t *testing.T) {
 	engine, err := NewEngine()
 	require.NoError(t, err)
 
-	_, err = engine.AnalyzeStorageHealth(context.Background(), "/nonexistent/path.snapshot")
+	_, err = engine.AnalyzeStorageHealth(context.Background(), "/nonexistent/path.snapshot", "")
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "failed to get metadata")
 }
@@ -494,7 +495,7 @@ func TestAnalyzeStorageHealthInsightsGeneration(t *testing.T) {
 		t.Skip("Test snapshot not found, skipping integration test")
 	}
 
-	result, err := engine.AnalyzeStorageHealth(context.Background(), snapshotPath)
+	result, err := engine.AnalyzeStorageHealth(context.Background(), snapshotPath, "")
 	require.NoError(t, err)
 
 	// Check that insights are generated
@@ -529,7 +530,7 @@ func TestAnalyzeStorageHealthMetricsCalculation(t *testing.T) {
 		t.Skip("Test snapshot not found, skipping integration test")
 	}
 
-	result, err := engine.AnalyzeStorageHealth(context.Background(), snapshotPath)
+	result, err := engine.AnalyzeStorageHealth(context.Background(), snapshotPath, "")
 	require.NoError(t, err)
 
 	// Test that calculated metrics are reasonable
@@ -579,3 +580,300 @@ func TestAnalyzeStorageHealthMetricsCalculation(t *testing.T) {
 		}
 	}
 }
+
+func TestQuoteString(t *testing.T) {
+	require.Equal(t, "'pods'", quoteString("pods"))
+	require.Equal(t, "'it''s'", quoteString("it's"))
+	require.Equal(t, "''", quoteString(""))
+}
+
+func TestGetKeyWithInvalidSnapshot(t *testing.T) {
+	engine, err := NewEngine()
+	require.NoError(t, err)
+
+	_, err = engine.GetKey(context.Background(), "relative.snapshot", "/kubernetes.io/pods/default/nginx")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "snapshot path must be absolute")
+}
+
+func TestSnapshotTable(t *testing.T) {
+	query := "SELECT * FROM {{SNAPSHOT}} a JOIN {{SNAPSHOT}}?table=churn b ON a.key = b.hotKey"
+	require.Equal(t, "SELECT * FROM /a.snapshot a JOIN /a.snapshot?table=churn b ON a.key = b.hotKey", snapshotTable(query, "/a.snapshot", false))
+	require.Equal(t, "SELECT * FROM /a.snapshot?index=true a JOIN /a.snapshot?index=true&table=churn b ON a.key = b.hotKey", snapshotTable(query, "/a.snapshot", true))
+}
+
+func TestExecuteQueryWithIndex(t *testing.T) {
+	// the index is stored next to the snapshot
+	data, err := os.ReadFile(basicSnapshot(t))
+	require.NoError(t, err)
+	snapshot := filepath.Join(t.TempDir(), "etcd.snapshot")
+	require.NoError(t, os.WriteFile(snapshot, data, 0600))
+	engine, err := NewEngine()
+	require.NoError(t, err)
+	db := &recordingDatabase{Database: engine.db}
+	engine.db = db
+
+	_, err = engine.WithIndex(true).ExecuteQuery(context.Background(), "SELECT * FROM {{SNAPSHOT}}?meta=true", snapshot)
+	require.NoError(t, err)
+	require.Equal(t, []map[string]string{{"index": "true", "meta": "true"}}, db.options)
+
+	// the copy doesn't change the engine
+	db.options = nil
+	_, err = engine.ExecuteQuery(context.Background(), "SELECT * FROM {{SNAPSHOT}}?meta=true", snapshot)
+	require.NoError(t, err)
+	require.Equal(t, []map[string]string{{"meta": "true"}}, db.options)
+}
+func TestMetaTable(t *testing.T) {
+	table, err := metaTable("")
+	require.NoError(t, err)
+	require.Equal(t, "{{SNAPSHOT}}?meta=true", table)
+
+	table, err = metaTable("2147483648")
+	require.NoError(t, err)
+	require.Equal(t, "{{SNAPSHOT}}?meta=true&quota=2147483648", table)
+
+	for _, invalid := range []string{"2GB", "0", "-5", "1 OR 1=1"} {
+		_, err = metaTable(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestScaleToQuota(t *testing.T) {
+	require.Equal(t, float64(100), scaleToQuota(100, 0))
+	require.Equal(t, float64(100), scaleToQuota(100, defaultQuota))
+	require.Equal(t, float64(25), scaleToQuota(100, 2*1024*1024*1024))
+	require.Equal(t, float64(200), scaleToQuota(100, 16*1024*1024*1024))
+}
+
+func TestGetSnapshotMetadataWithInvalidQuota(t *testing.T) {
+	engine, err := NewEngine()
+	require.NoError(t, err)
+
+	_, err = engine.GetSnapshotMetadata(context.Background(), "/nonexistent/path.snapshot", "lots")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid quota")
+}
+
+func TestGetChurnAnalysisStructure(t *testing.T) {
+	engine, err := NewEngine()
+	require.NoError(t, err)
+
+	// Create a test snapshot path
+	snapshotPath := filepath.Join(os.ExpandEnv("$HOME/snapshots"), "a.snapshot")
+	if _, err := os.Stat(snapshotPath); os.IsNotExist(err) {
+		t.Skip("Test snapshot not found, skipping integration test")
+	}
+
+	result, err := engine.GetChurnAnalysis(context.Background(), snapshotPath, "5")
+	require.NoError(t, err)
+
+	// Check structure
+	require.Equal(t, "churn", result.Type)
+	require.Equal(t, "Churn analysis completed for the top 5 writers", result.Summary)
+	require.Contains(t, result.Details, "churn_groups")
+	require.Contains(t, result.Details, "by_resource_type")
+	require.Contains(t, result.Details, "by_field_manager")
+	require.Contains(t, result.Details, "hot_loops")
+}
+
+func TestGetChurnAnalysisReadsChurnOnce(t *testing.T) {
+	str := octosql.NewString
+	churn := &memoryTable{
+		fields: []string{"resourceType", "namespace", "fieldManager", "subresource", "uniqueKeys", "writes", "bytesWritten", "writesPerKey",
+			"writeShare", "medianWriteInterval", "hotKey", "hotKeyWrites", "hotLoop"},
+		rows: [][]octosql.Value{
+			{str("leases"), str("kube-node-lease"), str("kubelet"), octosql.NewNull(), octosql.NewInt(1), octosql.NewInt(30), octosql.NewInt(900), octosql.NewFloat(30),
+				octosql.NewFloat(0.6), octosql.NewFloat(2), str("/registry/leases/a"), octosql.NewInt(30), octosql.NewBoolean(true)},
+			{str("pods"), str("default"), str("kubelet"), octosql.NewNull(), octosql.NewInt(4), octosql.NewInt(20), octosql.NewInt(2000), octosql.NewFloat(5),
+				octosql.NewFloat(0.4), octosql.NewFloat(60), str("/registry/pods/b"), octosql.NewInt(5), octosql.NewBoolean(false)},
+		},
+	}
+	db := &recordingDatabase{Database: &memoryDatabase{tables: map[string]*memoryTable{"churn": churn}}}
+	engine, err := NewEngine()
+	require.NoError(t, err)
+	engine.db = db
+
+	result, err := engine.GetChurnAnalysis(context.Background(), basicSnapshot(t), "1")
+	require.NoError(t, err)
+	require.Len(t, result.Details["churn_groups"], 1)
+	require.Equal(t, []map[string]interface{}{
+		{"fieldManager": "kubelet", "subresource": nil, "writes": float64(50), "bytes_written": float64(2900), "write_share": float64(1)},
+	}, result.Details["by_field_manager"])
+	require.Len(t, result.Details["by_resource_type"], 1)
+	require.Len(t, result.Details["hot_loops"], 1)
+	require.ElementsMatch(t, []string{"hot-loop", "dominant-field-manager"}, ruleIDsOf(result.Findings))
+
+	// the views and the rules don't query the churn table again
+	churnReads := 0
+	for _, options := range db.options {
+		if options["table"] == "churn" {
+			churnReads++
+		}
+	}
+	require.Equal(t, 1, churnReads, db.options)
+}
+func TestGetChurnAnalysisWithInvalidLimit(t *testing.T) {
+	engine, err := NewEngine()
+	require.NoError(t, err)
+
+	_, err = engine.GetChurnAnalysis(context.Background(), "/nonexistent/path.snapshot", "10; DROP")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid limit")
+}
+
+func TestListLeasesWithInvalidSnapshot(t *testing.T) {
+	engine, err := NewEngine()
+	require.NoError(t, err)
+
+	_, err = engine.ListLeases(context.Background(), "relative.snapshot")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "snapshot path must be absolute")
+}
+
+func TestMatchingKeysWithInvalidArguments(t *testing.T) {
+	engine, err := NewEngine()
+	require.NoError(t, err)
+
+	_, err = engine.MatchingKeys(context.Background(), "/tmp/test.snapshot", " ")
+	require.ErrorContains(t, err, "condition must not be empty")
+
+	_, err = engine.MatchingKeys(context.Background(), "relative.snapshot", "namespace = 'default'")
+	require.ErrorContains(t, err, "snapshot path must be absolute")
+}
+
+func TestExecuteQueryTimeout(t *testing.T) {
+	engine, err := NewEngine()
+	require.NoError(t, err)
+	engine.db = &memoryDatabase{blocking: true}
+
+	_, err = engine.WithTimeout(100*time.Millisecond).ExecuteQuery(context.Background(), "SELECT key FROM /a.snapshot", "")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.EqualError(t, err, "query timed out after 100ms: context deadline exceeded")
+
+	// the deadline of the context takes precedence over the engine's timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = engine.WithTimeout(time.Hour).ExecuteQuery(ctx, "SELECT key FROM /a.snapshot", "")
+	require.EqualError(t, err, "query timed out: context deadline exceeded")
+
+	// the plugin's scans stop too
+	engine.db = &etcdsnapshot.Database{}
+	expired, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	_, err = engine.ExecuteQuery(expired, "SELECT COUNT(*) FROM {{SNAPSHOT}}", basicSnapshot(t))
+	require.EqualError(t, err, "query timed out: context deadline exceeded")
+}
+func TestExecuteQueryCancelled(t *testing.T) {
+	engine, err := NewEngine()
+	require.NoError(t, err)
+	engine.db = &memoryDatabase{blocking: true}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	_, err = engine.ExecuteQuery(ctx, "SELECT key FROM /a.snapshot", "")
+	require.ErrorIs(t, err, context.Canceled)
+	require.EqualError(t, err, "query cancelled: context canceled")
+}
+
+func TestExecuteQuery(t *testing.T) {
+	engine, err := NewEngine()
+	require.NoError(t, err)
+
+	result, err := engine.ExecuteQuery(context.Background(), `SELECT t.key, modRevision, value IS NOT NULL AS hasValue
+		FROM {{SNAPSHOT}} t ORDER BY modRevision DESC LIMIT 2`, basicSnapshot(t))
+	require.NoError(t, err)
+	require.Equal(t, []string{"key", "modRevision", "hasValue"}, result.Columns)
+	require.Equal(t, 2, result.Count)
+	// numbers are float64 like in octosql's JSON output
+	require.IsType(t, float64(0), result.Data[0]["modRevision"])
+	require.Greater(t, result.Data[0]["modRevision"], result.Data[1]["modRevision"])
+	require.Equal(t, true, result.Data[0]["hasValue"])
+
+	result, err = engine.ExecuteQuery(context.Background(), "SELECT COUNT(*) FROM {{SNAPSHOT}} WHERE resourceType = 'nonexistent'", basicSnapshot(t))
+	require.NoError(t, err)
+	require.Equal(t, []map[string]interface{}{{"count": float64(0)}}, result.Data)
+}
+
+// basicSnapshot is the absolute path of the plugin's test snapshot
+func basicSnapshot(t *testing.T) string {
+	path, err := filepath.Abs("../etcdsnapshot/data/basic.snapshot")
+	require.NoError(t, err)
+	return path
+}
+
+// recordingDatabase records the options of the tables the queries read
+type recordingDatabase struct {
+	physical.Database
+	options []map[string]string
+}
+
+func (d *recordingDatabase) GetTable(ctx context.Context, name string, options map[string]string) (physical.DatasourceImplementation, physical.Schema, error) {
+	d.options = append(d.options, options)
+	return d.Database.GetTable(ctx, name, options)
+}
+
+// memoryDatabase serves the tables selected with "?table=" from memory, blocking makes the scans wait for the end
+// of the query instead
+type memoryDatabase struct {
+	tables   map[string]*memoryTable
+	blocking bool
+}
+
+type memoryTable struct {
+	fields   []string
+	rows     [][]octosql.Value
+	blocking bool
+}
+
+func (d *memoryDatabase) ListTables(ctx context.Context) ([]string, error) {
+	return nil, nil
+}
+
+func (d *memoryDatabase) GetTable(ctx context.Context, name string, options map[string]string) (physical.DatasourceImplementation, physical.Schema, error) {
+	table, ok := d.tables[options["table"]]
+	if d.blocking {
+		table, ok = &memoryTable{fields: []string{"key"}, blocking: true}, true
+	}
+	if !ok {
+		return nil, physical.Schema{}, fmt.Errorf("unknown table '%s'", options["table"])
+	}
+	var fields []physical.SchemaField
+	for _, name := range table.fields {
+		fields = append(fields, physical.SchemaField{Name: name, Type: octosql.Any})
+	}
+	return table, physical.NewSchema(fields, -1), nil
+}
+
+func (t *memoryTable) Materialize(ctx context.Context, env physical.Environment, schema physical.Schema, pushed []physical.Expression) (execution.Node, error) {
+	return &memoryNode{table: t, schema: schema}, nil
+}
+
+func (t *memoryTable) PushDownPredicates(newPredicates, pushedDownPredicates []physical.Expression) (rejected, pushedDown []physical.Expression, changed bool) {
+	return newPredicates, pushedDownPredicates, false
+}
+
+type memoryNode struct {
+	table  *memoryTable
+	schema physical.Schema
+}
+
+func (n *memoryNode) Run(ctx execution.ExecutionContext, produce execution.ProduceFn, metaSend execution.MetaSendFn) error {
+	if n.table.blocking {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	for _, row := range n.table.rows {
+		var values []octosql.Value
+		for _, field := range n.schema.Fields {
+			for i, name := range n.table.fields {
+				if name == field.Name {
+					values = append(values, row[i])
+				}
+			}
+		}
+		if err := produce(execution.ProduceFromExecutionContext(ctx), execution.NewRecord(values, false, time.Time{})); err != nil {
+			return err
+		}
+	}
+	return nil
+}
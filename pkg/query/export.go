@@ -0,0 +1,298 @@
+package query
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ExportOptions select the keys ExportManifests writes and how. The filters are the ones of FindResources,
+// but all of them are optional.
+type ExportOptions struct {
+	ResourceType string
+	Namespace    string
+	Name         string
+	// Dir is the absolute path of the directory the manifests are written to, it is created if missing. Existing
+	// manifests aren't overwritten.
+	Dir string
+	// Format is "yaml" or "json", defaults to yaml
+	Format string
+	// StripServerFields removes the status and the metadata the apiserver sets, so the manifests can be
+	// applied to a different cluster
+	StripServerFields bool
+}
+
+// protobufPrefix marks the values the apiserver stored as protobuf
+var protobufPrefix = []byte("k8s\x00")
+
+// serverMetadataFields are the metadata fields set by the apiserver, which it rejects or overwrites on create
+var serverMetadataFields = []string{"uid", "resourceVersion", "generation", "creationTimestamp", "deletionTimestamp", "deletionGracePeriodSeconds", "managedFields", "selfLink"}
+
+// ExportManifests writes the latest revision of every matching key as manifest to
+// <dir>/<group>/<resource>/<namespace>/<name>.<format>, cluster-scoped objects without the namespace directory.
+// JSON encoded objects, like custom resources, are exported as they're stored, the protobuf encoded built-in types
+// like Secrets, ConfigMaps or Deployments are decoded with the types of k8s.io/api first. Keys that are neither,
+// e.g. protobuf objects of aggregated apiservers, are skipped, as are deleted keys and manifests that exist
+// already, and it's an error when all matching keys are skipped. Values are written as the plugin returns them,
+// so redacted data stays redacted.
+func (e *Engine) ExportManifests(ctx context.Context, snapshot string, opts ExportOptions) (*AnalysisResult, error) {
+	format := opts.Format
+	switch format {
+	case "":
+		format = "yaml"
+	case "yaml", "json":
+	default:
+		return nil, fmt.Errorf("invalid format '%s', expected yaml or json", format)
+	}
+	if !filepath.IsAbs(opts.Dir) {
+		return nil, fmt.Errorf("output directory must be an absolute path, got: '%s'", opts.Dir)
+	}
+
+	// the subquery finds the latest revision of every key, the values are read base64 encoded since protobuf
+	// isn't valid UTF-8
+	where := ""
+	if filters := resourceFilters(opts.ResourceType, opts.Namespace, opts.Name); filters != "" {
+		where = " WHERE " + filters
+	}
+	query := `
+		SELECT t.key, apigroup, resourceType, namespace, name, modRevision, version, value
+		FROM {{SNAPSHOT}}?value=base64 t
+		JOIN (SELECT k.key, MAX(k.modRevision) AS latest FROM {{SNAPSHOT}} k` + where + ` GROUP BY k.key) l
+		ON l.key = t.key AND t.modRevision = l.latest` + where + `
+		ORDER BY t.key`
+
+	result, err := e.ExecuteQuery(ctx, query, snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the keys to export: %w", err)
+	}
+
+	exported := []map[string]interface{}{}
+	skipped := []map[string]interface{}{}
+	written := make(map[string]string)
+	redacted := 0
+	for _, row := range result.Data {
+		key, _ := row["key"].(string)
+		// a deletion resets the version to zero
+		if version, _ := row["version"].(float64); version == 0 {
+			continue
+		}
+
+		encoded, _ := row["value"].(string)
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode the value of %s: %w", key, err)
+		}
+		path, manifest, err := exportManifest(row, value, opts.Dir, format, opts.StripServerFields)
+		if err == nil {
+			if other, ok := written[path]; ok {
+				err = fmt.Errorf("maps to the same file as %s", other)
+			}
+		}
+		if err == nil {
+			err = writeManifest(path, manifest)
+		}
+		if err != nil {
+			skipped = append(skipped, map[string]interface{}{"key": key, "reason": err.Error()})
+			continue
+		}
+
+		written[path] = key
+		exported = append(exported, map[string]interface{}{"key": key, "path": path})
+		if isRedacted(value) {
+			redacted++
+		}
+	}
+
+	if len(exported) == 0 && len(skipped) > 0 {
+		return nil, fmt.Errorf("none of the %d matching keys could be exported, e.g. %s: %s", len(skipped), skipped[0]["key"], skipped[0]["reason"])
+	}
+
+	insights := []string{}
+	if redacted > 0 {
+		insights = append(insights, fmt.Sprintf("%d manifests contain redacted data, disable redaction in the plugin config to export them for re-applying", redacted))
+	}
+	if len(skipped) > 0 {
+		insights = append(insights, fmt.Sprintf("%d keys were skipped, see the reasons in skipped", len(skipped)))
+	}
+
+	return &AnalysisResult{
+		Type:    "export",
+		Summary: fmt.Sprintf("Exported %d manifests to %s", len(exported), opts.Dir),
+		Details: map[string]interface{}{
+			"exported": exported,
+			"skipped":  skipped,
+		},
+		Insights: insights,
+		Findings: []Finding{},
+	}, nil
+}
+
+// exportManifest returns the path and the encoded manifest of a row of the export query and its decoded value
+func exportManifest(row map[string]interface{}, value []byte, dir, format string, stripServerFields bool) (string, []byte, error) {
+	if bytes.HasPrefix(value, protobufPrefix) {
+		converted, err := protobufToJSON(value)
+		if err != nil {
+			return "", nil, err
+		}
+		value = converted
+	} else if !bytes.HasPrefix(bytes.TrimSpace(value), []byte("{")) {
+		return "", nil, fmt.Errorf("value is neither JSON nor protobuf")
+	}
+
+	// the node keeps the order of the fields
+	var doc yaml.Node
+	if err := yaml.Unmarshal(value, &doc); err != nil || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return "", nil, fmt.Errorf("value is not a JSON object")
+	}
+	object := doc.Content[0]
+
+	if stripServerFields {
+		removeField(object, "status")
+		if metadata := field(object, "metadata"); metadata != nil {
+			for _, name := range serverMetadataFields {
+				removeField(metadata, name)
+			}
+		}
+	}
+
+	path, err := manifestPath(row, object, dir, format)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if format == "json" {
+		var decoded interface{}
+		if err := object.Decode(&decoded); err != nil {
+			return "", nil, fmt.Errorf("failed to decode the object: %w", err)
+		}
+		data, err := json.MarshalIndent(decoded, "", "  ")
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to encode the manifest: %w", err)
+		}
+		return path, append(data, '\n'), nil
+	}
+
+	blockStyle(object)
+	var b strings.Builder
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(object); err != nil {
+		return "", nil, fmt.Errorf("failed to encode the manifest: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return "", nil, fmt.Errorf("failed to encode the manifest: %w", err)
+	}
+	return path, []byte(b.String()), nil
+}
+
+// manifestPath returns <dir>/<group>/<resource>/<namespace>/<name>.<format>, the group is taken from the
+// apiVersion of the object and is "core" for the legacy group
+func manifestPath(row map[string]interface{}, object *yaml.Node, dir, format string) (string, error) {
+	group, _ := row["apigroup"].(string)
+	if apiVersion := field(object, "apiVersion"); apiVersion != nil {
+		group = ""
+		if i := strings.Index(apiVersion.Value, "/"); i >= 0 {
+			group = apiVersion.Value[:i]
+		}
+	}
+	if group == "" {
+		group = "core"
+	}
+
+	resourceType, _ := row["resourceType"].(string)
+	namespace, _ := row["namespace"].(string)
+	name, _ := row["name"].(string)
+	if resourceType == "" || name == "" {
+		return "", fmt.Errorf("key has no resource type or name")
+	}
+
+	elems := []string{group, resourceType}
+	if namespace != "" {
+		elems = append(elems, namespace)
+	}
+	elems = append(elems, name+"."+format)
+	for _, elem := range elems {
+		// the keys come from the snapshot, they must not escape the directory
+		if elem == "." || elem == ".." || strings.ContainsAny(elem, `/\`) {
+			return "", fmt.Errorf("unsafe path element '%s'", elem)
+		}
+	}
+	return filepath.Join(append([]string{dir}, elems...)...), nil
+}
+
+// writeManifest writes the manifest only readable by the owner, since it may contain Secrets. An existing file
+// isn't overwritten.
+func writeManifest(path string, manifest []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("manifest %s exists already", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create manifest: %w", err)
+	}
+	if _, err := f.Write(manifest); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// isRedacted returns whether the plugin redacted data of the value, JSON escapes the "<" of the marker
+func isRedacted(value []byte) bool {
+	return bytes.Contains(value, []byte("<redacted ")) || bytes.Contains(value, []byte(`\u003credacted `))
+}
+
+// field returns the value of a field of a mapping node, nil if it doesn't exist
+func field(mapping *yaml.Node, name string) *yaml.Node {
+	if mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == name {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// removeField removes a field of a mapping node
+func removeField(mapping *yaml.Node, name string) {
+	if mapping.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == name {
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// yaml11Scalars match strings that are plain in YAML 1.2, but booleans or numbers in YAML 1.1, which kubectl reads
+var yaml11Scalars = regexp.MustCompile(`^(?:y|Y|yes|Yes|YES|n|N|no|No|NO|on|On|ON|off|Off|OFF|[-+]?[0-9][0-9_]*(?::[0-5]?[0-9])+(?:\.[0-9_]*)?)$`)
+
+// blockStyle removes the flow style of a node parsed from JSON, strings YAML 1.1 would read differently stay quoted
+func blockStyle(node *yaml.Node) {
+	if node.Kind != yaml.ScalarNode || node.Tag != "!!str" || !yaml11Scalars.MatchString(node.Value) {
+		node.Style = 0
+	}
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
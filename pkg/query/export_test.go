@@ -0,0 +1,194 @@
+package query
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cube2222/octosql/octosql"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const deploymentJSON = `{"kind":"Deployment","apiVersion":"apps/v1","metadata":{"name":"web","namespace":"shop","uid":"1234","resourceVersion":"42",` +
+	`"generation":3,"creationTimestamp":"2024-05-01T10:00:00Z","labels":{"app":"web","enabled":"yes","port":"8:30"},"managedFields":[{"manager":"kubectl"}]},` +
+	`"spec":{"replicas":2},"status":{"readyReplicas":2}}`
+
+func TestExportManifest(t *testing.T) {
+	dir := t.TempDir()
+	row := map[string]interface{}{"key": "/registry/deployments/shop/web", "resourceType": "deployments", "namespace": "shop", "name": "web"}
+	value := []byte(deploymentJSON)
+
+	path, manifest, err := exportManifest(row, value, dir, "yaml", false)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "apps", "deployments", "shop", "web.yaml"), path)
+	require.Contains(t, string(manifest), "resourceVersion: \"42\"\n")
+	require.Contains(t, string(manifest), "status:\n  readyReplicas: 2\n")
+
+	// the field order of the object is kept, strings that YAML would read differently stay quoted
+	path, manifest, err = exportManifest(row, value, dir, "yaml", true)
+	require.NoError(t, err)
+	require.Equal(t, `kind: Deployment
+apiVersion: apps/v1
+metadata:
+  name: web
+  namespace: shop
+  labels:
+    app: web
+    enabled: "yes"
+    port: "8:30"
+spec:
+  replicas: 2
+`, string(manifest))
+
+	path, manifest, err = exportManifest(row, value, dir, "json", true)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "apps", "deployments", "shop", "web.json"), path)
+	require.JSONEq(t, `{"kind":"Deployment","apiVersion":"apps/v1","metadata":{"name":"web","namespace":"shop","labels":{"app":"web","enabled":"yes","port":"8:30"}},"spec":{"replicas":2}}`, string(manifest))
+}
+
+// protobufValue encodes the object like the apiserver stores it
+func protobufValue(t *testing.T, object runtime.Object) []byte {
+	var b bytes.Buffer
+	require.NoError(t, protobufSerializer.Encode(object, &b))
+	return b.Bytes()
+}
+
+// unknownProtobufValue is a protobuf value of a kind that isn't in k8s.io/api
+func unknownProtobufValue(t *testing.T) []byte {
+	unknown := runtime.Unknown{TypeMeta: runtime.TypeMeta{APIVersion: "route.openshift.io/v1", Kind: "Route"}}
+	data, err := unknown.Marshal()
+	require.NoError(t, err)
+	return append([]byte("k8s\x00"), data...)
+}
+
+func TestExportProtobufManifest(t *testing.T) {
+	dir := t.TempDir()
+	secret := &corev1.Secret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{Name: "creds", Namespace: "shop", UID: "1234", ResourceVersion: "42"},
+		Data:       map[string][]byte{"password": []byte("hunter2")},
+		Type:       corev1.SecretTypeOpaque,
+	}
+	row := map[string]interface{}{"resourceType": "secrets", "namespace": "shop", "name": "creds"}
+
+	path, manifest, err := exportManifest(row, protobufValue(t, secret), dir, "yaml", true)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "core", "secrets", "shop", "creds.yaml"), path)
+	require.Equal(t, `kind: Secret
+apiVersion: v1
+metadata:
+  name: creds
+  namespace: shop
+data:
+  password: aHVudGVyMg==
+type: Opaque
+`, string(manifest))
+
+	_, manifest, err = exportManifest(row, protobufValue(t, secret), dir, "json", false)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"kind":"Secret","apiVersion":"v1","metadata":{"name":"creds","namespace":"shop","uid":"1234","resourceVersion":"42"},"data":{"password":"aHVudGVyMg=="},"type":"Opaque"}`, string(manifest))
+
+	_, _, err = exportManifest(row, unknownProtobufValue(t), dir, "yaml", false)
+	require.ErrorContains(t, err, "failed to decode the protobuf object")
+}
+
+func TestExportManifestPath(t *testing.T) {
+	dir := t.TempDir()
+
+	// cluster-scoped objects of the legacy group
+	path, _, err := exportManifest(map[string]interface{}{"resourceType": "namespaces", "name": "shop"}, []byte(`{"apiVersion":"v1","kind":"Namespace"}`), dir, "yaml", false)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "core", "namespaces", "shop.yaml"), path)
+
+	for _, tc := range []struct {
+		row      map[string]interface{}
+		value    string
+		expected string
+	}{
+		{map[string]interface{}{"resourceType": "masterleases", "name": "10.0.0.1"}, "plain", "value is neither JSON nor protobuf"},
+		{map[string]interface{}{"resourceType": "configmaps", "namespace": "..", "name": "x"}, `{"apiVersion":"v1"}`, "unsafe path element '..'"},
+		{map[string]interface{}{"resourceType": "configmaps", "namespace": "shop"}, `{"apiVersion":"v1"}`, "no resource type or name"},
+	} {
+		_, _, err := exportManifest(tc.row, []byte(tc.value), dir, "yaml", false)
+		require.ErrorContains(t, err, tc.expected)
+	}
+}
+
+func TestWriteManifest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "core", "secrets", "shop", "creds.yaml")
+	require.NoError(t, writeManifest(path, []byte("kind: Secret\n")))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// an existing manifest is kept
+	require.ErrorContains(t, writeManifest(path, []byte("kind: ConfigMap\n")), "exists already")
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "kind: Secret\n", string(data))
+}
+
+func TestExportManifestsWithInvalidOptions(t *testing.T) {
+	engine, err := NewEngine()
+	require.NoError(t, err)
+
+	_, err = engine.ExportManifests(context.Background(), "/nonexistent/path.snapshot", ExportOptions{Dir: t.TempDir(), Format: "xml"})
+	require.ErrorContains(t, err, "invalid format 'xml'")
+
+	_, err = engine.ExportManifests(context.Background(), "/nonexistent/path.snapshot", ExportOptions{Dir: "manifests"})
+	require.ErrorContains(t, err, "output directory must be an absolute path")
+
+	_, err = engine.ExportManifests(context.Background(), "/nonexistent/path.snapshot", ExportOptions{Dir: t.TempDir(), ResourceType: "pods"})
+	require.ErrorContains(t, err, "does not exist")
+}
+
+func TestResourceFilters(t *testing.T) {
+	require.Equal(t, "", resourceFilters("", "", ""))
+	require.Equal(t, "namespace = 'shop'", resourceFilters("", "shop", ""))
+	require.Equal(t, "resourceType = 'pods' AND namespace = 'shop' AND name = 'it''s'", resourceFilters("pods", "shop", "it's"))
+}
+
+func TestExportManifestsFailsWhenAllKeysAreSkipped(t *testing.T) {
+	str := octosql.NewString
+	value := func(value []byte) octosql.Value { return str(base64.StdEncoding.EncodeToString(value)) }
+	secret := &corev1.Secret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{Name: "creds", Namespace: "shop"},
+	}
+	content := &memoryTable{
+		fields: []string{"key", "apigroup", "resourceType", "namespace", "name", "modRevision", "version", "value"},
+		rows: [][]octosql.Value{
+			{str("/registry/secrets/shop/creds"), str(""), str("secrets"), str("shop"), str("creds"), octosql.NewInt(5), octosql.NewInt(1), value(protobufValue(t, secret))},
+			{str("/registry/deployments/shop/web"), str("apps"), str("deployments"), str("shop"), str("web"), octosql.NewInt(3), octosql.NewInt(1), value([]byte(`{"apiVersion":"apps/v1","kind":"Deployment","spec":{"replicas":1}}`))},
+			{str("/registry/deployments/shop/web"), str("apps"), str("deployments"), str("shop"), str("web"), octosql.NewInt(6), octosql.NewInt(2), value([]byte(`{"apiVersion":"apps/v1","kind":"Deployment","spec":{"replicas":2}}`))},
+			{str("/registry/routes/shop/web"), str("route.openshift.io"), str("routes"), str("shop"), str("web"), octosql.NewInt(7), octosql.NewInt(1), value(unknownProtobufValue(t))},
+		},
+	}
+	snapshot := filepath.Join(t.TempDir(), "etcd.snapshot")
+	require.NoError(t, os.WriteFile(snapshot, nil, 0600))
+	engine, err := NewEngine()
+	require.NoError(t, err)
+	engine.db = &memoryDatabase{tables: map[string]*memoryTable{"": content}}
+
+	dir := t.TempDir()
+	result, err := engine.ExportManifests(context.Background(), snapshot, ExportOptions{Dir: dir})
+	require.NoError(t, err)
+	require.Len(t, result.Details["exported"], 2)
+	require.Len(t, result.Details["skipped"], 1)
+
+	// only the latest revision of the deployment is exported
+	manifest, err := os.ReadFile(filepath.Join(dir, "apps", "deployments", "shop", "web.yaml"))
+	require.NoError(t, err)
+	require.Contains(t, string(manifest), "replicas: 2")
+
+	// the second export would overwrite the deployment and the secret
+	_, err = engine.ExportManifests(context.Background(), snapshot, ExportOptions{Dir: dir})
+	require.ErrorContains(t, err, "none of the 3 matching keys could be exported, e.g. /registry/deployments/shop/web: manifest")
+}
@@ -0,0 +1,47 @@
+package query
+
+import (
+	"context"
+	"time"
+
+	"github.com/tjungblu/octosql-plugin-etcdsnapshot/pkg/etcdsnapshot"
+)
+
+// Progress is how far the plugin got in scanning a snapshot while a query runs
+type Progress struct {
+	Snapshot   string        `json:"snapshot"`
+	Revisions  int64         `json:"revisions"`
+	Bytes      int64         `json:"bytes"`
+	TotalBytes int64         `json:"totalBytes"`
+	Percent    int           `json:"percent"`
+	ETA        time.Duration `json:"eta"`
+	// Finished is set on the last report of a scan
+	Finished bool `json:"-"`
+}
+
+// ProgressFunc receives the progress of the scans of a query, it's called from the goroutine scanning the
+// snapshot
+type ProgressFunc func(Progress)
+
+type progressKey struct{}
+
+// WithProgress returns a context that makes the queries executed with it report their progress to fn
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+func progressFromContext(ctx context.Context) ProgressFunc {
+	fn, _ := ctx.Value(progressKey{}).(ProgressFunc)
+	return fn
+}
+
+// pluginProgress passes the progress of the plugin's scans to fn, a nil fn discards it
+func pluginProgress(fn ProgressFunc) etcdsnapshot.ProgressFunc {
+	if fn == nil {
+		return nil
+	}
+	return func(p etcdsnapshot.Progress) {
+		fn(Progress{Snapshot: p.Snapshot, Revisions: p.Revisions, Bytes: p.Bytes, TotalBytes: p.TotalBytes,
+			Percent: p.Percent, ETA: p.ETA, Finished: p.Finished})
+	}
+}
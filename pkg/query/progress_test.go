@@ -0,0 +1,27 @@
+package query
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tjungblu/octosql-plugin-etcdsnapshot/pkg/etcdsnapshot"
+)
+
+func TestPluginProgress(t *testing.T) {
+	require.Nil(t, pluginProgress(nil))
+
+	var progress []Progress
+	ctx := WithProgress(context.Background(), func(p Progress) {
+		progress = append(progress, p)
+	})
+	report := pluginProgress(progressFromContext(ctx))
+	report(etcdsnapshot.Progress{Snapshot: "a.snapshot", Revisions: 10, Bytes: 250, TotalBytes: 1000, Percent: 25, ETA: 30 * time.Second})
+	report(etcdsnapshot.Progress{Snapshot: "a.snapshot", Revisions: 40, Bytes: 990, TotalBytes: 1000, Percent: 100, Finished: true})
+
+	require.Equal(t, []Progress{
+		{Snapshot: "a.snapshot", Revisions: 10, Bytes: 250, TotalBytes: 1000, Percent: 25, ETA: 30 * time.Second},
+		{Snapshot: "a.snapshot", Revisions: 40, Bytes: 990, TotalBytes: 1000, Percent: 100, Finished: true},
+	}, progress)
+}
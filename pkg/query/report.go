@@ -0,0 +1,184 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReportVersion is the version of the Report format. Fields may be added within a version, a version change
+// means fields were removed or changed their meaning.
+const ReportVersion = "etcdsnapshot.report/v1"
+
+// Report is the machine-readable form of an analysis, with stable field names and the rules that were checked.
+// Like SARIF, rules that didn't fire are listed too, so consumers can tell a passed check from one that didn't run.
+type Report struct {
+	Version     string        `json:"version"`
+	Snapshot    string        `json:"snapshot"`
+	Analysis    string        `json:"analysis"`
+	GeneratedAt time.Time     `json:"generated_at"`
+	Summary     ReportSummary `json:"summary"`
+	Rules       []ReportRule  `json:"rules"`
+	Findings    []Finding     `json:"findings"`
+	// Metadata is the row of the meta table, only set by HealthReport
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// ReportSummary counts the findings per severity
+type ReportSummary struct {
+	Critical int `json:"critical"`
+	Warning  int `json:"warning"`
+	Info     int `json:"info"`
+	Total    int `json:"total"`
+}
+
+// ReportRule is a rule that was checked
+type ReportRule struct {
+	ID       string   `json:"id"`
+	Severity Severity `json:"severity"`
+	Fired    bool     `json:"fired"`
+}
+
+// NewReport returns the report of an analysis result, the rules are the ones of the analysis or all rules
+// for a health check
+func (e *Engine) NewReport(snapshot string, result *AnalysisResult) *Report {
+	analysis := result.Type
+	for name, resultType := range analysisTypes {
+		if resultType == result.Type {
+			analysis = name
+		}
+	}
+
+	report := &Report{
+		Version:     ReportVersion,
+		Snapshot:    snapshot,
+		Analysis:    analysis,
+		GeneratedAt: time.Now().UTC(),
+		Rules:       []ReportRule{},
+		Findings:    result.Findings,
+	}
+	if report.Findings == nil {
+		report.Findings = []Finding{}
+	}
+
+	fired := make(map[string]bool)
+	for _, f := range report.Findings {
+		fired[f.RuleID] = true
+		switch f.Severity {
+		case SeverityCritical:
+			report.Summary.Critical++
+		case SeverityWarning:
+			report.Summary.Warning++
+		case SeverityInfo:
+			report.Summary.Info++
+		}
+		report.Summary.Total++
+	}
+
+	for _, rule := range e.rules {
+		if rule.Disabled || (result.Type != "health" && !contains(rule.Analyses, analysis)) {
+			continue
+		}
+		report.Rules = append(report.Rules, ReportRule{ID: rule.ID, Severity: rule.Severity, Fired: fired[rule.ID]})
+	}
+	return report
+}
+
+// HealthReport checks the snapshot like CheckHealth and returns the report including the meta table, the
+// quota is optional like for GetSnapshotMetadata
+func (e *Engine) HealthReport(ctx context.Context, snapshot string, quota string) (*Report, error) {
+	in := e.newRuleInput(ctx, snapshot, quota)
+	metadata, err := in.metadata()
+	if err != nil {
+		return nil, err
+	}
+	result, err := e.checkHealth(in)
+	if err != nil {
+		return nil, err
+	}
+
+	report := e.NewReport(snapshot, result)
+	report.Metadata = metadata
+	return report, nil
+}
+
+// prometheusMetrics are the columns of the meta table exported by WritePrometheus
+var prometheusMetrics = []struct {
+	name   string
+	help   string
+	column string
+}{
+	{"etcd_snapshot_size_bytes", "Size of the snapshot database file.", "size"},
+	{"etcd_snapshot_size_in_use_bytes", "Bytes of the database that are in use.", "sizeInUse"},
+	{"etcd_snapshot_size_free_bytes", "Bytes of the database on free pages, which a defrag would reclaim.", "sizeFree"},
+	{"etcd_snapshot_fragmentation_ratio", "Ratio of free to total database size.", "fragmentationRatio"},
+	{"etcd_snapshot_quota_bytes", "Storage quota the snapshot is checked against.", "quota"},
+	{"etcd_snapshot_quota_usage_ratio", "Ratio of database size to quota.", "quotaUsageRatio"},
+	{"etcd_snapshot_live_keys", "Keys whose latest revision isn't a deletion.", "totalKeys"},
+	{"etcd_snapshot_unique_keys", "Distinct keys in the database, including the deleted ones that still have revisions.", "uniqueKeys"},
+	{"etcd_snapshot_revisions", "Distinct revisions in the database.", "totalRevisions"},
+	{"etcd_snapshot_max_revision", "Highest revision in the database.", "maxRevision"},
+	{"etcd_snapshot_min_revision", "Lowest revision in the database.", "minRevision"},
+	{"etcd_snapshot_keys_with_multiple_revisions", "Keys with more than one revision.", "keysWithMultipleRevisions"},
+	{"etcd_snapshot_keys_with_leases", "Keys with a lease attached to any of their revisions.", "keysWithLeases"},
+	{"etcd_snapshot_active_leases", "Distinct leases attached to keys.", "activeLeases"},
+	{"etcd_snapshot_largest_value_bytes", "Size of the largest value.", "largestValueSize"},
+	{"etcd_snapshot_compaction_savings_bytes", "Estimated bytes a compaction would free.", "estimatedCompactionSavings"},
+}
+
+// WritePrometheus writes the report in the Prometheus text format, for the textfile collector of the node
+// exporter. It exports the meta table, the findings per severity and whether each rule fired.
+func WritePrometheus(w io.Writer, report *Report) error {
+	var b strings.Builder
+	gauge := func(name, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+
+	for _, m := range prometheusMetrics {
+		value, ok := report.Metadata[m.column].(float64)
+		if !ok {
+			continue
+		}
+		gauge(m.name, m.help)
+		fmt.Fprintf(&b, "%s %s\n", m.name, formatSample(value))
+	}
+
+	gauge("etcd_snapshot_findings", "Findings of the health rules by severity.")
+	for _, s := range []struct {
+		severity Severity
+		count    int
+	}{{SeverityCritical, report.Summary.Critical}, {SeverityWarning, report.Summary.Warning}, {SeverityInfo, report.Summary.Info}} {
+		fmt.Fprintf(&b, "etcd_snapshot_findings{severity=\"%s\"} %d\n", s.severity, s.count)
+	}
+
+	gauge("etcd_snapshot_rule_fired", "Whether a health rule reported a finding, 1 if it did.")
+	rules := append([]ReportRule(nil), report.Rules...)
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+	for _, rule := range rules {
+		fired := 0
+		if rule.Fired {
+			fired = 1
+		}
+		fmt.Fprintf(&b, "etcd_snapshot_rule_fired{rule=\"%s\",severity=\"%s\"} %d\n", escapeLabel(rule.ID), rule.Severity, fired)
+	}
+
+	gauge("etcd_snapshot_report_timestamp_seconds", "Time the report was generated.")
+	fmt.Fprintf(&b, "etcd_snapshot_report_timestamp_seconds %d\n", report.GeneratedAt.Unix())
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// formatSample formats a sample value, integers without exponent
+func formatSample(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// escapeLabel escapes a label value of the Prometheus text format
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,115 @@
+package query
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewReport(t *testing.T) {
+	engine, err := NewEngine()
+	require.NoError(t, err)
+
+	findings := []Finding{
+		{RuleID: "quota-usage-critical", Severity: SeverityCritical, Value: 90, Threshold: 85, Message: "Critical quota usage"},
+		{RuleID: "fragmentation", Severity: SeverityWarning, Value: 0.4, Threshold: 0.2, Message: "High fragmentation"},
+	}
+	report := engine.NewReport("/backup/etcd.snapshot", &AnalysisResult{Type: "storage_health", Findings: findings})
+	require.Equal(t, ReportVersion, report.Version)
+	require.Equal(t, AnalysisStorageHealth, report.Analysis)
+	require.Equal(t, ReportSummary{Critical: 1, Warning: 1, Total: 2}, report.Summary)
+	require.Equal(t, findings, report.Findings)
+
+	// only the rules of the analysis are listed, the ones that didn't fire too
+	require.Contains(t, report.Rules, ReportRule{ID: "fragmentation", Severity: SeverityWarning, Fired: true})
+	require.Contains(t, report.Rules, ReportRule{ID: "quota-usage", Severity: SeverityWarning, Fired: false})
+	require.NotContains(t, report.Rules, ReportRule{ID: "hot-loop", Severity: SeverityWarning, Fired: false})
+
+	// a health check lists all rules, no findings are an empty list
+	report = engine.NewReport("/backup/etcd.snapshot", &AnalysisResult{Type: "health"})
+	require.Equal(t, len(DefaultRules()), len(report.Rules))
+	data, err := json.Marshal(report)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"findings":[]`)
+	require.NotContains(t, string(data), `"metadata"`)
+}
+
+func TestWritePrometheus(t *testing.T) {
+	report := &Report{
+		GeneratedAt: time.Unix(1714557600, 0),
+		Summary:     ReportSummary{Warning: 1, Total: 1},
+		Rules: []ReportRule{
+			{ID: "lease-count", Severity: SeverityInfo},
+			{ID: "fragmentation", Severity: SeverityWarning, Fired: true},
+		},
+		Metadata: map[string]interface{}{
+			"size":               float64(2147483648),
+			"fragmentationRatio": 0.25,
+			"quotaSource":        "default",
+		},
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, WritePrometheus(&out, report))
+	require.Equal(t, `# HELP etcd_snapshot_size_bytes Size of the snapshot database file.
+# TYPE etcd_snapshot_size_bytes gauge
+etcd_snapshot_size_bytes 2147483648
+# HELP etcd_snapshot_fragmentation_ratio Ratio of free to total database size.
+# TYPE etcd_snapshot_fragmentation_ratio gauge
+etcd_snapshot_fragmentation_ratio 0.25
+# HELP etcd_snapshot_findings Findings of the health rules by severity.
+# TYPE etcd_snapshot_findings gauge
+etcd_snapshot_findings{severity="critical"} 0
+etcd_snapshot_findings{severity="warning"} 1
+etcd_snapshot_findings{severity="info"} 0
+# HELP etcd_snapshot_rule_fired Whether a health rule reported a finding, 1 if it did.
+# TYPE etcd_snapshot_rule_fired gauge
+etcd_snapshot_rule_fired{rule="fragmentation",severity="warning"} 1
+etcd_snapshot_rule_fired{rule="lease-count",severity="info"} 0
+# HELP etcd_snapshot_report_timestamp_seconds Time the report was generated.
+# TYPE etcd_snapshot_report_timestamp_seconds gauge
+etcd_snapshot_report_timestamp_seconds 1714557600
+`, out.String())
+}
+
+func TestWritePrometheusKeys(t *testing.T) {
+	report := &Report{
+		GeneratedAt: time.Unix(1714557600, 0),
+		Metadata: map[string]interface{}{
+			"totalKeys":      float64(90),
+			"uniqueKeys":     float64(100),
+			"keysWithLeases": float64(5),
+		},
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, WritePrometheus(&out, report))
+	require.Contains(t, out.String(), "\netcd_snapshot_live_keys 90\n")
+	require.Contains(t, out.String(), "\netcd_snapshot_unique_keys 100\n")
+	require.Contains(t, out.String(), "\netcd_snapshot_keys_with_leases 5\n")
+
+	// every metric exports a column of its own
+	columns := make(map[string]string)
+	for _, m := range prometheusMetrics {
+		other, ok := columns[m.column]
+		require.False(t, ok, "%s and %s both export %s", m.name, other, m.column)
+		columns[m.column] = m.name
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	require.Equal(t, `a\"b\\c\nd`, escapeLabel("a\"b\\c\nd"))
+}
+
+func TestHealthReportWithInvalidSnapshot(t *testing.T) {
+	engine, err := NewEngine()
+	require.NoError(t, err)
+
+	_, err = engine.HealthReport(context.Background(), "relative.snapshot", "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "snapshot path must be absolute")
+}
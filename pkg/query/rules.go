@@ -0,0 +1,841 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Severity of a finding
+type Severity string
+
+const (
+	SeverityInfo     Severity = "info"
+	SeverityWarning  Severity = "warning"
+	SeverityCritical Severity = "critical"
+)
+
+var severityRank = map[Severity]int{SeverityInfo: 0, SeverityWarning: 1, SeverityCritical: 2}
+
+// ParseSeverity returns the severity named s
+func ParseSeverity(s string) (Severity, error) {
+	if _, ok := severityRank[Severity(s)]; !ok {
+		return "", fmt.Errorf("invalid severity '%s', expected info, warning or critical", s)
+	}
+	return Severity(s), nil
+}
+
+// AtLeast returns whether the severity is as severe as other or more
+func (s Severity) AtLeast(other Severity) bool {
+	return severityRank[s] >= severityRank[other]
+}
+
+// The analyses a rule can be evaluated in
+const (
+	AnalysisOverview      = "overview"
+	AnalysisResources     = "resources"
+	AnalysisPerformance   = "performance"
+	AnalysisNamespaces    = "namespaces"
+	AnalysisMetadata      = "metadata"
+	AnalysisStorageHealth = "storage_health"
+	AnalysisChurn         = "churn"
+)
+
+var analyses = []string{AnalysisOverview, AnalysisResources, AnalysisPerformance, AnalysisNamespaces, AnalysisMetadata, AnalysisStorageHealth, AnalysisChurn}
+
+// Rule is a single health check. A rule observes values, either with a built-in metric or a SQL query, and
+// reports a finding for every value that crosses its threshold.
+type Rule struct {
+	ID       string   `yaml:"id"`
+	Severity Severity `yaml:"severity"`
+	// Analyses are the analyses that evaluate the rule, every rule is evaluated by CheckHealth
+	Analyses []string `yaml:"analyses"`
+
+	// Metric names a built-in metric, Query is a SQL query on {{SNAPSHOT}} whose rows are observed instead: the
+	// "value" column is compared to the threshold and the optional "subject" column tells what the row is about.
+	// Exactly one of them is set.
+	Metric string `yaml:"metric,omitempty"`
+	Query  string `yaml:"query,omitempty"`
+
+	// Operator compares the value to the threshold and is one of >, >=, < or <=, defaults to >
+	Operator  string  `yaml:"operator,omitempty"`
+	Threshold float64 `yaml:"threshold"`
+	// ScaleWithQuota scales a size threshold chosen for etcd's 8GB default quota to the quota of the cluster
+	ScaleWithQuota bool `yaml:"scaleWithQuota,omitempty"`
+	// Tier groups rules that check one metric at different thresholds, only the most severe finding of a tier is
+	// reported per subject. Rules without a tier are reported on their own.
+	Tier string `yaml:"tier,omitempty"`
+
+	// Message and Remediation are text/template strings, see findingData for what they can refer to
+	Message     string `yaml:"message"`
+	Remediation string `yaml:"remediation,omitempty"`
+	Disabled    bool   `yaml:"disabled,omitempty"`
+}
+
+// Finding is an observation that crossed the threshold of a rule
+type Finding struct {
+	RuleID      string   `json:"rule_id"`
+	Severity    Severity `json:"severity"`
+	Subject     string   `json:"subject,omitempty"`
+	Value       float64  `json:"value"`
+	Threshold   float64  `json:"threshold"`
+	Message     string   `json:"message"`
+	Remediation string   `json:"remediation,omitempty"`
+}
+
+// findingData is what the message and remediation templates are executed with, Row holds all columns of the
+// observed row
+type findingData struct {
+	Subject   string
+	Value     float64
+	Threshold float64
+	Row       map[string]interface{}
+}
+
+var templateFuncs = template.FuncMap{
+	"kb":      func(v float64) string { return fmt.Sprintf("%.2f", v/1024) },
+	"mb":      func(v float64) string { return fmt.Sprintf("%.2f", v/(1024*1024)) },
+	"gb":      func(v float64) string { return fmt.Sprintf("%.2f", v/(1024*1024*1024)) },
+	"percent": func(v float64) string { return fmt.Sprintf("%.1f", v*100) },
+}
+
+// observation is a value a rule compares to its threshold
+type observation struct {
+	subject string
+	value   float64
+	row     map[string]interface{}
+}
+
+// The queries the built-in metrics observe. The analyses run the same queries, so each runs once per analysis.
+const (
+	resourceTypesQuery = "SELECT resourceType, COUNT(*) as count FROM {{SNAPSHOT}} GROUP BY resourceType ORDER BY count DESC"
+
+	namespaceUsageQuery = `
+		SELECT namespace, COUNT(*) as object_count, SUM(valueSize) as total_size_bytes, AVG(valueSize) as avg_size_bytes
+		FROM {{SNAPSHOT}} t
+		WHERE namespace IS NOT NULL
+		GROUP BY namespace
+		ORDER BY total_size_bytes DESC`
+
+	resourceDistributionQuery = `
+		SELECT namespace, resourceType, COUNT(*) as count, SUM(valueSize) as total_size
+		FROM {{SNAPSHOT}} t
+		WHERE namespace IS NOT NULL
+		GROUP BY namespace, resourceType
+		ORDER BY namespace, total_size DESC`
+
+	multiRevisionKeysQuery = "SELECT t.key, COUNT(*) as revision_count, SUM(valueSize) as total_size, AVG(valueSize) as avg_size FROM {{SNAPSHOT}} t GROUP BY t.key ORDER BY total_size DESC LIMIT 10"
+
+	mostModifiedKeysQuery = "SELECT t.key, COUNT(*) as revision_count, MIN(createRevision) as first_revision, MAX(modRevision) as last_revision FROM {{SNAPSHOT}} t GROUP BY t.key ORDER BY revision_count DESC LIMIT 10"
+
+	churnGroupsQuery = `
+		SELECT resourceType, namespace, fieldManager, subresource, uniqueKeys, writes, bytesWritten, writesPerKey,
+			writeShare, medianWriteInterval, hotKey, hotKeyWrites, hotLoop
+		FROM {{SNAPSHOT}}?table=churn t
+		ORDER BY writes DESC`
+)
+
+// churnByResourceType sums the churn groups per resource type, ordered by writes. The churn analysis and its metrics
+// derive their views from the rows of churnGroupsQuery, so the churn table is only read once.
+func churnByResourceType(groups []map[string]interface{}) []map[string]interface{} {
+	return sumChurnGroups(groups, "resourceType")
+}
+
+// churnByFieldManager sums the churn groups per field manager and subresource, ordered by writes
+func churnByFieldManager(groups []map[string]interface{}) []map[string]interface{} {
+	return sumChurnGroups(groups, "fieldManager", "subresource")
+}
+
+// churnSums are the columns of the churn groups that are summed up and the columns of the sums
+var churnSums = [][2]string{{"writes", "writes"}, {"bytesWritten", "bytes_written"}, {"writeShare", "write_share"}}
+
+// sumChurnGroups sums the churn groups with equal values in the columns, null being a value of its own like in
+// a GROUP BY, and orders the sums by writes
+func sumChurnGroups(groups []map[string]interface{}, columns ...string) []map[string]interface{} {
+	var rows []map[string]interface{}
+	byValues := make(map[string]map[string]interface{})
+	for _, group := range groups {
+		values := make([]interface{}, len(columns))
+		for i, column := range columns {
+			values[i] = group[column]
+		}
+		key := fmt.Sprintf("%#v", values)
+		row, ok := byValues[key]
+		if !ok {
+			row = make(map[string]interface{})
+			for i, column := range columns {
+				row[column] = values[i]
+			}
+			for _, sum := range churnSums {
+				row[sum[1]] = float64(0)
+			}
+			byValues[key] = row
+			rows = append(rows, row)
+		}
+		for _, sum := range churnSums {
+			value, _ := group[sum[0]].(float64)
+			row[sum[1]] = row[sum[1]].(float64) + value
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i]["writes"].(float64) > rows[j]["writes"].(float64)
+	})
+	return rows
+}
+
+// churnHotLoops returns the churn groups in a hot loop, ordered by the writes of their hot key
+func churnHotLoops(groups []map[string]interface{}) []map[string]interface{} {
+	var rows []map[string]interface{}
+	for _, group := range groups {
+		if hotLoop, _ := group["hotLoop"].(bool); hotLoop {
+			rows = append(rows, group)
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, _ := rows[i]["hotKeyWrites"].(float64)
+		b, _ := rows[j]["hotKeyWrites"].(float64)
+		return a > b
+	})
+	return rows
+}
+
+// metric observes values of a snapshot for the rules referring to it by name
+type metric func(in *ruleInput) ([]observation, error)
+
+var metrics = map[string]metric{
+	"resource_type_objects": rowsMetric(resourceTypesQuery, "resourceType", "count"),
+	"namespace_bytes":       rowsMetric(namespaceUsageQuery, "namespace", "total_size_bytes"),
+	"namespace_objects":     rowsMetric(namespaceUsageQuery, "namespace", "object_count"),
+	"resource_type_namespaces": func(in *ruleInput) ([]observation, error) {
+		result, err := in.query(resourceDistributionQuery)
+		if err != nil {
+			return nil, err
+		}
+		namespaces := make(map[string]int)
+		var resourceTypes []string
+		for _, row := range result.Data {
+			if resourceType, ok := row["resourceType"].(string); ok {
+				if namespaces[resourceType] == 0 {
+					resourceTypes = append(resourceTypes, resourceType)
+				}
+				namespaces[resourceType]++
+			}
+		}
+		var observations []observation
+		for _, resourceType := range resourceTypes {
+			observations = append(observations, observation{subject: resourceType, value: float64(namespaces[resourceType])})
+		}
+		return observations, nil
+	},
+
+	"snapshot_bytes":       metaMetric(func(m map[string]float64) float64 { return m["size"] }, "size"),
+	"fragmentation_ratio":  metaMetric(func(m map[string]float64) float64 { return m["fragmentationRatio"] }, "fragmentationRatio"),
+	"quota_usage_percent":  metaMetric(func(m map[string]float64) float64 { return m["quotaUsagePercent"] }, "quotaUsagePercent"),
+	"revisions_per_key":    metaMetric(func(m map[string]float64) float64 { return m["avgRevisionsPerKey"] }, "avgRevisionsPerKey"),
+	"largest_value_bytes":  metaMetric(func(m map[string]float64) float64 { return m["largestValueSize"] }, "largestValueSize"),
+	"active_leases":        metaMetric(func(m map[string]float64) float64 { return m["activeLeases"] }, "activeLeases"),
+	"compaction_savings":   metaMetric(func(m map[string]float64) float64 { return m["estimatedCompactionSavings"] }, "estimatedCompactionSavings"),
+	"storage_efficiency":   metaMetric(func(m map[string]float64) float64 { return m["sizeInUse"] / m["size"] * 100 }, "size", "sizeInUse"),
+	"multi_revision_ratio": metaMetric(func(m map[string]float64) float64 { return m["keysWithMultipleRevisions"] / m["uniqueKeys"] }, "keysWithMultipleRevisions", "uniqueKeys"),
+
+	"key_revisions": rowsMetric(mostModifiedKeysQuery, "key", "revision_count"),
+	"key_history_bytes": func(in *ruleInput) ([]observation, error) {
+		observations, err := rowsMetric(multiRevisionKeysQuery, "key", "total_size")(in)
+		if err != nil {
+			return nil, err
+		}
+		// only keys with history churn, a few large revisions are large values
+		var churning []observation
+		for _, o := range observations {
+			if revisions, _ := o.row["revision_count"].(float64); revisions > 5 {
+				churning = append(churning, o)
+			}
+		}
+		return churning, nil
+	},
+
+	"hot_loop_writes":           churnMetric(churnHotLoops, "hotKey", "hotKeyWrites"),
+	"field_manager_write_share": churnMetric(churnByFieldManager, "fieldManager", "write_share"),
+	"writes_per_key":            rowsMetric(churnGroupsQuery, "resourceType", "writesPerKey"),
+}
+
+// rowsMetric observes one value per row of a query, rows without the value are skipped
+func rowsMetric(query, subjectColumn, valueColumn string) metric {
+	return func(in *ruleInput) ([]observation, error) {
+		result, err := in.query(query)
+		if err != nil {
+			return nil, err
+		}
+		return observeRows(result.Data, subjectColumn, valueColumn), nil
+	}
+}
+
+// churnMetric observes one value per row derived from the churn groups, like rowsMetric
+func churnMetric(derive func(groups []map[string]interface{}) []map[string]interface{}, subjectColumn, valueColumn string) metric {
+	return func(in *ruleInput) ([]observation, error) {
+		result, err := in.query(churnGroupsQuery)
+		if err != nil {
+			return nil, err
+		}
+		return observeRows(derive(result.Data), subjectColumn, valueColumn), nil
+	}
+}
+
+func observeRows(rows []map[string]interface{}, subjectColumn, valueColumn string) []observation {
+	var observations []observation
+	for _, row := range rows {
+		value, ok := row[valueColumn].(float64)
+		if !ok {
+			continue
+		}
+		subject, _ := row[subjectColumn].(string)
+		observations = append(observations, observation{subject: subject, value: value, row: row})
+	}
+	return observations
+}
+
+// metaMetric observes a value computed from the meta table, nothing is observed when one of the columns is missing
+func metaMetric(value func(m map[string]float64) float64, columns ...string) metric {
+	return func(in *ruleInput) ([]observation, error) {
+		metadata, err := in.metadata()
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]float64)
+		for _, column := range columns {
+			v, ok := metadata[column].(float64)
+			if !ok {
+				return nil, nil
+			}
+			m[column] = v
+		}
+		return []observation{{value: value(m), row: metadata}}, nil
+	}
+}
+
+// DefaultRules returns the built-in rules. Their thresholds are the ones the analyses had before the rules, where
+// two analyses checked a metric at different thresholds each gets a rule of its own.
+func DefaultRules() []Rule {
+	const (
+		mb = 1024 * 1024
+		gb = 1024 * mb
+	)
+	return []Rule{
+		{
+			ID: "high-resource-count", Severity: SeverityInfo, Analyses: []string{AnalysisOverview, AnalysisResources},
+			Metric: "resource_type_objects", Threshold: 1000,
+			Message:     `High resource count detected: {{printf "%.0f" .Value}} {{.Subject}}`,
+			Remediation: "Check whether a controller leaks {{.Subject}} or unused ones can be deleted",
+		},
+		{
+			ID: "large-namespace-overview", Severity: SeverityInfo, Analyses: []string{AnalysisOverview},
+			Metric: "namespace_bytes", Threshold: 10000000, ScaleWithQuota: true, Tier: "large-namespace",
+			Message:     "Large namespace detected: '{{.Subject}}' stores {{mb .Value}} MB",
+			Remediation: "Look for large ConfigMaps, Secrets or custom resources in namespace '{{.Subject}}'",
+		},
+		{
+			ID: "large-namespace", Severity: SeverityWarning, Analyses: []string{AnalysisNamespaces},
+			Metric: "namespace_bytes", Threshold: 100 * mb, ScaleWithQuota: true, Tier: "large-namespace",
+			Message:     "Namespace '{{.Subject}}' consumes {{mb .Value}} MB of etcd storage",
+			Remediation: "Look for large ConfigMaps, Secrets or custom resources in namespace '{{.Subject}}'",
+		},
+		{
+			ID: "namespace-object-count", Severity: SeverityInfo, Analyses: []string{AnalysisNamespaces},
+			Metric: "namespace_objects", Threshold: 1000,
+			Message: `Namespace '{{.Subject}}' has {{printf "%.0f" .Value}} objects - consider monitoring for resource bloat`,
+		},
+		{
+			ID: "widespread-resource-type", Severity: SeverityInfo, Analyses: []string{AnalysisNamespaces},
+			Metric: "resource_type_namespaces", Threshold: 5,
+			Message: `Resource type '{{.Subject}}' appears in {{printf "%.0f" .Value}} namespaces`,
+		},
+		{
+			ID: "large-snapshot", Severity: SeverityInfo, Analyses: []string{AnalysisMetadata},
+			Metric: "snapshot_bytes", Threshold: 1 * gb, ScaleWithQuota: true,
+			Message: "Large etcd snapshot: {{gb .Value}} GB total size",
+		},
+		{
+			ID: "fragmentation-metadata", Severity: SeverityWarning, Analyses: []string{AnalysisMetadata},
+			Metric: "fragmentation_ratio", Threshold: 0.3, Tier: "fragmentation",
+			Message:     "High fragmentation detected: {{percent .Value}}% - consider defragmentation",
+			Remediation: "Schedule regular defragmentation to improve performance",
+		},
+		{
+			ID: "fragmentation", Severity: SeverityWarning, Analyses: []string{AnalysisStorageHealth},
+			Metric: "fragmentation_ratio", Threshold: 0.2, Tier: "fragmentation",
+			Message:     "Fragmentation concern: {{percent .Value}}% fragmented - consider defragmentation",
+			Remediation: "Schedule regular defragmentation to improve performance",
+		},
+		{
+			ID: "storage-efficiency", Severity: SeverityWarning, Analyses: []string{AnalysisStorageHealth},
+			Metric: "storage_efficiency", Operator: "<", Threshold: 70,
+			Message:     `Poor storage efficiency: {{printf "%.1f" .Value}}% - significant wasted space`,
+			Remediation: "Consider running etcd defragmentation to reclaim wasted space",
+		},
+		{
+			ID: "quota-usage-metadata", Severity: SeverityWarning, Analyses: []string{AnalysisMetadata},
+			Metric: "quota_usage_percent", Threshold: 80, Tier: "quota-usage",
+			Message:     `High quota usage: {{printf "%.1f" .Value}}% - monitor for approaching limits`,
+			Remediation: "Monitor quota usage and plan for potential increase",
+		},
+		{
+			ID: "quota-usage", Severity: SeverityWarning, Analyses: []string{AnalysisStorageHealth},
+			Metric: "quota_usage_percent", Threshold: 70, Tier: "quota-usage",
+			Message:     `High quota usage: {{printf "%.1f" .Value}}% - monitor closely`,
+			Remediation: "Monitor quota usage and plan for potential increase",
+		},
+		{
+			ID: "quota-usage-critical", Severity: SeverityCritical, Analyses: []string{AnalysisStorageHealth},
+			Metric: "quota_usage_percent", Threshold: 85, Tier: "quota-usage",
+			Message:     `Critical quota usage: {{printf "%.1f" .Value}}% - immediate attention required`,
+			Remediation: "Urgent: Investigate large objects and consider quota increase",
+		},
+		{
+			ID: "revision-density", Severity: SeverityInfo, Analyses: []string{AnalysisMetadata},
+			Metric: "revisions_per_key", Threshold: 5, Tier: "revision-density",
+			Message:     `High revision density: {{printf "%.1f" .Value}} revisions per key - investigate write patterns`,
+			Remediation: "Find the writers with the churn analysis",
+		},
+		{
+			ID: "revision-buildup", Severity: SeverityWarning, Analyses: []string{AnalysisStorageHealth},
+			Metric: "revisions_per_key", Threshold: 10, Tier: "revision-density",
+			Message:     `Excessive revision buildup: {{printf "%.1f" .Value}} avg revisions per key`,
+			Remediation: "Consider more aggressive compaction policy to reduce revision history",
+		},
+		{
+			ID: "revision-churn-metadata", Severity: SeverityWarning, Analyses: []string{AnalysisMetadata},
+			Metric: "multi_revision_ratio", Threshold: 0.5, Tier: "revision-churn",
+			Message:     "High revision churn: {{percent .Value}}% of keys have multiple revisions",
+			Remediation: "Investigate write patterns causing high revision churn",
+		},
+		{
+			ID: "revision-churn", Severity: SeverityWarning, Analyses: []string{AnalysisStorageHealth},
+			Metric: "multi_revision_ratio", Threshold: 0.6, Tier: "revision-churn",
+			Message:     "High revision churn: {{percent .Value}}% of keys have multiple revisions",
+			Remediation: "Investigate write patterns causing high revision churn",
+		},
+		{
+			ID: "large-value", Severity: SeverityInfo, Analyses: []string{AnalysisPerformance},
+			Metric: "largest_value_bytes", Threshold: 1000000, Tier: "large-value",
+			Message:     "Large value detected: {{mb .Value}} MB",
+			Remediation: "Investigate large values and consider data optimization",
+		},
+		{
+			ID: "huge-value", Severity: SeverityWarning, Analyses: []string{AnalysisStorageHealth},
+			Metric: "largest_value_bytes", Threshold: 10 * mb, Tier: "large-value",
+			Message:     "Large value detected: {{mb .Value}} MB - investigate potential data bloat",
+			Remediation: "Investigate large values and consider data optimization",
+		},
+		{
+			ID: "lease-count", Severity: SeverityInfo, Analyses: []string{AnalysisStorageHealth},
+			Metric: "active_leases", Threshold: 1000,
+			Message: `High lease count: {{printf "%.0f" .Value}} active leases - monitor for lease accumulation`,
+		},
+		{
+			ID: "compaction-potential", Severity: SeverityWarning, Analyses: []string{AnalysisStorageHealth},
+			Metric: "compaction_savings", Threshold: 100 * mb, ScaleWithQuota: true,
+			Message:     "Significant compaction potential: {{mb .Value}} MB could be saved",
+			Remediation: "Run compaction to reclaim space and improve performance",
+		},
+		{
+			ID: "frequently-modified-key", Severity: SeverityInfo, Analyses: []string{AnalysisPerformance},
+			Metric: "key_revisions", Threshold: 10,
+			Message:     `Excessive key modifications detected: {{printf "%.0f" .Value}} revisions of '{{.Subject}}'`,
+			Remediation: "Find the writer of '{{.Subject}}' with the churn analysis",
+		},
+		{
+			ID: "high-churn-key", Severity: SeverityInfo, Analyses: []string{AnalysisPerformance},
+			Metric: "key_history_bytes", Threshold: 100000,
+			Message: `High-churn key detected: '{{.Subject}}' has {{printf "%.0f" .Row.revision_count}} revisions totaling {{kb .Value}} KB`,
+		},
+		{
+			ID: "hot-loop", Severity: SeverityWarning, Analyses: []string{AnalysisChurn},
+			Metric: "hot_loop_writes", Threshold: 0,
+			Message:     `Hot loop detected: '{{or .Row.fieldManager "unknown writer"}}' rewrites '{{.Subject}}' every {{printf "%.1f" .Row.medianWriteInterval}} seconds, {{printf "%.0f" .Value}} writes retained`,
+			Remediation: "Check the controller for an update loop, e.g. a status field that changes on every reconcile",
+		},
+		{
+			ID: "dominant-field-manager", Severity: SeverityInfo, Analyses: []string{AnalysisChurn},
+			Metric: "field_manager_write_share", Threshold: 0.5,
+			Message: "Field manager '{{.Subject}}' accounts for {{percent .Value}}% of all retained writes",
+		},
+		{
+			ID: "write-amplification", Severity: SeverityWarning, Analyses: []string{AnalysisChurn},
+			Metric: "writes_per_key", Threshold: 100,
+			Message:     `High write amplification: {{printf "%.0f" .Value}} writes per key of {{.Subject}}`,
+			Remediation: "Reduce how often the writers of {{.Subject}} update unchanged objects",
+		},
+	}
+}
+
+// ruleOverride changes a built-in rule, only the fields that are set
+type ruleOverride struct {
+	Severity       *Severity `yaml:"severity"`
+	Analyses       []string  `yaml:"analyses"`
+	Operator       *string   `yaml:"operator"`
+	Threshold      *float64  `yaml:"threshold"`
+	ScaleWithQuota *bool     `yaml:"scaleWithQuota"`
+	Tier           *string   `yaml:"tier"`
+	Message        *string   `yaml:"message"`
+	Remediation    *string   `yaml:"remediation"`
+	Disabled       *bool     `yaml:"disabled"`
+}
+
+// LoadRules reads rules from a YAML file with a list of "rules". Entries with the ID of a built-in rule change
+// the fields they set, all others are added and have to be complete. Without a path the built-in rules are used.
+func LoadRules(path string) ([]Rule, error) {
+	if path == "" {
+		return DefaultRules(), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules: %w", err)
+	}
+	rules, err := parseRules(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rules in %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+func parseRules(data []byte) ([]Rule, error) {
+	var file struct {
+		Rules []yaml.Node `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	rules := DefaultRules()
+	builtin := make(map[string]int)
+	for i, rule := range rules {
+		builtin[rule.ID] = i
+	}
+
+	for _, node := range file.Rules {
+		var id struct {
+			ID string `yaml:"id"`
+		}
+		if err := node.Decode(&id); err != nil {
+			return nil, err
+		}
+		if id.ID == "" {
+			return nil, fmt.Errorf("rule in line %d has no id", node.Line)
+		}
+
+		i, ok := builtin[id.ID]
+		if !ok {
+			var rule Rule
+			if err := node.Decode(&rule); err != nil {
+				return nil, fmt.Errorf("rule '%s': %w", id.ID, err)
+			}
+			rules = append(rules, rule)
+			continue
+		}
+
+		var override ruleOverride
+		if err := node.Decode(&override); err != nil {
+			return nil, fmt.Errorf("rule '%s': %w", id.ID, err)
+		}
+		rule := &rules[i]
+		if override.Severity != nil {
+			rule.Severity = *override.Severity
+		}
+		if override.Analyses != nil {
+			rule.Analyses = override.Analyses
+		}
+		if override.Operator != nil {
+			rule.Operator = *override.Operator
+		}
+		if override.Threshold != nil {
+			rule.Threshold = *override.Threshold
+		}
+		if override.ScaleWithQuota != nil {
+			rule.ScaleWithQuota = *override.ScaleWithQuota
+		}
+		if override.Tier != nil {
+			rule.Tier = *override.Tier
+		}
+		if override.Message != nil {
+			rule.Message = *override.Message
+		}
+		if override.Remediation != nil {
+			rule.Remediation = *override.Remediation
+		}
+		if override.Disabled != nil {
+			rule.Disabled = *override.Disabled
+		}
+	}
+
+	if err := validateRules(rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func validateRules(rules []Rule) error {
+	ids := make(map[string]bool)
+	for _, rule := range rules {
+		if ids[rule.ID] {
+			return fmt.Errorf("duplicate rule '%s'", rule.ID)
+		}
+		ids[rule.ID] = true
+
+		if _, ok := severityRank[rule.Severity]; !ok {
+			return fmt.Errorf("rule '%s' has invalid severity '%s', expected info, warning or critical", rule.ID, rule.Severity)
+		}
+		if (rule.Metric == "") == (rule.Query == "") {
+			return fmt.Errorf("rule '%s' needs either a metric or a query", rule.ID)
+		}
+		if _, ok := metrics[rule.Metric]; rule.Metric != "" && !ok {
+			return fmt.Errorf("rule '%s' has unknown metric '%s'", rule.ID, rule.Metric)
+		}
+		if _, err := compare(rule.Operator, 0, 0); err != nil {
+			return fmt.Errorf("rule '%s': %w", rule.ID, err)
+		}
+		if len(rule.Analyses) == 0 {
+			return fmt.Errorf("rule '%s' has no analyses", rule.ID)
+		}
+		for _, analysis := range rule.Analyses {
+			if !contains(analyses, analysis) {
+				return fmt.Errorf("rule '%s' has unknown analysis '%s', expected one of %s", rule.ID, analysis, strings.Join(analyses, ", "))
+			}
+		}
+		if rule.Message == "" {
+			return fmt.Errorf("rule '%s' has no message", rule.ID)
+		}
+		for _, text := range []string{rule.Message, rule.Remediation} {
+			if _, err := template.New(rule.ID).Funcs(templateFuncs).Parse(text); err != nil {
+				return fmt.Errorf("rule '%s': %w", rule.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// compare returns whether the value crosses the threshold
+func compare(operator string, value, threshold float64) (bool, error) {
+	switch operator {
+	case "", ">":
+		return value > threshold, nil
+	case ">=":
+		return value >= threshold, nil
+	case "<":
+		return value < threshold, nil
+	case "<=":
+		return value <= threshold, nil
+	default:
+		return false, fmt.Errorf("invalid operator '%s', expected one of >, >=, < or <=", operator)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleInput holds the query results of a single analysis, so the analysis and its rules run every query once
+type ruleInput struct {
+	ctx      context.Context
+	engine   *Engine
+	snapshot string
+	quota    string
+
+	results    map[string]*QueryResult
+	meta       map[string]interface{}
+	quotaBytes *float64
+}
+
+func (e *Engine) newRuleInput(ctx context.Context, snapshot, quota string) *ruleInput {
+	return &ruleInput{ctx: ctx, engine: e, snapshot: snapshot, quota: quota, results: make(map[string]*QueryResult)}
+}
+
+// query executes a query on the snapshot, or returns the result of an earlier execution
+func (in *ruleInput) query(query string) (*QueryResult, error) {
+	if result, ok := in.results[query]; ok {
+		return result, nil
+	}
+	result, err := in.engine.ExecuteQuery(in.ctx, query, in.snapshot)
+	if err != nil {
+		return nil, err
+	}
+	in.results[query] = result
+	return result, nil
+}
+
+// metadata returns the row of the meta table
+func (in *ruleInput) metadata() (map[string]interface{}, error) {
+	if in.meta != nil {
+		return in.meta, nil
+	}
+	table, err := metaTable(in.quota)
+	if err != nil {
+		return nil, err
+	}
+	result, err := in.query("SELECT * FROM " + table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute metadata query: %w", err)
+	}
+	if len(result.Data) == 0 {
+		return nil, fmt.Errorf("no metadata found for snapshot %s", in.snapshot)
+	}
+	in.meta = result.Data[0]
+	return in.meta, nil
+}
+
+// quotaInBytes returns the quota the snapshot is analyzed against, without computing all metadata
+func (in *ruleInput) quotaInBytes() (float64, error) {
+	if in.quotaBytes != nil {
+		return *in.quotaBytes, nil
+	}
+	var quota float64
+	if in.meta != nil {
+		quota, _ = in.meta["quota"].(float64)
+	} else {
+		var err error
+		quota, err = in.engine.snapshotQuota(in.ctx, in.snapshot, in.quota)
+		if err != nil {
+			return 0, err
+		}
+	}
+	in.quotaBytes = &quota
+	return quota, nil
+}
+
+// evaluateRules evaluates the enabled rules of an analysis, or all enabled rules when no analysis is given. Rules
+// of a tier are one check, so only the most severe finding per tier and subject is reported, all other rules report
+// their findings on their own. Findings are ordered by severity, most severe first.
+func (e *Engine) evaluateRules(in *ruleInput, analysis string) ([]Finding, error) {
+	findings := []Finding{}
+	reported := make(map[string]int)
+	for _, rule := range e.rules {
+		if rule.Disabled || (analysis != "" && !contains(rule.Analyses, analysis)) {
+			continue
+		}
+
+		observations, err := observe(in, rule)
+		if err != nil {
+			return nil, fmt.Errorf("failed to evaluate rule '%s': %w", rule.ID, err)
+		}
+
+		if len(observations) == 0 {
+			continue
+		}
+
+		threshold := rule.Threshold
+		if rule.ScaleWithQuota {
+			quota, err := in.quotaInBytes()
+			if err != nil {
+				return nil, fmt.Errorf("failed to evaluate rule '%s': %w", rule.ID, err)
+			}
+			threshold = scaleToQuota(threshold, quota)
+		}
+
+		for _, o := range observations {
+			crossed, err := compare(rule.Operator, o.value, threshold)
+			if err != nil {
+				return nil, err
+			}
+			if !crossed {
+				continue
+			}
+
+			finding, err := newFinding(rule, o, threshold)
+			if err != nil {
+				return nil, err
+			}
+
+			// tiers and rule IDs are kept apart, a custom rule may be named like a tier
+			tier := "rule\x00" + rule.ID + "\x00" + o.subject
+			if rule.Tier != "" {
+				tier = "tier\x00" + rule.Tier + "\x00" + o.subject
+			}
+			if i, ok := reported[tier]; ok {
+				if severityRank[finding.Severity] > severityRank[findings[i].Severity] {
+					findings[i] = finding
+				}
+				continue
+			}
+			reported[tier] = len(findings)
+			findings = append(findings, finding)
+		}
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		return severityRank[findings[i].Severity] > severityRank[findings[j].Severity]
+	})
+	return findings, nil
+}
+
+func observe(in *ruleInput, rule Rule) ([]observation, error) {
+	if rule.Metric != "" {
+		return metrics[rule.Metric](in)
+	}
+	return rowsMetric(rule.Query, "subject", "value")(in)
+}
+
+func newFinding(rule Rule, o observation, threshold float64) (Finding, error) {
+	data := findingData{Subject: o.subject, Value: o.value, Threshold: threshold, Row: o.row}
+	message, err := executeTemplate(rule.ID, rule.Message, data)
+	if err != nil {
+		return Finding{}, err
+	}
+	remediation, err := executeTemplate(rule.ID, rule.Remediation, data)
+	if err != nil {
+		return Finding{}, err
+	}
+	return Finding{
+		RuleID:      rule.ID,
+		Severity:    rule.Severity,
+		Subject:     o.subject,
+		Value:       o.value,
+		Threshold:   threshold,
+		Message:     message,
+		Remediation: remediation,
+	}, nil
+}
+
+func executeTemplate(name, text string, data findingData) (string, error) {
+	if text == "" {
+		return "", nil
+	}
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid template of rule '%s': %w", name, err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to format the message of rule '%s': %w", name, err)
+	}
+	return b.String(), nil
+}
+
+// insightsOf returns the messages of the findings
+func insightsOf(findings []Finding) []string {
+	insights := []string{}
+	for _, f := range findings {
+		insights = append(insights, f.Message)
+	}
+	return insights
+}
+
+// recommendationsOf returns the distinct remediations of the findings
+func recommendationsOf(findings []Finding) []string {
+	recommendations := []string{}
+	for _, f := range findings {
+		if f.Remediation != "" && !contains(recommendations, f.Remediation) {
+			recommendations = append(recommendations, f.Remediation)
+		}
+	}
+	return recommendations
+}
@@ -0,0 +1,371 @@
+package query
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// seededRuleInput returns a rule input that answers the given queries and metadata without running octosql
+func seededRuleInput(e *Engine, results map[string][]map[string]interface{}, metadata map[string]interface{}) *ruleInput {
+	in := e.newRuleInput(context.Background(), "/nonexistent/path.snapshot", "")
+	for query, rows := range results {
+		in.results[query] = &QueryResult{Data: rows, Count: len(rows)}
+	}
+	in.meta = metadata
+	return in
+}
+
+func TestDefaultRulesAreValid(t *testing.T) {
+	require.NoError(t, validateRules(DefaultRules()))
+
+	engine, err := NewEngine()
+	require.NoError(t, err)
+	require.Equal(t, DefaultRules(), engine.Rules())
+}
+
+// TestDefaultRulesKeepBaselineThresholds pins the built-in rules to the thresholds the analyses had before the rules
+func TestDefaultRulesKeepBaselineThresholds(t *testing.T) {
+	type baseline struct {
+		analyses  []string
+		operator  string
+		threshold float64
+	}
+	baselines := map[string]baseline{
+		"high-resource-count":      {[]string{AnalysisOverview, AnalysisResources}, "", 1000},
+		"large-namespace-overview": {[]string{AnalysisOverview}, "", 10000000},
+		"large-namespace":          {[]string{AnalysisNamespaces}, "", 100 * 1024 * 1024},
+		"namespace-object-count":   {[]string{AnalysisNamespaces}, "", 1000},
+		"widespread-resource-type": {[]string{AnalysisNamespaces}, "", 5},
+		"large-snapshot":           {[]string{AnalysisMetadata}, "", 1024 * 1024 * 1024},
+		"fragmentation-metadata":   {[]string{AnalysisMetadata}, "", 0.3},
+		"fragmentation":            {[]string{AnalysisStorageHealth}, "", 0.2},
+		"storage-efficiency":       {[]string{AnalysisStorageHealth}, "<", 70},
+		"quota-usage-metadata":     {[]string{AnalysisMetadata}, "", 80},
+		"quota-usage":              {[]string{AnalysisStorageHealth}, "", 70},
+		"quota-usage-critical":     {[]string{AnalysisStorageHealth}, "", 85},
+		"revision-density":         {[]string{AnalysisMetadata}, "", 5},
+		"revision-buildup":         {[]string{AnalysisStorageHealth}, "", 10},
+		"revision-churn-metadata":  {[]string{AnalysisMetadata}, "", 0.5},
+		"revision-churn":           {[]string{AnalysisStorageHealth}, "", 0.6},
+		"large-value":              {[]string{AnalysisPerformance}, "", 1000000},
+		"huge-value":               {[]string{AnalysisStorageHealth}, "", 10 * 1024 * 1024},
+		"lease-count":              {[]string{AnalysisStorageHealth}, "", 1000},
+		"compaction-potential":     {[]string{AnalysisStorageHealth}, "", 100 * 1024 * 1024},
+		"frequently-modified-key":  {[]string{AnalysisPerformance}, "", 10},
+		"high-churn-key":           {[]string{AnalysisPerformance}, "", 100000},
+		"hot-loop":                 {[]string{AnalysisChurn}, "", 0},
+		"dominant-field-manager":   {[]string{AnalysisChurn}, "", 0.5},
+		"write-amplification":      {[]string{AnalysisChurn}, "", 100},
+	}
+
+	rules := DefaultRules()
+	require.Len(t, rules, len(baselines))
+	for _, rule := range rules {
+		b, ok := baselines[rule.ID]
+		require.True(t, ok, "rule %s has no baseline", rule.ID)
+		require.Equal(t, b.analyses, rule.Analyses, rule.ID)
+		require.Equal(t, b.operator, rule.Operator, rule.ID)
+		require.Equal(t, b.threshold, rule.Threshold, rule.ID)
+	}
+}
+
+func TestDefaultRulesBaselineFindings(t *testing.T) {
+	engine, err := NewEngine()
+	require.NoError(t, err)
+
+	// between the thresholds of the metadata and the storage health analysis
+	metadata := map[string]interface{}{
+		"quota":                     float64(defaultQuota),
+		"fragmentationRatio":        0.25,
+		"quotaUsagePercent":         float64(75),
+		"avgRevisionsPerKey":        float64(7),
+		"keysWithMultipleRevisions": float64(55),
+		"uniqueKeys":                float64(100),
+	}
+	findings, err := engine.evaluateRules(seededRuleInput(engine, nil, metadata), AnalysisMetadata)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"revision-density", "revision-churn-metadata"}, ruleIDsOf(findings))
+
+	findings, err = engine.evaluateRules(seededRuleInput(engine, nil, metadata), AnalysisStorageHealth)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"fragmentation", "quota-usage"}, ruleIDsOf(findings))
+
+	// the overview flags smaller namespaces than the namespace analysis
+	rows := map[string][]map[string]interface{}{
+		resourceTypesQuery:        {},
+		resourceDistributionQuery: {},
+		namespaceUsageQuery: {
+			{"namespace": "medium", "object_count": float64(10), "total_size_bytes": float64(20000000)},
+		},
+	}
+	findings, err = engine.evaluateRules(seededRuleInput(engine, rows, metadata), AnalysisOverview)
+	require.NoError(t, err)
+	require.Equal(t, []string{"large-namespace-overview"}, ruleIDsOf(findings))
+	findings, err = engine.evaluateRules(seededRuleInput(engine, rows, metadata), AnalysisNamespaces)
+	require.NoError(t, err)
+	require.Empty(t, findings)
+
+	// only keys with more than 5 revisions are high-churn keys
+	rows = map[string][]map[string]interface{}{
+		multiRevisionKeysQuery: {
+			{"key": "few", "revision_count": float64(5), "total_size": float64(200000)},
+			{"key": "many", "revision_count": float64(6), "total_size": float64(200000)},
+		},
+		mostModifiedKeysQuery: {},
+	}
+	findings, err = engine.evaluateRules(seededRuleInput(engine, rows, map[string]interface{}{"largestValueSize": float64(1040000)}), AnalysisPerformance)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"high-churn-key", "large-value"}, ruleIDsOf(findings))
+	for _, f := range findings {
+		if f.RuleID == "high-churn-key" {
+			require.Equal(t, "many", f.Subject)
+		}
+	}
+}
+
+func ruleIDsOf(findings []Finding) []string {
+	var ids []string
+	for _, f := range findings {
+		ids = append(ids, f.RuleID)
+	}
+	return ids
+}
+
+func TestEvaluateRulesTiers(t *testing.T) {
+	engine, err := NewEngine()
+	require.NoError(t, err)
+
+	in := seededRuleInput(engine, nil, map[string]interface{}{
+		"quota":             float64(defaultQuota),
+		"size":              float64(100),
+		"sizeInUse":         float64(90),
+		"quotaUsagePercent": float64(90),
+	})
+	findings, err := engine.evaluateRules(in, AnalysisStorageHealth)
+	require.NoError(t, err)
+
+	// the critical quota rule replaces the warning on the same metric, metrics without columns don't fire
+	require.Equal(t, []Finding{{
+		RuleID:      "quota-usage-critical",
+		Severity:    SeverityCritical,
+		Value:       90,
+		Threshold:   85,
+		Message:     "Critical quota usage: 90.0% - immediate attention required",
+		Remediation: "Urgent: Investigate large objects and consider quota increase",
+	}}, findings)
+	require.Equal(t, []string{"Critical quota usage: 90.0% - immediate attention required"}, insightsOf(findings))
+}
+
+func TestEvaluateRulesCustomRuleOnBuiltinMetric(t *testing.T) {
+	rules, err := parseRules([]byte(`
+rules:
+  - id: quota-usage-page
+    severity: info
+    analyses: [storage_health]
+    metric: quota_usage_percent
+    threshold: 50
+    message: "Page the on-call at {{.Value}}%"
+  - id: quota-usage-emergency
+    severity: warning
+    analyses: [storage_health]
+    metric: quota_usage_percent
+    threshold: 60
+    tier: quota-usage
+    message: "Quota emergency at {{.Value}}%"
+`))
+	require.NoError(t, err)
+	engine, err := NewEngineWithRules(rules)
+	require.NoError(t, err)
+
+	in := seededRuleInput(engine, nil, map[string]interface{}{
+		"quota":             float64(defaultQuota),
+		"size":              float64(100),
+		"sizeInUse":         float64(90),
+		"quotaUsagePercent": float64(90),
+	})
+	findings, err := engine.evaluateRules(in, AnalysisStorageHealth)
+	require.NoError(t, err)
+
+	// the custom rule on the quota metric isn't part of the built-in tier, one that joins the tier is outranked
+	require.Equal(t, []string{"quota-usage-critical", "quota-usage-page"}, ruleIDsOf(findings))
+}
+
+func TestEvaluateRulesScaleWithQuota(t *testing.T) {
+	engine, err := NewEngine()
+	require.NoError(t, err)
+
+	rows := map[string][]map[string]interface{}{
+		namespaceUsageQuery: {
+			{"namespace": "big", "object_count": float64(10), "total_size_bytes": float64(60 * 1024 * 1024)},
+			{"namespace": "small", "object_count": float64(10), "total_size_bytes": float64(1024)},
+		},
+		resourceDistributionQuery: {},
+	}
+
+	// 60MB are fine with the default quota
+	in := seededRuleInput(engine, rows, map[string]interface{}{"quota": float64(defaultQuota)})
+	findings, err := engine.evaluateRules(in, AnalysisNamespaces)
+	require.NoError(t, err)
+	require.Empty(t, findings)
+
+	// but not with a 4GB quota, which halves the threshold
+	in = seededRuleInput(engine, rows, map[string]interface{}{"quota": float64(defaultQuota / 2)})
+	findings, err = engine.evaluateRules(in, AnalysisNamespaces)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(findings))
+	require.Equal(t, "large-namespace", findings[0].RuleID)
+	require.Equal(t, "big", findings[0].Subject)
+	require.Equal(t, float64(50*1024*1024), findings[0].Threshold)
+	require.Equal(t, "Namespace 'big' consumes 60.00 MB of etcd storage", findings[0].Message)
+	require.Equal(t, "Look for large ConfigMaps, Secrets or custom resources in namespace 'big'", findings[0].Remediation)
+}
+
+func TestEvaluateRulesRowTemplates(t *testing.T) {
+	engine, err := NewEngine()
+	require.NoError(t, err)
+
+	in := seededRuleInput(engine, map[string][]map[string]interface{}{
+		churnGroupsQuery: {
+			{"hotKey": "/registry/leases/b", "hotKeyWrites": float64(8), "fieldManager": nil, "medianWriteInterval": float64(1), "hotLoop": true},
+			{"hotKey": "/registry/leases/a", "hotKeyWrites": float64(40), "fieldManager": "operator", "medianWriteInterval": 2.5, "hotLoop": true},
+			{"hotKey": "/registry/pods/c", "hotKeyWrites": float64(100), "fieldManager": "kubelet", "medianWriteInterval": float64(60), "hotLoop": false},
+		},
+	}, nil)
+	findings, err := engine.evaluateRules(in, AnalysisChurn)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"Hot loop detected: 'operator' rewrites '/registry/leases/a' every 2.5 seconds, 40 writes retained",
+		"Hot loop detected: 'unknown writer' rewrites '/registry/leases/b' every 1.0 seconds, 8 writes retained",
+	}, insightsOf(findings))
+	require.Equal(t, []string{"Check the controller for an update loop, e.g. a status field that changes on every reconcile"}, recommendationsOf(findings))
+}
+
+func TestChurnViews(t *testing.T) {
+	groups := []map[string]interface{}{
+		{"resourceType": "pods", "fieldManager": "kubelet", "subresource": "status", "writes": float64(50), "bytesWritten": float64(5000), "writeShare": 0.5, "hotKeyWrites": float64(20), "hotLoop": true},
+		{"resourceType": "leases", "fieldManager": "kubelet", "subresource": nil, "writes": float64(30), "bytesWritten": float64(900), "writeShare": 0.3, "hotKeyWrites": float64(30), "hotLoop": true},
+		{"resourceType": "pods", "fieldManager": "kube-scheduler", "subresource": nil, "writes": float64(15), "bytesWritten": float64(1500), "writeShare": 0.15, "hotKeyWrites": float64(1), "hotLoop": false},
+		{"resourceType": nil, "fieldManager": "kubelet", "subresource": "", "writes": float64(5), "bytesWritten": float64(50), "writeShare": 0.05, "hotKeyWrites": float64(5), "hotLoop": false},
+	}
+
+	require.Equal(t, []map[string]interface{}{
+		{"resourceType": "pods", "writes": float64(65), "bytes_written": float64(6500), "write_share": 0.65},
+		{"resourceType": "leases", "writes": float64(30), "bytes_written": float64(900), "write_share": 0.3},
+		{"resourceType": nil, "writes": float64(5), "bytes_written": float64(50), "write_share": 0.05},
+	}, churnByResourceType(groups))
+
+	// a null subresource is a group of its own, not the empty one
+	require.Equal(t, []map[string]interface{}{
+		{"fieldManager": "kubelet", "subresource": "status", "writes": float64(50), "bytes_written": float64(5000), "write_share": 0.5},
+		{"fieldManager": "kubelet", "subresource": nil, "writes": float64(30), "bytes_written": float64(900), "write_share": 0.3},
+		{"fieldManager": "kube-scheduler", "subresource": nil, "writes": float64(15), "bytes_written": float64(1500), "write_share": 0.15},
+		{"fieldManager": "kubelet", "subresource": "", "writes": float64(5), "bytes_written": float64(50), "write_share": 0.05},
+	}, churnByFieldManager(groups))
+
+	require.Equal(t, []map[string]interface{}{groups[1], groups[0]}, churnHotLoops(groups))
+	require.Empty(t, churnHotLoops(nil))
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := parseRules([]byte(`
+rules:
+  - id: fragmentation
+    threshold: 0.4
+    severity: critical
+  - id: lease-count
+    disabled: true
+  - id: configmaps-per-namespace
+    severity: warning
+    analyses: [overview, namespaces]
+    query: SELECT namespace AS subject, COUNT(*) AS value FROM {{SNAPSHOT}} t WHERE resourceType = 'configmaps' GROUP BY namespace
+    operator: ">="
+    threshold: 500
+    message: "Namespace '{{.Subject}}' has {{.Value}} ConfigMaps"
+`))
+	require.NoError(t, err)
+	require.Equal(t, len(DefaultRules())+1, len(rules))
+
+	byID := make(map[string]Rule)
+	for _, rule := range rules {
+		byID[rule.ID] = rule
+	}
+	// overrides only change the fields they set
+	require.Equal(t, 0.4, byID["fragmentation"].Threshold)
+	require.Equal(t, SeverityCritical, byID["fragmentation"].Severity)
+	require.Equal(t, "fragmentation_ratio", byID["fragmentation"].Metric)
+	require.True(t, byID["lease-count"].Disabled)
+	require.Equal(t, ">=", byID["configmaps-per-namespace"].Operator)
+
+	engine, err := NewEngineWithRules(rules)
+	require.NoError(t, err)
+	query := byID["configmaps-per-namespace"].Query
+	in := seededRuleInput(engine, map[string][]map[string]interface{}{
+		query:                     {{"subject": "apps", "value": float64(500)}, {"subject": "dev", "value": float64(3)}},
+		namespaceUsageQuery:       {},
+		resourceDistributionQuery: {},
+	}, nil)
+	findings, err := engine.evaluateRules(in, AnalysisNamespaces)
+	require.NoError(t, err)
+	require.Equal(t, []string{"Namespace 'apps' has 500 ConfigMaps"}, insightsOf(findings))
+}
+
+func TestParseRulesErrors(t *testing.T) {
+	for rules, expected := range map[string]string{
+		"rules:\n- threshold: 1\n":                                                                                   "has no id",
+		"rules:\n- id: quota-usage\n  severity: fatal\n":                                                             "invalid severity 'fatal'",
+		"rules:\n- id: fragmentation\n  operator: '!='\n":                                                            "invalid operator '!='",
+		"rules:\n- id: custom\n  severity: info\n  analyses: [overview]\n  message: m\n":                             "needs either a metric or a query",
+		"rules:\n- id: custom\n  severity: info\n  analyses: [overview]\n  metric: nope\n  message: m\n":             "unknown metric 'nope'",
+		"rules:\n- id: custom\n  severity: info\n  analyses: [everything]\n  metric: active_leases\n  message: m\n":  "unknown analysis 'everything'",
+		"rules:\n- id: custom\n  severity: info\n  analyses: [overview]\n  metric: active_leases\n  message: '{{'\n": "unclosed action",
+		"rules:\n- id: custom\n  severity: info\n  analyses: [overview]\n  metric: active_leases\n  message: m\n- id: custom\n  severity: info\n  analyses: [overview]\n  metric: active_leases\n  message: m\n": "duplicate rule 'custom'",
+	} {
+		_, err := parseRules([]byte(rules))
+		require.ErrorContains(t, err, expected, rules)
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	rules, err := LoadRules("")
+	require.NoError(t, err)
+	require.Equal(t, DefaultRules(), rules)
+
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("rules:\n- id: large-snapshot\n  threshold: 1\n"), 0600))
+	rules, err = LoadRules(path)
+	require.NoError(t, err)
+	require.Equal(t, len(DefaultRules()), len(rules))
+
+	_, err = LoadRules(filepath.Join(t.TempDir(), "missing.yaml"))
+	require.ErrorContains(t, err, "failed to read rules")
+}
+
+func TestCompare(t *testing.T) {
+	crossed, err := compare("", 2, 1)
+	require.NoError(t, err)
+	require.True(t, crossed)
+
+	crossed, err = compare("<", 2, 1)
+	require.NoError(t, err)
+	require.False(t, crossed)
+
+	crossed, err = compare(">=", 1, 1)
+	require.NoError(t, err)
+	require.True(t, crossed)
+}
+
+func TestParseSeverity(t *testing.T) {
+	severity, err := ParseSeverity("warning")
+	require.NoError(t, err)
+	require.Equal(t, SeverityWarning, severity)
+	require.True(t, SeverityCritical.AtLeast(severity))
+	require.True(t, SeverityWarning.AtLeast(severity))
+	require.False(t, SeverityInfo.AtLeast(severity))
+
+	_, err = ParseSeverity("fatal")
+	require.ErrorContains(t, err, "invalid severity 'fatal'")
+}
@@ -0,0 +1,176 @@
+package snapshotgen
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Encodings of the stored objects, the apiserver stores built-in types as protobuf and custom resources as JSON
+const (
+	EncodingProtobuf = "protobuf"
+	EncodingJSON     = "json"
+)
+
+// Config describes a generated snapshot. The same config always generates the same snapshot.
+type Config struct {
+	// Seed makes the generation reproducible, different seeds generate different names, uids and values
+	Seed int64 `yaml:"seed"`
+	// Prefix is the prefix of all keys, "/registry" like the apiserver's default
+	Prefix string `yaml:"prefix"`
+	// Namespaces is the number of namespaces, every namespace has the namespaced resources and a Namespace object
+	Namespaces int        `yaml:"namespaces"`
+	Resources  []Resource `yaml:"resources"`
+	// DeleteRatio is the fraction of objects deleted after all updates, their history ends with a tombstone
+	DeleteRatio float64 `yaml:"deleteRatio"`
+	// Leases is the number of leases the objects of leased resources are spread over
+	Leases int `yaml:"leases"`
+	// CompactRevision compacts the history at the revision like etcd does, zero keeps the whole history
+	CompactRevision int64 `yaml:"compactRevision"`
+	// Encryption encrypts the values of some resources like the apiserver does with encryption at rest
+	Encryption *Encryption `yaml:"encryption"`
+	// Start is the creation time of the first object, every revision is one second later
+	Start time.Time `yaml:"start"`
+}
+
+// Resource is a resource type of the generated objects
+type Resource struct {
+	// Resource is the plural name in the key, e.g. pods
+	Resource string `yaml:"resource"`
+	// Group is the API group in the key, the apiserver only stores custom resources with their group
+	Group      string `yaml:"group,omitempty"`
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	// Count is the number of objects per namespace, or in total for cluster-scoped resources
+	Count         int  `yaml:"count"`
+	ClusterScoped bool `yaml:"clusterScoped,omitempty"`
+	// Encoding is protobuf or json, defaults to protobuf
+	Encoding string `yaml:"encoding,omitempty"`
+	// Revisions is the number of revisions of every object including its creation, defaults to 1
+	Revisions int `yaml:"revisions,omitempty"`
+	// ValueSize is the size of the spec in bytes
+	ValueSize int `yaml:"valueSize"`
+	// Owner is the resource type that owns the objects, in the same namespace and listed before this one
+	Owner string `yaml:"owner,omitempty"`
+	// Manager is the field manager of the objects
+	Manager string `yaml:"manager,omitempty"`
+	// Leased attaches the objects to leases, like the apiserver does for events
+	Leased bool `yaml:"leased,omitempty"`
+}
+
+// Encryption configures the encrypted resources, like a provider of an EncryptionConfiguration
+type Encryption struct {
+	Resources []string `yaml:"resources"`
+	// Provider is aescbc, aesgcm, secretbox or kms. kms values are random, they can't be decrypted without the
+	// KMS plugin anyway.
+	Provider string `yaml:"provider"`
+	KeyName  string `yaml:"keyName"`
+	// Secret is the base64 encoded key as in the EncryptionConfiguration, not needed for kms
+	Secret string `yaml:"secret,omitempty"`
+}
+
+// DefaultConfig returns a small cluster with the usual mix of workloads, configuration, events and a custom
+// resource, with some history, deletions and leased events
+func DefaultConfig() Config {
+	return Config{
+		Seed:        1,
+		Prefix:      "/registry",
+		Namespaces:  10,
+		DeleteRatio: 0.05,
+		Leases:      10,
+		Start:       time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Resources: []Resource{
+			{Resource: "nodes", APIVersion: "v1", Kind: "Node", Count: 3, ClusterScoped: true, Revisions: 10, ValueSize: 4096, Manager: "kubelet"},
+			{Resource: "deployments", APIVersion: "apps/v1", Kind: "Deployment", Count: 3, Revisions: 3, ValueSize: 1024, Manager: "kubectl-client-side-apply"},
+			{Resource: "replicasets", APIVersion: "apps/v1", Kind: "ReplicaSet", Count: 3, Revisions: 2, ValueSize: 1024, Owner: "deployments", Manager: "kube-controller-manager"},
+			{Resource: "pods", APIVersion: "v1", Kind: "Pod", Count: 6, Revisions: 4, ValueSize: 2048, Owner: "replicasets", Manager: "kubelet"},
+			{Resource: "configmaps", APIVersion: "v1", Kind: "ConfigMap", Count: 4, Revisions: 2, ValueSize: 2048, Manager: "kubectl-client-side-apply"},
+			{Resource: "secrets", APIVersion: "v1", Kind: "Secret", Count: 4, ValueSize: 512, Manager: "kubectl-client-side-apply"},
+			{Resource: "services", APIVersion: "v1", Kind: "Service", Count: 2, ValueSize: 512, Manager: "kubectl-client-side-apply"},
+			{Resource: "events", APIVersion: "v1", Kind: "Event", Count: 20, ValueSize: 256, Manager: "kubelet", Leased: true},
+			{Resource: "applications", Group: "argoproj.io", APIVersion: "argoproj.io/v1alpha1", Kind: "Application", Count: 2, Encoding: EncodingJSON, Revisions: 5, ValueSize: 4096, Manager: "argocd-application-controller"},
+		},
+	}
+}
+
+// LoadConfig reads a config from a YAML file, unset fields keep the values of DefaultConfig
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to read generator config: %w", err)
+	}
+	cfg := DefaultConfig()
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return Config{}, fmt.Errorf("failed to parse generator config: %w", err)
+	}
+	return cfg, nil
+}
+
+// validate checks the config and returns the decoded encryption secret
+func (c Config) validate() ([]byte, error) {
+	if c.Namespaces < 0 || c.Leases < 0 || c.CompactRevision < 0 {
+		return nil, fmt.Errorf("namespaces, leases and compactRevision must not be negative")
+	}
+	if c.DeleteRatio < 0 || c.DeleteRatio > 1 {
+		return nil, fmt.Errorf("deleteRatio must be between 0 and 1, got %v", c.DeleteRatio)
+	}
+	if len(c.Resources) == 0 {
+		return nil, fmt.Errorf("at least one resource is required")
+	}
+
+	seen := make(map[string]bool)
+	for _, r := range c.Resources {
+		if r.Resource == "" || r.APIVersion == "" || r.Kind == "" {
+			return nil, fmt.Errorf("resource, apiVersion and kind are required")
+		}
+		if r.Resource == "namespaces" {
+			return nil, fmt.Errorf("namespaces are generated from the namespaces setting")
+		}
+		if seen[r.Resource] {
+			return nil, fmt.Errorf("resource %s is listed twice", r.Resource)
+		}
+		switch r.Encoding {
+		case "", EncodingProtobuf, EncodingJSON:
+		default:
+			return nil, fmt.Errorf("invalid encoding '%s' of resource %s, expected protobuf or json", r.Encoding, r.Resource)
+		}
+		if r.Count < 0 || r.Revisions < 0 || r.ValueSize < 0 {
+			return nil, fmt.Errorf("count, revisions and valueSize of resource %s must not be negative", r.Resource)
+		}
+		if r.Owner != "" && !seen[r.Owner] {
+			return nil, fmt.Errorf("owner %s of resource %s must be listed before it", r.Owner, r.Resource)
+		}
+		if r.Leased && c.Leases == 0 {
+			return nil, fmt.Errorf("resource %s is leased, but there are no leases", r.Resource)
+		}
+		seen[r.Resource] = true
+	}
+
+	if c.Encryption == nil {
+		return nil, nil
+	}
+	if c.Encryption.KeyName == "" {
+		return nil, fmt.Errorf("encryption keyName is required")
+	}
+	secret, err := base64.StdEncoding.DecodeString(c.Encryption.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption secret: %w", err)
+	}
+	switch c.Encryption.Provider {
+	case "aescbc", "aesgcm":
+		if len(secret) != 16 && len(secret) != 24 && len(secret) != 32 {
+			return nil, fmt.Errorf("%s secrets must be 16, 24 or 32 bytes, got %d", c.Encryption.Provider, len(secret))
+		}
+	case "secretbox":
+		if len(secret) != 32 {
+			return nil, fmt.Errorf("secretbox secrets must be 32 bytes, got %d", len(secret))
+		}
+	case "kms":
+	default:
+		return nil, fmt.Errorf("invalid encryption provider '%s', expected aescbc, aesgcm, secretbox or kms", c.Encryption.Provider)
+	}
+	return secret, nil
+}
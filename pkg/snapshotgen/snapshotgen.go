@@ -0,0 +1,424 @@
+// Package snapshotgen writes synthetic etcd snapshots with Kubernetes objects, as fixtures for tests and
+// benchmarks that shouldn't depend on a real cluster.
+package snapshotgen
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/server/v3/mvcc/backend"
+	"go.etcd.io/etcd/server/v3/mvcc/buckets"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// batchSize is the number of revisions put in one write transaction
+	batchSize = 10000
+	// firstLeaseID is the ID of the first lease, the others follow it
+	firstLeaseID int64 = 0x694d8f2a00000000
+	// leaseTTL is the TTL of the leases in seconds, the apiserver's default for events is an hour
+	leaseTTL = 3600
+)
+
+// Result describes a generated snapshot
+type Result struct {
+	Objects int
+	// Revisions is the number of revisions in the snapshot, after the compaction
+	Revisions   int
+	Tombstones  int
+	MaxRevision int64
+	// CompactRevision is zero if the snapshot isn't compacted
+	CompactRevision int64
+	Leases          int
+	Size            int64
+}
+
+// object is a generated Kubernetes object
+type object struct {
+	resource  *Resource
+	key       string
+	namespace string
+	name      string
+	uid       string
+	// owner is the index of the owning object, -1 without owner
+	owner int
+	lease int64
+	// created is the revision the object was created at
+	created int64
+}
+
+// event is a revision of an object, a creation, an update or the deletion
+type event struct {
+	object   int
+	revision int64
+	version  int64
+	deleted  bool
+}
+
+// Generate writes a snapshot generated from the config to path, which must not exist. Like "etcdctl snapshot
+// save" the database is followed by its sha256.
+func Generate(path string, cfg Config) (*Result, error) {
+	secret, err := cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("snapshot '%s' already exists", path)
+	}
+
+	g := &generator{cfg: cfg, rng: rand.New(rand.NewSource(cfg.Seed)), secret: secret}
+	if g.cfg.Prefix == "" {
+		g.cfg.Prefix = "/registry"
+	}
+	if g.cfg.Start.IsZero() {
+		g.cfg.Start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	g.objects()
+	if len(g.objs) == 0 {
+		return nil, fmt.Errorf("the config generates no objects")
+	}
+	g.history()
+
+	result := &Result{Objects: len(g.objs), MaxRevision: g.events[len(g.events)-1].revision, Leases: g.cfg.Leases}
+	if cfg.CompactRevision > result.MaxRevision {
+		return nil, fmt.Errorf("compactRevision %d is higher than the highest revision %d", cfg.CompactRevision, result.MaxRevision)
+	}
+	result.CompactRevision = cfg.CompactRevision
+	dropped := g.compact(cfg.CompactRevision)
+
+	if err := g.write(path, dropped, result); err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+	if result.Size, err = appendHash(path); err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+	return result, nil
+}
+
+type generator struct {
+	cfg    Config
+	rng    *rand.Rand
+	secret []byte
+
+	objs   []object
+	events []event
+}
+
+// objects creates the Namespace objects, the cluster-scoped objects and then the objects of every namespace
+func (g *generator) objects() {
+	namespaces := &Resource{Resource: "namespaces", APIVersion: "v1", Kind: "Namespace", ClusterScoped: true, Revisions: 1, ValueSize: 64, Manager: "kubectl-create"}
+	names := make([]string, g.cfg.Namespaces)
+	for i := range names {
+		names[i] = fmt.Sprintf("namespace-%03d", i)
+		g.add(namespaces, "", names[i], -1)
+	}
+
+	for i := range g.cfg.Resources {
+		r := &g.cfg.Resources[i]
+		if !r.ClusterScoped {
+			continue
+		}
+		for j := 0; j < r.Count; j++ {
+			g.add(r, "", fmt.Sprintf("%s-%d", singular(r.Resource), j), -1)
+		}
+	}
+
+	for _, namespace := range names {
+		// the objects of each resource type in the namespace, to find the owners
+		byResource := make(map[string][]int)
+		for i := range g.cfg.Resources {
+			r := &g.cfg.Resources[i]
+			if r.ClusterScoped {
+				continue
+			}
+			for j := 0; j < r.Count; j++ {
+				owner := -1
+				name := fmt.Sprintf("%s-%d", singular(r.Resource), j)
+				if owners := byResource[r.Owner]; len(owners) > 0 {
+					// owned objects are named after their owner, like the controllers do
+					owner = owners[j%len(owners)]
+					name = fmt.Sprintf("%s-%s", g.objs[owner].name, g.suffix())
+				}
+				byResource[r.Resource] = append(byResource[r.Resource], g.add(r, namespace, name, owner))
+			}
+		}
+	}
+}
+
+// add adds an object and returns its index
+func (g *generator) add(r *Resource, namespace, name string, owner int) int {
+	parts := []string{g.cfg.Prefix}
+	if r.Group != "" {
+		parts = append(parts, r.Group)
+	}
+	parts = append(parts, r.Resource)
+	if namespace != "" {
+		parts = append(parts, namespace)
+	}
+	parts = append(parts, name)
+
+	o := object{resource: r, key: strings.Join(parts, "/"), namespace: namespace, name: name, uid: g.uid(), owner: owner}
+	if r.Leased {
+		o.lease = firstLeaseID + int64(len(g.objs)%g.cfg.Leases)
+	}
+	g.objs = append(g.objs, o)
+	return len(g.objs) - 1
+}
+
+// history creates all objects, updates them in rounds in random order until they have their revisions and
+// then deletes a random DeleteRatio of them. The first revision is 2, like in etcd.
+func (g *generator) history() {
+	revision := int64(1)
+	versions := make([]int64, len(g.objs))
+	next := func(i int, deleted bool) {
+		revision++
+		versions[i]++
+		if deleted {
+			versions[i] = 0
+		}
+		g.events = append(g.events, event{object: i, revision: revision, version: versions[i], deleted: deleted})
+	}
+
+	for i := range g.objs {
+		next(i, false)
+		g.objs[i].created = revision
+	}
+
+	for round := 1; ; round++ {
+		var updated []int
+		for i, o := range g.objs {
+			if revisions(o.resource) > round {
+				updated = append(updated, i)
+			}
+		}
+		if len(updated) == 0 {
+			break
+		}
+		g.rng.Shuffle(len(updated), func(a, b int) { updated[a], updated[b] = updated[b], updated[a] })
+		for _, i := range updated {
+			next(i, false)
+		}
+	}
+
+	order := g.rng.Perm(len(g.objs))
+	for _, i := range order[:int(float64(len(order))*g.cfg.DeleteRatio)] {
+		next(i, true)
+	}
+}
+
+// compact returns the events a compaction at revision drops: of the revisions at or below it etcd only keeps
+// the latest of each key, unless that one is a deletion
+func (g *generator) compact(revision int64) map[int]bool {
+	dropped := make(map[int]bool)
+	if revision == 0 {
+		return dropped
+	}
+
+	latest := make(map[int]int)
+	for i, e := range g.events {
+		if e.revision > revision {
+			break
+		}
+		if previous, ok := latest[e.object]; ok {
+			dropped[previous] = true
+		}
+		latest[e.object] = i
+	}
+	for _, i := range latest {
+		if g.events[i].deleted {
+			dropped[i] = true
+		}
+	}
+	return dropped
+}
+
+// write writes the database with the revisions that aren't dropped, the leases and the meta bucket
+func (g *generator) write(path string, dropped map[int]bool, result *Result) error {
+	db, err := bolt.Open(path, 0600, &bolt.Options{NoSync: true})
+	if err != nil {
+		return fmt.Errorf("failed to create database: %w", err)
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		// the buckets etcd creates on startup
+		for _, b := range []backend.Bucket{buckets.Key, buckets.Meta, buckets.Lease, buckets.Alarm, buckets.Cluster, buckets.Members, buckets.MembersRemoved, buckets.Auth, buckets.AuthUsers, buckets.AuthRoles} {
+			if _, err := tx.CreateBucketIfNotExists(b.Name()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create buckets: %w", err)
+	}
+
+	for start := 0; start < len(g.events); start += batchSize {
+		batch := g.events[start:min(start+batchSize, len(g.events))]
+		err := db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(buckets.Key.Name())
+			// revisions are appended in order, etcd writes the key bucket with the same fill percent
+			bucket.FillPercent = 0.9
+			for i, e := range batch {
+				if dropped[start+i] {
+					continue
+				}
+				revision, value, err := g.revision(e)
+				if err != nil {
+					return err
+				}
+				if err := bucket.Put(revision, value); err != nil {
+					return err
+				}
+				result.Revisions++
+				if e.deleted {
+					result.Tombstones++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to write revisions: %w", err)
+		}
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		leases := tx.Bucket(buckets.Lease.Name())
+		for i := 0; i < g.cfg.Leases; i++ {
+			// leasepb.Lease: 1 ID, 2 TTL
+			id := firstLeaseID + int64(i)
+			var lease []byte
+			lease = protowire.AppendTag(lease, 1, protowire.VarintType)
+			lease = protowire.AppendVarint(lease, uint64(id))
+			lease = protowire.AppendTag(lease, 2, protowire.VarintType)
+			lease = protowire.AppendVarint(lease, leaseTTL)
+			if err := leases.Put(uint64Bytes(uint64(id)), lease); err != nil {
+				return err
+			}
+		}
+
+		meta := tx.Bucket(buckets.Meta.Name())
+		// every revision was applied from one raft entry
+		if err := meta.Put(buckets.MetaConsistentIndexKeyName, uint64Bytes(uint64(result.MaxRevision))); err != nil {
+			return err
+		}
+		if err := meta.Put(buckets.MetaTermKeyName, uint64Bytes(2)); err != nil {
+			return err
+		}
+		if result.CompactRevision == 0 {
+			return nil
+		}
+		compacted := revisionBytes(result.CompactRevision, 0)
+		if err := meta.Put([]byte("scheduledCompactRev"), compacted); err != nil {
+			return err
+		}
+		return meta.Put([]byte("finishedCompactRev"), compacted)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write meta and leases: %w", err)
+	}
+	return db.Close()
+}
+
+// revision returns the key and value of an event in the key bucket
+func (g *generator) revision(e event) ([]byte, []byte, error) {
+	o := &g.objs[e.object]
+	revision := revisionBytes(e.revision, 0)
+	kv := mvccpb.KeyValue{Key: []byte(o.key), ModRevision: e.revision}
+	if e.deleted {
+		// etcd marks deletions with a 't' after the revision
+		revision = append(revision, 't')
+	} else {
+		value, err := g.value(o, e)
+		if err != nil {
+			return nil, nil, err
+		}
+		kv.CreateRevision = o.created
+		kv.Version = e.version
+		kv.Value = value
+		kv.Lease = o.lease
+	}
+
+	value, err := kv.Marshal()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal revision %d of key [%s]: %w", e.revision, o.key, err)
+	}
+	return revision, value, nil
+}
+
+// uid returns a random version 4 UUID
+func (g *generator) uid() string {
+	b := make([]byte, 16)
+	g.rng.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// suffix returns the random suffix controllers append to the names of the objects they create
+func (g *generator) suffix() string {
+	const alphabet = "bcdfghjklmnpqrstvwxz2456789"
+	b := make([]byte, 5)
+	for i := range b {
+		b[i] = alphabet[g.rng.Intn(len(alphabet))]
+	}
+	return string(b)
+}
+
+func revisions(r *Resource) int {
+	if r.Revisions == 0 {
+		return 1
+	}
+	return r.Revisions
+}
+
+func singular(resource string) string {
+	return strings.TrimSuffix(resource, "s")
+}
+
+// revisionBytes encodes a revision like etcd's key bucket does: main and sub revision separated by '_'
+func revisionBytes(main, sub int64) []byte {
+	b := make([]byte, 17)
+	binary.BigEndian.PutUint64(b, uint64(main))
+	b[8] = '_'
+	binary.BigEndian.PutUint64(b[9:], uint64(sub))
+	return b
+}
+
+func uint64Bytes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// appendHash appends the sha256 of the database and returns the size of the snapshot
+func appendHash(path string) (int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, fmt.Errorf("failed to hash snapshot: %w", err)
+	}
+	if _, err := f.Write(h.Sum(nil)); err != nil {
+		return 0, fmt.Errorf("failed to write snapshot hash: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return 0, fmt.Errorf("failed to close snapshot: %w", err)
+	}
+	return size + sha256.Size, nil
+}
@@ -0,0 +1,280 @@
+package snapshotgen
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/server/v3/mvcc/buckets"
+)
+
+// readRevisions returns the key bucket of a generated snapshot by revision
+func readRevisions(t *testing.T, path string) (revisions [][]byte, values []mvccpb.KeyValue) {
+	db, err := bolt.Open(path, 0400, &bolt.Options{ReadOnly: true})
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(buckets.Key.Name()).ForEach(func(k, v []byte) error {
+			kv := mvccpb.KeyValue{}
+			require.NoError(t, kv.Unmarshal(v))
+			revisions = append(revisions, append([]byte(nil), k...))
+			values = append(values, kv)
+			return nil
+		})
+	}))
+	return revisions, values
+}
+
+func smallConfig() Config {
+	cfg := DefaultConfig()
+	cfg.Namespaces = 2
+	return cfg
+}
+
+func TestGenerate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "generated.snapshot")
+	result, err := Generate(path, smallConfig())
+	require.NoError(t, err)
+
+	// 2 namespaces, 3 nodes and 44 objects per namespace
+	require.Equal(t, 2+3+2*44, result.Objects)
+	require.Equal(t, int64(result.Revisions+1), result.MaxRevision)
+	require.Equal(t, int(float64(result.Objects)*0.05), result.Tombstones)
+	require.Equal(t, 10, result.Leases)
+
+	// the database is followed by its sha256, like etcdctl writes it
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, result.Size, int64(len(data)))
+	sum := sha256.Sum256(data[:len(data)-sha256.Size])
+	require.Equal(t, sum[:], data[len(data)-sha256.Size:])
+
+	revisions, values := readRevisions(t, path)
+	require.Len(t, revisions, result.Revisions)
+	versions := make(map[string]int64)
+	tombstones := 0
+	for i, kv := range values {
+		require.Equal(t, int64(i+2), kv.ModRevision)
+		if bytes.HasSuffix(revisions[i], []byte("t")) {
+			tombstones++
+			require.Empty(t, kv.Value)
+			delete(versions, string(kv.Key))
+			continue
+		}
+		versions[string(kv.Key)]++
+		require.Equal(t, versions[string(kv.Key)], kv.Version, string(kv.Key))
+
+		key := string(kv.Key)
+		switch {
+		case strings.HasPrefix(key, "/registry/argoproj.io/applications/namespace-"):
+			require.True(t, bytes.HasPrefix(kv.Value, []byte(`{"apiVersion":"argoproj.io/v1alpha1","kind":"Application"`)), key)
+		case strings.HasPrefix(key, "/registry/events/"):
+			require.NotZero(t, kv.Lease, key)
+			require.True(t, bytes.HasPrefix(kv.Value, []byte(protobufPrefix)), key)
+		default:
+			require.Zero(t, kv.Lease, key)
+			require.True(t, bytes.HasPrefix(kv.Value, []byte(protobufPrefix)), key)
+		}
+	}
+	require.Equal(t, result.Tombstones, tombstones)
+	require.Contains(t, versions, "/registry/namespaces/namespace-001")
+	require.Contains(t, versions, "/registry/nodes/node-2")
+}
+
+func TestGenerateIsReproducible(t *testing.T) {
+	dir := t.TempDir()
+	_, err := Generate(filepath.Join(dir, "a.snapshot"), smallConfig())
+	require.NoError(t, err)
+	_, err = Generate(filepath.Join(dir, "b.snapshot"), smallConfig())
+	require.NoError(t, err)
+	cfg := smallConfig()
+	cfg.Seed = 2
+	_, err = Generate(filepath.Join(dir, "c.snapshot"), cfg)
+	require.NoError(t, err)
+
+	a, err := os.ReadFile(filepath.Join(dir, "a.snapshot"))
+	require.NoError(t, err)
+	b, err := os.ReadFile(filepath.Join(dir, "b.snapshot"))
+	require.NoError(t, err)
+	c, err := os.ReadFile(filepath.Join(dir, "c.snapshot"))
+	require.NoError(t, err)
+	require.Equal(t, a, b)
+	require.NotEqual(t, a, c)
+
+	_, err = Generate(filepath.Join(dir, "a.snapshot"), smallConfig())
+	require.ErrorContains(t, err, "already exists")
+}
+
+func TestGenerateCompacted(t *testing.T) {
+	dir := t.TempDir()
+	full, err := Generate(filepath.Join(dir, "full.snapshot"), smallConfig())
+	require.NoError(t, err)
+
+	cfg := smallConfig()
+	cfg.CompactRevision = full.MaxRevision
+	path := filepath.Join(dir, "compacted.snapshot")
+	result, err := Generate(path, cfg)
+	require.NoError(t, err)
+	require.Equal(t, full.MaxRevision, result.CompactRevision)
+
+	// compacted at the highest revision, only the latest revision of the objects that weren't deleted remain
+	require.Equal(t, full.Objects-full.Tombstones, result.Revisions)
+	require.Zero(t, result.Tombstones)
+	_, values := readRevisions(t, path)
+	keys := make(map[string]bool)
+	for _, kv := range values {
+		require.False(t, keys[string(kv.Key)], string(kv.Key))
+		keys[string(kv.Key)] = true
+	}
+
+	db, err := bolt.Open(path, 0400, &bolt.Options{ReadOnly: true})
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(buckets.Meta.Name())
+		require.Equal(t, revisionBytes(full.MaxRevision, 0), meta.Get([]byte("finishedCompactRev")))
+		require.Equal(t, uint64Bytes(uint64(full.MaxRevision)), meta.Get(buckets.MetaConsistentIndexKeyName))
+		require.Equal(t, 10, tx.Bucket(buckets.Lease.Name()).Stats().KeyN)
+		return nil
+	}))
+
+	cfg.CompactRevision = full.MaxRevision + 1
+	_, err = Generate(filepath.Join(dir, "invalid.snapshot"), cfg)
+	require.ErrorContains(t, err, "is higher than the highest revision")
+}
+
+func TestGenerateEncrypted(t *testing.T) {
+	for _, provider := range []string{"aescbc", "aesgcm", "secretbox", "kms"} {
+		t.Run(provider, func(t *testing.T) {
+			cfg := smallConfig()
+			cfg.Encryption = &Encryption{
+				Resources: []string{"secrets"},
+				Provider:  provider,
+				KeyName:   "key1",
+				Secret:    base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x42}, 32)),
+			}
+			path := filepath.Join(t.TempDir(), "encrypted.snapshot")
+			_, err := Generate(path, cfg)
+			require.NoError(t, err)
+
+			_, values := readRevisions(t, path)
+			encrypted := 0
+			for _, kv := range values {
+				if strings.HasPrefix(string(kv.Key), "/registry/secrets/") && len(kv.Value) > 0 {
+					require.True(t, bytes.HasPrefix(kv.Value, []byte("k8s:enc:"+provider+":")), string(kv.Key))
+					encrypted++
+				} else {
+					require.False(t, bytes.HasPrefix(kv.Value, []byte("k8s:enc:")), string(kv.Key))
+				}
+			}
+			require.NotZero(t, encrypted)
+		})
+	}
+}
+
+func TestGenerateOwners(t *testing.T) {
+	cfg := smallConfig()
+	cfg.Namespaces = 1
+	cfg.DeleteRatio = 0
+	for i := range cfg.Resources {
+		cfg.Resources[i].Encoding = EncodingJSON
+	}
+	path := filepath.Join(t.TempDir(), "generated.snapshot")
+	_, err := Generate(path, cfg)
+	require.NoError(t, err)
+
+	type object struct {
+		Kind     string `json:"kind"`
+		Metadata struct {
+			UID             string               `json:"uid"`
+			OwnerReferences []jsonOwnerReference `json:"ownerReferences"`
+		} `json:"metadata"`
+	}
+	// the latest revision of every key, namespaces aren't a resource of the config and stay protobuf
+	objects := make(map[string]object)
+	_, values := readRevisions(t, path)
+	for _, kv := range values {
+		if bytes.HasPrefix(kv.Value, []byte(protobufPrefix)) {
+			continue
+		}
+		var o object
+		require.NoError(t, json.Unmarshal(kv.Value, &o), string(kv.Key))
+		objects[string(kv.Key)] = o
+	}
+	kinds := make(map[string]string)
+	for _, o := range objects {
+		kinds[o.Metadata.UID] = o.Kind
+	}
+
+	// every replicaset is owned by a deployment and every pod by a replicaset, by uid
+	owners := make(map[string]int)
+	for key, o := range objects {
+		if len(o.Metadata.OwnerReferences) == 0 {
+			continue
+		}
+		require.Len(t, o.Metadata.OwnerReferences, 1, key)
+		ref := o.Metadata.OwnerReferences[0]
+		require.Equal(t, ref.Kind, kinds[ref.UID], key)
+		owners[o.Kind+"/"+ref.Kind]++
+	}
+	require.Equal(t, map[string]int{"ReplicaSet/Deployment": 3, "Pod/ReplicaSet": 6}, owners)
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, tc := range []struct {
+		change   func(cfg *Config)
+		expected string
+	}{
+		{func(cfg *Config) { cfg.Resources = nil }, "at least one resource is required"},
+		{func(cfg *Config) { cfg.DeleteRatio = 2 }, "deleteRatio must be between 0 and 1"},
+		{func(cfg *Config) { cfg.Resources[0].Encoding = "xml" }, "invalid encoding 'xml'"},
+		{func(cfg *Config) { cfg.Resources[1].Owner = "pods" }, "owner pods of resource deployments must be listed before it"},
+		{func(cfg *Config) { cfg.Resources = append(cfg.Resources, cfg.Resources[0]) }, "resource nodes is listed twice"},
+		{func(cfg *Config) { cfg.Leases = 0 }, "resource events is leased, but there are no leases"},
+		{func(cfg *Config) {
+			cfg.Encryption = &Encryption{Provider: "aescbc", KeyName: "key1", Secret: "c2hvcnQ="}
+		}, "aescbc secrets must be 16, 24 or 32 bytes"},
+		{func(cfg *Config) { cfg.Namespaces = 0; cfg.Resources = cfg.Resources[1:2] }, "the config generates no objects"},
+	} {
+		cfg := smallConfig()
+		tc.change(&cfg)
+		_, err := Generate(filepath.Join(t.TempDir(), "invalid.snapshot"), cfg)
+		require.ErrorContains(t, err, tc.expected)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+namespaces: 50
+compactRevision: 100
+resources:
+  - resource: configmaps
+    apiVersion: v1
+    kind: ConfigMap
+    count: 10
+    revisions: 3
+    valueSize: 1024
+`), 0600))
+
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, 50, cfg.Namespaces)
+	require.Equal(t, int64(100), cfg.CompactRevision)
+	require.Equal(t, []Resource{{Resource: "configmaps", APIVersion: "v1", Kind: "ConfigMap", Count: 10, Revisions: 3, ValueSize: 1024}}, cfg.Resources)
+	// the rest is the default
+	require.Equal(t, DefaultConfig().Seed, cfg.Seed)
+	require.Equal(t, DefaultConfig().Prefix, cfg.Prefix)
+
+	_, err = LoadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	require.ErrorContains(t, err, "failed to read generator config")
+}
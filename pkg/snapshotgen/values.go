@@ -0,0 +1,246 @@
+package snapshotgen
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protobufPrefix starts the values the apiserver stores with its protobuf serializer
+const protobufPrefix = "k8s\x00"
+
+// value returns the stored object of an event, encoded and encrypted like the apiserver does
+func (g *generator) value(o *object, e event) ([]byte, error) {
+	var value []byte
+	if o.resource.Encoding == EncodingJSON {
+		var err error
+		if value, err = g.jsonObject(o, e); err != nil {
+			return nil, fmt.Errorf("failed to encode object [%s]: %w", o.key, err)
+		}
+	} else {
+		value = g.protobufObject(o, e)
+	}
+
+	if g.cfg.Encryption == nil || !contains(g.cfg.Encryption.Resources, o.resource.Resource) {
+		return value, nil
+	}
+	return g.encrypt(o.key, value)
+}
+
+// times returns the creation time of the object and the time of the revision
+func (g *generator) times(o *object, e event) (time.Time, time.Time) {
+	return g.cfg.Start.Add(time.Duration(o.created) * time.Second), g.cfg.Start.Add(time.Duration(e.revision) * time.Second)
+}
+
+// filler returns random printable bytes for the spec, so values don't compress unrealistically well
+func (g *generator) filler(size int) []byte {
+	const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = alphabet[g.rng.Intn(len(alphabet))]
+	}
+	return b
+}
+
+type jsonOwnerReference struct {
+	APIVersion         string `json:"apiVersion"`
+	Kind               string `json:"kind"`
+	Name               string `json:"name"`
+	UID                string `json:"uid"`
+	Controller         bool   `json:"controller"`
+	BlockOwnerDeletion bool   `json:"blockOwnerDeletion"`
+}
+
+type jsonManagedFieldsEntry struct {
+	Manager    string `json:"manager"`
+	Operation  string `json:"operation"`
+	APIVersion string `json:"apiVersion"`
+	Time       string `json:"time"`
+	FieldsType string `json:"fieldsType"`
+}
+
+// jsonObject encodes the object like the apiserver stores custom resources
+func (g *generator) jsonObject(o *object, e event) ([]byte, error) {
+	created, modified := g.times(o, e)
+	type metadata struct {
+		Name              string                   `json:"name"`
+		Namespace         string                   `json:"namespace,omitempty"`
+		UID               string                   `json:"uid"`
+		Generation        int64                    `json:"generation"`
+		CreationTimestamp string                   `json:"creationTimestamp"`
+		OwnerReferences   []jsonOwnerReference     `json:"ownerReferences,omitempty"`
+		ManagedFields     []jsonManagedFieldsEntry `json:"managedFields,omitempty"`
+	}
+	object := struct {
+		APIVersion string            `json:"apiVersion"`
+		Kind       string            `json:"kind"`
+		Metadata   metadata          `json:"metadata"`
+		Spec       map[string]string `json:"spec"`
+	}{
+		APIVersion: o.resource.APIVersion,
+		Kind:       o.resource.Kind,
+		Metadata: metadata{
+			Name:              o.name,
+			Namespace:         o.namespace,
+			UID:               o.uid,
+			Generation:        e.version,
+			CreationTimestamp: created.Format(time.RFC3339),
+		},
+		Spec: map[string]string{"data": string(g.filler(o.resource.ValueSize))},
+	}
+	if o.owner >= 0 {
+		owner := &g.objs[o.owner]
+		object.Metadata.OwnerReferences = []jsonOwnerReference{{
+			APIVersion: owner.resource.APIVersion, Kind: owner.resource.Kind, Name: owner.name, UID: owner.uid, Controller: true, BlockOwnerDeletion: true,
+		}}
+	}
+	if o.resource.Manager != "" {
+		object.Metadata.ManagedFields = []jsonManagedFieldsEntry{{
+			Manager: o.resource.Manager, Operation: "Update", APIVersion: o.resource.APIVersion, Time: modified.Format(time.RFC3339), FieldsType: "FieldsV1",
+		}}
+	}
+	return json.Marshal(object)
+}
+
+// protobufObject encodes the object like the apiserver stores built-in types, as runtime.Unknown with the
+// object's metav1.ObjectMeta as first field
+func (g *generator) protobufObject(o *object, e event) []byte {
+	created, modified := g.times(o, e)
+
+	var typeMeta []byte
+	typeMeta = appendString(typeMeta, 1, o.resource.APIVersion)
+	typeMeta = appendString(typeMeta, 2, o.resource.Kind)
+
+	// metav1.ObjectMeta: 1 name, 3 namespace, 5 uid, 7 generation, 8 creationTimestamp, 13 ownerReferences,
+	// 17 managedFields
+	var meta []byte
+	meta = appendString(meta, 1, o.name)
+	if o.namespace != "" {
+		meta = appendString(meta, 3, o.namespace)
+	}
+	meta = appendString(meta, 5, o.uid)
+	meta = protowire.AppendTag(meta, 7, protowire.VarintType)
+	meta = protowire.AppendVarint(meta, uint64(e.version))
+	meta = appendMessage(meta, 8, protobufTime(created))
+	if o.owner >= 0 {
+		// metav1.OwnerReference: 1 kind, 3 name, 4 uid, 5 apiVersion, 6 controller, 7 blockOwnerDeletion
+		owner := &g.objs[o.owner]
+		var ref []byte
+		ref = appendString(ref, 1, owner.resource.Kind)
+		ref = appendString(ref, 3, owner.name)
+		ref = appendString(ref, 4, owner.uid)
+		ref = appendString(ref, 5, owner.resource.APIVersion)
+		ref = appendBool(ref, 6, true)
+		ref = appendBool(ref, 7, true)
+		meta = appendMessage(meta, 13, ref)
+	}
+	if o.resource.Manager != "" {
+		// metav1.ManagedFieldsEntry: 1 manager, 2 operation, 3 apiVersion, 4 time, 6 fieldsType
+		var entry []byte
+		entry = appendString(entry, 1, o.resource.Manager)
+		entry = appendString(entry, 2, "Update")
+		entry = appendString(entry, 3, o.resource.APIVersion)
+		entry = appendMessage(entry, 4, protobufTime(modified))
+		entry = appendString(entry, 6, "FieldsV1")
+		meta = appendMessage(meta, 17, entry)
+	}
+
+	var spec []byte
+	spec = appendMessage(spec, 1, g.filler(o.resource.ValueSize))
+
+	var raw []byte
+	raw = appendMessage(raw, 1, meta)
+	raw = appendMessage(raw, 2, spec)
+
+	// runtime.Unknown: 1 typeMeta, 2 raw, 4 contentType
+	unknown := []byte(protobufPrefix)
+	unknown = appendMessage(unknown, 1, typeMeta)
+	unknown = appendMessage(unknown, 2, raw)
+	unknown = appendString(unknown, 4, "application/vnd.kubernetes.protobuf")
+	return unknown
+}
+
+// protobufTime encodes metav1.Time: 1 seconds, 2 nanos
+func protobufTime(t time.Time) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(t.Unix()))
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendMessage(b []byte, num protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, protowire.EncodeBool(v))
+}
+
+// encrypt encrypts the value like the apiserver's providers, the nonces come from the seeded generator so the
+// snapshot stays reproducible: "k8s:enc:<provider>:v1:<key name>:<ciphertext>"
+func (g *generator) encrypt(key string, value []byte) ([]byte, error) {
+	enc := g.cfg.Encryption
+	prefix := []byte("k8s:enc:" + enc.Provider + ":v1:" + enc.KeyName + ":")
+
+	switch enc.Provider {
+	case "aescbc":
+		block, err := aes.NewCipher(g.secret)
+		if err != nil {
+			return nil, err
+		}
+		// PKCS#7 padding and a random IV in front of the ciphertext
+		padding := aes.BlockSize - len(value)%aes.BlockSize
+		padded := append(append([]byte{}, value...), make([]byte, padding)...)
+		for i := len(value); i < len(padded); i++ {
+			padded[i] = byte(padding)
+		}
+		out := make([]byte, aes.BlockSize+len(padded))
+		g.rng.Read(out[:aes.BlockSize])
+		cipher.NewCBCEncrypter(block, out[:aes.BlockSize]).CryptBlocks(out[aes.BlockSize:], padded)
+		return append(prefix, out...), nil
+	case "aesgcm":
+		block, err := aes.NewCipher(g.secret)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		// the etcd key is the authenticated data
+		nonce := make([]byte, aead.NonceSize())
+		g.rng.Read(nonce)
+		return append(prefix, aead.Seal(nonce, nonce, value, []byte(key))...), nil
+	case "secretbox":
+		var secret [32]byte
+		copy(secret[:], g.secret)
+		var nonce [24]byte
+		g.rng.Read(nonce[:])
+		return append(prefix, secretbox.Seal(nonce[:], value, &nonce, &secret)...), nil
+	default:
+		// kms values need the KMS plugin to be decrypted, random data of about the same size stands in for them
+		kms := make([]byte, len(value)+28)
+		g.rng.Read(kms)
+		return []byte("k8s:enc:kms:v2:" + enc.KeyName + ":" + string(kms)), nil
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package sqlengine
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// query is a parsed SELECT statement
+type query struct {
+	distinct bool
+	items    []selectItem
+	from     tableRef
+	joins    []join
+	where    expr
+	groupBy  []expr
+	having   expr
+	orderBy  []orderItem
+	// limit is the maximum number of rows, -1 is unlimited
+	limit int
+}
+
+type selectItem struct {
+	expr  expr
+	alias string
+	// star selects all columns, of starTable only if that's set
+	star      bool
+	starTable string
+}
+
+// tableRef is a snapshot with the options following its path, e.g. "etcd.snapshot?table=owners", or a subquery
+type tableRef struct {
+	path    string
+	options map[string]string
+	// subquery is set for "(SELECT ...) alias", path is empty then
+	subquery *query
+	alias    string
+}
+
+type join struct {
+	table tableRef
+	left  bool
+	on    expr
+}
+
+type orderItem struct {
+	expr expr
+	desc bool
+}
+
+// expr is one of the expression nodes below, their String is the canonical form used to tell identical
+// aggregates apart
+type expr interface {
+	String() string
+}
+
+type columnRef struct {
+	table string
+	name  string
+}
+
+func (c *columnRef) String() string {
+	if c.table != "" {
+		return c.table + "." + c.name
+	}
+	return c.name
+}
+
+type literal struct {
+	// value is nil, an int64, float64, string, bool or time.Time
+	value interface{}
+}
+
+func (l *literal) String() string {
+	switch v := l.value.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	case time.Time:
+		return "TIME '" + v.Format(time.RFC3339Nano) + "'"
+	}
+	return fmt.Sprint(l.value)
+}
+
+type unary struct {
+	// op is "-" or "NOT"
+	op string
+	x  expr
+}
+
+func (u *unary) String() string {
+	return "(" + u.op + " " + u.x.String() + ")"
+}
+
+type binary struct {
+	// op is an arithmetic or comparison operator, "||", "LIKE", "AND" or "OR"
+	op          string
+	left, right expr
+}
+
+func (b *binary) String() string {
+	return "(" + b.left.String() + " " + b.op + " " + b.right.String() + ")"
+}
+
+type isNull struct {
+	x   expr
+	not bool
+}
+
+func (i *isNull) String() string {
+	if i.not {
+		return "(" + i.x.String() + " IS NOT NULL)"
+	}
+	return "(" + i.x.String() + " IS NULL)"
+}
+
+type inList struct {
+	x    expr
+	list []expr
+}
+
+func (i *inList) String() string {
+	return "(" + i.x.String() + " IN (" + joinExprs(i.list) + "))"
+}
+
+// call is a function or an aggregate, the name is upper case
+type call struct {
+	name string
+	args []expr
+	// star is the argument of COUNT(*)
+	star     bool
+	distinct bool
+}
+
+func (c *call) String() string {
+	switch {
+	case c.star:
+		return c.name + "(*)"
+	case c.distinct:
+		return c.name + "(DISTINCT " + joinExprs(c.args) + ")"
+	}
+	return c.name + "(" + joinExprs(c.args) + ")"
+}
+
+func joinExprs(exprs []expr) string {
+	s := make([]string, len(exprs))
+	for i, e := range exprs {
+		s[i] = e.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// walk calls fn for e and all expressions nested in it, it doesn't descend into the expressions fn returns false for
+func walk(e expr, fn func(expr) bool) {
+	if e == nil || !fn(e) {
+		return
+	}
+	switch e := e.(type) {
+	case *unary:
+		walk(e.x, fn)
+	case *binary:
+		walk(e.left, fn)
+		walk(e.right, fn)
+	case *isNull:
+		walk(e.x, fn)
+	case *inList:
+		walk(e.x, fn)
+		for _, x := range e.list {
+			walk(x, fn)
+		}
+	case *call:
+		for _, x := range e.args {
+			walk(x, fn)
+		}
+	}
+}
+
+// conjuncts splits e at its top level ANDs
+func conjuncts(e expr) []expr {
+	if b, ok := e.(*binary); ok && b.op == "AND" {
+		return append(conjuncts(b.left), conjuncts(b.right)...)
+	}
+	if e == nil {
+		return nil
+	}
+	return []expr{e}
+}
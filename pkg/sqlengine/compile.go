@@ -0,0 +1,449 @@
+package sqlengine
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/cube2222/octosql/physical"
+)
+
+// env is what a compiled expression is evaluated on
+type env struct {
+	// row holds the columns the query reads, at the slots assigned by the compiler
+	row []value
+	// aggregates are the results of the aggregates of the current group
+	aggregates []value
+	// outputs are the select items of the current row, ORDER BY and HAVING refer to them by alias
+	outputs []value
+}
+
+type evalFn func(e *env) (value, error)
+
+// table is a table of the query and the columns the query reads from it
+type table struct {
+	ref tableRef
+	// impl is the plugin's table, subquery the plan of a subquery, only one of them is set
+	impl     physical.DatasourceImplementation
+	subquery *executionPlan
+	fields   []physical.SchemaField
+	// needed are the indices into fields of the columns the query reads, slots where they're stored in the row
+	needed []int
+	slots  []int
+	// pushed are the predicates the table evaluates itself
+	pushed []physical.Expression
+}
+
+// slot returns the row slot of the field, it's assigned on first use
+func (t *table) slot(field int, c *compiler) int {
+	for i, f := range t.needed {
+		if f == field {
+			return t.slots[i]
+		}
+	}
+	t.needed = append(t.needed, field)
+	t.slots = append(t.slots, c.slots)
+	c.slots++
+	return c.slots - 1
+}
+
+// aggregate is an aggregate call of the query, identical calls share one
+type aggregate struct {
+	call *call
+	// arg evaluates the argument on the row, it's nil for COUNT(*)
+	arg evalFn
+}
+
+type compiler struct {
+	tables []*table
+	// slots is the number of row slots assigned so far
+	slots      int
+	aggregates []*aggregate
+}
+
+// scope says what the expressions compiled in it may refer to
+type scope struct {
+	// tables is how many of the query's tables are visible, the ON clause of a join sees the tables up to its own
+	tables int
+	// aggregates allows aggregate calls, they're evaluated per group instead of per row
+	aggregates bool
+	// outputs maps the aliases of the select items to their index, an unqualified column of that name refers to
+	// the select item
+	outputs map[string]int
+}
+
+// resolve finds the table and field a column refers to
+func (c *compiler) resolve(ref *columnRef, tables int) (*table, int, error) {
+	var found *table
+	field := -1
+	for _, t := range c.tables[:tables] {
+		if ref.table != "" && ref.table != t.ref.alias && ref.table != t.ref.path {
+			continue
+		}
+		for i, f := range t.fields {
+			if f.Name != ref.name {
+				continue
+			}
+			if found != nil {
+				return nil, 0, fmt.Errorf("column '%s' is ambiguous, qualify it with the table alias", ref)
+			}
+			found, field = t, i
+		}
+	}
+	if found == nil {
+		return nil, 0, fmt.Errorf("unknown column '%s'", ref)
+	}
+	return found, field, nil
+}
+
+// tablesOf returns the indices of the tables the columns in e belong to
+func (c *compiler) tablesOf(e expr) (map[int]bool, error) {
+	tables := map[int]bool{}
+	var err error
+	walk(e, func(e expr) bool {
+		if ref, ok := e.(*columnRef); ok && err == nil {
+			var t *table
+			if t, _, err = c.resolve(ref, len(c.tables)); err == nil {
+				for i := range c.tables {
+					if c.tables[i] == t {
+						tables[i] = true
+					}
+				}
+			}
+		}
+		return true
+	})
+	return tables, err
+}
+
+func isAggregate(e expr) bool {
+	found := false
+	walk(e, func(e expr) bool {
+		if c, ok := e.(*call); ok {
+			if _, ok := aggregateFunctions[c.name]; ok {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+func (c *compiler) compile(e expr, s scope) (evalFn, error) {
+	switch e := e.(type) {
+	case *literal:
+		v := e.value
+		return func(*env) (value, error) { return v, nil }, nil
+
+	case *columnRef:
+		if i, ok := s.outputs[e.name]; ok && e.table == "" {
+			return func(env *env) (value, error) { return env.outputs[i], nil }, nil
+		}
+		t, field, err := c.resolve(e, s.tables)
+		if err != nil {
+			return nil, err
+		}
+		slot := t.slot(field, c)
+		return func(env *env) (value, error) { return env.row[slot], nil }, nil
+
+	case *unary:
+		x, err := c.compile(e.x, s)
+		if err != nil {
+			return nil, err
+		}
+		if e.op == "NOT" {
+			return func(env *env) (value, error) {
+				v, err := x(env)
+				if err != nil || v == nil {
+					return nil, err
+				}
+				b, ok := v.(bool)
+				if !ok {
+					return nil, fmt.Errorf("NOT expects a Boolean, got %s", typeName(v))
+				}
+				return !b, nil
+			}, nil
+		}
+		return func(env *env) (value, error) {
+			v, err := x(env)
+			if err != nil {
+				return nil, err
+			}
+			return arithmetic("-", int64(0), v)
+		}, nil
+
+	case *binary:
+		return c.compileBinary(e, s)
+
+	case *isNull:
+		x, err := c.compile(e.x, s)
+		if err != nil {
+			return nil, err
+		}
+		not := e.not
+		return func(env *env) (value, error) {
+			v, err := x(env)
+			if err != nil {
+				return nil, err
+			}
+			return (v == nil) != not, nil
+		}, nil
+
+	case *inList:
+		x, err := c.compile(e.x, s)
+		if err != nil {
+			return nil, err
+		}
+		list, err := c.compileAll(e.list, s)
+		if err != nil {
+			return nil, err
+		}
+		return func(env *env) (value, error) {
+			v, err := x(env)
+			if err != nil || v == nil {
+				return nil, err
+			}
+			var result value = false
+			for _, item := range list {
+				w, err := item(env)
+				if err != nil {
+					return nil, err
+				}
+				if w == nil {
+					result = nil
+					continue
+				}
+				if c, err := compare(v, w); err != nil {
+					return nil, err
+				} else if c == 0 {
+					return true, nil
+				}
+			}
+			return result, nil
+		}, nil
+
+	case *call:
+		return c.compileCall(e, s)
+	}
+	return nil, fmt.Errorf("unsupported expression %s", e)
+}
+
+func (c *compiler) compileAll(exprs []expr, s scope) ([]evalFn, error) {
+	fns := make([]evalFn, len(exprs))
+	for i, e := range exprs {
+		fn, err := c.compile(e, s)
+		if err != nil {
+			return nil, err
+		}
+		fns[i] = fn
+	}
+	return fns, nil
+}
+
+func (c *compiler) compileBinary(e *binary, s scope) (evalFn, error) {
+	left, err := c.compile(e.left, s)
+	if err != nil {
+		return nil, err
+	}
+	right, err := c.compile(e.right, s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.op {
+	case "AND", "OR":
+		// three-valued logic: false AND NULL is false, true OR NULL is true
+		decisive := e.op == "OR"
+		return func(env *env) (value, error) {
+			var result value = !decisive
+			for _, operand := range []evalFn{left, right} {
+				v, err := operand(env)
+				if err != nil {
+					return nil, err
+				}
+				if v == nil {
+					result = nil
+					continue
+				}
+				b, ok := v.(bool)
+				if !ok {
+					return nil, fmt.Errorf("%s expects Booleans, got %s", e.op, typeName(v))
+				}
+				if b == decisive {
+					return decisive, nil
+				}
+			}
+			return result, nil
+		}, nil
+
+	case "LIKE":
+		// a constant pattern is compiled once
+		var constant *regexp.Regexp
+		if l, ok := e.right.(*literal); ok {
+			if pattern, ok := l.value.(string); ok {
+				if constant, err = likePattern(pattern); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return func(env *env) (value, error) {
+			v, err := left(env)
+			if err != nil {
+				return nil, err
+			}
+			p, err := right(env)
+			if err != nil || v == nil || p == nil {
+				return nil, err
+			}
+			s, ok := v.(string)
+			pattern, pok := p.(string)
+			if !ok || !pok {
+				return nil, fmt.Errorf("LIKE expects Strings, got %s and %s", typeName(v), typeName(p))
+			}
+			re := constant
+			if re == nil {
+				if re, err = likePattern(pattern); err != nil {
+					return nil, err
+				}
+			}
+			return re.MatchString(s), nil
+		}, nil
+
+	case "=", "<>", "<", "<=", ">", ">=":
+		op := e.op
+		return func(env *env) (value, error) {
+			a, err := left(env)
+			if err != nil {
+				return nil, err
+			}
+			b, err := right(env)
+			if err != nil || a == nil || b == nil {
+				return nil, err
+			}
+			c, err := compare(a, b)
+			if err != nil {
+				return nil, err
+			}
+			switch op {
+			case "=":
+				return c == 0, nil
+			case "<>":
+				return c != 0, nil
+			case "<":
+				return c < 0, nil
+			case "<=":
+				return c <= 0, nil
+			case ">":
+				return c > 0, nil
+			}
+			return c >= 0, nil
+		}, nil
+	}
+
+	op := e.op
+	return func(env *env) (value, error) {
+		a, err := left(env)
+		if err != nil {
+			return nil, err
+		}
+		b, err := right(env)
+		if err != nil {
+			return nil, err
+		}
+		return arithmetic(op, a, b)
+	}, nil
+}
+
+func (c *compiler) compileCall(e *call, s scope) (evalFn, error) {
+	if _, ok := aggregateFunctions[e.name]; ok {
+		if !s.aggregates {
+			return nil, fmt.Errorf("aggregate %s isn't allowed here", e)
+		}
+		i, err := c.aggregate(e, s)
+		if err != nil {
+			return nil, err
+		}
+		return func(env *env) (value, error) { return env.aggregates[i], nil }, nil
+	}
+
+	function, ok := scalarFunctions[e.name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s", e.name)
+	}
+	if e.star || e.distinct || len(e.args) < function.minArgs || len(e.args) > function.maxArgs {
+		return nil, fmt.Errorf("invalid arguments for %s", e)
+	}
+	args, err := c.compileAll(e.args, s)
+	if err != nil {
+		return nil, err
+	}
+	name := e.name
+	return func(env *env) (value, error) {
+		values := make([]value, len(args))
+		for i, arg := range args {
+			v, err := arg(env)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		v, err := function.fn(values)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		return v, nil
+	}, nil
+}
+
+// aggregate returns the index of the aggregate e, it's added unless an identical one exists
+func (c *compiler) aggregate(e *call, s scope) (int, error) {
+	for i, a := range c.aggregates {
+		if a.call.String() == e.String() {
+			return i, nil
+		}
+	}
+	a := &aggregate{call: e}
+	switch {
+	case e.star && e.name == "COUNT":
+	case len(e.args) == 1 && !e.star:
+		if isAggregate(e.args[0]) {
+			return 0, fmt.Errorf("aggregates can't be nested in %s", e)
+		}
+		// the argument is evaluated on the rows, it doesn't see the select items
+		arg, err := c.compile(e.args[0], scope{tables: s.tables})
+		if err != nil {
+			return 0, err
+		}
+		a.arg = arg
+	default:
+		return 0, fmt.Errorf("invalid arguments for %s", e)
+	}
+	c.aggregates = append(c.aggregates, a)
+	return len(c.aggregates) - 1, nil
+}
+
+// outputName is the column name of a select item without alias: a column keeps its name, COUNT(*) is "count",
+// COUNT(column) "count_column", the other aggregates are named after their function and everything else after
+// its position, e.g. "col_1" for the second column
+func outputName(item selectItem, position int) string {
+	switch e := item.expr.(type) {
+	case *columnRef:
+		return e.name
+	case *call:
+		if _, ok := aggregateFunctions[e.name]; ok {
+			name := strings.ToLower(e.name)
+			if ref, ok := firstArg(e).(*columnRef); ok && e.name == "COUNT" {
+				return name + "_" + ref.name
+			}
+			return name
+		}
+	}
+	return fmt.Sprintf("col_%d", position)
+}
+
+func firstArg(c *call) expr {
+	if len(c.args) == 0 {
+		return nil
+	}
+	return c.args[0]
+}
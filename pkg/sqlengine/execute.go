@@ -0,0 +1,657 @@
+// Package sqlengine executes SQL queries on the tables of an octosql plugin in-process, so that querying a snapshot
+// doesn't need the octosql binary. It supports the subset of octosql's SQL the analyses use: SELECT [DISTINCT] with
+// FROM, [LEFT] JOIN ... ON with tables or subqueries, WHERE, GROUP BY, HAVING, ORDER BY and LIMIT, the aggregates
+// COUNT, SUM, AVG, MIN and MAX, the functions LOWER, UPPER, LENGTH, SUBSTR and COALESCE, and the operators AND, OR,
+// NOT, comparisons, arithmetic, "||", LIKE, IN and IS [NOT] NULL.
+package sqlengine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/cube2222/octosql/execution"
+	"github.com/cube2222/octosql/octosql"
+	"github.com/cube2222/octosql/physical"
+)
+
+// Result are the rows of a query, the values are nil, int64, float64, string, bool, time.Time or time.Duration
+type Result struct {
+	Columns []string
+	Rows    [][]interface{}
+}
+
+// errLimitReached stops the scan once a query without ORDER BY has all the rows of its LIMIT
+var errLimitReached = errors.New("limit reached")
+
+// Execute runs query on the tables of db, which are the snapshot paths the query reads from
+func Execute(ctx context.Context, db physical.Database, query string) (*Result, error) {
+	q, err := parse(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query: %w", err)
+	}
+	p, err := plan(ctx, db, q)
+	if err != nil {
+		return nil, err
+	}
+	return p.run(ctx)
+}
+
+// joinStage joins the rows of the tables before it with the table of the join
+type joinStage struct {
+	table *table
+	left  bool
+	// leftKeys and rightKeys are the sides of the equalities of the ON clause, the right table's rows are hashed on
+	// rightKeys and looked up with leftKeys
+	leftKeys, rightKeys []evalFn
+	// residual is the rest of the ON clause, nil if there's none
+	residual evalFn
+	rows     map[string][][]value
+	// all holds the rows of the table if there are no keys to hash on
+	all [][]value
+}
+
+type outputRow struct {
+	values []value
+	order  []value
+}
+
+type executionPlan struct {
+	query    *query
+	compiler *compiler
+	joins    []*joinStage
+	where    evalFn
+	// grouped is set for queries with GROUP BY or aggregates
+	grouped bool
+	groupBy []evalFn
+	items   []evalFn
+	columns []string
+	having  evalFn
+	order   []evalFn
+}
+
+func plan(ctx context.Context, db physical.Database, q *query) (*executionPlan, error) {
+	c := &compiler{}
+	for _, ref := range append([]tableRef{q.from}, joinTables(q.joins)...) {
+		t, err := openTable(ctx, db, ref)
+		if err != nil {
+			return nil, err
+		}
+		c.tables = append(c.tables, t)
+	}
+	all := scope{tables: len(c.tables)}
+	p := &executionPlan{query: q, compiler: c}
+
+	// select items are expanded first, so that "*" lists the columns in schema order
+	items, err := expandStars(c, q.items)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := range q.joins {
+		stage, err := c.joinStage(c.tables[i+1], j, i+2)
+		if err != nil {
+			return nil, err
+		}
+		p.joins = append(p.joins, stage)
+	}
+	if q.where != nil {
+		if isAggregate(q.where) {
+			return nil, fmt.Errorf("aggregates aren't allowed in WHERE, use HAVING")
+		}
+		if p.where, err = c.compile(q.where, all); err != nil {
+			return nil, err
+		}
+		if err := c.pushDown(q); err != nil {
+			return nil, err
+		}
+	}
+
+	p.grouped = len(q.groupBy) > 0 || q.having != nil
+	for _, item := range items {
+		p.grouped = p.grouped || isAggregate(item.expr)
+	}
+	for _, item := range q.orderBy {
+		p.grouped = p.grouped || isAggregate(item.expr)
+	}
+	for _, e := range q.groupBy {
+		if isAggregate(e) {
+			return nil, fmt.Errorf("aggregates aren't allowed in GROUP BY")
+		}
+	}
+	if p.groupBy, err = c.compileAll(q.groupBy, all); err != nil {
+		return nil, err
+	}
+
+	output := scope{tables: len(c.tables), aggregates: p.grouped}
+	aliases := map[string]int{}
+	seen := map[string]int{}
+	for i, item := range items {
+		fn, err := c.compile(item.expr, output)
+		if err != nil {
+			return nil, err
+		}
+		p.items = append(p.items, fn)
+		name := item.alias
+		if name == "" {
+			name = outputName(item, i)
+		} else {
+			aliases[name] = i
+		}
+		// duplicate names get a suffix, the rows are returned as maps
+		if n := seen[name]; n > 0 {
+			seen[name]++
+			name += "_" + strconv.Itoa(n)
+		} else {
+			seen[name] = 1
+		}
+		p.columns = append(p.columns, name)
+	}
+
+	output.outputs = aliases
+	if q.having != nil {
+		if p.having, err = c.compile(q.having, output); err != nil {
+			return nil, err
+		}
+	}
+	for _, item := range q.orderBy {
+		// "ORDER BY 2" orders by the second column
+		if l, ok := item.expr.(*literal); ok {
+			if n, ok := l.value.(int64); ok {
+				if n < 1 || int(n) > len(items) {
+					return nil, fmt.Errorf("ORDER BY position %d is out of range", n)
+				}
+				i := int(n) - 1
+				p.order = append(p.order, func(env *env) (value, error) { return env.outputs[i], nil })
+				continue
+			}
+		}
+		fn, err := c.compile(item.expr, output)
+		if err != nil {
+			return nil, err
+		}
+		p.order = append(p.order, fn)
+	}
+	return p, nil
+}
+
+// openTable gets the table from the plugin, a subquery is planned and its result columns are the fields
+func openTable(ctx context.Context, db physical.Database, ref tableRef) (*table, error) {
+	if ref.subquery != nil {
+		sub, err := plan(ctx, db, ref.subquery)
+		if err != nil {
+			return nil, fmt.Errorf("subquery: %w", err)
+		}
+		t := &table{ref: ref, subquery: sub}
+		for _, column := range sub.columns {
+			t.fields = append(t.fields, physical.SchemaField{Name: column, Type: octosql.Any})
+		}
+		return t, nil
+	}
+	impl, schema, err := db.GetTable(ctx, ref.path, ref.options)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open table '%s': %w", ref.path, err)
+	}
+	return &table{ref: ref, impl: impl, fields: schema.Fields}, nil
+}
+
+func joinTables(joins []join) []tableRef {
+	refs := make([]tableRef, len(joins))
+	for i, j := range joins {
+		refs[i] = j.table
+	}
+	return refs
+}
+
+// expandStars replaces "*" and "t.*" by the columns of the tables
+func expandStars(c *compiler, items []selectItem) ([]selectItem, error) {
+	var expanded []selectItem
+	for _, item := range items {
+		if !item.star {
+			expanded = append(expanded, item)
+			continue
+		}
+		found := false
+		for _, t := range c.tables {
+			if item.starTable != "" && item.starTable != t.ref.alias {
+				continue
+			}
+			found = true
+			for _, f := range t.fields {
+				expanded = append(expanded, selectItem{expr: &columnRef{table: t.ref.alias, name: f.Name}})
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown table '%s'", item.starTable)
+		}
+	}
+	return expanded, nil
+}
+
+// joinStage compiles the ON clause of a join, its equalities between the joined table and the tables before it
+// become the keys of a hash join
+func (c *compiler) joinStage(t *table, j join, visible int) (*joinStage, error) {
+	stage := &joinStage{table: t, left: j.left}
+	joined := visible - 1
+	var residual []expr
+	for _, conjunct := range conjuncts(j.on) {
+		if b, ok := conjunct.(*binary); ok && b.op == "=" {
+			left, err := c.tablesOf(b.left)
+			if err != nil {
+				return nil, err
+			}
+			right, err := c.tablesOf(b.right)
+			if err != nil {
+				return nil, err
+			}
+			if onlyTable(right, joined) && beforeTable(left, joined) {
+				left, right = right, left
+				b = &binary{op: "=", left: b.right, right: b.left}
+			}
+			if onlyTable(left, joined) && beforeTable(right, joined) {
+				rightKey, err := c.compile(b.left, scope{tables: visible})
+				if err != nil {
+					return nil, err
+				}
+				leftKey, err := c.compile(b.right, scope{tables: visible})
+				if err != nil {
+					return nil, err
+				}
+				stage.rightKeys = append(stage.rightKeys, rightKey)
+				stage.leftKeys = append(stage.leftKeys, leftKey)
+				continue
+			}
+		}
+		residual = append(residual, conjunct)
+	}
+	for _, e := range residual {
+		fn, err := c.compile(e, scope{tables: visible})
+		if err != nil {
+			return nil, err
+		}
+		previous := stage.residual
+		stage.residual = func(env *env) (value, error) {
+			if previous != nil {
+				if v, err := previous(env); err != nil || v != true {
+					return v, err
+				}
+			}
+			return fn(env)
+		}
+	}
+	return stage, nil
+}
+
+func onlyTable(tables map[int]bool, t int) bool {
+	return len(tables) == 1 && tables[t]
+}
+
+func beforeTable(tables map[int]bool, t int) bool {
+	if len(tables) == 0 {
+		return false
+	}
+	for i := range tables {
+		if i >= t {
+			return false
+		}
+	}
+	return true
+}
+
+// pushDown passes the equalities of WHERE that compare a column with a string to the tables they belong to, the
+// plugin filters the keys with them before decoding the values. The tables on the right of a LEFT JOIN keep their
+// rows, WHERE has to see them null-extended. The predicates are evaluated again by WHERE.
+func (c *compiler) pushDown(q *query) error {
+	for _, conjunct := range conjuncts(q.where) {
+		b, ok := conjunct.(*binary)
+		if !ok || b.op != "=" {
+			continue
+		}
+		ref, lit := b.left, b.right
+		if _, ok := ref.(*columnRef); !ok {
+			ref, lit = lit, ref
+		}
+		column, ok := ref.(*columnRef)
+		if !ok {
+			continue
+		}
+		constant, ok := lit.(*literal)
+		if !ok {
+			continue
+		}
+		s, ok := constant.value.(string)
+		if !ok {
+			continue
+		}
+		t, field, err := c.resolve(column, len(c.tables))
+		if err != nil {
+			return err
+		}
+		if i := c.tableIndex(t); t.subquery != nil || i > 0 && q.joins[i-1].left {
+			continue
+		}
+		name := t.fields[field].Name
+		if t.ref.alias != "" {
+			name = t.ref.alias + "." + name
+		}
+		predicate := physical.Expression{
+			Type:           octosql.Boolean,
+			ExpressionType: physical.ExpressionTypeFunctionCall,
+			FunctionCall: &physical.FunctionCall{
+				Name: "=",
+				Arguments: []physical.Expression{
+					{Type: t.fields[field].Type, ExpressionType: physical.ExpressionTypeVariable, Variable: &physical.Variable{Name: name, IsLevel0: true}},
+					{Type: octosql.String, ExpressionType: physical.ExpressionTypeConstant, Constant: &physical.Constant{Value: octosql.NewString(s)}},
+				},
+			},
+		}
+		_, t.pushed, _ = t.impl.PushDownPredicates([]physical.Expression{predicate}, t.pushed)
+	}
+	return nil
+}
+
+func (c *compiler) tableIndex(t *table) int {
+	for i := range c.tables {
+		if c.tables[i] == t {
+			return i
+		}
+	}
+	return -1
+}
+
+// scan produces the rows of the table with the columns the query reads at their slots in a row of size slots
+func (t *table) scan(ctx context.Context, slots int, fn func(row []value) error) error {
+	if t.subquery != nil {
+		result, err := t.subquery.run(ctx)
+		if err != nil {
+			return err
+		}
+		for _, values := range result.Rows {
+			row := make([]value, slots)
+			for i, f := range t.needed {
+				row[t.slots[i]] = values[f]
+			}
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	fields := make([]physical.SchemaField, len(t.needed))
+	for i, f := range t.needed {
+		fields[i] = t.fields[f]
+	}
+	node, err := t.impl.Materialize(ctx, physical.Environment{}, physical.NewSchema(fields, -1, physical.WithNoRetractions(true)), t.pushed)
+	if err != nil {
+		return err
+	}
+	return node.Run(execution.ExecutionContext{Context: ctx},
+		func(_ execution.ProduceContext, record execution.Record) error {
+			if len(record.Values) != len(t.slots) {
+				return fmt.Errorf("table '%s' produced %d values for %d columns", t.ref.path, len(record.Values), len(t.slots))
+			}
+			row := make([]value, slots)
+			for i, v := range record.Values {
+				converted, err := fromOctosql(v)
+				if err != nil {
+					return fmt.Errorf("column '%s': %w", fields[i].Name, err)
+				}
+				row[t.slots[i]] = converted
+			}
+			return fn(row)
+		},
+		func(execution.ProduceContext, execution.MetadataMessage) error { return nil })
+}
+
+// load reads the rows of the joined table into memory, hashed on the keys of the join
+func (s *joinStage) load(ctx context.Context, slots int) error {
+	s.rows = map[string][][]value{}
+	return s.table.scan(ctx, slots, func(row []value) error {
+		if len(s.rightKeys) == 0 {
+			s.all = append(s.all, row)
+			return nil
+		}
+		key, ok, err := joinKey(s.rightKeys, &env{row: row})
+		if err != nil || !ok {
+			return err
+		}
+		s.rows[key] = append(s.rows[key], row)
+		return nil
+	})
+}
+
+// joinKey returns the key of the row, ok is false if one of its values is NULL, those never match
+func joinKey(keys []evalFn, e *env) (string, bool, error) {
+	var key []byte
+	for _, k := range keys {
+		v, err := k(e)
+		if err != nil || v == nil {
+			return "", false, err
+		}
+		key = appendKey(key, v)
+	}
+	return string(key), true, nil
+}
+
+// stage returns the function that joins a row and passes the results to next
+func (s *joinStage) stage(next func(row []value) error) func(row []value) error {
+	return func(row []value) error {
+		candidates := s.all
+		if len(s.leftKeys) > 0 {
+			key, ok, err := joinKey(s.leftKeys, &env{row: row})
+			if err != nil {
+				return err
+			}
+			candidates = nil
+			if ok {
+				candidates = s.rows[key]
+			}
+		}
+		matched := false
+		var joined []value
+		for _, candidate := range candidates {
+			if joined == nil {
+				joined = append([]value(nil), row...)
+			}
+			for _, slot := range s.table.slots {
+				joined[slot] = candidate[slot]
+			}
+			if s.residual != nil {
+				if v, err := s.residual(&env{row: joined}); err != nil {
+					return err
+				} else if v != true {
+					continue
+				}
+			}
+			matched = true
+			if err := next(joined); err != nil {
+				return err
+			}
+			joined = nil
+		}
+		if !matched && s.left {
+			// the row is kept with NULLs for the joined table, its slots are still empty
+			return next(row)
+		}
+		return nil
+	}
+}
+
+func (p *executionPlan) run(ctx context.Context) (*Result, error) {
+	slots := p.compiler.slots
+	for _, j := range p.joins {
+		if err := j.load(ctx, slots); err != nil {
+			return nil, err
+		}
+	}
+
+	var rows []outputRow
+	var distinct map[string]bool
+	if p.query.distinct {
+		distinct = map[string]bool{}
+	}
+	// emit adds a row to the result, it stops the scan once the rows of the LIMIT are there and there's nothing
+	// to order them by
+	emit := func(e *env) error {
+		values := make([]value, len(p.items))
+		for i, item := range p.items {
+			v, err := item(e)
+			if err != nil {
+				return err
+			}
+			values[i] = v
+		}
+		e.outputs = values
+		if p.having != nil {
+			if v, err := p.having(e); err != nil || v != true {
+				return err
+			}
+		}
+		if distinct != nil {
+			var key []byte
+			for _, v := range values {
+				key = appendKey(key, v)
+			}
+			if distinct[string(key)] {
+				return nil
+			}
+			distinct[string(key)] = true
+		}
+		row := outputRow{values: values}
+		for _, o := range p.order {
+			v, err := o(e)
+			if err != nil {
+				return err
+			}
+			row.order = append(row.order, v)
+		}
+		rows = append(rows, row)
+		if len(p.order) == 0 && p.query.limit >= 0 && len(rows) >= p.query.limit {
+			return errLimitReached
+		}
+		return nil
+	}
+
+	type group struct {
+		row    []value
+		states []aggregateState
+	}
+	var groups []*group
+	groupIndex := map[string]*group{}
+	newGroup := func(row []value) *group {
+		g := &group{row: row}
+		for _, a := range p.compiler.aggregates {
+			g.states = append(g.states, aggregateFunctions[a.call.name](a.call.distinct))
+		}
+		groups = append(groups, g)
+		return g
+	}
+	sink := func(row []value) error {
+		e := &env{row: row}
+		if !p.grouped {
+			return emit(e)
+		}
+		key, err := groupKey(p.groupBy, e)
+		if err != nil {
+			return err
+		}
+		g, ok := groupIndex[key]
+		if !ok {
+			g = newGroup(row)
+			groupIndex[key] = g
+		}
+		for i, a := range p.compiler.aggregates {
+			var v value = true
+			if a.arg != nil {
+				if v, err = a.arg(e); err != nil {
+					return err
+				}
+			}
+			if err := g.states[i].add(v); err != nil {
+				return fmt.Errorf("%s: %w", a.call, err)
+			}
+		}
+		return nil
+	}
+
+	next := sink
+	if p.where != nil {
+		filtered := next
+		next = func(row []value) error {
+			if v, err := p.where(&env{row: row}); err != nil || v != true {
+				return err
+			}
+			return filtered(row)
+		}
+	}
+	for i := len(p.joins) - 1; i >= 0; i-- {
+		next = p.joins[i].stage(next)
+	}
+
+	if p.query.limit != 0 {
+		if err := p.compiler.tables[0].scan(ctx, slots, next); err != nil && !errors.Is(err, errLimitReached) {
+			return nil, err
+		}
+	}
+
+	if p.grouped {
+		// an aggregate without GROUP BY has a row even if there's no input
+		if len(groups) == 0 && len(p.groupBy) == 0 {
+			newGroup(make([]value, slots))
+		}
+		for _, g := range groups {
+			e := &env{row: g.row, aggregates: make([]value, len(g.states))}
+			for i, s := range g.states {
+				e.aggregates[i] = s.result()
+			}
+			if err := emit(e); errors.Is(err, errLimitReached) {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(p.order) > 0 {
+		var sortErr error
+		sort.SliceStable(rows, func(i, j int) bool {
+			for k, item := range p.query.orderBy {
+				c, err := orderValues(rows[i].order[k], rows[j].order[k])
+				if err != nil && sortErr == nil {
+					sortErr = fmt.Errorf("ORDER BY %s: %w", item.expr, err)
+				}
+				if c != 0 {
+					return (c < 0) != item.desc
+				}
+			}
+			return false
+		})
+		if sortErr != nil {
+			return nil, sortErr
+		}
+	}
+	if p.query.limit >= 0 && len(rows) > p.query.limit {
+		rows = rows[:p.query.limit]
+	}
+
+	result := &Result{Columns: p.columns, Rows: make([][]interface{}, len(rows))}
+	for i, row := range rows {
+		result.Rows[i] = row.values
+	}
+	return result, nil
+}
+
+// groupKey returns the key of the group of the row, NULLs are grouped together
+func groupKey(keys []evalFn, e *env) (string, error) {
+	var key []byte
+	for _, k := range keys {
+		v, err := k(e)
+		if err != nil {
+			return "", err
+		}
+		key = appendKey(key, v)
+	}
+	return string(key), nil
+}
@@ -0,0 +1,247 @@
+package sqlengine
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cube2222/octosql/execution"
+	"github.com/cube2222/octosql/octosql"
+	"github.com/cube2222/octosql/physical"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryDatabase serves tables from memory, the tables accept pushed down equalities on "name" like the plugin
+// does on its key columns
+type memoryDatabase struct {
+	tables map[string]*memoryTable
+}
+
+type memoryTable struct {
+	fields []physical.SchemaField
+	rows   [][]octosql.Value
+	// materialized records the fields of the scans
+	materialized [][]string
+	pushed       []physical.Expression
+}
+
+func (d *memoryDatabase) ListTables(ctx context.Context) ([]string, error) {
+	return nil, nil
+}
+
+func (d *memoryDatabase) GetTable(ctx context.Context, name string, options map[string]string) (physical.DatasourceImplementation, physical.Schema, error) {
+	if options["fail"] == "true" {
+		return nil, physical.Schema{}, errors.New("broken table")
+	}
+	t, ok := d.tables[name]
+	if !ok {
+		return nil, physical.Schema{}, errors.New("no such table")
+	}
+	return t, physical.NewSchema(t.fields, -1), nil
+}
+
+func (t *memoryTable) Materialize(ctx context.Context, env physical.Environment, schema physical.Schema, pushed []physical.Expression) (execution.Node, error) {
+	var names []string
+	for _, f := range schema.Fields {
+		names = append(names, f.Name)
+	}
+	t.materialized = append(t.materialized, names)
+	t.pushed = pushed
+	return &memoryNode{table: t, fields: names, pushed: pushed}, nil
+}
+
+func (t *memoryTable) PushDownPredicates(newPredicates, pushedDownPredicates []physical.Expression) (rejected, pushedDown []physical.Expression, changed bool) {
+	pushedDown = pushedDownPredicates
+	for _, p := range newPredicates {
+		if p.FunctionCall.Arguments[0].Variable.Name == "name" || p.FunctionCall.Arguments[0].Variable.Name == "t.name" {
+			pushedDown = append(pushedDown, p)
+			changed = true
+		} else {
+			rejected = append(rejected, p)
+		}
+	}
+	return rejected, pushedDown, changed
+}
+
+type memoryNode struct {
+	table  *memoryTable
+	fields []string
+	pushed []physical.Expression
+}
+
+func (n *memoryNode) Run(ctx execution.ExecutionContext, produce execution.ProduceFn, metaSend execution.MetaSendFn) error {
+	for _, row := range n.table.rows {
+		if len(n.pushed) > 0 && row[0].Str != n.pushed[0].FunctionCall.Arguments[1].Constant.Value.Str {
+			continue
+		}
+		var values []octosql.Value
+		for _, name := range n.fields {
+			for i, f := range n.table.fields {
+				if f.Name == name {
+					values = append(values, row[i])
+				}
+			}
+		}
+		if err := produce(execution.ProduceFromExecutionContext(ctx), execution.NewRecord(values, false, time.Time{})); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newTestDatabase() *memoryDatabase {
+	str, num := octosql.NewString, func(i int) octosql.Value { return octosql.NewInt(i) }
+	pods := &memoryTable{
+		fields: []physical.SchemaField{
+			{Name: "name", Type: octosql.String},
+			{Name: "namespace", Type: octosql.TypeSum(octosql.String, octosql.Null)},
+			{Name: "size", Type: octosql.Int},
+			{Name: "ready", Type: octosql.Boolean},
+		},
+		rows: [][]octosql.Value{
+			{str("a"), str("default"), num(10), octosql.NewBoolean(true)},
+			{str("b"), str("default"), num(30), octosql.NewBoolean(false)},
+			{str("c"), str("kube-system"), num(5), octosql.NewBoolean(true)},
+			{str("d"), octosql.NewNull(), num(1), octosql.NewBoolean(true)},
+		},
+	}
+	owners := &memoryTable{
+		fields: []physical.SchemaField{
+			{Name: "name", Type: octosql.String},
+			{Name: "owner", Type: octosql.String},
+		},
+		rows: [][]octosql.Value{
+			{str("a"), str("rs-1")},
+			{str("b"), str("rs-2")},
+			{str("b"), str("rs-3")},
+		},
+	}
+	return &memoryDatabase{tables: map[string]*memoryTable{"pods.snapshot": pods, "owners.snapshot": owners}}
+}
+
+func execute(t *testing.T, db *memoryDatabase, query string) *Result {
+	result, err := Execute(context.Background(), db, query)
+	require.NoError(t, err)
+	return result
+}
+
+func TestExecuteSelect(t *testing.T) {
+	db := newTestDatabase()
+	result := execute(t, db, "SELECT name, size * 2 AS double, SUBSTR(namespace, 0, 4) FROM pods.snapshot WHERE size > 4 AND ready ORDER BY size DESC")
+	require.Equal(t, []string{"name", "double", "col_2"}, result.Columns)
+	require.Equal(t, [][]interface{}{
+		{"a", int64(20), "defa"},
+		{"c", int64(10), "kube"},
+	}, result.Rows)
+	// only the columns the query refers to are read
+	materialized := db.tables["pods.snapshot"].materialized
+	require.Len(t, materialized, 1)
+	require.ElementsMatch(t, []string{"name", "size", "namespace", "ready"}, materialized[0])
+}
+
+func TestExecuteStar(t *testing.T) {
+	result := execute(t, newTestDatabase(), "SELECT * FROM pods.snapshot p WHERE p.namespace IS NULL")
+	require.Equal(t, []string{"name", "namespace", "size", "ready"}, result.Columns)
+	require.Equal(t, [][]interface{}{{"d", nil, int64(1), true}}, result.Rows)
+}
+
+func TestExecuteAggregates(t *testing.T) {
+	result := execute(t, newTestDatabase(), `SELECT namespace, COUNT(*), COUNT(name), SUM(size) AS total, AVG(size) AS average, MAX(size)
+		FROM pods.snapshot GROUP BY namespace HAVING COUNT(*) >= 1 ORDER BY total DESC, namespace`)
+	require.Equal(t, []string{"namespace", "count", "count_name", "total", "average", "max"}, result.Columns)
+	require.Equal(t, [][]interface{}{
+		{"default", int64(2), int64(2), int64(40), 20.0, int64(30)},
+		{"kube-system", int64(1), int64(1), int64(5), 5.0, int64(5)},
+		{nil, int64(1), int64(1), int64(1), 1.0, int64(1)},
+	}, result.Rows)
+
+	// without GROUP BY there's a row even if nothing matched
+	result = execute(t, newTestDatabase(), "SELECT COUNT(*) AS n, SUM(size) AS total FROM pods.snapshot WHERE size > 100")
+	require.Equal(t, [][]interface{}{{int64(0), nil}}, result.Rows)
+}
+
+func TestExecuteHavingAndOrderByAlias(t *testing.T) {
+	result := execute(t, newTestDatabase(), "SELECT namespace, COUNT(*) AS cnt FROM pods.snapshot GROUP BY namespace HAVING cnt > 1 ORDER BY cnt DESC")
+	require.Equal(t, [][]interface{}{{"default", int64(2)}}, result.Rows)
+}
+
+func TestExecuteDistinctAndLimit(t *testing.T) {
+	result := execute(t, newTestDatabase(), "SELECT DISTINCT namespace FROM pods.snapshot WHERE namespace IS NOT NULL")
+	require.Equal(t, [][]interface{}{{"default"}, {"kube-system"}}, result.Rows)
+
+	result = execute(t, newTestDatabase(), "SELECT name FROM pods.snapshot LIMIT 2")
+	require.Equal(t, [][]interface{}{{"a"}, {"b"}}, result.Rows)
+
+	result = execute(t, newTestDatabase(), "SELECT name FROM pods.snapshot ORDER BY size LIMIT 1")
+	require.Equal(t, [][]interface{}{{"d"}}, result.Rows)
+}
+
+func TestExecuteJoin(t *testing.T) {
+	db := newTestDatabase()
+	result := execute(t, db, "SELECT p.name, o.owner FROM pods.snapshot p JOIN owners.snapshot o ON o.name = p.name ORDER BY o.owner")
+	require.Equal(t, []string{"name", "owner"}, result.Columns)
+	require.Equal(t, [][]interface{}{{"a", "rs-1"}, {"b", "rs-2"}, {"b", "rs-3"}}, result.Rows)
+
+	result = execute(t, db, "SELECT p.name FROM pods.snapshot p LEFT JOIN owners.snapshot o ON p.name = o.name AND o.owner <> 'rs-1' WHERE o.name IS NULL")
+	require.Equal(t, [][]interface{}{{"a"}, {"c"}, {"d"}}, result.Rows)
+}
+
+func TestExecutePushesDownEqualities(t *testing.T) {
+	db := newTestDatabase()
+	result := execute(t, db, "SELECT t.size FROM pods.snapshot t WHERE t.name = 'b' AND size > 0")
+	require.Equal(t, [][]interface{}{{int64(30)}}, result.Rows)
+	require.Len(t, db.tables["pods.snapshot"].pushed, 1)
+}
+
+func TestExecuteExpressions(t *testing.T) {
+	result := execute(t, newTestDatabase(), `SELECT name FROM pods.snapshot
+		WHERE (name LIKE "_" OR name IN ('x', 'y')) AND NOT name = 'a' AND COALESCE(namespace, 'none') <> 'none'
+		AND LOWER(UPPER(name)) || '!' <> 'c!'`)
+	require.Equal(t, [][]interface{}{{"b"}}, result.Rows)
+}
+
+func TestExecuteTimeLiteral(t *testing.T) {
+	db := &memoryDatabase{tables: map[string]*memoryTable{"events.snapshot": {
+		fields: []physical.SchemaField{{Name: "name", Type: octosql.String}, {Name: "created", Type: octosql.Time}},
+		rows: [][]octosql.Value{
+			{octosql.NewString("old"), octosql.NewTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))},
+			{octosql.NewString("new"), octosql.NewTime(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC))},
+		},
+	}}}
+	result := execute(t, db, "SELECT name FROM events.snapshot WHERE created > TIME '2024-05-01T00:00:00Z'")
+	require.Equal(t, [][]interface{}{{"new"}}, result.Rows)
+}
+
+func TestExecuteErrors(t *testing.T) {
+	for query, expected := range map[string]string{
+		"SELECT FROM pods.snapshot":                                                  "invalid query",
+		"SELECT name FROM pods.snapshot WHERE":                                       "expected an expression",
+		"SELECT name FROM pods.snapshot WHERE name = 'a":                             "unterminated",
+		"SELECT missing FROM pods.snapshot":                                          "unknown column 'missing'",
+		"SELECT name FROM pods.snapshot?fail=true":                                   "broken table",
+		"SELECT name FROM pods.snapshot WHERE COUNT(*) > 1":                          "aggregates aren't allowed in WHERE",
+		"SELECT name FROM pods.snapshot p JOIN owners.snapshot o ON p.name = o.name": "ambiguous",
+		"SELECT NOW() FROM pods.snapshot":                                            "unknown function NOW",
+		"SELECT name FROM pods.snapshot WHERE name > 1":                              "can't compare String and Int",
+	} {
+		_, err := Execute(context.Background(), newTestDatabase(), query)
+		require.ErrorContains(t, err, expected, query)
+	}
+}
+
+func TestExecuteSubquery(t *testing.T) {
+	db := newTestDatabase()
+	// the largest pod of every namespace, NULL namespaces don't join
+	result := execute(t, db, `SELECT p.name, l.largest FROM pods.snapshot p
+		JOIN (SELECT namespace, MAX(size) AS largest FROM pods.snapshot GROUP BY namespace) l
+		ON l.namespace = p.namespace AND p.size = l.largest ORDER BY p.name`)
+	require.Equal(t, []string{"name", "largest"}, result.Columns)
+	require.Equal(t, [][]interface{}{{"b", int64(30)}, {"c", int64(5)}}, result.Rows)
+
+	result = execute(t, db, "SELECT COUNT(*) FROM (SELECT DISTINCT namespace FROM pods.snapshot) n WHERE n.namespace IS NOT NULL")
+	require.Equal(t, [][]interface{}{{int64(2)}}, result.Rows)
+
+	_, err := Execute(context.Background(), db, "SELECT x FROM (SELECT missing FROM pods.snapshot) s")
+	require.ErrorContains(t, err, "subquery: unknown column 'missing'")
+}
@@ -0,0 +1,697 @@
+package sqlengine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	// tokenQuotedIdent is an identifier in backticks, it's never a keyword
+	tokenQuotedIdent
+	tokenString
+	tokenNumber
+	tokenSymbol
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of query"
+	}
+	return fmt.Sprintf("'%s' at offset %d", t.text, t.pos)
+}
+
+// parser is a recursive descent parser, the tokens are read lazily because the table references after FROM and
+// JOIN are paths that don't follow the rules of the other tokens
+type parser struct {
+	input  string
+	pos    int
+	peeked *token
+	// err is the error of lexing the peeked token
+	err error
+}
+
+func parse(input string) (*query, error) {
+	p := &parser{input: input}
+	q, err := p.query()
+	if err != nil {
+		return nil, err
+	}
+	p.acceptSymbol(";")
+	if t := p.peek(); p.err != nil || t.kind != tokenEOF {
+		return nil, p.unexpected("end of query")
+	}
+	return q, nil
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *parser) lex() (token, error) {
+	p.skipSpace()
+	start := p.pos
+	if p.pos >= len(p.input) {
+		return token{kind: tokenEOF, pos: start}, nil
+	}
+	c := p.input[p.pos]
+	switch {
+	case c == '\'' || c == '"':
+		s, err := p.quoted(c)
+		return token{kind: tokenString, text: s, pos: start}, err
+	case c == '`':
+		s, err := p.quoted(c)
+		return token{kind: tokenQuotedIdent, text: s, pos: start}, err
+	case isIdentStart(c):
+		for p.pos < len(p.input) && isIdentPart(p.input[p.pos]) {
+			p.pos++
+		}
+		return token{kind: tokenIdent, text: p.input[start:p.pos], pos: start}, nil
+	case c >= '0' && c <= '9':
+		for p.pos < len(p.input) && (isDigit(p.input[p.pos]) || p.input[p.pos] == '.') {
+			p.pos++
+		}
+		return token{kind: tokenNumber, text: p.input[start:p.pos], pos: start}, nil
+	}
+	for _, symbol := range []string{"<>", "!=", "<=", ">=", "||"} {
+		if strings.HasPrefix(p.input[p.pos:], symbol) {
+			p.pos += len(symbol)
+			return token{kind: tokenSymbol, text: symbol, pos: start}, nil
+		}
+	}
+	if strings.ContainsRune("(),.*+-/%=<>;", rune(c)) {
+		p.pos++
+		return token{kind: tokenSymbol, text: string(c), pos: start}, nil
+	}
+	return token{}, fmt.Errorf("unexpected character '%c' at offset %d", c, start)
+}
+
+// quoted reads a string or identifier enclosed in quote, a doubled quote stands for the quote itself
+func (p *parser) quoted(quote byte) (string, error) {
+	start := p.pos
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		p.pos++
+		if c != quote {
+			b.WriteByte(c)
+			continue
+		}
+		if p.pos < len(p.input) && p.input[p.pos] == quote {
+			b.WriteByte(quote)
+			p.pos++
+			continue
+		}
+		return b.String(), nil
+	}
+	return "", fmt.Errorf("unterminated %c at offset %d", quote, start)
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || isDigit(c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// peek returns the next token without consuming it, if it can't be lexed that's an EOF token and next and
+// unexpected return the error
+func (p *parser) peek() token {
+	if p.peeked == nil {
+		t, err := p.lex()
+		p.err = err
+		p.peeked = &t
+	}
+	return *p.peeked
+}
+
+func (p *parser) next() (token, error) {
+	t := p.peek()
+	p.peeked = nil
+	return t, p.err
+}
+
+func (p *parser) isKeyword(keyword string) bool {
+	t := p.peek()
+	return t.kind == tokenIdent && strings.EqualFold(t.text, keyword)
+}
+
+func (p *parser) acceptKeyword(keyword string) bool {
+	if p.isKeyword(keyword) {
+		p.peeked = nil
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(keyword string) error {
+	if !p.acceptKeyword(keyword) {
+		return p.unexpected(keyword)
+	}
+	return nil
+}
+
+func (p *parser) isSymbol(symbol string) bool {
+	t := p.peek()
+	return t.kind == tokenSymbol && t.text == symbol
+}
+
+func (p *parser) acceptSymbol(symbol string) bool {
+	if p.isSymbol(symbol) {
+		p.peeked = nil
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectSymbol(symbol string) error {
+	if !p.acceptSymbol(symbol) {
+		return p.unexpected("'" + symbol + "'")
+	}
+	return nil
+}
+
+// unexpected returns the error for the next token when expected was required
+func (p *parser) unexpected(expected string) error {
+	t := p.peek()
+	if p.err != nil {
+		return p.err
+	}
+	return fmt.Errorf("expected %s, got %s", expected, t)
+}
+
+// reserved are the keywords that end an expression or a table reference, they can't be used as alias
+var reserved = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "GROUP": true, "BY": true, "HAVING": true, "ORDER": true,
+	"LIMIT": true, "JOIN": true, "LEFT": true, "OUTER": true, "INNER": true, "ON": true, "AS": true, "AND": true, "OR": true,
+	"NOT": true, "IS": true, "NULL": true, "LIKE": true, "IN": true, "ASC": true, "DESC": true, "DISTINCT": true,
+	"TRUE": true, "FALSE": true,
+}
+
+func (p *parser) query() (*query, error) {
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+	q := &query{limit: -1}
+	q.distinct = p.acceptKeyword("DISTINCT")
+
+	for {
+		item, err := p.selectItem()
+		if err != nil {
+			return nil, err
+		}
+		q.items = append(q.items, item)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	from, err := p.tableRef()
+	if err != nil {
+		return nil, err
+	}
+	q.from = from
+
+	for {
+		var j join
+		if p.acceptKeyword("LEFT") {
+			p.acceptKeyword("OUTER")
+			j.left = true
+		} else if !p.acceptKeyword("INNER") && !p.isKeyword("JOIN") {
+			break
+		}
+		if err := p.expectKeyword("JOIN"); err != nil {
+			return nil, err
+		}
+		if j.table, err = p.tableRef(); err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("ON"); err != nil {
+			return nil, err
+		}
+		if j.on, err = p.expr(); err != nil {
+			return nil, err
+		}
+		q.joins = append(q.joins, j)
+	}
+
+	if p.acceptKeyword("WHERE") {
+		if q.where, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("GROUP") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			q.groupBy = append(q.groupBy, e)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+	if p.acceptKeyword("HAVING") {
+		if q.having, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("ORDER") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			item := orderItem{expr: e}
+			if p.acceptKeyword("DESC") {
+				item.desc = true
+			} else {
+				p.acceptKeyword("ASC")
+			}
+			q.orderBy = append(q.orderBy, item)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+	if p.acceptKeyword("LIMIT") {
+		t, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		n, convErr := strconv.Atoi(t.text)
+		if t.kind != tokenNumber || convErr != nil || n < 0 {
+			return nil, fmt.Errorf("expected a row count after LIMIT, got %s", t)
+		}
+		q.limit = n
+	}
+	return q, nil
+}
+
+func (p *parser) selectItem() (selectItem, error) {
+	if p.acceptSymbol("*") {
+		return selectItem{star: true}, nil
+	}
+	// "t.*" is told apart from a column of t by looking ahead
+	if t := p.peek(); t.kind == tokenIdent || t.kind == tokenQuotedIdent {
+		pos, peeked := p.pos, p.peeked
+		p.peeked = nil
+		if p.acceptSymbol(".") && p.acceptSymbol("*") {
+			return selectItem{star: true, starTable: t.text}, nil
+		}
+		p.pos, p.peeked = pos, peeked
+	}
+
+	e, err := p.expr()
+	if err != nil {
+		return selectItem{}, err
+	}
+	item := selectItem{expr: e}
+	if alias, ok, err := p.alias(); err != nil {
+		return selectItem{}, err
+	} else if ok {
+		item.alias = alias
+	}
+	return item, nil
+}
+
+// alias reads an optional "[AS] name"
+func (p *parser) alias() (string, bool, error) {
+	explicit := p.acceptKeyword("AS")
+	t := p.peek()
+	if t.kind == tokenQuotedIdent || (t.kind == tokenIdent && !reserved[strings.ToUpper(t.text)]) ||
+		(explicit && t.kind == tokenString) {
+		p.peeked = nil
+		return t.text, true, nil
+	}
+	if explicit {
+		return "", false, p.unexpected("an alias")
+	}
+	return "", false, nil
+}
+
+// tableRef reads a snapshot path with its options, like "/tmp/etcd.snapshot?table=owners", and its alias
+func (p *parser) tableRef() (tableRef, error) {
+	if p.peeked != nil {
+		return tableRef{}, fmt.Errorf("expected a table, got %s", p.peek())
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) && p.input[p.pos] == '(' {
+		return p.subquery()
+	}
+	start := p.pos
+	var raw string
+	if p.pos < len(p.input) && (p.input[p.pos] == '`' || p.input[p.pos] == '"' || p.input[p.pos] == '\'') {
+		s, err := p.quoted(p.input[p.pos])
+		if err != nil {
+			return tableRef{}, err
+		}
+		raw = s
+	} else {
+		for p.pos < len(p.input) && !unicode.IsSpace(rune(p.input[p.pos])) && !strings.ContainsRune(",();", rune(p.input[p.pos])) {
+			p.pos++
+		}
+		raw = p.input[start:p.pos]
+	}
+	if raw == "" {
+		return tableRef{}, fmt.Errorf("expected a table at offset %d", start)
+	}
+
+	ref := tableRef{path: raw, options: map[string]string{}}
+	if i := strings.IndexByte(raw, '?'); i >= 0 {
+		ref.path = raw[:i]
+		for _, option := range strings.Split(raw[i+1:], "&") {
+			if option == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(option, "=")
+			ref.options[name] = value
+		}
+	}
+	alias, ok, err := p.alias()
+	if err != nil {
+		return tableRef{}, err
+	}
+	if ok {
+		ref.alias = alias
+	}
+	return ref, nil
+}
+
+// subquery parses "(SELECT ...) alias" in FROM or JOIN
+func (p *parser) subquery() (tableRef, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return tableRef{}, err
+	}
+	q, err := p.query()
+	if err != nil {
+		return tableRef{}, err
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return tableRef{}, err
+	}
+	ref := tableRef{subquery: q}
+	alias, ok, err := p.alias()
+	if err != nil {
+		return tableRef{}, err
+	}
+	if ok {
+		ref.alias = alias
+	}
+	return ref, nil
+}
+
+// expr parses an expression, the precedence from low to high is OR, AND, NOT, comparisons, addition and
+// multiplication
+func (p *parser) expr() (expr, error) {
+	return p.or()
+}
+
+func (p *parser) or() (expr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("OR") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &binary{op: "OR", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (expr, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("AND") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = &binary{op: "AND", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) not() (expr, error) {
+	if p.acceptKeyword("NOT") {
+		x, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{op: "NOT", x: x}, nil
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (expr, error) {
+	left, err := p.additive()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.acceptKeyword("IS"):
+			not := p.acceptKeyword("NOT")
+			if err := p.expectKeyword("NULL"); err != nil {
+				return nil, err
+			}
+			left = &isNull{x: left, not: not}
+			continue
+		case p.isKeyword("NOT") || p.isKeyword("LIKE") || p.isKeyword("IN"):
+			not := p.acceptKeyword("NOT")
+			switch {
+			case p.acceptKeyword("LIKE"):
+				right, err := p.additive()
+				if err != nil {
+					return nil, err
+				}
+				left = &binary{op: "LIKE", left: left, right: right}
+			case p.acceptKeyword("IN"):
+				list, err := p.list()
+				if err != nil {
+					return nil, err
+				}
+				left = &inList{x: left, list: list}
+			default:
+				return nil, p.unexpected("LIKE or IN")
+			}
+			if not {
+				left = &unary{op: "NOT", x: left}
+			}
+			continue
+		}
+		t := p.peek()
+		if t.kind != tokenSymbol {
+			return left, nil
+		}
+		switch t.text {
+		case "=", "<>", "!=", "<", "<=", ">", ">=":
+			p.peeked = nil
+			right, err := p.additive()
+			if err != nil {
+				return nil, err
+			}
+			op := t.text
+			if op == "!=" {
+				op = "<>"
+			}
+			left = &binary{op: op, left: left, right: right}
+		default:
+			return left, nil
+		}
+	}
+}
+
+// list reads the parenthesized expressions after IN
+func (p *parser) list() ([]expr, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	var list []expr
+	for {
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, e)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	return list, p.expectSymbol(")")
+}
+
+func (p *parser) additive() (expr, error) {
+	left, err := p.multiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for p.isSymbol("+") || p.isSymbol("-") || p.isSymbol("||") {
+		op, _ := p.next()
+		right, err := p.multiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = &binary{op: op.text, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) multiplicative() (expr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isSymbol("*") || p.isSymbol("/") || p.isSymbol("%") {
+		op, _ := p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binary{op: op.text, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) unary() (expr, error) {
+	if p.acceptSymbol("-") {
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{op: "-", x: x}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (expr, error) {
+	if p.acceptSymbol("(") {
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expectSymbol(")")
+	}
+
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch t.kind {
+	case tokenString:
+		return &literal{value: t.text}, nil
+	case tokenNumber:
+		if i, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return &literal{value: i}, nil
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", t)
+		}
+		return &literal{value: f}, nil
+	case tokenQuotedIdent:
+		return p.column(t.text)
+	case tokenIdent:
+		switch strings.ToUpper(t.text) {
+		case "NULL":
+			return &literal{value: nil}, nil
+		case "TRUE":
+			return &literal{value: true}, nil
+		case "FALSE":
+			return &literal{value: false}, nil
+		case "TIME":
+			if s := p.peek(); s.kind == tokenString {
+				p.peeked = nil
+				v, err := time.Parse(time.RFC3339Nano, s.text)
+				if err != nil {
+					return nil, fmt.Errorf("invalid time %s, expected RFC 3339: %w", s, err)
+				}
+				return &literal{value: v}, nil
+			}
+		}
+		if reserved[strings.ToUpper(t.text)] {
+			return nil, fmt.Errorf("unexpected %s", t)
+		}
+		if p.isSymbol("(") {
+			return p.call(t.text)
+		}
+		return p.column(t.text)
+	}
+	return nil, fmt.Errorf("expected an expression, got %s", t)
+}
+
+// column reads the rest of a column reference that started with name, it's either "column" or "table.column"
+func (p *parser) column(name string) (expr, error) {
+	if !p.acceptSymbol(".") {
+		return &columnRef{name: name}, nil
+	}
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if t.kind != tokenIdent && t.kind != tokenQuotedIdent {
+		return nil, fmt.Errorf("expected a column name, got %s", t)
+	}
+	return &columnRef{table: name, name: t.text}, nil
+}
+
+func (p *parser) call(name string) (expr, error) {
+	c := &call{name: strings.ToUpper(name)}
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	if p.acceptSymbol("*") {
+		c.star = true
+		return c, p.expectSymbol(")")
+	}
+	if p.acceptSymbol(")") {
+		return c, nil
+	}
+	c.distinct = p.acceptKeyword("DISTINCT")
+	for {
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		c.args = append(c.args, e)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	return c, p.expectSymbol(")")
+}
@@ -0,0 +1,436 @@
+package sqlengine
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cube2222/octosql/octosql"
+)
+
+// The values of the executor are nil for NULL, int64, float64, string, bool, time.Time and time.Duration. Ints
+// stay int64 so that lease IDs and revisions don't lose precision.
+type value = interface{}
+
+// fromOctosql converts a value the plugin produced
+func fromOctosql(v octosql.Value) (value, error) {
+	switch v.TypeID {
+	case octosql.TypeIDNull:
+		return nil, nil
+	case octosql.TypeIDInt:
+		return int64(v.Int), nil
+	case octosql.TypeIDFloat:
+		return v.Float, nil
+	case octosql.TypeIDBoolean:
+		return v.Boolean, nil
+	case octosql.TypeIDString:
+		return v.Str, nil
+	case octosql.TypeIDTime:
+		return v.Time, nil
+	case octosql.TypeIDDuration:
+		return v.Duration, nil
+	}
+	return nil, fmt.Errorf("unsupported value of type %s", octosql.Type{TypeID: v.TypeID})
+}
+
+func typeName(v value) string {
+	switch v.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return "Int"
+	case float64:
+		return "Float"
+	case string:
+		return "String"
+	case bool:
+		return "Boolean"
+	case time.Time:
+		return "Time"
+	case time.Duration:
+		return "Duration"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// compare orders two values that aren't NULL, ints and floats compare with each other, other types only with
+// their own
+func compare(a, b value) (int, error) {
+	switch a := a.(type) {
+	case int64:
+		switch b := b.(type) {
+		case int64:
+			return cmp(a, b), nil
+		case float64:
+			return cmp(float64(a), b), nil
+		}
+	case float64:
+		switch b := b.(type) {
+		case int64:
+			return cmp(a, float64(b)), nil
+		case float64:
+			return cmp(a, b), nil
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), nil
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			switch {
+			case a == b:
+				return 0, nil
+			case b:
+				return -1, nil
+			}
+			return 1, nil
+		}
+	case time.Time:
+		if b, ok := b.(time.Time); ok {
+			return a.Compare(b), nil
+		}
+	case time.Duration:
+		if b, ok := b.(time.Duration); ok {
+			return cmp(a, b), nil
+		}
+	}
+	return 0, fmt.Errorf("can't compare %s and %s", typeName(a), typeName(b))
+}
+
+func cmp[T int64 | float64 | time.Duration](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// orderValues orders like compare, but NULL is smaller than everything else
+func orderValues(a, b value) (int, error) {
+	switch {
+	case a == nil && b == nil:
+		return 0, nil
+	case a == nil:
+		return -1, nil
+	case b == nil:
+		return 1, nil
+	}
+	return compare(a, b)
+}
+
+// appendKey appends an encoding of v to key that's equal for equal values, it's used to group and join
+func appendKey(key []byte, v value) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(key, 'N', 0)
+	case int64:
+		// ints and floats of the same number are equal, as they are for compare
+		return fmt.Appendf(key, "n%v\x00", float64(v))
+	case float64:
+		return fmt.Appendf(key, "n%v\x00", v)
+	case string:
+		return fmt.Appendf(key, "s%d:%s", len(v), v)
+	case time.Time:
+		return fmt.Appendf(key, "t%d\x00", v.UnixNano())
+	}
+	return fmt.Appendf(key, "%T%v\x00", v, v)
+}
+
+func arithmetic(op string, a, b value) (value, error) {
+	if a == nil || b == nil {
+		return nil, nil
+	}
+	if op == "||" {
+		as, aok := a.(string)
+		bs, bok := b.(string)
+		if !aok || !bok {
+			return nil, fmt.Errorf("can't concatenate %s and %s", typeName(a), typeName(b))
+		}
+		return as + bs, nil
+	}
+
+	ai, aInt := a.(int64)
+	bi, bInt := b.(int64)
+	if aInt && bInt {
+		switch op {
+		case "+":
+			return ai + bi, nil
+		case "-":
+			return ai - bi, nil
+		case "*":
+			return ai * bi, nil
+		case "/", "%":
+			if bi == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			if op == "/" {
+				return ai / bi, nil
+			}
+			return ai % bi, nil
+		}
+	}
+
+	af, aok := toFloat(a)
+	bf, bok := toFloat(b)
+	if !aok || !bok {
+		return nil, fmt.Errorf("can't apply %s to %s and %s", op, typeName(a), typeName(b))
+	}
+	switch op {
+	case "+":
+		return af + bf, nil
+	case "-":
+		return af - bf, nil
+	case "*":
+		return af * bf, nil
+	case "/":
+		return af / bf, nil
+	}
+	return math.Mod(af, bf), nil
+}
+
+func toFloat(v value) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// likePattern converts a LIKE pattern, where "%" matches any text and "_" a single character, into a regexp
+func likePattern(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("(?s)^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			b.WriteString(".*")
+		case '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// scalarFunctions are the functions that aren't aggregates, the arguments have been checked for their number
+var scalarFunctions = map[string]struct {
+	minArgs, maxArgs int
+	fn               func(args []value) (value, error)
+}{
+	"LOWER":    {1, 1, stringFunction(strings.ToLower)},
+	"UPPER":    {1, 1, stringFunction(strings.ToUpper)},
+	"LENGTH":   {1, 1, length},
+	"SUBSTR":   {2, 3, substr},
+	"COALESCE": {1, math.MaxInt, coalesce},
+}
+
+func stringFunction(fn func(string) string) func(args []value) (value, error) {
+	return func(args []value) (value, error) {
+		switch s := args[0].(type) {
+		case nil:
+			return nil, nil
+		case string:
+			return fn(s), nil
+		}
+		return nil, fmt.Errorf("expected a String, got %s", typeName(args[0]))
+	}
+}
+
+func length(args []value) (value, error) {
+	switch s := args[0].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return int64(len(s)), nil
+	}
+	return nil, fmt.Errorf("expected a String, got %s", typeName(args[0]))
+}
+
+// substr returns the part of a string starting at the zero based index args[1], of at most args[2] bytes
+func substr(args []value) (value, error) {
+	for _, arg := range args {
+		if arg == nil {
+			return nil, nil
+		}
+	}
+	s, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("expected a String, got %s", typeName(args[0]))
+	}
+	start, ok := args[1].(int64)
+	if !ok {
+		return nil, fmt.Errorf("expected an Int start, got %s", typeName(args[1]))
+	}
+	start = min(max(start, 0), int64(len(s)))
+	end := int64(len(s))
+	if len(args) == 3 {
+		n, ok := args[2].(int64)
+		if !ok {
+			return nil, fmt.Errorf("expected an Int length, got %s", typeName(args[2]))
+		}
+		end = min(start+max(n, 0), end)
+	}
+	return s[start:end], nil
+}
+
+func coalesce(args []value) (value, error) {
+	for _, arg := range args {
+		if arg != nil {
+			return arg, nil
+		}
+	}
+	return nil, nil
+}
+
+// aggregateFunctions are the aggregates and the constructors of their state for one group
+var aggregateFunctions = map[string]func(distinct bool) aggregateState{
+	"COUNT": func(distinct bool) aggregateState { return &countState{distinct: newDistinct(distinct)} },
+	"SUM":   func(distinct bool) aggregateState { return &sumState{distinct: newDistinct(distinct)} },
+	"AVG":   func(distinct bool) aggregateState { return &avgState{distinct: newDistinct(distinct)} },
+	"MIN":   func(bool) aggregateState { return &extremeState{sign: -1} },
+	"MAX":   func(bool) aggregateState { return &extremeState{sign: 1} },
+}
+
+// aggregateState accumulates the values of an aggregate of one group, NULLs are skipped except by COUNT(*)
+type aggregateState interface {
+	add(v value) error
+	result() value
+}
+
+// distinctValues remembers the values an aggregate with DISTINCT has seen, nil means all values count
+type distinctValues map[string]bool
+
+func newDistinct(distinct bool) distinctValues {
+	if distinct {
+		return distinctValues{}
+	}
+	return nil
+}
+
+// seen returns whether v was added before and records it
+func (d distinctValues) seen(v value) bool {
+	if d == nil {
+		return false
+	}
+	key := string(appendKey(nil, v))
+	if d[key] {
+		return true
+	}
+	d[key] = true
+	return false
+}
+
+type countState struct {
+	distinct distinctValues
+	n        int64
+}
+
+func (s *countState) add(v value) error {
+	if v != nil && !s.distinct.seen(v) {
+		s.n++
+	}
+	return nil
+}
+
+func (s *countState) result() value {
+	return s.n
+}
+
+// sumState sums ints as int64 until a float is added
+type sumState struct {
+	distinct distinctValues
+	sum      value
+}
+
+func (s *sumState) add(v value) error {
+	if v == nil || s.distinct.seen(v) {
+		return nil
+	}
+	if _, ok := toFloat(v); !ok {
+		if d, ok := v.(time.Duration); ok {
+			if s.sum == nil {
+				s.sum = time.Duration(0)
+			}
+			if sum, ok := s.sum.(time.Duration); ok {
+				s.sum = sum + d
+				return nil
+			}
+		}
+		return fmt.Errorf("can't sum %s", typeName(v))
+	}
+	if s.sum == nil {
+		s.sum = int64(0)
+	}
+	sum, err := arithmetic("+", s.sum, v)
+	if err != nil {
+		return err
+	}
+	s.sum = sum
+	return nil
+}
+
+func (s *sumState) result() value {
+	return s.sum
+}
+
+type avgState struct {
+	distinct distinctValues
+	sum      float64
+	n        int64
+}
+
+func (s *avgState) add(v value) error {
+	if v == nil || s.distinct.seen(v) {
+		return nil
+	}
+	f, ok := toFloat(v)
+	if !ok {
+		return fmt.Errorf("can't average %s", typeName(v))
+	}
+	s.sum += f
+	s.n++
+	return nil
+}
+
+func (s *avgState) result() value {
+	if s.n == 0 {
+		return nil
+	}
+	return s.sum / float64(s.n)
+}
+
+// extremeState is MIN with sign -1 and MAX with sign 1
+type extremeState struct {
+	sign  int
+	value value
+}
+
+func (s *extremeState) add(v value) error {
+	if v == nil {
+		return nil
+	}
+	if s.value == nil {
+		s.value = v
+		return nil
+	}
+	c, err := compare(v, s.value)
+	if err != nil {
+		return err
+	}
+	if c*s.sign > 0 {
+		s.value = v
+	}
+	return nil
+}
+
+func (s *extremeState) result() value {
+	return s.value
+}